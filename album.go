@@ -0,0 +1,270 @@
+/*
+Album shuffle mode. Instead of picking a random song, a random album is picked
+and played in track order; then the next random album is picked. An album is
+either a sub directory of the mapped folder, a group of files in the mapped
+folder sharing the same album tag, or a single file split by a cue sheet.
+Albums with any track found in songsPlayedQueue are not picked.
+*/
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// doublePressDelay is the maximum time between two short presses to count as
+// a double press (skip the whole album).
+const doublePressDelay = 600 * time.Millisecond
+
+type album struct {
+	key  string   // sub directory or album tag
+	refs []string // history entries in play order, relative to the mapped folder
+}
+
+// albumPlan is the album currently being played for a folder
+type albumPlan struct {
+	album *album
+	pos   int // index of the next ref to play
+}
+
+var (
+	albumLock      sync.Mutex
+	albumPlanMap   = make(map[string]*albumPlan) // folder -> current album
+	albumSkipMap   = make(map[string]bool)       // folder -> skip rest of current album
+	lastShortPress = make(map[int]time.Time)     // pid -> time of the last short press
+)
+
+// isDoublePress records a short press of button pid at now and reports whether
+// it followed the previous short press of the same button within doublePressDelay.
+func isDoublePress(pid int, now time.Time) bool {
+	albumLock.Lock()
+	defer albumLock.Unlock()
+	last := lastShortPress[pid]
+	lastShortPress[pid] = now
+	return !last.IsZero() && now.Sub(last) < doublePressDelay
+}
+
+// requestAlbumSkip makes the next call to nextAlbumTrack pick a new album.
+func requestAlbumSkip(folder string) {
+	albumLock.Lock()
+	albumSkipMap[folder] = true
+	albumLock.Unlock()
+}
+
+/*
+nextAlbumTrack returns the history entry of the next song to play in album
+shuffle mode: the next track of the current album, or the first track of a
+random album not found in songsPlayedQueue. It returns "" if no such album
+exists.
+*/
+func nextAlbumTrack(folder string, fileArray []os.FileInfo, songsPlayedQueue queueChecker) string {
+	albumLock.Lock()
+	plan := albumPlanMap[folder]
+	if albumSkipMap[folder] {
+		albumSkipMap[folder] = false
+		if plan != nil {
+			logm.Infof("%s skip album '%s'", pluginname, plan.album.key)
+		}
+		plan = nil
+	}
+	if plan != nil && plan.pos < len(plan.album.refs) {
+		ref := plan.album.refs[plan.pos]
+		plan.pos++
+		albumLock.Unlock()
+		return ref
+	}
+	delete(albumPlanMap, folder)
+	albumLock.Unlock()
+
+	albums := collectAlbums(folder, fileArray)
+	for _, idx := range shufflePerm(len(albums)) {
+		nextAlbum := albums[idx]
+		if albumInQueue(nextAlbum, songsPlayedQueue) {
+			logm.Debugf("%s album '%s' found inQueue - skip", pluginname, nextAlbum.key)
+			continue
+		}
+		logm.Infof("%s next album '%s' (%d tracks)", pluginname, nextAlbum.key, len(nextAlbum.refs))
+		albumLock.Lock()
+		albumPlanMap[folder] = &albumPlan{album: nextAlbum, pos: 1}
+		albumLock.Unlock()
+		return nextAlbum.refs[0]
+	}
+	return ""
+}
+
+func albumInQueue(a *album, songsPlayedQueue queueChecker) bool {
+	if songsPlayedQueue == nil {
+		return false
+	}
+	for _, ref := range a.refs {
+		if songsPlayedQueue.InQueue(ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectAlbums returns all albums of a folder: one per sub directory, one
+// per file with a cue sheet and one per album tag among the remaining files.
+func collectAlbums(folder string, fileArray []os.FileInfo) []*album {
+	var albums []*album
+	tagAlbums := make(map[string]*album)
+	tagFiles := make(map[string][]string) // album key -> file names
+	for _, fi := range fileArray {
+		if fi == nil {
+			continue
+		}
+		name := fi.Name()
+		if fi.IsDir() {
+			subArray, err := ioutil.ReadDir(folder + "/" + name)
+			if err != nil {
+				continue
+			}
+			var names []string
+			for _, sub := range subArray {
+				if !sub.IsDir() && isAudioFile(sub.Name()) {
+					names = append(names, name+"/"+sub.Name())
+				}
+			}
+			if len(names) > 0 {
+				albums = append(albums, &album{key: name, refs: albumRefs(folder, names)})
+			}
+			continue
+		}
+		if !isAudioFile(name) {
+			continue
+		}
+		if len(loadCueTracks(folder+"/"+name)) > 0 {
+			albums = append(albums, &album{key: name, refs: albumRefs(folder, []string{name})})
+			continue
+		}
+		key := readSongTags(folder + "/" + name).album
+		if key == "" {
+			// without an album tag every file is an album of its own
+			key = name
+		}
+		if tagAlbums[key] == nil {
+			tagAlbums[key] = &album{key: key}
+			albums = append(albums, tagAlbums[key])
+		}
+		tagFiles[key] = append(tagFiles[key], name)
+	}
+	for key, names := range tagFiles {
+		tagAlbums[key].refs = albumRefs(folder, names)
+	}
+	return albums
+}
+
+// albumRefs orders the files of an album by disc and track number and
+// expands cue sheets.
+func albumRefs(folder string, names []string) []string {
+	sortByTrackNumber(folder, names)
+	return expandCueRefs(folder, names)
+}
+
+// sortByTrackNumber orders files by disc and track number, falling back to
+// the natural order of the file names.
+func sortByTrackNumber(folder string, names []string) {
+	tags := make(map[string]*songTags, len(names))
+	for _, name := range names {
+		tags[name] = readSongTags(folder + "/" + name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return trackLess(names[i], tags[names[i]], names[j], tags[names[j]])
+	})
+}
+
+/*
+trackLess orders the files of an album: by disc number (none counts as disc
+1), then by track number with files without one last, then by name in
+natural order and finally byte by byte. Every pair of files is ordered the
+same way whatever else is missing, so the album order is stable.
+*/
+func trackLess(a string, ta *songTags, b string, tb *songTags) bool {
+	discA, discB := ta.disc, tb.disc
+	if discA == 0 {
+		discA = 1
+	}
+	if discB == 0 {
+		discB = 1
+	}
+	if discA != discB {
+		return discA < discB
+	}
+	if ta.track != tb.track {
+		if ta.track == 0 || tb.track == 0 {
+			return tb.track == 0
+		}
+		return ta.track < tb.track
+	}
+	if naturalLess(a, b) != naturalLess(b, a) {
+		return naturalLess(a, b)
+	}
+	return a < b
+}
+
+// expandCueRefs replaces files split by a cue sheet with their track refs.
+func expandCueRefs(folder string, names []string) []string {
+	var refs []string
+	for _, name := range names {
+		tracks := loadCueTracks(folder + "/" + name)
+		if len(tracks) == 0 {
+			refs = append(refs, name)
+			continue
+		}
+		for _, track := range tracks {
+			refs = append(refs, trackRef(name, track.number))
+		}
+	}
+	return refs
+}
+
+// naturalLess compares strings so that "track 2" sorts before "track 10".
+func naturalLess(a, b string) bool {
+	for len(a) > 0 && len(b) > 0 {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			na, restA := leadingNumber(a)
+			nb, restB := leadingNumber(b)
+			if na != nb {
+				// compare by value: strip leading zeros, then shorter is smaller
+				ta, tb := trimZeros(na), trimZeros(nb)
+				if len(ta) != len(tb) {
+					return len(ta) < len(tb)
+				}
+				if ta != tb {
+					return ta < tb
+				}
+				return len(na) < len(nb)
+			}
+			a, b = restA, restB
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func leadingNumber(s string) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func trimZeros(s string) string {
+	for len(s) > 1 && s[0] == '0' {
+		s = s[1:]
+	}
+	return s
+}
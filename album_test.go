@@ -0,0 +1,268 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mehrvarz/log"
+)
+
+// TestTrackLess checks that files with and without disc and track tags are
+// in a total order, whatever order they come in.
+func TestTrackLess(t *testing.T) {
+	files := []struct {
+		name  string
+		disc  int
+		track int
+	}{
+		{"z intro.flac", 0, 1},
+		{"b.flac", 1, 2},
+		{"a.flac", 0, 0},
+		{"c.flac", 0, 3},
+		{"bonus 10.flac", 0, 0},
+		{"bonus 9.flac", 0, 0},
+		{"Bonus 9.flac", 0, 0},
+		{"d.flac", 2, 1},
+		{"x.flac", 2, 0},
+		{"e.flac", 0, 2},
+	}
+	want := "z intro.flac|b.flac|e.flac|c.flac|Bonus 9.flac|a.flac|bonus 9.flac|bonus 10.flac|d.flac|x.flac"
+	tags := make(map[string]*songTags)
+	for _, f := range files {
+		tags[f.name] = &songTags{disc: f.disc, track: f.track}
+	}
+	less := func(a, b string) bool { return trackLess(a, tags[a], b, tags[b]) }
+
+	for _, a := range files {
+		for _, b := range files {
+			if a.name != b.name && less(a.name, b.name) == less(b.name, a.name) {
+				t.Errorf("%s and %s not ordered", a.name, b.name)
+			}
+			for _, c := range files {
+				if less(a.name, b.name) && less(b.name, c.name) && !less(a.name, c.name) {
+					t.Errorf("%s < %s < %s, but not %s < %s", a.name, b.name, c.name, a.name, c.name)
+				}
+			}
+		}
+	}
+
+	// insertion sort from every rotation of the list
+	for r := range files {
+		var names []string
+		for i := range files {
+			name := files[(r+i)%len(files)].name
+			k := len(names)
+			names = append(names, name)
+			for ; k > 0 && less(name, names[k-1]); k-- {
+				names[k] = names[k-1]
+			}
+			names[k] = name
+		}
+		if got := strings.Join(names, "|"); got != want {
+			t.Errorf("rotation %d:\n got %s\nwant %s", r, got, want)
+		}
+	}
+}
+
+func TestNaturalLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		less bool
+	}{
+		{"track 2.flac", "track 10.flac", true},
+		{"track 10.flac", "track 2.flac", false},
+		{"02.flac", "10.flac", true},
+		{"2.flac", "02.flac", true}, // same value: fewer zeros first
+		{"02.flac", "2.flac", false},
+		{"disc1/10.flac", "disc2/1.flac", true},
+		{"a", "ab", true},
+		{"ab", "a", false},
+		{"a1b2", "a1b10", true},
+		{"B", "a", true}, // byte order, no case folding
+		{"x", "x", false},
+		{"", "1", true},
+		{"9", "a", true},
+		{"99999999999999999999", "100000000000000000000", true}, // longer than an int
+	}
+	for _, test := range tests {
+		if got := naturalLess(test.a, test.b); got != test.less {
+			t.Errorf("naturalLess(%q, %q) = %v", test.a, test.b, got)
+		}
+	}
+}
+
+// playedRefs is a queueChecker for the history entries in it.
+type playedRefs map[string]bool
+
+func (p playedRefs) InQueue(ref string) bool {
+	return p[ref]
+}
+
+// albumFolder writes a folder with a sub directory album, a tag album with
+// track numbers against the order of the names, a file without album tag
+// and a file split by a cue sheet.
+func albumFolder(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tremote_album")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir+"/Live", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"Live/b.flac", "Live/a.flac", "blue 1.flac", "blue 2.flac", "single.flac", "whole.flac"} {
+		fx := newFlacFixture(i+1, 44100, 16, 0.05)
+		fx.name = name
+		fx.write(t, dir)
+	}
+	(&fixture{name: "blue 1.flac"}).tag(t, dir, "ALBUM=Blue", "TRACKNUMBER=2")
+	(&fixture{name: "blue 2.flac"}).tag(t, dir, "ALBUM=Blue", "TRACKNUMBER=1")
+	sheet := strings.Replace(testCueSheet, "album.flac", "whole.flac", 1)
+	if err := ioutil.WriteFile(dir+"/whole.cue", []byte(sheet), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestCollectAlbums(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	dir := albumFolder(t)
+	defer os.RemoveAll(dir)
+	fileArray, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, a := range collectAlbums(dir, fileArray) {
+		got = append(got, a.key+": "+strings.Join(a.refs, " "))
+	}
+	want := []string{
+		"Live: Live/a.flac Live/b.flac",
+		"Blue: blue 2.flac blue 1.flac",
+		"single.flac: single.flac",
+		"whole.flac: whole.flac#1 whole.flac#2 whole.flac#3",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("albums\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestNextAlbumTrack(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	dir := albumFolder(t)
+	defer os.RemoveAll(dir)
+	fileArray, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initShuffle(3, "")
+
+	// every album is played whole, in track order, before the next one
+	played := playedRefs{}
+	var order []string
+	for ref := nextAlbumTrack(dir, fileArray, played); ref != ""; ref = nextAlbumTrack(dir, fileArray, played) {
+		played[ref] = true
+		order = append(order, ref)
+	}
+	joined := " " + strings.Join(order, " ") + " "
+	for _, album := range []string{" Live/a.flac Live/b.flac ", " blue 2.flac blue 1.flac ", " single.flac ",
+		" whole.flac#1 whole.flac#2 whole.flac#3 "} {
+		if !strings.Contains(joined, album) {
+			t.Errorf("%q not played in a row: %q", album, order)
+		}
+	}
+	if len(order) != 8 {
+		t.Errorf("played %d tracks, want 8: %q", len(order), order)
+	}
+
+	// a skip drops the rest of the album; an album with a track in the
+	// history is not picked
+	played = playedRefs{"blue 1.flac": true, "single.flac": true, "whole.flac#2": true}
+	first := nextAlbumTrack(dir, fileArray, played)
+	if first != "Live/a.flac" {
+		t.Fatalf("first track %q, want Live/a.flac", first)
+	}
+	played[first] = true
+	requestAlbumSkip(dir)
+	if next := nextAlbumTrack(dir, fileArray, played); next != "" {
+		t.Errorf("after a skip: %q, want no album left", next)
+	}
+}
+
+func TestIsDoublePress(t *testing.T) {
+	albumLock.Lock()
+	lastShortPress = make(map[int]time.Time)
+	albumLock.Unlock()
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		pid  int
+		at   time.Duration // since start
+		want bool
+	}{
+		{1, 0, false}, // first press
+		{1, 599 * time.Millisecond, true},
+		{1, 1199 * time.Millisecond, false}, // 600 ms after the last press
+		{2, 1300 * time.Millisecond, false}, // another button
+		{1, 1300 * time.Millisecond, true},
+		{2, 1899 * time.Millisecond, true},
+		{2, 5 * time.Second, false},
+	}
+	for _, test := range tests {
+		if got := isDoublePress(test.pid, start.Add(test.at)); got != test.want {
+			t.Errorf("button %d at %v: double press %v", test.pid, test.at, got)
+		}
+	}
+}
+
+// TestDoublePress presses twice while the first track of an album plays: a
+// double press skips the rest of the album, two single presses only the track.
+func TestDoublePress(t *testing.T) {
+	// the albums are A (01, 02) and B (03, 04); which one comes first is random
+	next := map[string]string{"01.flac": "02.flac", "03.flac": "04.flac"}
+	other := map[string][]string{"01.flac": {"03.flac", "04.flac"}, "03.flac": {"01.flac", "02.flac"}}
+	tests := []struct {
+		name  string
+		pause time.Duration // between the presses
+		album bool          // the rest of the first album skipped
+	}{
+		{"double press", 0, true},
+		{"two presses", time.Second, false},
+	}
+	for _, test := range tests {
+		fixtures := []*fixture{newFlacFixture(1, 44100, 16, 0.1), newFlacFixture(2, 44100, 16, 0.1),
+			newFlacFixture(3, 44100, 16, 0.1), newFlacFixture(4, 44100, 16, 0.1)}
+		h := newHarness(t, true, []string{"mode=album", "repeat=once"}, fixtures...)
+		for i, fx := range fixtures {
+			fx.tag(t, h.folder, "ALBUM="+[]string{"A", "B"}[i/2], "TRACKNUMBER="+string(rune('1'+i%2)))
+		}
+		h.shortPress(1)
+		h.out.allow(2)
+		h.waitWrites(2)
+		h.clock.Advance(test.pause)
+		h.shortPress(1)
+		h.out.unlimited()
+		h.waitState(stateIdle)
+		h.finish()
+
+		names, _ := h.played()
+		h.remove()
+		if len(names) == 0 {
+			t.Fatalf("%s: nothing played", test.name)
+		}
+		first := names[0]
+		want := []string{first}
+		if !test.album {
+			want = append(want, next[first])
+		}
+		want = append(want, other[first]...)
+		if strings.Join(names, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: played %v, want %v", test.name, names, want)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+/*
+Artwork for ph.ImageInfo. The picture embedded in the file is used if there is
+one; otherwise a cover image in the song's directory (cover.jpg, folder.jpg,
+front.png, AlbumArt*.jpg, ...). Images larger than "artworksize" pixels (width
+or height, config.txt) are scaled down and sent as JPEG with "artworkquality".
+Results are cached, so a large scan is decoded once, not for every song.
+*/
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	_ "image/gif"
+	_ "image/png"
+)
+
+const (
+	maxArtworkCache    = 16          // number of cached images
+	maxArtworkPassthru = 256 * 1024  // bytes; larger images are always re-encoded
+	maxArtworkPixels   = 4096 * 4096 // width * height; larger images are not decoded at all
+	maxScaleSamples    = 4           // source pixels sampled per destination pixel, in each direction
+)
+
+// artworkNames are the cover file names we look for, best first. A trailing
+// "*" matches any rest of the name (AlbumArt_{GUID}_Large.jpg).
+var artworkNames = []string{"cover", "folder", "front", "album", "albumart*", "thumb"}
+
+var artworkExts = []string{".jpg", ".jpeg", ".png", ".gif"}
+
+type artwork struct {
+	data     []byte
+	mimeType string
+	used     time.Time
+}
+
+var (
+	artworkLock  sync.Mutex
+	artworkCache = make(map[string]*artwork) // source (path + mtime) -> normalized image
+
+	// artworkDecodeLock lets one image be decoded at a time, so quick skips
+	// do not pile up decodes of large scans
+	artworkDecodeLock sync.Mutex
+)
+
+/*
+songArtwork returns the image to display for pathfile: the embedded picture
+pic (may be nil) or a cover file next to pathfile, normalized. It returns nil
+if there is no artwork, or if wanted reports false once it is our turn to
+decode (the song is over).
+*/
+func songArtwork(pathfile string, pic []byte, picMime string, wanted func() bool) ([]byte, string) {
+	imagefile := pathfile
+	if len(pic) == 0 {
+		imagefile = findCoverFile(filepath.Dir(pathfile))
+		if imagefile == "" {
+			return nil, ""
+		}
+	}
+	fi, err := os.Stat(imagefile)
+	if err != nil {
+		return nil, ""
+	}
+	source := imagefile + "@" + fi.ModTime().String()
+
+	if data, mimeType, ok := cachedArtwork(source); ok {
+		return data, mimeType
+	}
+
+	artworkDecodeLock.Lock()
+	defer artworkDecodeLock.Unlock()
+	if !wanted() {
+		return nil, ""
+	}
+	// the same image may have been decoded while we waited
+	if data, mimeType, ok := cachedArtwork(source); ok {
+		return data, mimeType
+	}
+
+	if len(pic) == 0 {
+		pic, err = ioutil.ReadFile(imagefile)
+		if err != nil {
+			logm.Warningf("%s read artwork err=%s", pluginname, err.Error())
+			return nil, ""
+		}
+		picMime = ""
+	}
+	data, mimeType := normalizeArtwork(pic, picMime)
+
+	artworkLock.Lock()
+	if len(artworkCache) >= maxArtworkCache {
+		// drop the least recently used entry
+		oldest := ""
+		for key, a := range artworkCache {
+			if oldest == "" || a.used.Before(artworkCache[oldest].used) {
+				oldest = key
+			}
+		}
+		delete(artworkCache, oldest)
+	}
+	artworkCache[source] = &artwork{data: data, mimeType: mimeType, used: time.Now()}
+	artworkLock.Unlock()
+	return data, mimeType
+}
+
+// cachedArtwork returns the cached image of source, if any.
+func cachedArtwork(source string) ([]byte, string, bool) {
+	artworkLock.Lock()
+	defer artworkLock.Unlock()
+	cached := artworkCache[source]
+	if cached == nil {
+		return nil, "", false
+	}
+	cached.used = time.Now()
+	return cached.data, cached.mimeType, true
+}
+
+// findCoverFile returns the best cover image in dir, or "".
+func findCoverFile(dir string) string {
+	fileArray, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	type candidate struct {
+		name     string
+		priority int
+		size     int64
+	}
+	var candidates []candidate
+	for _, fi := range fileArray {
+		if fi.IsDir() {
+			continue
+		}
+		name := strings.ToLower(fi.Name())
+		ext := filepath.Ext(name)
+		if !validSetting(ext, artworkExts) {
+			continue
+		}
+		base := strings.TrimSuffix(name, ext)
+		for priority, pattern := range artworkNames {
+			if base == pattern || strings.HasSuffix(pattern, "*") && strings.HasPrefix(base, strings.TrimSuffix(pattern, "*")) {
+				candidates = append(candidates, candidate{fi.Name(), priority, fi.Size()})
+				break
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	// best name first; among AlbumArt*_Large/_Small the larger file
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].priority != candidates[j].priority {
+			return candidates[i].priority < candidates[j].priority
+		}
+		return candidates[i].size > candidates[j].size
+	})
+	return dir + "/" + candidates[0].name
+}
+
+/*
+normalizeArtwork scales an image down to configArtworkSize and encodes it as
+JPEG. Small JPEGs that fit are passed on unchanged. Images that cannot be
+decoded are passed on if small, dropped otherwise. The size is checked before
+decoding: images of more than maxArtworkPixels are dropped, because decoding
+them would take more memory than a Pi can spare while playing.
+*/
+func normalizeArtwork(data []byte, mimeType string) ([]byte, string) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		logm.Infof("%s artwork decode err=%s", pluginname, err.Error())
+		if len(data) <= maxArtworkPassthru {
+			return data, mimeType
+		}
+		return nil, ""
+	}
+	if config.Width*config.Height > maxArtworkPixels {
+		logm.Infof("%s artwork %s %dx%d too large", pluginname, format, config.Width, config.Height)
+		return nil, ""
+	}
+	maxSize := configArtworkSize
+	fits := maxSize <= 0 || config.Width <= maxSize && config.Height <= maxSize
+	if fits && format == "jpeg" && len(data) <= maxArtworkPassthru {
+		return data, "image/jpeg"
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		logm.Infof("%s artwork decode err=%s", pluginname, err.Error())
+		if len(data) <= maxArtworkPassthru {
+			return data, mimeType
+		}
+		return nil, ""
+	}
+	bounds := img.Bounds()
+	if !fits {
+		w, h := bounds.Dx(), bounds.Dy()
+		if w >= h {
+			h = h * maxSize / w
+			w = maxSize
+		} else {
+			w = w * maxSize / h
+			h = maxSize
+		}
+		if w < 1 {
+			w = 1
+		}
+		if h < 1 {
+			h = 1
+		}
+		img = scaleImage(img, w, h)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: configArtworkQuality}); err != nil {
+		logm.Warningf("%s artwork encode err=%s", pluginname, err.Error())
+		return nil, ""
+	}
+	logm.Debugf("%s artwork %s %dx%d %d bytes -> %dx%d %d bytes", pluginname, format,
+		bounds.Dx(), bounds.Dy(), len(data), img.Bounds().Dx(), img.Bounds().Dy(), buf.Len())
+	return buf.Bytes(), "image/jpeg"
+}
+
+/*
+scaleImage scales src down to w x h. Each destination pixel is the average of
+up to maxScaleSamples x maxScaleSamples source pixels spread over the area it
+covers (a subsampled box filter), so the cost depends on the size of the
+result, not on the size of src.
+*/
+func scaleImage(src image.Image, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	pixel := rgbReader(src)
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*sh/h
+		y1 := b.Min.Y + (y+1)*sh/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		ystep := (y1 - y0 + maxScaleSamples - 1) / maxScaleSamples
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*sw/w
+			x1 := b.Min.X + (x+1)*sw/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			xstep := (x1 - x0 + maxScaleSamples - 1) / maxScaleSamples
+			var r, g, bl, n uint32
+			for sy := y0; sy < y1; sy += ystep {
+				for sx := x0; sx < x1; sx += xstep {
+					cr, cg, cb := pixel(sx, sy)
+					r += cr
+					g += cg
+					bl += cb
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(bl / n)
+			dst.Pix[i+3] = 0xff
+		}
+	}
+	return dst
+}
+
+// rgbReader returns a function reading the 8 bit RGB value of a pixel of img,
+// alpha premultiplied. The image types the decoders return are read directly,
+// without a color.Color per pixel.
+func rgbReader(img image.Image) func(x, y int) (uint32, uint32, uint32) {
+	switch img := img.(type) {
+	case *image.YCbCr:
+		return func(x, y int) (uint32, uint32, uint32) {
+			c := img.COffset(x, y)
+			r, g, b := color.YCbCrToRGB(img.Y[img.YOffset(x, y)], img.Cb[c], img.Cr[c])
+			return uint32(r), uint32(g), uint32(b)
+		}
+	case *image.RGBA:
+		return func(x, y int) (uint32, uint32, uint32) {
+			i := img.PixOffset(x, y)
+			return uint32(img.Pix[i]), uint32(img.Pix[i+1]), uint32(img.Pix[i+2])
+		}
+	case *image.NRGBA:
+		return func(x, y int) (uint32, uint32, uint32) {
+			i := img.PixOffset(x, y)
+			a := uint32(img.Pix[i+3])
+			return uint32(img.Pix[i]) * a / 0xff, uint32(img.Pix[i+1]) * a / 0xff, uint32(img.Pix[i+2]) * a / 0xff
+		}
+	case *image.Gray:
+		return func(x, y int) (uint32, uint32, uint32) {
+			v := uint32(img.Pix[img.PixOffset(x, y)])
+			return v, v, v
+		}
+	case *image.Paletted:
+		palette := make([][3]uint32, len(img.Palette))
+		for i, c := range img.Palette {
+			r, g, b, _ := c.RGBA()
+			palette[i] = [3]uint32{r >> 8, g >> 8, b >> 8}
+		}
+		return func(x, y int) (uint32, uint32, uint32) {
+			idx := int(img.Pix[img.PixOffset(x, y)])
+			if idx >= len(palette) {
+				return 0, 0, 0
+			}
+			c := palette[idx]
+			return c[0], c[1], c[2]
+		}
+	}
+	return func(x, y int) (uint32, uint32, uint32) {
+		r, g, b, _ := img.At(x, y).RGBA()
+		return r >> 8, g >> 8, b >> 8
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mehrvarz/log"
+)
+
+// testImage returns a w x h image whose left half is red and right half blue.
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < w/2 {
+				img.SetRGBA(x, y, color.RGBA{R: 200, A: 0xff})
+			} else {
+				img.SetRGBA(x, y, color.RGBA{B: 200, A: 0xff})
+			}
+		}
+	}
+	return img
+}
+
+func encodeTestImage(t *testing.T, format string, img image.Image) []byte {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	case "png":
+		err = png.Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNormalizeArtwork(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	defer func(orig int) { configArtworkSize = orig }(configArtworkSize)
+	configArtworkSize = 100
+
+	smallJpeg := encodeTestImage(t, "jpeg", testImage(80, 60))
+	// a GIF that claims to be 20000x20000 pixels; only its header is read
+	hugeGif := encodeTestImage(t, "gif", testImage(8, 8))
+	binary.LittleEndian.PutUint16(hugeGif[6:], 20000)
+	binary.LittleEndian.PutUint16(hugeGif[8:], 20000)
+	// one pixel more than maxArtworkPixels
+	tooLargeGif := encodeTestImage(t, "gif", testImage(8, 8))
+	binary.LittleEndian.PutUint16(tooLargeGif[6:], 4097)
+	binary.LittleEndian.PutUint16(tooLargeGif[8:], 4096)
+	junk := bytes.Repeat([]byte("junk"), maxArtworkPassthru/4+1)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		mimeType string
+		same     bool // passed on unchanged
+		w, h     int  // of the JPEG sent; 0 = dropped
+	}{
+		{"small jpeg", smallJpeg, "image/jpeg", true, 80, 60},
+		{"small png", encodeTestImage(t, "png", testImage(80, 60)), "image/png", false, 80, 60},
+		{"large jpeg", encodeTestImage(t, "jpeg", testImage(400, 200)), "image/jpeg", false, 100, 50},
+		{"tall png", encodeTestImage(t, "png", testImage(30, 300)), "image/png", false, 10, 100},
+		{"thin gif", encodeTestImage(t, "gif", testImage(1000, 5)), "image/gif", false, 100, 1},
+		{"too many pixels", hugeGif, "image/gif", false, 0, 0},
+		{"just too many pixels", tooLargeGif, "image/gif", false, 0, 0},
+		{"small junk", []byte("no image"), "image/x-unknown", true, 0, 0},
+		{"large junk", junk, "image/x-unknown", false, 0, 0},
+	}
+	for _, test := range tests {
+		data, mimeType := normalizeArtwork(test.data, test.mimeType)
+		if test.same {
+			if !bytes.Equal(data, test.data) || mimeType != test.mimeType {
+				t.Errorf("%s: changed to %d bytes %s", test.name, len(data), mimeType)
+			}
+			continue
+		}
+		if test.w == 0 {
+			if data != nil {
+				t.Errorf("%s: %d bytes %s, want nothing", test.name, len(data), mimeType)
+			}
+			continue
+		}
+		config, format, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil || format != "jpeg" || mimeType != "image/jpeg" || config.Width != test.w || config.Height != test.h {
+			t.Errorf("%s: %s %dx%d %s err=%v, want jpeg %dx%d", test.name, format, config.Width, config.Height,
+				mimeType, err, test.w, test.h)
+		}
+	}
+}
+
+// TestScaleImage scales the same picture held in each image type.
+func TestScaleImage(t *testing.T) {
+	src := testImage(64, 32)
+	ycbcr := image.NewYCbCr(src.Bounds(), image.YCbCrSubsampleRatio420)
+	nrgba := image.NewNRGBA(src.Bounds())
+	paletted := image.NewPaletted(src.Bounds(), palette.Plan9)
+	gray := image.NewGray(src.Bounds())
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			c := src.RGBAAt(x, y)
+			yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+			ycbcr.Y[ycbcr.YOffset(x, y)] = yy
+			ycbcr.Cb[ycbcr.COffset(x, y)] = cb
+			ycbcr.Cr[ycbcr.COffset(x, y)] = cr
+			nrgba.Set(x, y, c)
+			paletted.Set(x, y, c)
+			gray.Set(x, y, color.Gray{Y: uint8(x * 4)})
+		}
+	}
+	tests := []struct {
+		name string
+		img  image.Image
+	}{
+		{"RGBA", src},
+		{"YCbCr", ycbcr},
+		{"NRGBA", nrgba},
+		{"Paletted", paletted},
+		{"generic", subImage{image.NewUniform(color.RGBA{R: 200, A: 0xff}), image.Rect(0, 0, 64, 32)}},
+	}
+	for _, test := range tests {
+		dst := scaleImage(test.img, 8, 4)
+		left, right := dst.RGBAAt(1, 2), dst.RGBAAt(6, 1)
+		if !near(left, color.RGBA{R: 200, A: 0xff}) {
+			t.Errorf("%s: left %v, want red", test.name, left)
+		}
+		if test.name != "generic" && !near(right, color.RGBA{B: 200, A: 0xff}) {
+			t.Errorf("%s: right %v, want blue", test.name, right)
+		}
+	}
+
+	// a gray ramp: each destination pixel covers 16 source pixels and
+	// averages every 4th of them, e.g. 0, 16, 32 and 48
+	dst := scaleImage(gray, 4, 1)
+	for x, want := range []uint8{24, 88, 152, 216} {
+		if c := dst.RGBAAt(x, 0); !near(c, color.RGBA{want, want, want, 0xff}) {
+			t.Errorf("gray ramp at %d: %v, want %d", x, c, want)
+		}
+	}
+}
+
+// subImage gives an image a different bounds rectangle.
+type subImage struct {
+	image.Image
+	bounds image.Rectangle
+}
+
+func (s subImage) Bounds() image.Rectangle { return s.bounds }
+
+// near reports whether c is want, give or take JPEG and palette rounding.
+func near(c, want color.RGBA) bool {
+	diff := func(a, b uint8) bool { return int(a)+8 < int(b) || int(b)+8 < int(a) }
+	return !diff(c.R, want.R) && !diff(c.G, want.G) && !diff(c.B, want.B) && c.A == want.A
+}
+
+// TestSongArtworkSkipped checks that a song skipped while its artwork waits
+// for another decode gets none, and that the image is decoded for the next
+// song wanting it.
+func TestSongArtworkSkipped(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	dir, err := ioutil.TempDir("", "tremote_artwork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cover := encodeTestImage(t, "png", testImage(80, 60))
+	if err := ioutil.WriteFile(dir+"/cover.png", cover, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		artworkLock.Lock()
+		for source := range artworkCache {
+			if strings.HasPrefix(source, dir+"/") {
+				delete(artworkCache, source)
+			}
+		}
+		artworkLock.Unlock()
+	}()
+
+	var lock sync.Mutex
+	playing := true
+	stillPlaying := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return playing
+	}
+	done := make(chan []byte)
+	artworkDecodeLock.Lock() // another decode is running
+	go func() {
+		data, _ := songArtwork(dir+"/01.flac", nil, "", stillPlaying)
+		done <- data
+	}()
+	lock.Lock()
+	playing = false // skipped
+	lock.Unlock()
+	artworkDecodeLock.Unlock()
+	if data := <-done; data != nil {
+		t.Errorf("skipped song: %d bytes of artwork", len(data))
+	}
+
+	data, mimeType := songArtwork(dir+"/02.flac", nil, "", func() bool { return true })
+	if len(data) == 0 || mimeType != "image/jpeg" {
+		t.Errorf("next song: %d bytes %s", len(data), mimeType)
+	}
+}
+
+func TestFindCoverFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tremote_artwork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		files []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"notes.txt", "cover.bmp"}, ""},
+		{[]string{"Thumb.jpg"}, "Thumb.jpg"},
+		{[]string{"Front.PNG", "thumb.jpg"}, "Front.PNG"},
+		{[]string{"folder.gif", "cover.jpeg", "front.jpg"}, "cover.jpeg"},
+		{[]string{"AlbumArt_{1}_Small.jpg", "AlbumArt_{1}_Large.jpg", "albumart.txt"}, "AlbumArt_{1}_Large.jpg"},
+	}
+	for i, test := range tests {
+		sub := dir + "/" + string(rune('a'+i))
+		if err := os.Mkdir(sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for j, name := range test.files {
+			// later files are larger
+			if err := ioutil.WriteFile(sub+"/"+name, make([]byte, 10+j), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := ""
+		if test.want != "" {
+			want = sub + "/" + test.want
+		}
+		if got := findCoverFile(sub); got != want {
+			t.Errorf("%v: %q, want %q", test.files, got, want)
+		}
+	}
+}
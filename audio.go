@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gordonklaus/portaudio"
+)
+
+// audioStream is what playSong needs of an output stream: the samples in the
+// buffer handed to OpenStream are played on each Write().
+type audioStream interface {
+	Start() error
+	Write() error
+	Stop() error
+	Close() error
+}
+
+// audioDevice describes an output device as the host audio system lists it.
+type audioDevice struct {
+	name     string
+	channels int     // output channels, at most
+	rate     float64 // default sample rate
+}
+
+/*
+sampleFormat is how samples are laid out in the buffer of an output stream.
+The sink tells which ones it takes (audioOutput.IsFormatSupported); a sample
+is only shifted as far as the format calls for:
+
+	S16      int16
+	S24_3LE  24 bit, packed into 3 bytes (portaudio.Int24)
+	S24_32   24 bit in the lower 3 bytes of an int32, sign extended
+	S32      int32, full scale: a 24 bit sample is shifted up by 8 bits
+
+portaudio has no S24_32; other sinks may.
+*/
+type sampleFormat struct {
+	name  string
+	bits  int // significant bits of a sample
+	bytes int // per sample in the buffer
+}
+
+var (
+	formatS16    = sampleFormat{name: "S16", bits: 16, bytes: 2}
+	formatS24_3  = sampleFormat{name: "S24_3LE", bits: 24, bytes: 3}
+	formatS24_32 = sampleFormat{name: "S24_32", bits: 24, bytes: 4}
+	formatS32    = sampleFormat{name: "S32", bits: 32, bytes: 4}
+)
+
+// sampleFormatsFor returns the formats to try for songs of bits, best first:
+// the depth of the song, packed; then wider ones; 16 bit last.
+func sampleFormatsFor(bits int) []sampleFormat {
+	if bits == 16 {
+		return []sampleFormat{formatS16, formatS24_3, formatS24_32, formatS32}
+	}
+	return []sampleFormat{formatS24_3, formatS24_32, formatS32, formatS16}
+}
+
+var errS24_32 = errors.New("S24_32 not supported by portaudio")
+
+// audioOutput opens output streams. It is portaudio when running in TRemote;
+// tests capture the samples instead. Devices are given by their index in the
+// list returned by Devices().
+type audioOutput interface {
+	Initialize() error
+	Terminate() error
+	// Devices returns all devices and the index of the default output device.
+	Devices() ([]audioDevice, int, error)
+	// IsFormatSupported returns nil if device can play format at sampleRate.
+	IsFormatSupported(device int, channels int, sampleRate float64, format sampleFormat) error
+	// OpenStream opens a stream playing buf, interleaved: *[]int16 for S16,
+	// *[]portaudio.Int24 for S24_3LE, *[]int32 for S24_32 and S32. Each Write
+	// plays len(buf)/channels frames, framesPerBuffer at most.
+	OpenStream(device int, channels int, sampleRate float64, format sampleFormat, framesPerBuffer int, buf interface{}) (audioStream, error)
+}
+
+var output audioOutput = portaudioOutput{}
+
+type portaudioOutput struct{}
+
+func (portaudioOutput) Initialize() error {
+	return portaudio.Initialize()
+}
+
+func (portaudioOutput) Terminate() error {
+	return portaudio.Terminate()
+}
+
+func (portaudioOutput) Devices() ([]audioDevice, int, error) {
+	infos, err := portaudio.Devices()
+	if err != nil {
+		return nil, -1, err
+	}
+	// portaudio hands out the same *DeviceInfo for a device each time
+	defaultInfo, err := portaudio.DefaultOutputDevice()
+	defaultIndex := -1
+	devices := make([]audioDevice, len(infos))
+	for i, info := range infos {
+		devices[i] = audioDevice{name: info.Name, channels: info.MaxOutputChannels, rate: info.DefaultSampleRate}
+		if err == nil && info == defaultInfo {
+			defaultIndex = i
+		}
+	}
+	return devices, defaultIndex, nil
+}
+
+// streamParameters returns the parameters of an output stream on device.
+func streamParameters(device int, channels int, sampleRate float64, framesPerBuffer int) (portaudio.StreamParameters, error) {
+	infos, err := portaudio.Devices()
+	if err != nil {
+		return portaudio.StreamParameters{}, err
+	}
+	if device < 0 || device >= len(infos) {
+		return portaudio.StreamParameters{}, fmt.Errorf("no audio device %d", device)
+	}
+	p := portaudio.HighLatencyParameters(nil, infos[device])
+	p.Output.Channels = channels
+	p.SampleRate = sampleRate
+	p.FramesPerBuffer = framesPerBuffer
+	return p, nil
+}
+
+// portaudioBuffer returns an empty buffer of the type portaudio takes for
+// format.
+func portaudioBuffer(format sampleFormat) (interface{}, error) {
+	switch format {
+	case formatS16:
+		return &[]int16{}, nil
+	case formatS24_3:
+		return &[]portaudio.Int24{}, nil
+	case formatS32:
+		return &[]int32{}, nil
+	}
+	return nil, errS24_32
+}
+
+func (portaudioOutput) IsFormatSupported(device int, channels int, sampleRate float64, format sampleFormat) error {
+	buf, err := portaudioBuffer(format)
+	if err != nil {
+		return err
+	}
+	p, err := streamParameters(device, channels, sampleRate, portaudio.FramesPerBufferUnspecified)
+	if err != nil {
+		return err
+	}
+	return portaudio.IsFormatSupported(p, buf)
+}
+
+func (portaudioOutput) OpenStream(device int, channels int, sampleRate float64, format sampleFormat, framesPerBuffer int, buf interface{}) (audioStream, error) {
+	if format == formatS24_32 {
+		return nil, errS24_32
+	}
+	p, err := streamParameters(device, channels, sampleRate, framesPerBuffer)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := portaudio.OpenStream(p, buf)
+	if err != nil {
+		// not a nil *portaudio.Stream in a non-nil interface
+		return nil, err
+	}
+	return stream, nil
+}
+
+/*
+sinkBuffer is the buffer an audioStream plays from, in the sample format the
+sink takes. Samples of another depth are shifted to fit: 16 bit samples get
+zero bits below them in a wider format, 24 bit samples lose their lowest 8
+bits in S16. It holds one write of up to size samples, and is allocated once
+per song; set converts the samples of each write in place.
+*/
+type sinkBuffer struct {
+	format     sampleFormat
+	sampleBits int  // of the samples: 16 or 24
+	size       int  // samples per write, at most
+	truncated  bool // bits have been lost
+	buf16      []int16
+	buf24      []portaudio.Int24
+	buf32      []int32
+}
+
+// newSinkBuffer returns a buffer for a sink taking format, for writes of up
+// to size samples of sampleBits.
+func newSinkBuffer(format sampleFormat, sampleBits int, size int) *sinkBuffer {
+	sb := &sinkBuffer{format: format, sampleBits: sampleBits, size: size}
+	switch format.bytes {
+	case 2:
+		sb.buf16 = make([]int16, size)
+	case 3:
+		sb.buf24 = make([]portaudio.Int24, size)
+	default:
+		sb.buf32 = make([]int32, size)
+	}
+	return sb
+}
+
+// buffer returns the buffer to hand to OpenStream.
+func (sb *sinkBuffer) buffer() interface{} {
+	switch sb.format.bytes {
+	case 2:
+		return &sb.buf16
+	case 3:
+		return &sb.buf24
+	}
+	return &sb.buf32
+}
+
+// open opens an output stream on device playing from sb.
+func (sb *sinkBuffer) open(device int, channels int, sampleRate float64) (audioStream, error) {
+	return output.OpenStream(device, channels, sampleRate, sb.format, sb.size/channels, sb.buffer())
+}
+
+// set puts samples (interleaved, as decoded) into the buffer for the next write.
+func (sb *sinkBuffer) set(samples []int32) {
+	shift := uint(0)
+	if sb.format.bits > sb.sampleBits {
+		shift = uint(sb.format.bits - sb.sampleBits)
+	}
+	switch sb.format {
+	case formatS16:
+		out := sb.buf16[:len(samples)]
+		if sb.sampleBits == 16 {
+			for i, sample := range samples {
+				out[i] = int16(sample)
+			}
+		} else {
+			var lost int32
+			for i, sample := range samples {
+				out[i] = int16(sample >> 8)
+				lost |= sample & 0xff
+			}
+			if lost != 0 {
+				sb.truncated = true
+			}
+		}
+		sb.buf16 = out
+	case formatS24_3:
+		// PutInt32 takes the upper 3 bytes
+		out := sb.buf24[:len(samples)]
+		for i, sample := range samples {
+			out[i].PutInt32(sample << (shift + 8))
+		}
+		sb.buf24 = out
+	default:
+		out := sb.buf32[:len(samples)]
+		for i, sample := range samples {
+			out[i] = sample << shift
+		}
+		sb.buf32 = out
+	}
+}
+
+// sample returns sample i of the last write, at the depth of the format.
+func (sb *sinkBuffer) sample(i int) int32 {
+	switch sb.format.bytes {
+	case 2:
+		return int32(sb.buf16[i])
+	case 3:
+		// native byte order, little endian on the machines TRemote runs on
+		b := sb.buf24[i]
+		return int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+	}
+	return sb.buf32[i]
+}
+
+// samples returns the number of samples of the last write.
+func (sb *sinkBuffer) samples() int {
+	return len(sb.buf16) + len(sb.buf24) + len(sb.buf32) // two of them are empty
+}
+
+/*
+sinkChain is what happens to decoded samples on their way to the device:
+resampling, if the device does not take the rate of the song, and conversion
+into the sink buffer. If verify is set, it gets what reaches the sink.
+*/
+type sinkChain struct {
+	resampled *resampler // nil if the device takes the rate of the song: bypassed
+	sink      *sinkBuffer
+	verify    *sinkVerifier
+}
+
+// newSinkChain returns the chain for a song of channels, rate and bits played
+// in format, for writes of up to chunk samples. quality is the resampler
+// preset, if one is needed.
+func newSinkChain(format outputFormat, channels int, rate int, bits int, chunk int, quality resampleQuality) *sinkChain {
+	chain := &sinkChain{}
+	size := chunk
+	if format.rate != rate {
+		chain.resampled = newResampler(channels, rate, format.rate, bits, chunk, quality)
+		size = chain.resampled.outputSize(chunk)
+	}
+	chain.sink = newSinkBuffer(format.sample, bits, size)
+	return chain
+}
+
+// set puts samples (interleaved, as decoded) through the chain into the sink
+// buffer, for the next write.
+func (chain *sinkChain) set(samples []int32) {
+	if chain.resampled != nil {
+		samples = chain.resampled.process(samples)
+	}
+	chain.sink.set(samples)
+	if chain.verify != nil {
+		chain.verify.add(chain.sink)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSinkBuffer(t *testing.T) {
+	const channels, frames = 2, 1024
+	tests := []struct {
+		format sampleFormat
+		bits   int // of the samples
+		shift  int // of the samples in the buffer
+	}{
+		{formatS16, 16, 0},
+		{formatS16, 24, -8},
+		{formatS24_3, 16, 8},
+		{formatS24_3, 24, 0},
+		{formatS24_32, 16, 8},
+		{formatS24_32, 24, 0},
+		{formatS32, 16, 16},
+		{formatS32, 24, 8},
+	}
+	for _, test := range tests {
+		out := newCaptureOutput(false)
+		output = out
+		fx := newFlacFixture(1, 44100, test.bits, 0.1)
+		// negative samples, and the extremes of the depth
+		samples := append([]int32{-1 << uint(test.bits-1), 1<<uint(test.bits-1) - 1}, fx.samples[:channels*frames-2]...)
+
+		sb := newSinkBuffer(test.format, test.bits, channels*frames)
+		stream, err := sb.open(0, channels, 44100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sb.set(samples)
+		stream.Write()
+		sb.set(samples[:channels*frames/2])
+		stream.Write()
+		output = portaudioOutput{}
+
+		got := out.streams[0]
+		if got.framesPerBuffer != frames || got.oversized > 0 {
+			t.Errorf("%s, %d bit: %d frames per buffer, %d writes oversized; want %d frames",
+				test.format.name, test.bits, got.framesPerBuffer, got.oversized, frames)
+		}
+		want := append(shifted(samples, test.shift), shifted(samples[:channels*frames/2], test.shift)...)
+		if !equalSamples(got.samples, want) {
+			t.Errorf("%s, %d bit: wrong samples", test.format.name, test.bits)
+		}
+		if n := sb.samples(); n != channels*frames/2 || sb.sample(n-1) != want[len(want)-1] {
+			t.Errorf("%s, %d bit: %d samples in the buffer", test.format.name, test.bits, n)
+		}
+		if sb.truncated != (test.shift < 0) {
+			t.Errorf("%s, %d bit: truncated %v", test.format.name, test.bits, sb.truncated)
+		}
+		if allocs := testing.AllocsPerRun(100, func() { sb.set(samples) }); allocs != 0 {
+			t.Errorf("%s, %d bit: %.1f allocations per set, want 0", test.format.name, test.bits, allocs)
+		}
+	}
+}
+
+// TestPortaudioFormats checks the buffers portaudio is given for each format.
+func TestPortaudioFormats(t *testing.T) {
+	for _, format := range []sampleFormat{formatS16, formatS24_3, formatS32} {
+		buf, err := portaudioBuffer(format)
+		if err != nil {
+			t.Fatalf("%s: %v", format.name, err)
+		}
+		sb := newSinkBuffer(format, 24, 8)
+		if got, want := typeName(sb.buffer()), typeName(buf); got != want {
+			t.Errorf("%s: sink buffer %s, portaudio is asked for %s", format.name, got, want)
+		}
+	}
+	if _, err := portaudioBuffer(formatS24_32); err != errS24_32 {
+		t.Errorf("S24_32: %v, want %v", err, errS24_32)
+	}
+}
+
+func typeName(v interface{}) string {
+	return fmt.Sprintf("%T", v)
+}
@@ -1,2 +1 @@
-CGO_ENABLED=1 go build $1 -buildmode=plugin play_audio_mp3flac.go
-
+CGO_ENABLED=1 go build $1 -buildmode=plugin -o play_audio_mp3flac.so .
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/mehrvarz/tremote_plugin"
+)
+
+/*
+pluginCommands can be bound to buttons in place of a folder, in the style of
+ph.HostCmd(): "play_audio|<command>|<argument>". A command does not start or
+stop playback by itself; it acts on the currently active folder.
+
+	P9, Mode,   play_audio|PlayMode
+	P10, Repeat, play_audio|Repeat|one
+	P11, Stats,  play_audio|Stats
+	P12, Fav,    play_audio|Favorite
+	P13, Ban,    play_audio|Ban
+	P14, Rate5,  play_audio|Rate|5
+	P18, Buffer, play_audio|Buffer
+	P20, Verify, play_audio|Verify
+	P22, Check,  play_audio|Check
+*/
+var pluginCommands = map[string]func(args []string, ph tremote_plugin.PluginHelper){
+	"PlayMode": cmdPlayMode,
+	"Repeat":   cmdRepeat,
+	"Stats":    cmdStats,
+	"Favorite": cmdFavorite,
+	"Ban":      cmdBan,
+	"Rate":     cmdRate,
+	"Buffer":   cmdBuffer,
+	"Verify":   cmdVerify,
+	"Check":    cmdCheck,
+}
+
+// pluginCommand returns the command for a mapping line, or nil if the
+// mapping line names a folder or a file.
+func pluginCommand(strArray []string) func(args []string, ph tremote_plugin.PluginHelper) {
+	if len(strArray) < 1 {
+		return nil
+	}
+	return pluginCommands[strArray[0]]
+}
@@ -0,0 +1,510 @@
+/*
+CUE sheet support for single-file album rips. An album stored as one big FLAC
+(or MP3) plus a .cue file, or a FLAC with an embedded CUESHEET block, is split
+into virtual tracks. Each virtual track is stored in songsPlayedQueue as
+"<filename>#<tracknumber>" so that it has its own history entry.
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bobertlo/go-mpg123/mpg123"
+	"github.com/mewkiz/flac/meta"
+)
+
+// cueTrack describes one virtual track inside a single audio file.
+// start and end are inter-channel sample positions; end==0 means end of file.
+type cueTrack struct {
+	number    int
+	title     string
+	performer string
+	album     string
+	start     uint64
+	end       uint64
+}
+
+var (
+	cueLock        sync.Mutex
+	cueTracksCache = make(map[string][]cueTrack) // pathfile -> tracks (nil = no cue sheet)
+	cueContinueMap = make(map[string]string)     // folder -> next track ref in the same file
+)
+
+// trackRef returns the history entry for cue track number of fileName.
+func trackRef(fileName string, number int) string {
+	return fileName + "#" + strconv.Itoa(number)
+}
+
+// trackSamples returns the length of track in a file of total inter-channel
+// samples: total itself if track is nil, 0 if unknown.
+func trackSamples(track *cueTrack, total uint64) uint64 {
+	if track == nil || total == 0 {
+		return total
+	}
+	end := track.end
+	if end == 0 || end > total {
+		end = total
+	}
+	if end > track.start {
+		return end - track.start
+	}
+	return 0
+}
+
+// splitTrackRef splits a history entry into the file name and the cue track
+// number. number is 0 if ref does not point to a cue track.
+func splitTrackRef(ref string) (string, int) {
+	idx := strings.LastIndex(ref, "#")
+	if idx < 0 {
+		return ref, 0
+	}
+	number, err := strconv.Atoi(ref[idx+1:])
+	if err != nil || number <= 0 {
+		return ref, 0
+	}
+	return ref[:idx], number
+}
+
+// findCueTrack returns the track with the given number or nil.
+func findCueTrack(tracks []cueTrack, number int) *cueTrack {
+	for i := range tracks {
+		if tracks[i].number == number {
+			return &tracks[i]
+		}
+	}
+	return nil
+}
+
+// unplayedTrackRef returns fileName itself if the file has no cue sheet.
+// Otherwise it returns the ref of the first cue track not found in
+// songsPlayedQueue, or "" if all tracks have been played recently.
+func unplayedTrackRef(folder string, fileName string, songsPlayedQueue queueChecker) string {
+	tracks := loadCueTracks(folder + "/" + fileName)
+	if len(tracks) == 0 {
+		if songsPlayedQueue != nil && songsPlayedQueue.InQueue(fileName) {
+			return ""
+		}
+		return fileName
+	}
+	for _, track := range tracks {
+		ref := trackRef(fileName, track.number)
+		if songsPlayedQueue == nil || !songsPlayedQueue.InQueue(ref) {
+			return ref
+		}
+	}
+	return ""
+}
+
+// queueChecker is the part of go_queue.Queue used by unplayedTrackRef
+// and the shuffle strategies
+type queueChecker interface {
+	InQueue(string) bool
+}
+
+// setCueContinue remembers which track of the same file follows the track
+// that is about to be played, so that a short press (or the end of the
+// current track) continues inside the album instead of picking a random song.
+func setCueContinue(folder string, fileName string, tracks []cueTrack, track *cueTrack) {
+	next := ""
+	if track != nil {
+		for i := range tracks {
+			if tracks[i].number == track.number && i+1 < len(tracks) {
+				next = trackRef(fileName, tracks[i+1].number)
+				break
+			}
+		}
+	}
+	cueLock.Lock()
+	cueContinueMap[folder] = next
+	cueLock.Unlock()
+}
+
+// takeCueContinue returns and clears the pending next track ref for folder.
+func takeCueContinue(folder string) string {
+	cueLock.Lock()
+	defer cueLock.Unlock()
+	next := cueContinueMap[folder]
+	cueContinueMap[folder] = ""
+	return next
+}
+
+/*
+loadCueTracks returns the virtual tracks of an audio file, or nil if the file
+is not split by a cue sheet. A .cue file next to the audio file is preferred,
+because unlike an embedded CUESHEET block it carries TITLE and PERFORMER
+information. Results are cached per pathfile.
+*/
+func loadCueTracks(pathfile string) []cueTrack {
+	cueLock.Lock()
+	tracks, ok := cueTracksCache[pathfile]
+	cueLock.Unlock()
+	if ok {
+		return tracks
+	}
+
+	cuefile := findCueFile(pathfile)
+	if cuefile != "" {
+		tracks = readCueFile(cuefile, pathfile)
+	}
+	if tracks == nil && strings.HasSuffix(pathfile, ".flac") {
+		tracks = readEmbeddedCueSheet(pathfile)
+	}
+	if len(tracks) > 0 {
+		logm.Debugf("%s cue sheet for %s: %d tracks", pluginname, pathfile, len(tracks))
+	}
+
+	cueLock.Lock()
+	cueTracksCache[pathfile] = tracks
+	cueLock.Unlock()
+	return tracks
+}
+
+// findCueFile looks for "album.cue" or "album.flac.cue" next to "album.flac",
+// then for any .cue file in the same directory that references the file.
+func findCueFile(pathfile string) string {
+	ext := filepath.Ext(pathfile)
+	for _, candidate := range []string{strings.TrimSuffix(pathfile, ext) + ".cue", pathfile + ".cue"} {
+		if fi, err := os.Stat(candidate); err == nil && !fi.IsDir() {
+			return candidate
+		}
+	}
+
+	dir := filepath.Dir(pathfile)
+	fileArray, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	base := filepath.Base(pathfile)
+	for _, fi := range fileArray {
+		if fi.IsDir() || !strings.HasSuffix(strings.ToLower(fi.Name()), ".cue") {
+			continue
+		}
+		f, err := os.Open(dir + "/" + fi.Name())
+		if err != nil {
+			continue
+		}
+		sheet := parseCueSheet(f)
+		f.Close()
+		for _, name := range sheet.files {
+			if name == base {
+				return dir + "/" + fi.Name()
+			}
+		}
+	}
+	return ""
+}
+
+// readCueFile reads the tracks for pathfile from a .cue file.
+func readCueFile(cuefile string, pathfile string) []cueTrack {
+	f, err := os.Open(cuefile)
+	if err != nil {
+		logm.Warningf("%s open cue file %s err=%s", pluginname, cuefile, err.Error())
+		return nil
+	}
+	defer f.Close()
+
+	sampleRate, err := audioSampleRate(pathfile)
+	if err != nil {
+		logm.Warningf("%s cue file %s: no sample rate for %s err=%s", pluginname, cuefile, pathfile, err.Error())
+		return nil
+	}
+	return parseCueSheet(f).tracksFor(filepath.Base(pathfile), uint64(sampleRate))
+}
+
+// readEmbeddedCueSheet reads the CUESHEET metadata block of a FLAC file. If
+// the file also carries a CUESHEET vorbis comment (the text of the original
+// .cue file), that one is used, because it contains titles.
+func readEmbeddedCueSheet(pathfile string) []cueTrack {
+	f, err := os.Open(pathfile)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	stream, err := parseFlacStream(f)
+	if err != nil {
+		return nil
+	}
+
+	var cuesheet *meta.CueSheet
+	for _, block := range stream.Blocks {
+		switch body := block.Body.(type) {
+		case *meta.VorbisComment:
+			for _, tag := range body.Tags {
+				if strings.EqualFold(tag[0], "CUESHEET") {
+					sheet := parseCueSheet(strings.NewReader(tag[1]))
+					tracks := sheet.tracksFor("", uint64(stream.Info.SampleRate))
+					if len(tracks) > 0 {
+						return tracks
+					}
+				}
+			}
+		case *meta.CueSheet:
+			cuesheet = body
+		}
+	}
+	if cuesheet == nil {
+		return nil
+	}
+
+	var tracks []cueTrack
+	for _, t := range cuesheet.Tracks {
+		if t.Num == 170 || t.Num == 255 {
+			// lead-out track marks the end of the last track
+			if len(tracks) > 0 {
+				tracks[len(tracks)-1].end = t.Offset
+			}
+			break
+		}
+		if !t.IsAudio {
+			continue
+		}
+		start := t.Offset
+		for _, index := range t.Indicies {
+			if index.Num == 1 {
+				start = t.Offset + index.Offset
+			}
+		}
+		if len(tracks) > 0 {
+			tracks[len(tracks)-1].end = start
+		}
+		tracks = append(tracks, cueTrack{number: int(t.Num), title: fmt.Sprintf("Track %d", t.Num), start: start})
+	}
+	if len(tracks) < 2 {
+		// a cue sheet with a single track does not split anything
+		return nil
+	}
+	return tracks
+}
+
+// audioSampleRate returns the sample rate of a flac or mp3 file.
+func audioSampleRate(pathfile string) (int64, error) {
+	if strings.HasSuffix(pathfile, ".flac") {
+		f, err := os.Open(pathfile)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		stream, err := openFlacStream(f)
+		if err != nil {
+			return 0, err
+		}
+		return int64(stream.Info.SampleRate), nil
+	}
+
+	mp3decoder, err := mpg123.NewDecoder("")
+	if err != nil {
+		return 0, err
+	}
+	defer mp3decoder.Delete()
+	err = mp3decoder.Open(pathfile)
+	if err != nil {
+		return 0, err
+	}
+	defer mp3decoder.Close()
+	sampleRate, _, _ := mp3decoder.GetFormat()
+	return sampleRate, nil
+}
+
+// cueSheetText holds the parsed content of a .cue file. Index positions are
+// kept in CD frames (1/75 s) until the sample rate of the audio file is known.
+type cueSheetText struct {
+	title     string
+	performer string
+	files     []string
+	tracks    []cueSheetTextTrack
+}
+
+type cueSheetTextTrack struct {
+	file      string
+	number    int
+	title     string
+	performer string
+	index01   uint64 // in CD frames
+	hasIndex  bool
+}
+
+// parseCueSheet parses the subset of the cue sheet format that matters for
+// playback: FILE, TRACK, TITLE, PERFORMER and INDEX 01.
+func parseCueSheet(r io.Reader) *cueSheetText {
+	sheet := &cueSheetText{}
+	var current *cueSheetTextTrack
+	file := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		keyword := strings.ToUpper(fields[0])
+		value := strings.TrimSpace(line[len(fields[0]):])
+		switch keyword {
+		case "FILE":
+			// FILE "name.flac" WAVE
+			if idx := strings.LastIndex(value, "\""); strings.HasPrefix(value, "\"") && idx > 0 {
+				file = value[1:idx]
+			} else if len(fields) >= 2 {
+				file = fields[1]
+			}
+			sheet.files = append(sheet.files, file)
+		case "TRACK":
+			if len(fields) >= 2 {
+				number, err := strconv.Atoi(fields[1])
+				if err == nil {
+					sheet.tracks = append(sheet.tracks, cueSheetTextTrack{file: file, number: number})
+					current = &sheet.tracks[len(sheet.tracks)-1]
+				}
+			}
+		case "TITLE":
+			if current != nil {
+				current.title = cueUnquote(value)
+			} else {
+				sheet.title = cueUnquote(value)
+			}
+		case "PERFORMER":
+			if current != nil {
+				current.performer = cueUnquote(value)
+			} else {
+				sheet.performer = cueUnquote(value)
+			}
+		case "INDEX":
+			if current != nil && len(fields) >= 3 && fields[1] == "01" {
+				frames, err := parseCueTime(fields[2])
+				if err == nil {
+					current.index01 = frames
+					current.hasIndex = true
+				}
+			}
+		}
+	}
+	return sheet
+}
+
+// tracksFor converts the text tracks that belong to fileName into cueTracks.
+// If fileName is empty, or the sheet references only one file, all tracks are
+// used (files are often renamed after ripping).
+func (sheet *cueSheetText) tracksFor(fileName string, sampleRate uint64) []cueTrack {
+	var tracks []cueTrack
+	for _, t := range sheet.tracks {
+		if fileName != "" && len(sheet.files) > 1 && t.file != fileName {
+			continue
+		}
+		if !t.hasIndex {
+			continue
+		}
+		// 1 CD frame is 1/75 s; all common sample rates are multiples of 75
+		start := t.index01 * sampleRate / 75
+		if len(tracks) > 0 {
+			tracks[len(tracks)-1].end = start
+		}
+		performer := t.performer
+		if performer == "" {
+			performer = sheet.performer
+		}
+		title := t.title
+		if title == "" {
+			title = fmt.Sprintf("Track %d", t.number)
+		}
+		tracks = append(tracks, cueTrack{number: t.number, title: title, performer: performer,
+			album: sheet.title, start: start})
+	}
+	if len(tracks) < 2 {
+		return nil
+	}
+	return tracks
+}
+
+// parseCueTime parses "mm:ss:ff" into CD frames.
+func parseCueTime(str string) (uint64, error) {
+	parts := strings.Split(str, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid cue time %s", str)
+	}
+	var values [3]uint64
+	for i, part := range parts {
+		value, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		values[i] = value
+	}
+	return (values[0]*60+values[1])*75 + values[2], nil
+}
+
+func cueUnquote(str string) string {
+	str = strings.TrimSpace(str)
+	if len(str) >= 2 && str[0] == '"' && str[len(str)-1] == '"' {
+		return str[1 : len(str)-1]
+	}
+	return str
+}
+
+// resolveTrackRef returns the pathfile and the cue track (nil for a whole
+// file) for a history entry. It remembers the entry as the song played last,
+// which track of the same file comes next, and the artist and album for the
+// spread strategy.
+func resolveTrackRef(folder string, ref string) (string, *cueTrack) {
+	fileName, number := splitTrackRef(ref)
+	pathfile := folder + "/" + fileName
+	var track *cueTrack
+	var tracks []cueTrack
+	if number > 0 {
+		tracks = loadCueTracks(pathfile)
+		track = findCueTrack(tracks, number)
+		if track == nil {
+			logm.Warningf("%s cue track %d of %s not found; playing whole file", pluginname, number, pathfile)
+		}
+	}
+	setCueContinue(folder, fileName, tracks, track)
+	setLastPlayed(folder, ref)
+
+	st := readSongTags(pathfile)
+	artist, albumName := st.artist, st.album
+	if track != nil {
+		if track.performer != "" {
+			artist = track.performer
+		}
+		if track.album != "" {
+			albumName = track.album
+		}
+	}
+	recordRecentSong(folder, artist, albumName)
+	return pathfile, track
+}
+
+// window returns the range [first,last) of frames, decoded at samplePos, that
+// belong to the track, and whether the track ends within these frames.
+// A nil track covers the whole file.
+func (track *cueTrack) window(samplePos uint64, frames int) (int, int, bool) {
+	if track == nil {
+		return 0, frames, false
+	}
+	first, last := 0, frames
+	if samplePos < track.start {
+		if track.start-samplePos >= uint64(frames) {
+			first = frames
+		} else {
+			first = int(track.start - samplePos)
+		}
+	}
+	endOfTrack := false
+	if track.end > 0 && samplePos+uint64(frames) >= track.end {
+		endOfTrack = true
+		last = 0
+		if track.end > samplePos {
+			last = int(track.end - samplePos)
+		}
+		if last < first {
+			last = first
+		}
+	}
+	return first, last, endOfTrack
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mehrvarz/log"
+)
+
+const testCueSheet = `REM GENRE Jazz
+PERFORMER "The Band"
+TITLE "Live at Home"
+FILE "album.flac" WAVE
+  TRACK 01 AUDIO
+    TITLE "Intro"
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Second Song"
+    PERFORMER "Guest"
+    INDEX 00 01:59:70
+    INDEX 01 02:00:00
+  TRACK 03 AUDIO
+    INDEX 01 05:30:15
+`
+
+func TestParseCueSheet(t *testing.T) {
+	tests := []struct {
+		name       string
+		sheet      string
+		file       string
+		sampleRate uint64
+		want       []cueTrack
+	}{
+		{
+			name: "album", sheet: testCueSheet, file: "album.flac", sampleRate: 44100,
+			want: []cueTrack{
+				{number: 1, title: "Intro", performer: "The Band", album: "Live at Home", start: 0, end: 120 * 44100},
+				{number: 2, title: "Second Song", performer: "Guest", album: "Live at Home", start: 120 * 44100, end: 330*44100 + 15*588},
+				{number: 3, title: "Track 3", performer: "The Band", album: "Live at Home", start: 330*44100 + 15*588},
+			},
+		},
+		{
+			// a renamed file still matches a sheet with one FILE
+			name: "renamed", sheet: testCueSheet, file: "renamed.flac", sampleRate: 96000,
+			want: []cueTrack{
+				{number: 1, title: "Intro", performer: "The Band", album: "Live at Home", start: 0, end: 120 * 96000},
+				{number: 2, title: "Second Song", performer: "Guest", album: "Live at Home", start: 120 * 96000, end: 330*96000 + 15*1280},
+				{number: 3, title: "Track 3", performer: "The Band", album: "Live at Home", start: 330*96000 + 15*1280},
+			},
+		},
+		{
+			name: "BOM, lower case, unquoted",
+			sheet: "\ufefftitle Album\nfile disc.flac WAVE\ntrack 1 audio\nindex 01 00:00:00\n" +
+				"track 2 audio\nperformer Solo\nindex 01 00:00:01\n",
+			file: "disc.flac", sampleRate: 48000,
+			want: []cueTrack{
+				{number: 1, title: "Track 1", album: "Album", start: 0, end: 640},
+				{number: 2, title: "Track 2", performer: "Solo", album: "Album", start: 640},
+			},
+		},
+		{
+			name: "two files",
+			sheet: "FILE \"a b.flac\" WAVE\nTRACK 01 AUDIO\nINDEX 01 00:00:00\nTRACK 02 AUDIO\nINDEX 01 01:00:00\n" +
+				"FILE \"c.flac\" WAVE\nTRACK 03 AUDIO\nINDEX 01 00:00:00\nTRACK 04 AUDIO\nINDEX 01 00:30:00\n",
+			file: "c.flac", sampleRate: 44100,
+			want: []cueTrack{
+				{number: 3, title: "Track 3", start: 0, end: 30 * 44100},
+				{number: 4, title: "Track 4", start: 30 * 44100},
+			},
+		},
+		{
+			name:  "single track",
+			sheet: "FILE \"a.flac\" WAVE\nTRACK 01 AUDIO\nINDEX 01 00:00:00\n",
+			file:  "a.flac", sampleRate: 44100,
+		},
+		{
+			name:  "no INDEX 01",
+			sheet: "FILE \"a.flac\" WAVE\nTRACK 01 AUDIO\nINDEX 00 00:00:00\nTRACK 02 AUDIO\nINDEX 01 00:10:xx\n",
+			file:  "a.flac", sampleRate: 44100,
+		},
+		{name: "empty", sheet: "", file: "a.flac", sampleRate: 44100},
+	}
+	for _, test := range tests {
+		got := parseCueSheet(strings.NewReader(test.sheet)).tracksFor(test.file, test.sampleRate)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s:\n got %v\nwant %v", test.name, got, test.want)
+		}
+	}
+
+	sheet := parseCueSheet(strings.NewReader(testCueSheet))
+	if sheet.title != "Live at Home" || sheet.performer != "The Band" || len(sheet.files) != 1 || sheet.files[0] != "album.flac" {
+		t.Errorf("sheet %q by %q, files %q", sheet.title, sheet.performer, sheet.files)
+	}
+}
+
+func TestParseCueTime(t *testing.T) {
+	tests := []struct {
+		str    string
+		frames uint64
+		valid  bool
+	}{
+		{"00:00:00", 0, true},
+		{"01:02:03", (62)*75 + 3, true},
+		{"79:59:74", (79*60+59)*75 + 74, true},
+		{"1:2:3", 62*75 + 3, true},
+		{"01:02", 0, false},
+		{"01:02:x", 0, false},
+		{"-1:00:00", 0, false},
+	}
+	for _, test := range tests {
+		frames, err := parseCueTime(test.str)
+		if (err == nil) != test.valid || frames != test.frames {
+			t.Errorf("parseCueTime(%q) = %d, %v; want %d", test.str, frames, err, test.frames)
+		}
+	}
+}
+
+func TestSplitTrackRef(t *testing.T) {
+	tests := []struct {
+		ref    string
+		file   string
+		number int
+	}{
+		{"album.flac#3", "album.flac", 3},
+		{"album.flac#12", "album.flac", 12},
+		{"album.flac", "album.flac", 0},
+		{"#1 hit.mp3", "#1 hit.mp3", 0},
+		{"song #2.flac#4", "song #2.flac", 4},
+		{"album.flac#0", "album.flac#0", 0},
+		{"album.flac#-1", "album.flac#-1", 0},
+	}
+	for _, test := range tests {
+		if file, number := splitTrackRef(test.ref); file != test.file || number != test.number {
+			t.Errorf("splitTrackRef(%q) = %q, %d; want %q, %d", test.ref, file, number, test.file, test.number)
+		}
+		if test.number > 0 && trackRef(test.file, test.number) != test.ref {
+			t.Errorf("trackRef(%q, %d) = %q", test.file, test.number, trackRef(test.file, test.number))
+		}
+	}
+}
+
+func TestCueTrackWindow(t *testing.T) {
+	track := &cueTrack{number: 2, start: 10000, end: 20000}
+	last := &cueTrack{number: 3, start: 20000}
+	short := &cueTrack{number: 4, start: 100, end: 200}
+	tests := []struct {
+		track       *cueTrack
+		samplePos   uint64
+		frames      int
+		first, last int
+		endOfTrack  bool
+	}{
+		{nil, 0, 4096, 0, 4096, false},
+		{track, 0, 4096, 4096, 4096, false},    // before the track
+		{track, 8192, 4096, 1808, 4096, false}, // the track starts within
+		{track, 10000, 4096, 0, 4096, false},   // exactly at the start
+		{track, 12288, 4096, 0, 4096, false},   // within
+		{track, 16384, 4096, 0, 3616, true},    // the track ends within
+		{track, 15904, 4096, 0, 4096, true},    // ends exactly after the block
+		{track, 24576, 4096, 0, 0, true},       // after the track
+		{short, 0, 4096, 100, 200, true},       // starts and ends within
+		{last, 16384, 4096, 3616, 4096, false},
+		{last, 1 << 40, 4096, 0, 4096, false}, // to the end of the file
+	}
+	for _, test := range tests {
+		first, last, endOfTrack := test.track.window(test.samplePos, test.frames)
+		if first != test.first || last != test.last || endOfTrack != test.endOfTrack {
+			t.Errorf("%v.window(%d, %d) = %d, %d, %v; want %d, %d, %v", test.track, test.samplePos, test.frames,
+				first, last, endOfTrack, test.first, test.last, test.endOfTrack)
+		}
+	}
+}
+
+// TestLoadCueTracks finds the cue sheet of a flac file by name and by content,
+// and continues within the album.
+func TestLoadCueTracks(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	dir, err := ioutil.TempDir("", "tremote_cue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"album.flac", "other.flac", "single.flac"} {
+		fx := newFlacFixture(1, 44100, 16, 0.1)
+		fx.name = name
+		fx.write(t, dir)
+	}
+	files := map[string]string{
+		"album.cue": testCueSheet, // next to album.flac
+		"live.cue":  strings.Replace(testCueSheet, "album.flac", "other.flac", 1),
+	}
+	for name, sheet := range files {
+		if err := ioutil.WriteFile(dir+"/"+name, []byte(sheet), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]int{"album.flac": 3, "other.flac": 3, "single.flac": 0} {
+		if tracks := loadCueTracks(dir + "/" + name); len(tracks) != want {
+			t.Errorf("%s: %d tracks, want %d", name, len(tracks), want)
+		}
+	}
+
+	folder := dir + "/continue"
+	if ref := unplayedTrackRef(dir, "album.flac", nil); ref != "album.flac#1" {
+		t.Errorf("unplayedTrackRef = %q", ref)
+	}
+	tracks := loadCueTracks(dir + "/album.flac")
+	setCueContinue(folder, "album.flac", tracks, &tracks[1])
+	if next := takeCueContinue(folder); next != "album.flac#3" {
+		t.Errorf("after track 2: %q, want album.flac#3", next)
+	}
+	if next := takeCueContinue(folder); next != "" {
+		t.Errorf("taken twice: %q", next)
+	}
+	setCueContinue(folder, "album.flac", tracks, &tracks[2])
+	if next := takeCueContinue(folder); next != "" {
+		t.Errorf("after the last track: %q", next)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bobertlo/go-mpg123/mpg123"
+	"github.com/mehrvarz/go_queue"
+	"github.com/mehrvarz/log"
+)
+
+// damageFrame flips bytes in the middle of flac frame k, which breaks its CRC-16.
+func damageFrame(k int) func(fx *fixture, data []byte) []byte {
+	return func(fx *fixture, data []byte) []byte {
+		data[fx.frameOffsets[k]+100] ^= 0x55
+		data[fx.frameOffsets[k]+101] ^= 0xaa
+		return data
+	}
+}
+
+func damageAllFrames(fx *fixture, data []byte) []byte {
+	for k := range fx.frameOffsets {
+		data = damageFrame(k)(fx, data)
+	}
+	return data
+}
+
+// truncateInFrame cuts the file in the middle of flac frame k.
+func truncateInFrame(k int) func(fx *fixture, data []byte) []byte {
+	return func(fx *fixture, data []byte) []byte {
+		return data[:fx.frameOffsets[k]+50]
+	}
+}
+
+func garbage(fx *fixture, data []byte) []byte {
+	for i := range data {
+		data[i] = byte(i*7 + i/3)
+	}
+	return data
+}
+
+// withoutBlock returns the samples the sink gets from fx, without flac block k.
+func withoutBlock(fx *fixture, k int) []int32 {
+	samples := fx.sinkSamples()
+	from, to := k*testFlacBlockSize*fx.channels, (k+1)*testFlacBlockSize*fx.channels
+	return append(append([]int32{}, samples[:from]...), samples[to:]...)
+}
+
+// flakyMp3 fails the given number of reads before each read that succeeds, as
+// mpg123 does for an mp3 with damaged frames all through it.
+type flakyMp3 struct {
+	mp3Source
+	failures int
+	failed   int
+}
+
+func (f *flakyMp3) Read(buf []byte) (int, error) {
+	if f.failed < f.failures {
+		f.failed++
+		return 0, errors.New("damaged frame")
+	}
+	f.failed = 0
+	return f.mp3Source.Read(buf)
+}
+
+func TestDamagedFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		damaged  *fixture
+		failures int                       // failed mp3 reads before each good one
+		want     func(fx *fixture) []int32 // samples of the damaged file reaching the sink; nil = none
+		outcome  string
+		status   string
+	}{
+		{
+			name:    "damaged frame is skipped",
+			damaged: &fixture{damage: damageFrame(4)},
+			want:    func(fx *fixture) []int32 { return withoutBlock(fx, 4) },
+			outcome: playFinished,
+		},
+		{
+			name:    "truncated file",
+			damaged: &fixture{damage: truncateInFrame(6)},
+			want:    func(fx *fixture) []int32 { return fx.sinkSamples()[:6*testFlacBlockSize*fx.channels] },
+			outcome: playError,
+			status:  "error reading audio source",
+		},
+		{
+			name:    "error budget",
+			damaged: &fixture{damage: damageAllFrames},
+			outcome: playError,
+			status:  "error reading audio source",
+		},
+		{
+			name:    "garbage flac",
+			damaged: &fixture{damage: garbage},
+			outcome: playError,
+			status:  "error open flac file",
+		},
+		{
+			name:    "garbage mp3",
+			damaged: &fixture{name: "01.mp3", damage: garbage},
+			outcome: playError,
+			status:  "mp3",
+		},
+		{
+			// 6 failed reads per block stay under the budget, 16 for the file do not
+			name:     "mp3 error budget",
+			damaged:  &fixture{name: "01.mp3"},
+			failures: 6,
+			want:     func(fx *fixture) []int32 { return fx.sinkSamples()[:2*4096*fx.channels] },
+			outcome:  playError,
+			status:   "error reading audio source",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			damaged := newFlacFixture(1, 44100, 16, 0.5)
+			if test.damaged.name != "" {
+				damaged = newMp3Fixture(1, 10)
+			}
+			damaged.damage = test.damaged.damage
+			if test.failures > 0 {
+				defer func(orig func(d *mpg123.Decoder) mp3Source) { newMp3Source = orig }(newMp3Source)
+				newMp3Source = func(d *mpg123.Decoder) mp3Source {
+					return &flakyMp3{mp3Source: d, failures: test.failures}
+				}
+			}
+			good := newFlacFixture(2, 96000, 24, 0.1)
+			h := newHarness(t, false, []string{"mode=sequential", "repeat=once"}, damaged, good)
+			defer h.remove()
+			h.shortPress(1)
+			h.waitState(stateIdle)
+			h.finish()
+
+			streams := h.out.streams
+			if test.want != nil {
+				if len(streams) == 0 || !equalSamples(streams[0].samples, test.want(damaged)) {
+					t.Errorf("damaged file: wrong samples")
+				}
+				streams = streams[1:]
+			}
+			if len(streams) != 1 || !equalSamples(streams[0].samples, good.sinkSamples()) {
+				t.Errorf("next song not played after the damaged one")
+			}
+			if got := h.outcomes(damaged.name); len(got) != 1 || got[0] != test.outcome {
+				t.Errorf("outcome %v, want %s", got, test.outcome)
+			}
+			if test.status != "" && !h.host.called("PrintStatus", test.status) {
+				t.Errorf("no PrintStatus(%q) in %q", test.status, h.host.args("PrintStatus"))
+			}
+		})
+	}
+}
+
+// decodeTimeout is how long playSong may take for a fuzz input.
+const decodeTimeout = 10 * time.Second
+
+/*
+decodeFile plays data as file name through playSong, as a session would (cue
+track starting at sample start, if not 0). It fails if playSong panics, takes
+longer than decodeTimeout or leaves an output stream open.
+*/
+func decodeFile(t *testing.T, name string, data []byte, start uint64) {
+	dir, err := ioutil.TempDir("", "tremote_fuzz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pathfile := dir + "/" + name
+	if err := ioutil.WriteFile(pathfile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	out := newCaptureOutput(false)
+	output = out
+	defer func() { output = portaudioOutput{} }()
+	host := newFakeHost()
+	s := &session{instance: 1, ph: host.ph, quit: make(chan struct{}), pause: make(chan bool, 1)}
+	var track *cueTrack
+	if start > 0 {
+		track = &cueTrack{number: 2, start: start}
+	}
+
+	done := make(chan interface{})
+	go func() {
+		defer func() { done <- recover() }()
+		playSong(name, pathfile, track, host.ph, s, go_queue.NewQueue(queueSize))
+	}()
+	select {
+	case r := <-done:
+		if r != nil {
+			t.Fatalf("playSong panics on %d bytes: %v", len(data), r)
+		}
+	case <-time.After(decodeTimeout):
+		t.Fatalf("playSong hangs on %d bytes", len(data))
+	}
+	if out.open != 0 {
+		t.Errorf("output stream left open")
+	}
+}
+
+func FuzzDecodeFlac(f *testing.F) {
+	for _, fx := range []*fixture{newFlacFixture(1, 44100, 16, 0.1), newFlacFixture(2, 96000, 24, 0.05)} {
+		data := fx.flacBytes()
+		f.Add(data, uint16(0))
+		f.Add(data, uint16(2000))
+		f.Add(data[:len(data)/2], uint16(0))
+		f.Add(data[:fx.frameOffsets[0]], uint16(0))
+		f.Add(damageFrame(1)(fx, append([]byte{}, data...)), uint16(1500))
+	}
+	f.Fuzz(func(t *testing.T, data []byte, start uint16) {
+		decodeFile(t, "fuzz.flac", data, uint64(start))
+	})
+}
+
+func FuzzDecodeMp3(f *testing.F) {
+	data := newMp3Fixture(1, 10).mp3Bytes()
+	f.Add(data)
+	f.Add(data[:len(data)/2])
+	f.Add(data[:20])
+	f.Add([]byte(strings.Repeat("\xff\xfb\x90\x64", 200)))
+	// extended header flag without room for one: dhowden/tag reads its size from the audio
+	f.Add([]byte("ID3\x03\x00\x40\x00\x00\x00\x00z0000"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeFile(t, "fuzz.mp3", data, 0)
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/bobertlo/go-mpg123/mpg123"
+)
+
+var errMp3ErrorBudget = errors.New("too many failed mp3 reads")
+
+// mp3Source is what songDecoder needs of an mpg123.Decoder.
+type mp3Source interface {
+	Read(buf []byte) (int, error)
+}
+
+// newMp3Source returns the source songDecoder reads an mp3 file from; tests
+// replace it.
+var newMp3Source = func(d *mpg123.Decoder) mp3Source {
+	return d
+}
+
+/*
+songDecoder decodes a song ahead of playback. run() puts the interleaved
+samples of the song (or cue track) into ring, as mpg123 or flacDecoder deliver
+them: 16 bit mp3 samples, 16 or 24 bit flac samples. playSong's output loop
+gets them from there, so a slow moment of the decoder no longer starves the
+audio sink, and a slow sink no longer holds up the decoder.
+Once the buffers have been allocated for the first block, decoding does not
+allocate anything: see TestSteadyStateAllocs.
+*/
+type songDecoder struct {
+	ring       *sampleRing
+	mp3decoder mp3Source // nil for flac
+	flacframes *flacFrames
+	track      *cueTrack
+	channels   int
+	samplePos  uint64 // inter-channel sample position in the file of the next decoded sample
+
+	stop chan struct{} // closed by playSong: song over
+	done chan struct{} // closed by run() when it returns
+
+	// valid once done is closed
+	reachedEnd bool  // the end of the song (cue track) was decoded
+	err        error // decoding failed; nil if stopped
+
+	audioBuf     []byte  // mp3 decode buffer
+	block        []int32 // samples of the track from the last decoded block
+	decodeErrors int     // failed mp3 reads of the file so far
+}
+
+func newSongDecoder(ring *sampleRing, channels int, track *cueTrack, samplePos uint64) *songDecoder {
+	return &songDecoder{ring: ring, channels: channels, track: track, samplePos: samplePos,
+		stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// run decodes until the end of the song, an error, or stop.
+func (d *songDecoder) run() {
+	defer close(d.done)
+	for {
+		endOfTrack, err := d.decodeBlock()
+		if err == io.EOF {
+			d.reachedEnd = true
+			return
+		}
+		if err != nil {
+			d.err = err
+			return
+		}
+		if !d.ring.put(d.block, d.stop) {
+			return
+		}
+		if endOfTrack {
+			logm.Debugf("%s end of cue track at sample %d", pluginname, d.samplePos)
+			d.reachedEnd = true
+			return
+		}
+	}
+}
+
+// close stops run() and waits for it to return.
+func (d *songDecoder) close() {
+	close(d.stop)
+	<-d.done
+}
+
+// finished returns true once run() has returned.
+func (d *songDecoder) finished() bool {
+	select {
+	case <-d.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// decodeBlock decodes the next block of the song into d.block and returns
+// whether the cue track ends within it; io.EOF at the end of the file.
+func (d *songDecoder) decodeBlock() (bool, error) {
+	if d.mp3decoder != nil {
+		return d.decodeMp3()
+	}
+	return d.decodeFlac()
+}
+
+// blockOf returns d.block, resized to n samples.
+func (d *songDecoder) blockOf(n int) []int32 {
+	if cap(d.block) < n {
+		d.block = make([]int32, n)
+	}
+	d.block = d.block[:n]
+	return d.block
+}
+
+// decodeMp3 reads 4096 frames into d.block; io.EOF at the end of the file.
+func (d *songDecoder) decodeMp3() (bool, error) {
+	const bytesPerSample = 2 // always 16 bit from mpg123
+	if d.audioBuf == nil {
+		d.audioBuf = make([]byte, 4096*d.channels*bytesPerSample)
+	}
+	for {
+		count, err := d.mp3decoder.Read(d.audioBuf)
+		if err == mpg123.EOF {
+			return false, io.EOF
+		}
+		if err != nil || count == 0 {
+			// mpg123 resyncs by itself; we only make sure this ends, counting
+			// the failed reads of the whole file
+			d.decodeErrors++
+			if err == nil {
+				err = errors.New("no data")
+			}
+			logm.Warningf("%s error reading audio source (%d/%d) err=%s",
+				pluginname, d.decodeErrors, decodeErrorBudget, err.Error())
+			if d.decodeErrors >= decodeErrorBudget {
+				return false, errMp3ErrorBudget
+			}
+			if count == 0 {
+				continue
+			}
+		}
+
+		frames := count / (bytesPerSample * d.channels)
+		first, last, endOfTrack := d.track.window(d.samplePos, frames)
+		d.samplePos += uint64(frames)
+		pcm := d.audioBuf[first*d.channels*bytesPerSample : last*d.channels*bytesPerSample]
+		block := d.blockOf(len(pcm) / bytesPerSample)
+		for i := range block {
+			block[i] = int32(int16(binary.LittleEndian.Uint16(pcm[2*i:])))
+		}
+		return endOfTrack, nil
+	}
+}
+
+// decodeFlac decodes the next flac frame into d.block; io.EOF at the end of
+// the file. Damaged frames have been skipped by flacFrames already.
+func (d *songDecoder) decodeFlac() (bool, error) {
+	blockSize, err := d.flacframes.next()
+	if err != nil {
+		return false, err
+	}
+	first, last, endOfTrack := d.track.window(d.samplePos, blockSize)
+	d.samplePos += uint64(blockSize)
+	block := d.blockOf((last - first) * d.channels)
+	if d.channels == 2 {
+		left, right := d.flacframes.samples(0)[first:last], d.flacframes.samples(1)[first:last]
+		right = right[:len(left)]
+		for i, sample := range left {
+			block[2*i] = sample
+			block[2*i+1] = right[i]
+		}
+		return endOfTrack, nil
+	}
+	for c := 0; c < d.channels; c++ {
+		for i, sample := range d.flacframes.samples(c)[first:last] {
+			block[i*d.channels+c] = sample
+		}
+	}
+	return endOfTrack, nil
+}
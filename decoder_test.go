@@ -0,0 +1,267 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/bobertlo/go-mpg123/mpg123"
+	"github.com/mehrvarz/log"
+	"github.com/mewkiz/flac"
+)
+
+// monoFixture returns fx with its left channel only.
+func monoFixture(fx *fixture) *fixture {
+	mono := *fx
+	mono.channels = 1
+	mono.samples = nil
+	for i := 0; i < len(fx.samples); i += fx.channels {
+		mono.samples = append(mono.samples, fx.samples[i])
+	}
+	return &mono
+}
+
+func predicted(fx *fixture) *fixture {
+	fx.predicted = true
+	return fx
+}
+
+func escaped(fx *fixture) *fixture {
+	fx.predicted, fx.escaped = true, true
+	return fx
+}
+
+// TestFlacDecoder decodes fixtures with flacDecoder, and with mewkiz/flac to
+// make sure the fixtures are what an encoder would write. mewkiz/flac cannot
+// decode escaped residual partitions.
+func TestFlacDecoder(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	tests := []struct {
+		name string
+		fx   *fixture
+	}{
+		{"verbatim 16/44.1", newFlacFixture(1, 44100, 16, 0.1)},
+		{"verbatim 24/96", newFlacFixture(2, 96000, 24, 0.1)},
+		{"predicted 16/44.1", predicted(newFlacFixture(3, 44100, 16, 0.3))},
+		{"predicted 24/96", predicted(newFlacFixture(4, 96000, 24, 0.3))},
+		{"predicted mono", predicted(monoFixture(newFlacFixture(5, 48000, 16, 0.1)))},
+		{"escaped 24/96", escaped(newFlacFixture(6, 96000, 24, 0.3))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "tremote_decoder")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			fx := test.fx
+			fx.write(t, dir)
+			pathfile := dir + "/" + fx.name
+
+			ref, err := flac.ParseFile(pathfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ref.Close()
+			var want []int32
+			for !fx.escaped {
+				frame, err := ref.ParseNext()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("mewkiz/flac: %v", err)
+				}
+				for i := 0; i < int(frame.BlockSize); i++ {
+					for _, subframe := range frame.Subframes {
+						want = append(want, subframe.Samples[i])
+					}
+				}
+			}
+			if !fx.escaped && !equalSamples(want, fx.samples) {
+				t.Fatalf("mewkiz/flac does not decode the fixture")
+			}
+
+			f, err := os.Open(pathfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			offset, err := flacAudioOffset(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ff, err := newFlacFrames(f, ref.Info, offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []int32
+			for {
+				blockSize, err := ff.next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < blockSize; i++ {
+					for c := 0; c < fx.channels; c++ {
+						got = append(got, ff.samples(c)[i])
+					}
+				}
+			}
+			if !equalSamples(got, fx.samples) {
+				t.Errorf("wrong samples")
+			}
+			if ff.errors != 0 {
+				t.Errorf("%d frames dropped", ff.errors)
+			}
+		})
+	}
+}
+
+/*
+steadyState does playSong's work per buffer, without the waiting: decode a
+block, pass it through the ring, convert it for the sink and write it.
+*/
+type steadyState struct {
+	decoder *songDecoder
+	samples []int32
+	sink    *sinkBuffer
+	stream  audioStream
+	close   func()
+}
+
+// discardStream is an audioStream playing nothing.
+type discardStream struct{}
+
+func (discardStream) Start() error { return nil }
+func (discardStream) Write() error { return nil }
+func (discardStream) Stop() error  { return nil }
+func (discardStream) Close() error { return nil }
+
+// newSteadyState opens fixture fx (written to dir) the way playSong does.
+func newSteadyState(tb testing.TB, dir string, fx *fixture) *steadyState {
+	pathfile := dir + "/" + fx.name
+	chunk := 4096 * fx.channels
+	ring := newSampleRing(ringSeconds, fx.rate*fx.channels, 2*chunk)
+	st := &steadyState{decoder: newSongDecoder(ring, fx.channels, nil, 0), stream: discardStream{}}
+	if fx.isFlac() {
+		f, err := os.Open(pathfile)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		stream, err := openFlacStream(f)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		offset, err := flacAudioOffset(f)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		st.decoder.flacframes, err = newFlacFrames(f, stream.Info, offset)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		chunk = int(stream.Info.BlockSizeMax) * fx.channels
+		st.close = func() { f.Close() }
+	} else {
+		mp3decoder, err := mpg123.NewDecoder("")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if err = mp3decoder.Open(pathfile); err != nil {
+			tb.Fatal(err)
+		}
+		sampleRate, channels, _ := mp3decoder.GetFormat()
+		mp3decoder.FormatNone()
+		mp3decoder.Format(sampleRate, channels, mpg123.ENC_SIGNED_16)
+		st.decoder.mp3decoder = mp3decoder
+		st.close = func() { mp3decoder.Close() }
+	}
+	st.samples = make([]int32, chunk)
+	st.sink = newSinkBuffer(sampleFormatsFor(fx.bits)[0], fx.bits, chunk)
+	return st
+}
+
+func (st *steadyState) step() error {
+	if _, err := st.decoder.decodeBlock(); err != nil {
+		return err
+	}
+	st.decoder.ring.put(st.decoder.block, nil)
+	n := st.decoder.ring.get(st.samples)
+	st.sink.set(st.samples[:n])
+	return st.stream.Write()
+}
+
+// steadyStateFixtures are the reference files: an mp3 and a 24/96 flac, long
+// enough for 100 buffers.
+func steadyStateFixtures() []*fixture {
+	return []*fixture{newMp3Fixture(1, 400), predicted(newFlacFixture(2, 96000, 24, 2))}
+}
+
+func TestSteadyStateAllocs(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	dir, err := ioutil.TempDir("", "tremote_allocs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, fx := range steadyStateFixtures() {
+		fx.write(t, dir)
+		st := newSteadyState(t, dir, fx)
+		allocs := testing.AllocsPerRun(100, func() {
+			if err := st.step(); err != nil {
+				t.Fatalf("%s: %v", fx.name, err)
+			}
+		})
+		st.close()
+		if allocs != 0 {
+			t.Errorf("%s: %.1f allocations per buffer, want 0", fx.name, allocs)
+		}
+	}
+}
+
+func benchmarkSteadyState(b *testing.B, fx *fixture) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	dir, err := ioutil.TempDir("", "tremote_bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fx.write(b, dir)
+	st := newSteadyState(b, dir, fx)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := st.step()
+		if err == io.EOF {
+			// start over
+			b.StopTimer()
+			st.close()
+			st = newSteadyState(b, dir, fx)
+			b.StartTimer()
+			continue
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	st.close()
+}
+
+func BenchmarkSteadyStateMp3(b *testing.B) {
+	benchmarkSteadyState(b, steadyStateFixtures()[0])
+}
+
+func BenchmarkSteadyStateFlac2496(b *testing.B) {
+	benchmarkSteadyState(b, steadyStateFixtures()[1])
+}
@@ -0,0 +1,204 @@
+/*
+Now-playing display templates. The string sent to ph.PrintInfo and the status
+sent with ph.PrintStatus when a song starts are rendered from templates that
+can be set per mapping line:
+
+	play_audio|/media/sda1/Music|display=[{artist}: ]{title}[ ({year})]|status=[{format} {bits}/{khz}]
+
+{name} is replaced by a field, text in [brackets] is only shown if none of the
+fields in it is empty. Separators ("-", "/", ",", ":" and spaces) left at the
+start or end of the result are removed. If nothing remains, the file name is
+shown. A mapping line cannot contain "|", so neither can a template.
+*/
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/mehrvarz/tremote_plugin"
+)
+
+const (
+	defaultDisplayTemplate = "{title}[ - {artist}][ - {album}]"
+	defaultStatusTemplate  = "{hires}" // "24 96000" for hi-res files, like before
+	progressTemplate       = "{elapsed}[ / {duration}][ -{remaining}][ {percent}%]"
+
+	// where progress updates go (config.txt "progress = ...")
+	progressOff     = "off"
+	progressStatus  = "status"  // ph.PrintStatus("1:23 / 4:05 -2:42 33%")
+	progressHostCmd = "hostcmd" // ph.HostCmd("Progress", "83 245 33"): elapsed, duration (s), percent
+	progressDisplay = "display" // ph.PrintInfo with the display template, for {elapsed} and friends
+)
+
+// displaySeparators are trimmed from both ends of a rendered template
+const displaySeparators = " -/,:"
+
+// songInfo holds the fields available to display templates
+type songInfo struct {
+	title    string
+	artist   string
+	album    string
+	file     string
+	year     int
+	track    int
+	tracks   int
+	format   string  // "FLAC" or "MP3"
+	bits     int     // bits per sample
+	rate     int64   // sample rate in Hz
+	elapsed  float64 // seconds
+	duration float64 // seconds; 0 = unknown
+}
+
+// field returns the display value of a template field; "" if unknown or empty.
+func (info *songInfo) field(name string) string {
+	switch name {
+	case "title":
+		return displayText(info.title)
+	case "artist":
+		return displayText(info.artist)
+	case "album":
+		return displayText(info.album)
+	case "file":
+		return displayText(info.file)
+	case "year":
+		return positive(info.year)
+	case "track":
+		return positive(info.track)
+	case "tracks":
+		return positive(info.tracks)
+	case "format":
+		return info.format
+	case "bits":
+		return positive(info.bits)
+	case "rate":
+		if info.rate > 0 {
+			return fmt.Sprintf("%d", info.rate)
+		}
+	case "khz":
+		if info.rate > 0 {
+			return strings.TrimSuffix(fmt.Sprintf("%.1f", float64(info.rate)/1000), ".0")
+		}
+	case "hires":
+		if info.rate > 44100 || info.bits > 16 {
+			return fmt.Sprintf("%d %d", info.bits, info.rate)
+		}
+	case "elapsed":
+		return formatSeconds(info.elapsed)
+	case "duration":
+		if info.duration > 0 {
+			return formatSeconds(info.duration)
+		}
+	case "remaining":
+		if info.duration > 0 {
+			return formatSeconds(math.Max(info.duration-info.elapsed, 0))
+		}
+	case "percent":
+		if info.duration > 0 {
+			return fmt.Sprintf("%d", int(math.Min(info.elapsed/info.duration, 1)*100))
+		}
+	}
+	return ""
+}
+
+func positive(i int) string {
+	if i > 0 {
+		return fmt.Sprintf("%d", i)
+	}
+	return ""
+}
+
+// formatSeconds returns m:ss, or h:mm:ss for an hour or more.
+func formatSeconds(seconds float64) string {
+	s := int(seconds)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+// render fills in tmpl; see the top of this file.
+func (info *songInfo) render(tmpl string) string {
+	var out strings.Builder
+	var segment strings.Builder
+	inSegment := false
+	segmentEmpty := false
+	for len(tmpl) > 0 {
+		c := tmpl[0]
+		switch {
+		case c == '[' && !inSegment:
+			inSegment, segmentEmpty = true, false
+			segment.Reset()
+			tmpl = tmpl[1:]
+		case c == ']' && inSegment:
+			if !segmentEmpty {
+				out.WriteString(segment.String())
+			}
+			inSegment = false
+			tmpl = tmpl[1:]
+		case c == '{' && strings.IndexByte(tmpl, '}') > 0:
+			end := strings.IndexByte(tmpl, '}')
+			value := info.field(strings.ToLower(tmpl[1:end]))
+			if inSegment {
+				segment.WriteString(value)
+				segmentEmpty = segmentEmpty || value == ""
+			} else {
+				out.WriteString(value)
+			}
+			tmpl = tmpl[end+1:]
+		default:
+			if inSegment {
+				segment.WriteByte(c)
+			} else {
+				out.WriteByte(c)
+			}
+			tmpl = tmpl[1:]
+		}
+	}
+	if inSegment && !segmentEmpty {
+		// missing ']'
+		out.WriteString(segment.String())
+	}
+	return strings.Trim(out.String(), displaySeparators)
+}
+
+// display renders the now-playing string; the file name if it comes out empty.
+func (info *songInfo) display(tmpl string) string {
+	if str := info.render(tmpl); str != "" {
+		return str
+	}
+	return displayText(info.file)
+}
+
+// displayTemplates returns the display and status templates of the active
+// mapping line.
+func displayTemplates() (string, string) {
+	playModeLock.Lock()
+	options := activeOptions
+	playModeLock.Unlock()
+	display, status := defaultDisplayTemplate, defaultStatusTemplate
+	if tmpl, ok := options["display"]; ok {
+		display = tmpl
+	}
+	if tmpl, ok := options["status"]; ok {
+		status = tmpl
+	}
+	return display, status
+}
+
+// sendProgress sends a progress update the way config.txt asks for.
+func (info *songInfo) sendProgress(ph tremote_plugin.PluginHelper, displayTemplate string) {
+	switch configProgress {
+	case progressStatus:
+		ph.PrintStatus(info.render(progressTemplate))
+	case progressHostCmd:
+		percent := 0
+		if info.duration > 0 {
+			percent = int(math.Min(info.elapsed/info.duration, 1) * 100)
+		}
+		ph.HostCmd("Progress", fmt.Sprintf("%d %d %d", int(info.elapsed), int(info.duration), percent))
+	case progressDisplay:
+		ph.PrintInfo(info.display(displayTemplate))
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import "testing"
+
+func TestRender(t *testing.T) {
+	full := songInfo{title: "Song", artist: "Band", album: "Blue", file: "01 song.flac", year: 1999,
+		track: 3, tracks: 12, format: "FLAC", bits: 24, rate: 96000, elapsed: 83.6, duration: 245}
+	bare := songInfo{file: "02 other.mp3", format: "MP3", bits: 16, rate: 44100, elapsed: 5}
+	tests := []struct {
+		name string
+		info songInfo
+		tmpl string
+		want string
+	}{
+		{"default", full, defaultDisplayTemplate, "Song - Band - Blue"},
+		{"default, no tags", bare, defaultDisplayTemplate, ""},
+		{"status hi-res", full, defaultStatusTemplate, "24 96000"},
+		{"status cd", bare, defaultStatusTemplate, ""},
+		{"segments", full, "[{artist}: ]{title}[ ({year})]", "Band: Song (1999)"},
+		{"empty segments", bare, "[{artist}: ]{file}[ ({year})]", "02 other.mp3"},
+		{"two fields in a segment", full, "[{track}/{tracks} ]{title}", "3/12 Song"},
+		{"one of two fields empty", songInfo{title: "Song", track: 3}, "[{track}/{tracks} ]{title}", "Song"},
+		{"separators trimmed", bare, "{artist} - {title} / {album}", ""},
+		{"khz", full, "{format} {bits}/{khz}", "FLAC 24/96"},
+		{"khz fraction", bare, "{format} {bits}/{khz}", "MP3 16/44.1"},
+		{"rate", bare, "{rate}", "44100"},
+		{"case and unknown fields", full, "{TITLE}{nope}", "Song"},
+		{"missing ]", full, "{title}[ - {artist}", "Song - Band"},
+		{"missing }", full, "{title} {artist", "Song {artist"},
+		{"progress", full, progressTemplate, "1:23 / 4:05 -2:41 34%"},
+		{"progress, unknown duration", bare, progressTemplate, "0:05"},
+		{"past the end", songInfo{elapsed: 250, duration: 245}, progressTemplate, "4:10 / 4:05 -0:00 100%"},
+	}
+	for _, test := range tests {
+		if got := test.info.render(test.tmpl); got != test.want {
+			t.Errorf("%s: render(%q) = %q, want %q", test.name, test.tmpl, got, test.want)
+		}
+	}
+	if got := bare.display(defaultDisplayTemplate); got != "02 other.mp3" {
+		t.Errorf("display without tags = %q, want the file name", got)
+	}
+}
+
+func TestFormatSeconds(t *testing.T) {
+	tests := []struct {
+		seconds float64
+		want    string
+	}{
+		{0, "0:00"},
+		{59.9, "0:59"},
+		{61, "1:01"},
+		{3599, "59:59"},
+		{3600, "1:00:00"},
+		{36061, "10:01:01"},
+	}
+	for _, test := range tests {
+		if got := formatSeconds(test.seconds); got != test.want {
+			t.Errorf("formatSeconds(%g) = %q, want %q", test.seconds, got, test.want)
+		}
+	}
+}
+
+func TestDisplayTemplates(t *testing.T) {
+	defer setActiveFolder("", nil)
+	tests := []struct {
+		options         map[string]string
+		display, status string
+	}{
+		{nil, defaultDisplayTemplate, defaultStatusTemplate},
+		{map[string]string{"display": "{title}"}, "{title}", defaultStatusTemplate},
+		{map[string]string{"status": ""}, defaultDisplayTemplate, ""},
+	}
+	for _, test := range tests {
+		setActiveFolder("/music/display", test.options)
+		if display, status := displayTemplates(); display != test.display || status != test.status {
+			t.Errorf("%v: %q, %q", test.options, display, status)
+		}
+	}
+}
+
+func TestSendProgress(t *testing.T) {
+	defer func(orig string) { configProgress = orig }(configProgress)
+	info := songInfo{title: "Song", elapsed: 83, duration: 245}
+	tests := []struct {
+		progress string
+		fkt      string
+		want     string
+	}{
+		{progressStatus, "PrintStatus", "1:23 / 4:05 -2:42 33%"},
+		{progressHostCmd, "HostCmd", "Progress"},
+		{progressDisplay, "PrintInfo", "Song 1:23"},
+		{progressOff, "", ""},
+	}
+	for _, test := range tests {
+		configProgress = test.progress
+		host := newFakeHost()
+		info.sendProgress(host.ph, "{title} {elapsed}")
+		host.mu.Lock()
+		calls := host.calls
+		host.mu.Unlock()
+		if test.fkt == "" {
+			if len(calls) != 0 {
+				t.Errorf("progress=%s: %d calls", test.progress, len(calls))
+			}
+			continue
+		}
+		if len(calls) != 1 || calls[0].fkt != test.fkt || calls[0].arg != test.want {
+			t.Errorf("progress=%s: %+v, want %s(%q)", test.progress, calls, test.fkt, test.want)
+		} else if test.fkt == "HostCmd" && calls[0].arg2 != "83 245 33" {
+			t.Errorf("progress=%s: HostCmd arg %q", test.progress, calls[0].arg2)
+		}
+	}
+}
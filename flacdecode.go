@@ -0,0 +1,475 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/mewkiz/flac/meta"
+)
+
+/*
+flacDecoder decodes FLAC audio frames into sample buffers it keeps from frame
+to frame. mewkiz/flac allocates a Frame, its subframes, their samples, a CRC
+hash and a bit reader for every frame; on a single core Pi the garbage
+collection that follows is audible. We still use mewkiz/flac for the metadata
+blocks, which are read once per song. (mewkiz/flac v1.0.5 also gets residual
+partitions with a Rice escape code wrong.)
+*/
+type flacDecoder struct {
+	info    *meta.StreamInfo
+	br      bitReader
+	samples [][]int32 // per channel, decoded samples of the last frame
+	coeffs  [32]int32 // LPC coefficients of the current subframe
+
+	blockSize int // samples per channel of the last frame
+}
+
+// errFlacShort is returned by decode for data that ends within the frame.
+var errFlacShort = errors.New("flac frame incomplete")
+
+func newFlacDecoder(info *meta.StreamInfo) *flacDecoder {
+	maxBlock := int(info.BlockSizeMax)
+	if maxBlock == 0 {
+		maxBlock = 65535
+	}
+	d := &flacDecoder{info: info, samples: make([][]int32, info.NChannels)}
+	for c := range d.samples {
+		d.samples[c] = make([]int32, maxBlock)
+	}
+	return d
+}
+
+// decode decodes the frame at the start of data and returns its length in
+// bytes. The samples of channel c are then d.samples[c][:d.blockSize]. Frames
+// not matching STREAMINFO are rejected, as are frames with a bad CRC.
+func (d *flacDecoder) decode(data []byte) (int, error) {
+	br := &d.br
+	br.reset(data)
+
+	// frame header
+	if br.read(15) != 0x7ffc {
+		// 14 bit sync code, 1 reserved bit
+		if br.short {
+			return 0, errFlacShort
+		}
+		return 0, errors.New("no frame sync code")
+	}
+	br.read(1) // blocking strategy; we do not need the frame (sample) number
+	blockCode := br.read(4)
+	rateCode := br.read(4)
+	assignment := br.read(4)
+	bitsCode := br.read(3)
+	if br.read(1) != 0 {
+		return 0, errors.New("reserved frame header bit set")
+	}
+	if number := br.read(8); number&0x80 != 0 {
+		// frame or sample number, UTF-8 coded
+		n := bits.LeadingZeros8(^uint8(number))
+		if n < 2 || n > 7 {
+			return 0, errors.New("invalid frame number")
+		}
+		for i := 1; i < n; i++ {
+			if br.read(8)&0xc0 != 0x80 {
+				return 0, errors.New("invalid frame number")
+			}
+		}
+	}
+	var blockSize int
+	switch {
+	case blockCode == 0:
+		return 0, errors.New("reserved block size")
+	case blockCode == 1:
+		blockSize = 192
+	case blockCode <= 5:
+		blockSize = 576 << (blockCode - 2)
+	case blockCode == 6:
+		blockSize = int(br.read(8)) + 1
+	case blockCode == 7:
+		blockSize = int(br.read(16)) + 1
+	default:
+		blockSize = 256 << (blockCode - 8)
+	}
+	switch rateCode {
+	case 12:
+		br.read(8)
+	case 13, 14:
+		br.read(16)
+	case 15:
+		return 0, errors.New("invalid sample rate")
+	}
+	if br.short {
+		return 0, errFlacShort
+	}
+	if crc := byte(br.read(8)); crc != flacCRC8(data[:br.bytePos()-1]) {
+		if br.short {
+			return 0, errFlacShort
+		}
+		return 0, errors.New("frame header CRC mismatch")
+	}
+
+	bps := uint(0)
+	switch bitsCode {
+	case 0:
+		bps = uint(d.info.BitsPerSample)
+	case 1:
+		bps = 8
+	case 2:
+		bps = 12
+	case 4:
+		bps = 16
+	case 5:
+		bps = 20
+	case 6:
+		bps = 24
+	}
+	if bps != uint(d.info.BitsPerSample) {
+		return 0, fmt.Errorf("%d bits per sample", bps)
+	}
+	channels := int(assignment) + 1
+	if assignment >= 8 {
+		// left/side, side/right, mid/side
+		channels = 2
+		if assignment > 10 {
+			return 0, errors.New("reserved channel assignment")
+		}
+	}
+	if channels != len(d.samples) {
+		return 0, fmt.Errorf("%d channels", channels)
+	}
+	if blockSize > len(d.samples[0]) {
+		return 0, fmt.Errorf("block size %d", blockSize)
+	}
+
+	for c := 0; c < channels; c++ {
+		sbps := bps
+		if (assignment == 8 || assignment == 10) && c == 1 || assignment == 9 && c == 0 {
+			// the side channel has an extra bit
+			sbps++
+		}
+		if err := d.subframe(d.samples[c][:blockSize], sbps); err != nil {
+			return 0, err
+		}
+		if br.short {
+			return 0, errFlacShort
+		}
+	}
+	br.align()
+	frameLen := br.bytePos()
+	crc := uint16(br.read(16))
+	if br.short {
+		return 0, errFlacShort
+	}
+	if crc != flacCRC16(data[:frameLen]) {
+		return 0, errors.New("frame CRC mismatch")
+	}
+
+	if channels == 2 {
+		decorrelate(assignment, d.samples[0][:blockSize], d.samples[1][:blockSize])
+	}
+	d.blockSize = blockSize
+	return frameLen + 2, nil
+}
+
+// subframe decodes the subframe of one channel into out.
+func (d *flacDecoder) subframe(out []int32, bps uint) error {
+	br := &d.br
+	if br.read(1) != 0 {
+		return errors.New("subframe padding bit set")
+	}
+	kind := br.read(6)
+	wasted := uint(0)
+	if br.read(1) != 0 {
+		// wasted bits per sample, unary coded
+		wasted = uint(br.unary()) + 1
+		if wasted >= bps {
+			return errors.New("invalid wasted bits")
+		}
+		bps -= wasted
+	}
+
+	switch {
+	case kind == 0:
+		// CONSTANT
+		value := br.signed(bps)
+		for i := range out {
+			out[i] = value
+		}
+	case kind == 1:
+		// VERBATIM
+		for i := range out {
+			out[i] = br.signed(bps)
+		}
+	case kind >= 8 && kind <= 12:
+		// FIXED
+		order := int(kind - 8)
+		if order > len(out) {
+			return errors.New("predictor order beyond block size")
+		}
+		for i := 0; i < order; i++ {
+			out[i] = br.signed(bps)
+		}
+		if err := d.residual(out, order); err != nil {
+			return err
+		}
+		fixedPredict(out, order)
+	case kind >= 32:
+		// LPC
+		order := int(kind - 31)
+		if order > len(out) {
+			return errors.New("predictor order beyond block size")
+		}
+		for i := 0; i < order; i++ {
+			out[i] = br.signed(bps)
+		}
+		precision := uint(br.read(4)) + 1
+		if precision == 16 {
+			return errors.New("invalid LPC precision")
+		}
+		shift := br.signed(5)
+		if shift < 0 {
+			return errors.New("negative LPC shift")
+		}
+		coeffs := d.coeffs[:order]
+		for i := range coeffs {
+			coeffs[i] = br.signed(precision)
+		}
+		if err := d.residual(out, order); err != nil {
+			return err
+		}
+		lpcPredict(out, coeffs, uint(shift))
+	default:
+		return errors.New("reserved subframe type")
+	}
+
+	if wasted > 0 {
+		for i := range out {
+			out[i] <<= wasted
+		}
+	}
+	return nil
+}
+
+// residual reads the Rice coded residual of a subframe into out[order:].
+func (d *flacDecoder) residual(out []int32, order int) error {
+	br := &d.br
+	paramBits, escape := uint(4), uint64(15)
+	switch br.read(2) {
+	case 0:
+	case 1:
+		paramBits, escape = 5, 31
+	default:
+		return errors.New("reserved residual coding method")
+	}
+	partitionOrder := uint(br.read(4))
+	n := len(out) >> partitionOrder
+	if n<<partitionOrder != len(out) || n < order {
+		return errors.New("invalid partition order")
+	}
+	i := order
+	for end := n; end <= len(out); end += n {
+		k := br.read(paramBits)
+		if k == escape {
+			// unencoded, in a given number of bits
+			size := uint(br.read(5))
+			for ; i < end; i++ {
+				out[i] = br.signed(size)
+			}
+		} else {
+			for ; i < end; i++ {
+				v := br.unary()<<k | br.read(uint(k))
+				out[i] = int32(v>>1) ^ -int32(v&1)
+			}
+		}
+		if br.short {
+			return errFlacShort
+		}
+	}
+	return nil
+}
+
+// fixedPredict adds the predictions of a FIXED subframe to the residual in
+// out[order:].
+func fixedPredict(out []int32, order int) {
+	switch order {
+	case 1:
+		for i := 1; i < len(out); i++ {
+			out[i] += out[i-1]
+		}
+	case 2:
+		for i := 2; i < len(out); i++ {
+			out[i] += 2*out[i-1] - out[i-2]
+		}
+	case 3:
+		for i := 3; i < len(out); i++ {
+			out[i] += 3*(out[i-1]-out[i-2]) + out[i-3]
+		}
+	case 4:
+		for i := 4; i < len(out); i++ {
+			out[i] += 4*(out[i-1]+out[i-3]) - 6*out[i-2] - out[i-4]
+		}
+	}
+}
+
+// lpcPredict adds the predictions of an LPC subframe to the residual in
+// out[len(coeffs):].
+func lpcPredict(out []int32, coeffs []int32, shift uint) {
+	order := len(coeffs)
+	for i := order; i < len(out); i++ {
+		var sum int64
+		history := out[i-order : i]
+		for j, c := range coeffs {
+			sum += int64(c) * int64(history[order-1-j])
+		}
+		out[i] += int32(sum >> shift)
+	}
+}
+
+// decorrelate turns the two channels of a stereo frame into left and right.
+func decorrelate(assignment uint64, ch0, ch1 []int32) {
+	ch1 = ch1[:len(ch0)]
+	switch assignment {
+	case 8:
+		// left, side
+		for i, left := range ch0 {
+			ch1[i] = left - ch1[i]
+		}
+	case 9:
+		// side, right
+		for i, right := range ch1 {
+			ch0[i] += right
+		}
+	case 10:
+		// mid, side
+		for i, side := range ch1 {
+			mid := ch0[i]<<1 | side&1
+			ch0[i] = (mid + side) >> 1
+			ch1[i] = (mid - side) >> 1
+		}
+	}
+}
+
+/*
+bitReader reads big endian bit fields from a byte slice. Reading beyond the
+end sets short and yields zeros, so that the decoder only needs to check for
+it now and then.
+*/
+type bitReader struct {
+	data  []byte
+	pos   int    // next byte of data to go into cache
+	cache uint64 // unread bits, left aligned; the bits below them are zero
+	n     uint   // number of unread bits in cache
+	short bool
+}
+
+func (br *bitReader) reset(data []byte) {
+	*br = bitReader{data: data}
+}
+
+func (br *bitReader) fill() {
+	for br.n <= 56 && br.pos < len(br.data) {
+		br.cache |= uint64(br.data[br.pos]) << (56 - br.n)
+		br.pos++
+		br.n += 8
+	}
+}
+
+// read returns the next n bits, n <= 56.
+func (br *bitReader) read(n uint) uint64 {
+	if n == 0 {
+		return 0
+	}
+	if br.n < n {
+		br.fill()
+		if br.n < n {
+			br.short = true
+			br.cache, br.n = 0, 0
+			return 0
+		}
+	}
+	v := br.cache >> (64 - n)
+	br.cache <<= n
+	br.n -= n
+	return v
+}
+
+// signed returns the next n bits as a two's complement number.
+func (br *bitReader) signed(n uint) int32 {
+	if n == 0 {
+		return 0
+	}
+	return int32(int64(br.read(n)<<(64-n)) >> (64 - n))
+}
+
+// unary returns the number of 0 bits before the next 1 bit.
+func (br *bitReader) unary() uint64 {
+	var zeros uint64
+	for {
+		if br.n == 0 {
+			br.fill()
+			if br.n == 0 {
+				br.short = true
+				return zeros
+			}
+		}
+		if lz := uint(bits.LeadingZeros64(br.cache)); lz < br.n {
+			br.cache <<= lz + 1
+			br.n -= lz + 1
+			return zeros + uint64(lz)
+		}
+		zeros += uint64(br.n)
+		br.cache, br.n = 0, 0
+	}
+}
+
+// align skips the bits up to the next byte boundary.
+func (br *bitReader) align() {
+	br.read(br.n % 8)
+}
+
+// bytePos returns the number of bytes read; the reader must be aligned.
+func (br *bitReader) bytePos() int {
+	return br.pos - int(br.n/8)
+}
+
+var (
+	flacCRC8Table  [256]byte
+	flacCRC16Table [256]uint16
+)
+
+func init() {
+	for i := range flacCRC8Table {
+		crc8, crc16 := byte(i), uint16(i)<<8
+		for j := 0; j < 8; j++ {
+			if crc8&0x80 != 0 {
+				crc8 = crc8<<1 ^ 0x07
+			} else {
+				crc8 <<= 1
+			}
+			if crc16&0x8000 != 0 {
+				crc16 = crc16<<1 ^ 0x8005
+			} else {
+				crc16 <<= 1
+			}
+		}
+		flacCRC8Table[i], flacCRC16Table[i] = crc8, crc16
+	}
+}
+
+// flacCRC8 is the CRC of a frame header: polynomial x^8+x^2+x+1.
+func flacCRC8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc = flacCRC8Table[crc^b]
+	}
+	return crc
+}
+
+// flacCRC16 is the CRC of a frame: polynomial x^16+x^15+x^2+1.
+func flacCRC16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc = crc<<8 ^ flacCRC16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/meta"
+)
+
+const (
+	// decodeErrorBudget is the number of damaged flac frames, or failed mp3
+	// reads, tolerated per file. A file with more is skipped.
+	decodeErrorBudget = 16
+	// flacResyncLimit is how far we search for the next frame after a damaged
+	// one. Anything further away is not worth waiting for.
+	flacResyncLimit = 1024 * 1024
+)
+
+var errFlacErrorBudget = errors.New("too many damaged flac frames")
+
+// flacWindowSize is the least number of bytes flacFrames reads a file in.
+const flacWindowSize = 256 * 1024
+
+/*
+flacFrames reads the audio frames of a flac file. A frame that cannot be
+decoded (bad CRC, invalid sync code, truncated) or does not match STREAMINFO
+is dropped: we search for the next valid frame header after its start and
+continue from there. Dropped frames are counted against decodeErrorBudget.
+The file is read through a window that always holds at least one whole frame,
+so that no frame decode has to wait for, or allocate, anything.
+*/
+type flacFrames struct {
+	f        *os.File
+	info     *meta.StreamInfo
+	dec      *flacDecoder
+	window   []byte
+	start    int // window[start:end] has not been decoded yet
+	end      int
+	eof      bool  // window ends with the file
+	maxFrame int   // bytes of the largest possible frame
+	offset   int64 // byte offset of the next frame
+	errors   int   // frames dropped so far
+}
+
+// newFlacFrames returns a reader of the frames of f, starting at offset.
+func newFlacFrames(f *os.File, info *meta.StreamInfo, offset int64) (*flacFrames, error) {
+	dec := newFlacDecoder(info)
+	// all verbatim: samples of the side channel have an extra bit
+	maxFrame := len(dec.samples[0])*int(info.NChannels)*(int(info.BitsPerSample)+1)/8 + 64
+	size := flacWindowSize
+	if size < 2*maxFrame {
+		size = 2 * maxFrame
+	}
+	ff := &flacFrames{f: f, info: info, dec: dec, window: make([]byte, size), maxFrame: maxFrame}
+	if err := ff.seek(offset); err != nil {
+		return nil, err
+	}
+	return ff, nil
+}
+
+func (ff *flacFrames) seek(offset int64) error {
+	_, err := ff.f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	ff.start, ff.end, ff.eof = 0, 0, false
+	ff.offset = offset
+	return nil
+}
+
+// fill moves the undecoded bytes to the start of the window and reads more
+// behind them.
+func (ff *flacFrames) fill() error {
+	ff.end = copy(ff.window, ff.window[ff.start:ff.end])
+	ff.start = 0
+	n, err := io.ReadFull(ff.f, ff.window[ff.end:])
+	ff.end += n
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		ff.eof = true
+		err = nil
+	}
+	return err
+}
+
+// samples returns the decoded samples of channel c of the last frame.
+func (ff *flacFrames) samples(c int) []int32 {
+	return ff.dec.samples[c][:ff.dec.blockSize]
+}
+
+// next decodes the next good frame and returns its block size; see samples.
+// io.EOF at the end of the file.
+func (ff *flacFrames) next() (int, error) {
+	for {
+		if ff.end-ff.start < ff.maxFrame && !ff.eof {
+			if err := ff.fill(); err != nil {
+				return 0, err
+			}
+		}
+		if ff.start == ff.end && ff.eof {
+			return 0, io.EOF
+		}
+		start := ff.offset
+		n, err := ff.dec.decode(ff.window[ff.start:ff.end])
+		if err == nil {
+			ff.start += n
+			ff.offset += int64(n)
+			return ff.dec.blockSize, nil
+		}
+
+		ff.errors++
+		logm.Warningf("%s damaged flac frame at byte %d (%d/%d) err=%s",
+			pluginname, start, ff.errors, decodeErrorBudget, err.Error())
+		if ff.errors >= decodeErrorBudget {
+			return 0, errFlacErrorBudget
+		}
+		offset, _, err := flacFrameAt(ff.f, start+1, flacResyncLimit, ff.info)
+		if err == errNoFlacFrame {
+			// truncated, or garbage up to the end
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		logm.Debugf("%s flac resync at byte %d", pluginname, offset)
+		if err = ff.seek(offset); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// openFlacStream is flac.New for f, with malformed metadata rejected
+// (checkFlacMetadata) and panics turned into errors.
+func openFlacStream(f *os.File) (*flac.Stream, error) {
+	return guardFlacStream(flac.New, f)
+}
+
+// parseFlacStream is flac.Parse (all metadata blocks) for f, made safe the
+// same way.
+func parseFlacStream(f *os.File) (*flac.Stream, error) {
+	return guardFlacStream(flac.Parse, f)
+}
+
+func guardFlacStream(open func(io.Reader) (*flac.Stream, error), f *os.File) (stream *flac.Stream, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err = checkFlacMetadata(f, fi.Size()); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			stream, err = nil, fmt.Errorf("flac metadata parser panic: %v", r)
+		}
+	}()
+	stream, err = open(f)
+	if err == nil && stream.Info == nil {
+		err = errors.New("flac stream without STREAMINFO")
+	}
+	return stream, err
+}
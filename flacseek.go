@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+
+	flacframe "github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+)
+
+// flacScanSize is the number of bytes searched for a frame header per read.
+// The binary search in flacSeek stops once the remaining range is this small.
+const flacScanSize = 64 * 1024
+
+var errNoFlacFrame = errors.New("no flac frame found")
+
+/*
+flacSeek finds a frame starting at or before sample target and returns its
+byte offset plus the number of its first sample. mewkiz/flac cannot seek, but starting track 12 of a single-file album by
+decoding everything before it would take minutes on a Pi. We do a binary
+search over the byte offsets instead, using the frame header sync code and the
+header CRC-8 to find frame boundaries. The caller decodes and discards the
+remaining samples up to target.
+*/
+func flacSeek(f *os.File, info *meta.StreamInfo, target uint64) (int64, uint64, error) {
+	audioOffset, err := flacAudioOffset(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	loOffset, loSample, err := flacFrameAt(f, audioOffset, 0, info)
+	if err != nil {
+		return 0, 0, err
+	}
+	hi, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for hi-loOffset > flacScanSize {
+		mid := loOffset + (hi-loOffset)/2
+		offset, sample, err := flacFrameAt(f, mid, 0, info)
+		if err != nil || sample > target {
+			hi = mid
+			continue
+		}
+		loOffset, loSample = offset, sample
+	}
+	return loOffset, loSample, nil
+}
+
+// flacAudioOffset returns the byte offset of the first audio frame, which
+// follows the "fLaC" signature and the metadata blocks.
+func flacAudioOffset(f io.ReadSeeker) (int64, error) {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	var hdr [4]byte
+	_, err = io.ReadFull(f, hdr[:])
+	if err != nil {
+		return 0, err
+	}
+	if string(hdr[:]) != "fLaC" {
+		return 0, errors.New("invalid flac signature")
+	}
+	offset := int64(4)
+	for {
+		_, err = io.ReadFull(f, hdr[:])
+		if err != nil {
+			return 0, err
+		}
+		isLast := hdr[0]&0x80 != 0
+		length := int64(hdr[1])<<16 | int64(hdr[2])<<8 | int64(hdr[3])
+		offset += 4 + length
+		if isLast {
+			return offset, nil
+		}
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// flacFrameAt searches forward from byte offset for the next valid frame
+// header and returns its offset and the number of its first sample. With
+// maxScan>0, the header must start within maxScan bytes.
+func flacFrameAt(f io.ReadSeeker, offset int64, maxScan int64, info *meta.StreamInfo) (int64, uint64, error) {
+	buf := make([]byte, flacScanSize)
+	start := offset
+	for {
+		if maxScan > 0 && offset-start >= maxScan {
+			return 0, 0, errNoFlacFrame
+		}
+		_, err := f.Seek(offset, io.SeekStart)
+		if err != nil {
+			return 0, 0, err
+		}
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				return 0, 0, errNoFlacFrame
+			}
+			return 0, 0, err
+		}
+		for i := 0; i+1 < n; i++ {
+			if buf[i] != 0xFF || (buf[i+1] != 0xF8 && buf[i+1] != 0xF9) {
+				continue
+			}
+			hdr, err := flacframe.New(bytes.NewReader(buf[i:n]))
+			if err != nil {
+				// not a frame header; the CRC-8 rejects almost all false sync codes
+				continue
+			}
+			if (hdr.SampleRate != 0 && hdr.SampleRate != info.SampleRate) ||
+				hdr.Channels.Count() != int(info.NChannels) {
+				continue
+			}
+			sample := hdr.Num
+			if hdr.HasFixedBlockSize {
+				// Num is the frame number
+				sample = hdr.Num * uint64(info.BlockSizeMax)
+			}
+			if maxScan > 0 && offset+int64(i)-start >= maxScan {
+				return 0, 0, errNoFlacFrame
+			}
+			return offset + int64(i), sample, nil
+		}
+		if n < len(buf) {
+			return 0, 0, errNoFlacFrame
+		}
+		// a frame header is at most 16 bytes long; overlap so none gets cut in half
+		offset += int64(n - 16)
+	}
+}
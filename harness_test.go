@@ -0,0 +1,1020 @@
+package main
+
+/*
+Test harness: a fake TRemote host (PluginHelper) on a fake clock, an audio
+output capturing what would reach the sound card, and generated MP3/FLAC
+fixtures. A harness runs the real player and playFolder() against a folder of
+fixtures; see playback_test.go.
+*/
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gordonklaus/portaudio"
+	"github.com/mehrvarz/log"
+	"github.com/mehrvarz/tremote_plugin"
+)
+
+// waitTimeout bounds every wait of the harness, so that a broken player fails
+// the test instead of hanging it.
+const waitTimeout = 10 * time.Second
+
+// waitFor polls cond until it is true; it fails the test after waitTimeout.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	d  time.Duration
+	f  func()
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// ms returns the time in ms, the way the host fills in PLastPressedMS.
+func (c *fakeClock) ms() int64 {
+	return c.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) {
+	c.mu.Lock()
+	c.timers = append(c.timers, &fakeTimer{at: c.now.Add(d), d: d, f: f})
+	c.mu.Unlock()
+}
+
+// Advance moves the clock forward by d and runs the timers due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			due = append(due, timer)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+	for _, timer := range due {
+		timer.f()
+	}
+}
+
+// fire waits until a timer for d has been set (timers are set by other
+// goroutines) and advances the clock to the one set last. Older timers fire
+// on the way.
+func (c *fakeClock) fire(t *testing.T, d time.Duration) {
+	t.Helper()
+	var at time.Time
+	waitFor(t, fmt.Sprintf("a %v timer", d), func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i := len(c.timers) - 1; i >= 0; i-- {
+			if c.timers[i].d == d {
+				at = c.timers[i].at
+				return true
+			}
+		}
+		return false
+	})
+	c.Advance(at.Sub(c.Now()))
+}
+
+// hostCall is a call of a PluginHelper function
+type hostCall struct {
+	fkt  string // PrintInfo, PrintStatus, ImageInfo, HostCmd or StopCurrentAudioPlayback
+	arg  string
+	arg2 string
+	data []byte
+}
+
+// fakeHost plays the part of TRemote: it hands a PluginHelper to Action() and
+// records everything the plugin tells it.
+type fakeHost struct {
+	ph tremote_plugin.PluginHelper
+
+	mu    sync.Mutex
+	calls []hostCall
+
+	stop        chan bool
+	pause       chan bool
+	active      bool
+	lastPressed int
+	actionDone  [tremote_plugin.MaxButton]bool
+	pressedMS   [tremote_plugin.MaxButton]int64
+}
+
+func newFakeHost() *fakeHost {
+	h := &fakeHost{}
+	h.ph = tremote_plugin.PluginHelper{
+		PrintInfo: func(str string) {
+			h.record(hostCall{fkt: "PrintInfo", arg: str})
+		},
+		PrintStatus: func(str string) {
+			h.record(hostCall{fkt: "PrintStatus", arg: str})
+		},
+		StopCurrentAudioPlayback: func() error {
+			h.record(hostCall{fkt: "StopCurrentAudioPlayback"})
+			return nil
+		},
+		StopAudioPlayerChan:  &h.stop,
+		PauseAudioPlayerChan: &h.pause,
+		PluginIsActive:       &h.active,
+		PIdLastPressed:       &h.lastPressed,
+		PLastPressActionDone: &h.actionDone,
+		PLastPressedMS:       &h.pressedMS,
+		ImageInfo: func(data []byte, mimeType string) {
+			h.record(hostCall{fkt: "ImageInfo", arg: mimeType, data: data})
+		},
+		HostCmd: func(cmd string, arg string) string {
+			h.record(hostCall{fkt: "HostCmd", arg: cmd, arg2: arg})
+			return ""
+		},
+	}
+	return h
+}
+
+func (h *fakeHost) record(call hostCall) {
+	h.mu.Lock()
+	h.calls = append(h.calls, call)
+	h.mu.Unlock()
+}
+
+// args returns the first argument of all calls of fkt, in order.
+func (h *fakeHost) args(fkt string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var args []string
+	for _, call := range h.calls {
+		if call.fkt == fkt {
+			args = append(args, call.arg)
+		}
+	}
+	return args
+}
+
+// called reports whether fkt has been called with an argument containing str.
+func (h *fakeHost) called(fkt string, str string) bool {
+	for _, arg := range h.args(fkt) {
+		if strings.Contains(arg, str) {
+			return true
+		}
+	}
+	return false
+}
+
+// captureOutput is an audioOutput keeping everything written to it. Writes can
+// be held back, so that a test can act while a song is playing.
+type captureOutput struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	streams []*captureStream
+	open    int // streams open now
+	maxOpen int // streams open at the same time, at most
+	writes  int // Write() calls of all streams
+	limit   int // Write() calls allowed; -1 = any number
+
+	devices       []audioDevice
+	defaultDevice int
+	// rejects returns why device does not take a format; nil = takes any
+	rejects func(device int, channels int, sampleRate float64, format sampleFormat) error
+}
+
+type captureStream struct {
+	out             *captureOutput
+	device          int
+	channels        int
+	sampleRate      float64
+	format          sampleFormat
+	framesPerBuffer int
+	buf             interface{}
+	samples         []int32 // interleaved, at the depth of the format, as written
+	writes          int
+	oversized       int // writes of more than framesPerBuffer frames, or of part of a frame
+	closed          bool
+}
+
+func newCaptureOutput(gated bool) *captureOutput {
+	out := &captureOutput{limit: -1, devices: []audioDevice{{name: "capture", channels: 2, rate: 48000}}}
+	if gated {
+		out.limit = 0
+	}
+	out.cond = sync.NewCond(&out.mu)
+	return out
+}
+
+func (out *captureOutput) Initialize() error { return nil }
+func (out *captureOutput) Terminate() error  { return nil }
+
+func (out *captureOutput) Devices() ([]audioDevice, int, error) {
+	return out.devices, out.defaultDevice, nil
+}
+
+func (out *captureOutput) IsFormatSupported(device int, channels int, sampleRate float64, format sampleFormat) error {
+	if out.rejects == nil {
+		return nil
+	}
+	return out.rejects(device, channels, sampleRate, format)
+}
+
+func (out *captureOutput) OpenStream(device int, channels int, sampleRate float64, format sampleFormat, framesPerBuffer int, buf interface{}) (audioStream, error) {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	var ok bool
+	switch format.bytes {
+	case 2:
+		_, ok = buf.(*[]int16)
+	case 3:
+		_, ok = buf.(*[]portaudio.Int24)
+	case 4:
+		_, ok = buf.(*[]int32)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%T buffer for %s", buf, format.name)
+	}
+	stream := &captureStream{out: out, device: device, channels: channels, sampleRate: sampleRate,
+		format: format, framesPerBuffer: framesPerBuffer, buf: buf}
+	out.streams = append(out.streams, stream)
+	out.open++
+	if out.open > out.maxOpen {
+		out.maxOpen = out.open
+	}
+	return stream, nil
+}
+
+func (stream *captureStream) Start() error { return nil }
+func (stream *captureStream) Stop() error  { return nil }
+
+func (stream *captureStream) Close() error {
+	out := stream.out
+	out.mu.Lock()
+	if !stream.closed {
+		stream.closed = true
+		out.open--
+	}
+	out.mu.Unlock()
+	return nil
+}
+
+func (stream *captureStream) Write() error {
+	out := stream.out
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	for out.limit >= 0 && out.writes >= out.limit {
+		out.cond.Wait()
+	}
+	n := 0
+	switch buf := stream.buf.(type) {
+	case *[]int16:
+		n = len(*buf)
+		for _, sample := range *buf {
+			stream.samples = append(stream.samples, int32(sample))
+		}
+	case *[]portaudio.Int24:
+		n = len(*buf)
+		for _, b := range *buf {
+			stream.samples = append(stream.samples, int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8)
+		}
+	case *[]int32:
+		n = len(*buf)
+		stream.samples = append(stream.samples, *buf...)
+	}
+	if n > stream.framesPerBuffer*stream.channels || n%stream.channels != 0 {
+		stream.oversized++
+	}
+	stream.writes++
+	out.writes++
+	return nil
+}
+
+// allow lets n more writes through.
+func (out *captureOutput) allow(n int) {
+	out.mu.Lock()
+	if out.limit >= 0 {
+		out.limit += n
+	}
+	out.cond.Broadcast()
+	out.mu.Unlock()
+}
+
+// unlimited lets all writes through from now on.
+func (out *captureOutput) unlimited() {
+	out.mu.Lock()
+	out.limit = -1
+	out.cond.Broadcast()
+	out.mu.Unlock()
+}
+
+func (out *captureOutput) writeCount() int {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	return out.writes
+}
+
+// fixture is a generated audio file
+type fixture struct {
+	name     string // file name
+	title    string // title tag
+	rate     int
+	bits     int
+	channels int
+	frames   int     // inter-channel samples
+	samples  []int32 // interleaved samples of the file (zero for mp3)
+	// flac: CONSTANT, FIXED and LPC subframes with Rice coded residuals and
+	// stereo decorrelation, as an encoder would write them; else VERBATIM only
+	predicted bool
+	escaped   bool // predicted, with the first residual partition of some subframes unencoded
+
+	frameOffsets []int                                 // byte offsets of the flac frames, set by flacBytes
+	damage       func(fx *fixture, data []byte) []byte // applied to the file written, if set
+}
+
+const (
+	testFlacBlockSize = 1024
+	testMp3FrameSize  = 417 // MPEG-1 layer III, 128 kbit/s, 44.1 kHz, no padding
+	testMp3Samples    = 1152
+)
+
+// newFlacFixture returns a FLAC fixture of the given length. Every fixture
+// number has its own sample values, so captured audio can be told apart.
+func newFlacFixture(number int, rate int, bits int, seconds float64) *fixture {
+	fx := &fixture{
+		name:     fmt.Sprintf("%02d.flac", number),
+		title:    fmt.Sprintf("Song %d", number),
+		rate:     rate,
+		bits:     bits,
+		channels: 2,
+		frames:   int(seconds * float64(rate)),
+	}
+	scale := int32(1) << uint(bits-16)
+	for i := 0; i < fx.frames; i++ {
+		left := (int32(number)*1000 + int32(i%500)) * scale
+		fx.samples = append(fx.samples, left, -left)
+	}
+	return fx
+}
+
+// newMp3Fixture returns an MP3 fixture of silent frames.
+func newMp3Fixture(number int, frames int) *fixture {
+	return &fixture{
+		name:     fmt.Sprintf("%02d.mp3", number),
+		title:    fmt.Sprintf("Song %d", number),
+		rate:     44100,
+		bits:     16,
+		channels: 2,
+		frames:   frames * testMp3Samples,
+		samples:  make([]int32, frames*testMp3Samples*2),
+	}
+}
+
+func (fx *fixture) isFlac() bool {
+	return strings.HasSuffix(fx.name, ".flac")
+}
+
+// sinkSamples returns the samples as a sink taking every format gets them:
+// S16 or S24_3LE, unchanged.
+func (fx *fixture) sinkSamples() []int32 {
+	return fx.samples
+}
+
+func (fx *fixture) write(t testing.TB, dir string) {
+	var data []byte
+	if fx.isFlac() {
+		data = fx.flacBytes()
+	} else {
+		data = fx.mp3Bytes()
+	}
+	if fx.damage != nil {
+		data = fx.damage(fx, data)
+	}
+	if err := ioutil.WriteFile(dir+"/"+fx.name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tag adds Vorbis comments such as "ALBUM=Blue" to the flac file of fx in dir.
+func (fx *fixture) tag(t testing.TB, dir string, comments ...string) {
+	err := rewriteFile(dir+"/"+fx.name, func(src *os.File, dst io.Writer) error {
+		return rewriteFlacComments(src, dst, nil, comments)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mp3Bytes returns an ID3v2.3 tag with the title and silent frames: all side
+// information zero, so there is no main data to decode.
+func (fx *fixture) mp3Bytes() []byte {
+	text := append([]byte{0}, fx.title...) // encoding Latin-1
+	frame := append([]byte("TIT2"), 0, 0, 0, byte(len(text)), 0, 0)
+	frame = append(frame, text...)
+	size := len(frame)
+	data := []byte{'I', 'D', '3', 3, 0, 0,
+		byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	data = append(data, frame...)
+	for i := 0; i < fx.frames/testMp3Samples; i++ {
+		mp3frame := make([]byte, testMp3FrameSize)
+		copy(mp3frame, []byte{0xff, 0xfb, 0x90, 0x64})
+		data = append(data, mp3frame...)
+	}
+	return data
+}
+
+// bitWriter writes big endian bit fields, as FLAC needs them.
+type bitWriter struct {
+	buf  []byte
+	bits uint
+}
+
+func (w *bitWriter) write(value uint64, n uint) {
+	for i := n; i > 0; i-- {
+		if w.bits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if value>>(i-1)&1 != 0 {
+			w.buf[len(w.buf)-1] |= 1 << (7 - w.bits%8)
+		}
+		w.bits++
+	}
+}
+
+func (w *bitWriter) align() {
+	for w.bits%8 != 0 {
+		w.write(0, 1)
+	}
+}
+
+func crc8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// flacBytes encodes the fixture as FLAC with verbatim subframes, a STREAMINFO
+// block with the MD5 of the samples and a VORBIS_COMMENT block with the title.
+func (fx *fixture) flacBytes() []byte {
+	rateCodes := map[int]uint64{88200: 0x1, 192000: 0x3, 32000: 0x8, 44100: 0x9, 48000: 0xa, 96000: 0xb}
+	bitsCodes := map[int]uint64{8: 0x1, 12: 0x2, 16: 0x4, 20: 0x5, 24: 0x6}
+	bytesPerSample := (fx.bits + 7) / 8
+
+	sum := md5.New()
+	for _, sample := range fx.samples {
+		for i := 0; i < bytesPerSample; i++ {
+			sum.Write([]byte{byte(sample >> uint(8*i))})
+		}
+	}
+
+	w := &bitWriter{}
+	w.write(0x664c6143, 32) // "fLaC"
+	// STREAMINFO
+	w.write(0, 1)
+	w.write(0, 7)
+	w.write(34, 24)
+	w.write(testFlacBlockSize, 16)
+	w.write(testFlacBlockSize, 16)
+	w.write(0, 24) // frame sizes unknown
+	w.write(0, 24)
+	w.write(uint64(fx.rate), 20)
+	w.write(uint64(fx.channels-1), 3)
+	w.write(uint64(fx.bits-1), 5)
+	w.write(uint64(fx.frames), 36)
+	w.buf = append(w.buf, sum.Sum(nil)...)
+	w.bits += 128
+	// VORBIS_COMMENT, little endian
+	var comment []byte
+	le32 := func(n int) {
+		comment = append(comment, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(comment[len(comment)-4:], uint32(n))
+	}
+	vendor := "harness"
+	le32(len(vendor))
+	comment = append(comment, vendor...)
+	le32(1)
+	le32(len("TITLE=" + fx.title))
+	comment = append(comment, "TITLE="+fx.title...)
+	w.write(1, 1)
+	w.write(4, 7)
+	w.write(uint64(len(comment)), 24)
+	w.buf = append(w.buf, comment...)
+	w.bits += uint(8 * len(comment))
+
+	// frames
+	fx.frameOffsets = nil
+	for number, start := 0, 0; start < fx.frames; number, start = number+1, start+testFlacBlockSize {
+		fx.frameOffsets = append(fx.frameOffsets, len(w.buf))
+		blockSize := testFlacBlockSize
+		if start+blockSize > fx.frames {
+			blockSize = fx.frames - start
+		}
+		assignment := uint64(fx.channels - 1) // independent channels
+		if fx.predicted && fx.channels == 2 {
+			// also left/side, side/right and mid/side
+			assignment = []uint64{1, 8, 9, 10}[number%4]
+		}
+		fw := &bitWriter{}
+		fw.write(0x3ffe, 14)
+		fw.write(0, 1)                  // reserved
+		fw.write(0, 1)                  // fixed block size
+		fw.write(0x7, 4)                // block size-1 in 16 bits at the end of the header
+		fw.write(rateCodes[fx.rate], 4) // sample rate
+		fw.write(assignment, 4)
+		fw.write(bitsCodes[fx.bits], 3)
+		fw.write(0, 1)
+		var utf [utf8.UTFMax]byte
+		for _, b := range utf[:utf8.EncodeRune(utf[:], rune(number))] {
+			fw.write(uint64(b), 8)
+		}
+		fw.write(uint64(blockSize-1), 16)
+		fw.write(uint64(crc8(fw.buf)), 8)
+		channels := make([][]int32, fx.channels)
+		for ch := range channels {
+			for i := start; i < start+blockSize; i++ {
+				channels[ch] = append(channels[ch], fx.samples[i*fx.channels+ch])
+			}
+		}
+		for ch, samples := range correlate(assignment, channels) {
+			bps := uint(fx.bits)
+			if (assignment == 8 || assignment == 10) && ch == 1 || assignment == 9 && ch == 0 {
+				bps++ // side channel
+			}
+			if fx.predicted {
+				writePredicted(fw, samples, bps, number+ch, fx.escaped)
+			} else {
+				fw.write(0, 1)
+				fw.write(1, 6) // VERBATIM
+				fw.write(0, 1)
+				for _, sample := range samples {
+					fw.write(uint64(sample)&mask(bps), bps)
+				}
+			}
+		}
+		fw.align()
+		fw.write(uint64(crc16(fw.buf)), 16)
+		w.buf = append(w.buf, fw.buf...)
+		w.bits += fw.bits
+	}
+	return w.buf
+}
+
+func mask(bps uint) uint64 {
+	return uint64(1)<<bps - 1
+}
+
+// correlate turns left and right into the channels of a stereo frame with the
+// given channel assignment.
+func correlate(assignment uint64, channels [][]int32) [][]int32 {
+	if assignment < 8 {
+		return channels
+	}
+	left, right := channels[0], channels[1]
+	mid, side := make([]int32, len(left)), make([]int32, len(left))
+	for i := range left {
+		mid[i] = (left[i] + right[i]) >> 1
+		side[i] = left[i] - right[i]
+	}
+	switch assignment {
+	case 8:
+		return [][]int32{left, side}
+	case 9:
+		return [][]int32{side, right}
+	}
+	return [][]int32{mid, side}
+}
+
+/*
+writePredicted writes samples as a subframe of bps bits: CONSTANT if all are
+the same, else FIXED of order 1-4 or LPC of order 2, depending on variant.
+Zero bits at the bottom of all samples are written as wasted bits. The
+residual is Rice coded in 1, 2 or 4 partitions; with escaped, the first of
+them is unencoded for some variants.
+*/
+func writePredicted(w *bitWriter, samples []int32, bps uint, variant int, escaped bool) {
+	var or int32
+	constant := true
+	for _, sample := range samples {
+		or |= sample
+		constant = constant && sample == samples[0]
+	}
+	w.write(0, 1)
+	if constant {
+		w.write(0, 6) // CONSTANT
+		w.write(0, 1)
+		w.write(uint64(samples[0])&mask(bps), bps)
+		return
+	}
+
+	lpc := variant%2 == 1
+	order := 1 + variant%4
+	if lpc {
+		order = 2
+		w.write(32+uint64(order)-1, 6) // LPC
+	} else {
+		w.write(8+uint64(order), 6) // FIXED
+	}
+	wasted := uint(bits.TrailingZeros32(uint32(or)))
+	if wasted > 0 {
+		w.write(1, 1)
+		w.write(1, wasted) // unary: wasted-1 zeros, then a one
+		bps -= wasted
+	} else {
+		w.write(0, 1)
+	}
+	s := make([]int32, len(samples))
+	for i, sample := range samples {
+		s[i] = sample >> wasted
+	}
+	for _, sample := range s[:order] {
+		w.write(uint64(sample)&mask(bps), bps)
+	}
+	if lpc {
+		// 2*s[i-1] - s[i-2], in 3 bit coefficients, no shift
+		w.write(3-1, 4)
+		w.write(0, 5)
+		w.write(2, 3)
+		w.write(uint64(7), 3) // -1
+	}
+
+	residual := make([]int32, len(s))
+	for i := order; i < len(s); i++ {
+		var prediction int32
+		switch order {
+		case 1:
+			prediction = s[i-1]
+		case 2:
+			prediction = 2*s[i-1] - s[i-2]
+		case 3:
+			prediction = 3*s[i-1] - 3*s[i-2] + s[i-3]
+		case 4:
+			prediction = 4*s[i-1] - 6*s[i-2] + 4*s[i-3] - s[i-4]
+		}
+		residual[i] = s[i] - prediction
+	}
+
+	partitionOrder := uint(variant % 3)
+	for len(s)%(1<<partitionOrder) != 0 || len(s)>>partitionOrder < order {
+		partitionOrder--
+	}
+	w.write(0, 2) // 4 bit Rice parameters
+	w.write(uint64(partitionOrder), 4)
+	n := len(s) >> partitionOrder
+	for p := 0; p < 1<<partitionOrder; p++ {
+		from, to := p*n, (p+1)*n
+		if p == 0 {
+			from = order
+		}
+		if p == 0 && escaped && variant%3 != 1 {
+			// escape: unencoded, in 20 bits
+			w.write(15, 4)
+			w.write(20, 5)
+			for _, r := range residual[from:to] {
+				w.write(uint64(r)&mask(20), 20)
+			}
+			continue
+		}
+		var sum uint64
+		for _, r := range residual[from:to] {
+			sum += uint64(r<<1 ^ r>>31)
+		}
+		k := uint(0)
+		if to > from {
+			k = uint(bits.Len64(sum / uint64(to-from)))
+		}
+		if k > 14 {
+			k = 14
+		}
+		w.write(uint64(k), 4)
+		for _, r := range residual[from:to] {
+			v := uint64(uint32(r<<1 ^ r>>31))
+			w.write(0, uint(v>>k))
+			w.write(1, 1)
+			w.write(v&mask(k), k)
+		}
+	}
+}
+
+// harness runs the real player on a folder of fixtures.
+type harness struct {
+	t        *testing.T
+	home     string // homedir with songdb and play log
+	folder   string
+	clock    *fakeClock
+	host     *fakeHost
+	out      *captureOutput
+	wg       sync.WaitGroup
+	fixtures []*fixture
+	mappings map[int]*tremote_plugin.RemoteControlSpec
+}
+
+/*
+newHarness writes fixtures to a new folder, maps button 1 to it with options
+("mode=sequential") and starts a player on a fake clock. With gated, nothing
+is written to the capture output until allowed. Call finish at the end and
+remove when done with the files.
+*/
+func newHarness(t *testing.T, gated bool, options []string, fixtures ...*fixture) *harness {
+	home, err := ioutil.TempDir("", "tremote_home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := home + "/music"
+	if err := os.Mkdir(folder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, fx := range fixtures {
+		fx.write(t, folder)
+	}
+	h := &harness{
+		t:        t,
+		home:     home,
+		folder:   folder,
+		clock:    newFakeClock(),
+		host:     newFakeHost(),
+		out:      newCaptureOutput(gated),
+		fixtures: fixtures,
+		mappings: make(map[int]*tremote_plugin.RemoteControlSpec),
+	}
+	h.mapping(1, append([]string{folder}, options...)...)
+
+	// what Action() does on first use, without the host's logger and homedir
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	firstinstance(home)
+	// presses of an earlier harness were on a clock starting at the same time
+	albumLock.Lock()
+	lastShortPress = make(map[int]time.Time)
+	albumLock.Unlock()
+	output = h.out
+	player = newPlayer(playFolder, h.clock)
+	return h
+}
+
+// mapping binds button pid to a mapping line: a folder and options, or a command.
+func (h *harness) mapping(pid int, strArray ...string) {
+	h.mappings[pid] = &tremote_plugin.RemoteControlSpec{Pnumber: pid, StrArray: strArray}
+}
+
+// status returns the player state; it also makes sure the player is done with
+// all events sent so far.
+func (h *harness) status() playerStatus {
+	return player.status()
+}
+
+// press presses button pid, the way the host reports it.
+func (h *harness) press(pid int) {
+	h.status()
+	h.host.actionDone[pid] = false
+	h.host.pressedMS[pid] = h.clock.ms()
+	Action(log.NullLogger, pid, false, 0, h.home, h.mappings[pid], h.host.ph, &h.wg)
+	// the long press timer is set now
+	h.status()
+}
+
+// release releases button pid.
+func (h *harness) release(pid int) {
+	h.status()
+	held := h.clock.ms() - h.host.pressedMS[pid]
+	if held < 1 {
+		held = 1
+	}
+	h.host.pressedMS[pid] = 0
+	Action(log.NullLogger, pid, false, held, h.home, h.mappings[pid], h.host.ph, &h.wg)
+}
+
+// settle lets other audio players stop, if the player is waiting for that.
+func (h *harness) settle() {
+	if h.status().state == stateStarting {
+		h.clock.fire(h.t, stopOthersDelay)
+	}
+}
+
+func (h *harness) shortPress(pid int) {
+	h.press(pid)
+	h.release(pid)
+	h.settle()
+}
+
+func (h *harness) longPress(pid int) {
+	h.press(pid)
+	h.clock.fire(h.t, tremote_plugin.LongPressDelay*time.Millisecond)
+	h.release(pid)
+	h.settle()
+}
+
+// hostPause and hostStop send what the host sends on PauseAudioPlayerChan and
+// StopAudioPlayerChan. They return once the player has passed it on.
+func (h *harness) hostPause() {
+	st := h.status()
+	if st.pause == nil {
+		h.t.Fatalf("pause in state %s", st.state)
+	}
+	st.pause <- true
+	h.status()
+}
+
+func (h *harness) hostStop() {
+	st := h.status()
+	if st.stop == nil {
+		h.t.Fatalf("stop in state %s", st.state)
+	}
+	st.stop <- true
+	h.status()
+}
+
+func (h *harness) waitState(state playerState) {
+	h.t.Helper()
+	waitFor(h.t, "state "+state.String(), func() bool {
+		return h.status().state == state
+	})
+}
+
+func (h *harness) waitWrites(n int) {
+	h.t.Helper()
+	waitFor(h.t, fmt.Sprintf("%d writes", n), func() bool {
+		return h.out.writeCount() >= n
+	})
+}
+
+// fixture returns the fixture written as name.
+func (h *harness) fixture(name string) *fixture {
+	for _, fx := range h.fixtures {
+		if fx.name == name {
+			return fx
+		}
+	}
+	h.t.Fatalf("no fixture %s", name)
+	return nil
+}
+
+// writesFor returns the number of writes it takes playSong to play fx.
+func (h *harness) writesFor(fx *fixture) int {
+	if fx.isFlac() {
+		return (fx.frames + testFlacBlockSize - 1) / testFlacBlockSize
+	}
+	return (fx.frames + 4095) / 4096
+}
+
+/*
+played returns the fixture each output stream played, in order: the fixture
+whose samples start like the captured ones. complete tells whether all
+samples of the fixture arrived, and nothing else.
+*/
+func (h *harness) played() (names []string, complete []bool) {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	for _, stream := range h.out.streams {
+		name, full := "?", false
+		for _, fx := range h.fixtures {
+			want := fx.sinkSamples()
+			if len(stream.samples) == 0 || len(stream.samples) > len(want) && fx.isFlac() {
+				continue
+			}
+			if !fx.isFlac() {
+				// mpg123 may add or drop a frame of silence; all we know is zeros
+				if stream.samples[0] == 0 && len(stream.samples) <= len(want)+4*testMp3Samples {
+					name = fx.name
+					full = len(stream.samples) >= len(want)-4*testMp3Samples
+				}
+				continue
+			}
+			if equalSamples(stream.samples, want[:len(stream.samples)]) {
+				name, full = fx.name, len(stream.samples) == len(want)
+				break
+			}
+		}
+		names = append(names, name)
+		complete = append(complete, full)
+	}
+	return names, complete
+}
+
+func equalSamples(a, b []int32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// outcomes returns the outcomes in the play log (songdb) of fixture name.
+func (h *harness) outcomes(name string) []string {
+	file, err := os.Open(h.home + "/" + pluginname + ".plays")
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	var outcomes []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) == 4 && fields[3] == h.folder+"/"+name {
+			outcomes = append(outcomes, fields[2])
+		}
+	}
+	return outcomes
+}
+
+// finish stops playback, waits for the player to become idle and checks that
+// nothing was left behind.
+func (h *harness) finish() {
+	t := h.t
+	t.Helper()
+	h.out.unlimited()
+	h.settle()
+	for i := 0; i < 100; i++ {
+		st := h.status()
+		if st.state == stateIdle {
+			break
+		}
+		if st.stop != nil {
+			select {
+			case st.stop <- true:
+			case <-time.After(10 * time.Millisecond):
+			}
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	h.waitState(stateIdle)
+	h.wg.Wait()
+	if h.out.maxOpen > 1 {
+		t.Errorf("%d output streams open at the same time", h.out.maxOpen)
+	}
+	if h.out.open != 0 {
+		t.Errorf("%d output streams left open", h.out.open)
+	}
+	if h.host.stop != nil || h.host.pause != nil {
+		t.Errorf("StopAudioPlayerChan/PauseAudioPlayerChan not cleared when idle")
+	}
+	output = portaudioOutput{}
+}
+
+// remove deletes the folder and homedir of the harness.
+func (h *harness) remove() {
+	os.RemoveAll(h.home)
+}
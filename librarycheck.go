@@ -0,0 +1,557 @@
+/*
+Library check. "play_audio|Check" decodes every flac file in the folders of
+the mapping file (mapping.txt in homedir, sub directories included) without
+playing it, and compares its samples with the MD5 in STREAMINFO. Files that
+are corrupt, truncated or cannot be verified are listed in
+play_audio_mp3flac.check in homedir.
+
+A check is resumable: every file checked is appended to
+play_audio_mp3flac.checked in homedir, and the next run continues behind it.
+Once all files have been checked, that file is removed and the next run starts
+over. Decoding is throttled to checkload percent of the time, so that a check
+does not hold up playback; with checkwindow in config.txt, the check runs by
+itself every night within that time window.
+*/
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mehrvarz/tremote_plugin"
+)
+
+// results of a file check
+const (
+	checkOK           = "ok"
+	checkCorrupt      = "corrupt"
+	checkTruncated    = "truncated"
+	checkUnverifiable = "unverifiable"
+)
+
+const (
+	defaultCheckLoad = 25
+	// checkSlice is the decoding time after which the throttle pauses.
+	checkSlice = 20 * time.Millisecond
+)
+
+var errCheckStopped = errors.New("check stopped")
+
+// checkSleep pauses the check; tests replace it.
+var checkSleep = time.Sleep
+
+type checkEntry struct {
+	pathfile string
+	result   string
+	detail   string // e.g. "MD5 mismatch"; "" for ok
+}
+
+/*
+checkThrottle keeps decoding at load percent of the time: after each
+checkSlice of decoding it sleeps long enough for the rest. Reading from the
+disk is part of decoding, so the disk gets the same break as the CPU.
+*/
+type checkThrottle struct {
+	load  int // percent
+	busy  time.Duration
+	start time.Time
+}
+
+func newCheckThrottle(load int) *checkThrottle {
+	return &checkThrottle{load: load, start: time.Now()}
+}
+
+// pause is called after each decoded block.
+func (t *checkThrottle) pause() {
+	now := time.Now()
+	t.busy += now.Sub(t.start)
+	if t.load < 100 && t.busy >= checkSlice {
+		checkSleep(t.busy * time.Duration(100-t.load) / time.Duration(t.load))
+		t.busy = 0
+		now = time.Now()
+	}
+	t.start = now
+}
+
+/*
+checkFlac decodes pathfile and compares its samples with the MD5 in
+STREAMINFO. stopped is polled between blocks; if it returns true, checkFlac
+returns errCheckStopped and no result.
+*/
+func checkFlac(pathfile string, throttle *checkThrottle, stopped func() bool) (checkEntry, error) {
+	entry := checkEntry{pathfile: pathfile, result: checkCorrupt}
+	f, err := os.Open(pathfile)
+	if err != nil {
+		entry.detail = err.Error()
+		return entry, nil
+	}
+	defer f.Close()
+	stream, err := openFlacStream(f)
+	if err != nil {
+		entry.detail = "metadata: " + err.Error()
+		return entry, nil
+	}
+	info := stream.Info
+	offset, err := flacAudioOffset(f)
+	if err == nil {
+		var frames *flacFrames
+		frames, err = newFlacFrames(f, info, offset)
+		if err == nil {
+			return checkFrames(entry, frames, throttle, stopped)
+		}
+	}
+	entry.detail = err.Error()
+	return entry, nil
+}
+
+func checkFrames(entry checkEntry, frames *flacFrames, throttle *checkThrottle, stopped func() bool) (checkEntry, error) {
+	info := frames.info
+	channels := int(info.NChannels)
+	bytesPerSample := (int(info.BitsPerSample) + 7) / 8
+	decoder := newSongDecoder(nil, channels, nil, 0)
+	decoder.flacframes = frames
+	sum := md5.New()
+	var buf []byte
+	var samples uint64 // inter-channel
+	truncated := false
+	for {
+		if stopped() {
+			return entry, errCheckStopped
+		}
+		_, err := decoder.decodeBlock()
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			truncated = true
+			break
+		}
+		if err != nil {
+			entry.detail = err.Error()
+			return entry, nil
+		}
+		buf = hashSamples(sum, buf, decoder.block, bytesPerSample)
+		samples += uint64(len(decoder.block) / channels)
+		throttle.pause()
+	}
+
+	var md5sum [md5.Size]uint8
+	copy(md5sum[:], sum.Sum(nil))
+	switch {
+	case truncated:
+		entry.result = checkTruncated
+		entry.detail = fmt.Sprintf("%d of %d samples", samples, info.NSamples)
+	case frames.errors > 0:
+		entry.detail = fmt.Sprintf("%d damaged frames", frames.errors)
+	case info.NSamples > 0 && samples < info.NSamples:
+		// cut at a frame boundary
+		entry.result = checkTruncated
+		entry.detail = fmt.Sprintf("%d of %d samples", samples, info.NSamples)
+	case info.MD5sum == [md5.Size]uint8{}:
+		entry.result = checkUnverifiable
+		entry.detail = "no MD5 in STREAMINFO"
+	case md5sum != info.MD5sum:
+		entry.detail = "MD5 mismatch"
+	default:
+		entry.result = checkOK
+	}
+	return entry, nil
+}
+
+// hashSamples writes samples to h the way the MD5 in STREAMINFO is computed:
+// little endian, bytesPerSample each. buf is reused and returned.
+func hashSamples(h hash.Hash, buf []byte, samples []int32, bytesPerSample int) []byte {
+	n := len(samples) * bytesPerSample
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	for i, sample := range samples {
+		for b := 0; b < bytesPerSample; b++ {
+			buf[i*bytesPerSample+b] = byte(sample >> uint(8*b))
+		}
+	}
+	h.Write(buf)
+	return buf
+}
+
+// mappedFolders returns the folders of the play_audio lines of the mapping
+// file; commands (no absolute path) and folders that do not exist are left out.
+func mappedFolders(mappingfile string) []string {
+	file, err := os.Open(mappingfile)
+	if err != nil {
+		logm.Warningf("%s read %s err=%s", pluginname, mappingfile, err.Error())
+		return nil
+	}
+	defer file.Close()
+	var folders []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		for {
+			i := strings.Index(line, "play_audio|")
+			if i < 0 {
+				break
+			}
+			line = line[i+len("play_audio|"):]
+			folder := strings.TrimSpace(strings.SplitN(line, "|", 2)[0])
+			if seen[folder] || !filepath.IsAbs(folder) {
+				// a command
+				continue
+			}
+			if fi, err := os.Stat(folder); err != nil || !fi.IsDir() {
+				continue
+			}
+			seen[folder] = true
+			folders = append(folders, folder)
+		}
+	}
+	return folders
+}
+
+// flacFiles returns the flac files in and below folders, sorted, each once.
+func flacFiles(folders []string) []string {
+	seen := make(map[string]bool)
+	var files []string
+	for _, folder := range folders {
+		filepath.Walk(folder, func(pathfile string, fi os.FileInfo, err error) error {
+			if err != nil {
+				logm.Warningf("%s check %s err=%s", pluginname, pathfile, err.Error())
+				return nil
+			}
+			if !fi.IsDir() && strings.HasSuffix(pathfile, ".flac") && !seen[pathfile] {
+				seen[pathfile] = true
+				files = append(files, pathfile)
+			}
+			return nil
+		})
+	}
+	sort.Strings(files)
+	return files
+}
+
+// readCheckProgress reads the files checked so far by an unfinished check,
+// and its start time ("" if there is none).
+func readCheckProgress(progressfile string) ([]checkEntry, string) {
+	data, err := ioutil.ReadFile(progressfile)
+	if err != nil {
+		return nil, ""
+	}
+	var entries []checkEntry
+	started := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "# started ") {
+			started = strings.TrimPrefix(line, "# started ")
+			continue
+		}
+		// result, detail, pathfile
+		tokens := strings.SplitN(line, "\t", 3)
+		if len(tokens) == 3 {
+			entries = append(entries, checkEntry{pathfile: tokens[2], result: tokens[0], detail: tokens[1]})
+		}
+	}
+	return entries, started
+}
+
+func writeCheckReport(reportfile string, started string, entries []checkEntry, total int) error {
+	file, err := os.Create(reportfile)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	ok := 0
+	for _, entry := range entries {
+		if entry.result == checkOK {
+			ok++
+		}
+	}
+	if len(entries) < total {
+		fmt.Fprintf(w, "check started %s, stopped after %d of %d files, %d ok\n", started, len(entries), total, ok)
+	} else {
+		fmt.Fprintf(w, "check started %s, complete: %d files, %d ok\n", started, len(entries), ok)
+	}
+	for _, result := range []string{checkCorrupt, checkTruncated, checkUnverifiable} {
+		fmt.Fprintf(w, "\n%s:\n", result)
+		for _, entry := range entries {
+			if entry.result == result {
+				fmt.Fprintf(w, "%s: %s\n", entry.pathfile, entry.detail)
+			}
+		}
+	}
+	err = w.Flush()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// libraryChecker runs one check at a time.
+type libraryChecker struct {
+	lock      sync.Mutex
+	homedir   string
+	running   bool
+	stop      chan struct{} // closed to stop the running check
+	done      chan struct{} // closed when the running check has returned
+	checked   int           // files of this check, including earlier runs
+	total     int
+	problems  int
+	lastNight string // of the last scheduled check
+}
+
+var checker libraryChecker
+
+func (c *libraryChecker) init(homedir string) {
+	c.lock.Lock()
+	c.homedir = homedir
+	c.lock.Unlock()
+}
+
+/*
+start starts a check of the mapped folders, unless one is running. It stops by
+itself at until, unless until is zero. ph is nil for a scheduled check: the
+result goes to the log only.
+*/
+func (c *libraryChecker) start(until time.Time, ph *tremote_plugin.PluginHelper) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.running {
+		return false
+	}
+	c.running = true
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	c.checked, c.total, c.problems = 0, 0, 0
+	go c.run(c.homedir, until, c.stop, c.done, ph)
+	return true
+}
+
+// stopRun stops the running check and waits for it; false if none is running.
+func (c *libraryChecker) stopRun() bool {
+	c.lock.Lock()
+	if !c.running {
+		c.lock.Unlock()
+		return false
+	}
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+	done := c.done
+	c.lock.Unlock()
+	<-done
+	return true
+}
+
+// progress returns e.g. "120 of 3400 files, 2 problems", or "" if no check
+// is running.
+func (c *libraryChecker) progress() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.running {
+		return ""
+	}
+	return fmt.Sprintf("%d of %d files, %d problems", c.checked, c.total, c.problems)
+}
+
+func (c *libraryChecker) run(homedir string, until time.Time, stop chan struct{}, done chan struct{}, ph *tremote_plugin.PluginHelper) {
+	defer func() {
+		c.lock.Lock()
+		c.running = false
+		c.lock.Unlock()
+		close(done)
+	}()
+	showStatus := func(status string) {
+		logm.Infof("%s %s", pluginname, status)
+		if ph != nil {
+			ph.PrintStatus(status)
+		}
+	}
+
+	folders := mappedFolders(homedir + "/mapping.txt")
+	if len(folders) == 0 {
+		showStatus("check: no folders in mapping.txt")
+		return
+	}
+	files := flacFiles(folders)
+	progressfile := homedir + "/" + pluginname + ".checked"
+	reportfile := homedir + "/" + pluginname + ".check"
+	entries, started := readCheckProgress(progressfile)
+	if started == "" {
+		started = time.Now().Format("2006-01-02 15:04")
+		entries = nil
+		if err := ioutil.WriteFile(progressfile, []byte("# started "+started+"\n"), 0644); err != nil {
+			logm.Warningf("%s write %s err=%s", pluginname, progressfile, err.Error())
+			showStatus("check: " + err.Error())
+			return
+		}
+	}
+	// files checked before, and since removed, no longer count
+	checked := make(map[string]bool)
+	kept := entries[:0]
+	for _, entry := range entries {
+		if !checked[entry.pathfile] && containsString(files, entry.pathfile) {
+			checked[entry.pathfile] = true
+			kept = append(kept, entry)
+		}
+	}
+	entries = kept
+	problems := 0
+	for _, entry := range entries {
+		if entry.result != checkOK {
+			problems++
+		}
+	}
+	c.lock.Lock()
+	c.checked, c.total, c.problems = len(entries), len(files), problems
+	c.lock.Unlock()
+	if len(entries) > 0 {
+		showStatus("check: resuming at " + strconv.Itoa(len(entries)+1) + " of " + strconv.Itoa(len(files)) + " files")
+	} else {
+		showStatus("checking " + strconv.Itoa(len(files)) + " flac files")
+	}
+
+	progress, err := os.OpenFile(progressfile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		logm.Warningf("%s open %s err=%s", pluginname, progressfile, err.Error())
+		showStatus("check: " + err.Error())
+		return
+	}
+	stopped := func() bool {
+		select {
+		case <-stop:
+			return true
+		default:
+			return !until.IsZero() && time.Now().After(until)
+		}
+	}
+	throttle := newCheckThrottle(configCheckLoad)
+	for _, pathfile := range files {
+		if checked[pathfile] {
+			continue
+		}
+		entry, err := checkFlac(pathfile, throttle, stopped)
+		if err == errCheckStopped {
+			break
+		}
+		if entry.result != checkOK {
+			logm.Warningf("%s check %s: %s, %s", pluginname, pathfile, entry.result, entry.detail)
+			problems++
+		}
+		fmt.Fprintf(progress, "%s\t%s\t%s\n", entry.result, entry.detail, pathfile)
+		entries = append(entries, entry)
+		c.lock.Lock()
+		c.checked, c.problems = len(entries), problems
+		c.lock.Unlock()
+	}
+	progress.Close()
+
+	if err := writeCheckReport(reportfile, started, entries, len(files)); err != nil {
+		logm.Warningf("%s write %s err=%s", pluginname, reportfile, err.Error())
+	}
+	if len(entries) < len(files) {
+		showStatus(fmt.Sprintf("check stopped: %d of %d files, %d problems", len(entries), len(files), problems))
+		return
+	}
+	os.Remove(progressfile)
+	showStatus(fmt.Sprintf("check complete: %d files, %d problems", len(files), problems))
+}
+
+func containsString(list []string, s string) bool {
+	i := sort.SearchStrings(list, s)
+	return i < len(list) && list[i] == s
+}
+
+/*
+cmdCheck starts the check of the mapped folders; while one is running, it
+shows its progress. "play_audio|Check|stop" stops it; the next Check
+continues where it stopped.
+*/
+func cmdCheck(args []string, ph tremote_plugin.PluginHelper) {
+	if len(args) > 0 && args[0] == "stop" {
+		if !checker.stopRun() {
+			ph.PrintStatus("check: not running")
+		}
+		return
+	}
+	if !checker.start(time.Time{}, &ph) {
+		ph.PrintStatus("check: " + checker.progress())
+	}
+}
+
+// parseCheckWindow parses a checkwindow like "01:00-06:00" into minutes
+// after midnight. The window may span midnight.
+func parseCheckWindow(value string) (int, int, error) {
+	var times [2]int
+	tokens := strings.Split(value, "-")
+	if len(tokens) != 2 {
+		return 0, 0, errors.New("must be hh:mm-hh:mm")
+	}
+	for i, token := range tokens {
+		t, err := time.Parse("15:04", strings.TrimSpace(token))
+		if err != nil {
+			return 0, 0, errors.New("must be hh:mm-hh:mm")
+		}
+		times[i] = t.Hour()*60 + t.Minute()
+	}
+	if times[0] == times[1] {
+		return 0, 0, errors.New("window is empty")
+	}
+	return times[0], times[1], nil
+}
+
+/*
+checkWindowAt returns whether now lies within the window from-to (minutes after
+midnight), the end of the window, and the night it belongs to: the date the
+window opened.
+*/
+func checkWindowAt(now time.Time, from int, to int) (bool, time.Time, string) {
+	minute := now.Hour()*60 + now.Minute()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	opened := midnight.Add(time.Duration(from) * time.Minute)
+	if minute < from {
+		opened = opened.AddDate(0, 0, -1)
+	}
+	end := opened.Add(time.Duration((to-from+24*60)%(24*60)) * time.Minute)
+	return now.Before(end), end, opened.Format("2006-01-02")
+}
+
+// scheduled starts a check once per night within the window from-to; it
+// stops at the end of the window.
+func (c *libraryChecker) scheduled(now time.Time, from int, to int) {
+	within, end, night := checkWindowAt(now, from, to)
+	if !within {
+		return
+	}
+	c.lock.Lock()
+	due := c.lastNight != night
+	c.lastNight = night
+	c.lock.Unlock()
+	if due {
+		c.start(end, nil)
+	}
+}
+
+// scheduleChecks runs checks within checkwindow of config.txt.
+func scheduleChecks(window string) {
+	from, to, err := parseCheckWindow(window)
+	if err != nil {
+		return
+	}
+	for now := range time.Tick(time.Minute) {
+		checker.scheduled(now, from, to)
+	}
+}
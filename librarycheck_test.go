@@ -0,0 +1,260 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mehrvarz/log"
+)
+
+// wrongMD5 changes the MD5 in STREAMINFO.
+func wrongMD5(fx *fixture, data []byte) []byte {
+	data[26] ^= 0xff
+	return data
+}
+
+func TestCheckFlac(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	tests := []struct {
+		name   string
+		fx     *fixture
+		damage func(fx *fixture, data []byte) []byte
+		result string
+		detail string
+	}{
+		{name: "16/44.1", fx: newFlacFixture(1, 44100, 16, 0.3), result: checkOK},
+		{name: "24/96", fx: fine(predicted(newFlacFixture(1, 96000, 24, 0.3))), result: checkOK},
+		{name: "escaped", fx: escaped(newFlacFixture(1, 44100, 16, 0.3)), result: checkOK},
+		{name: "mono", fx: monoFixture(newFlacFixture(1, 44100, 16, 0.3)), result: checkOK},
+		{
+			name: "damaged frame", fx: newFlacFixture(1, 44100, 16, 0.3), damage: damageFrame(3),
+			result: checkCorrupt, detail: "1 damaged frames",
+		},
+		{
+			name: "wrong MD5", fx: newFlacFixture(1, 44100, 16, 0.3), damage: wrongMD5,
+			result: checkCorrupt, detail: "MD5 mismatch",
+		},
+		{
+			name: "truncated", fx: newFlacFixture(1, 44100, 16, 0.3), damage: truncateInFrame(5),
+			result: checkTruncated, detail: "5120 of 13230 samples",
+		},
+		{
+			name: "no MD5", fx: newFlacFixture(1, 44100, 16, 0.3), damage: withoutMD5,
+			result: checkUnverifiable, detail: "no MD5 in STREAMINFO",
+		},
+		{name: "garbage", fx: newFlacFixture(1, 44100, 16, 0.3), damage: garbage, result: checkCorrupt},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "tremote_check")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			test.fx.damage = test.damage
+			test.fx.write(t, dir)
+
+			entry, err := checkFlac(dir+"/"+test.fx.name, newCheckThrottle(100), func() bool { return false })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.result != test.result || test.detail != "" && entry.detail != test.detail {
+				t.Errorf("%s (%s), want %s (%s)", entry.result, entry.detail, test.result, test.detail)
+			}
+		})
+	}
+}
+
+// checkLibrary writes a home directory with a mapping file for two folders:
+// good and damaged files, one of them in a sub directory.
+func checkLibrary(t *testing.T) string {
+	homedir, err := ioutil.TempDir("", "tremote_check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"/Jazz/Album", "/Pop"} {
+		if err := os.MkdirAll(homedir+dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fixtures := []struct {
+		dir    string
+		fx     *fixture
+		damage func(fx *fixture, data []byte) []byte
+	}{
+		{"/Jazz", newFlacFixture(1, 44100, 16, 0.1), nil},
+		{"/Jazz/Album", newFlacFixture(2, 44100, 16, 0.1), damageFrame(2)},
+		{"/Pop", newFlacFixture(3, 44100, 16, 0.1), truncateInFrame(3)},
+		{"/Pop", newFlacFixture(4, 96000, 24, 0.1), withoutMD5},
+		{"/Pop", newMp3Fixture(5, 10), nil},
+	}
+	for _, f := range fixtures {
+		f.fx.damage = f.damage
+		f.fx.write(t, homedir+f.dir)
+	}
+	mapping := "P3, Jazz, play_audio|" + homedir + "/Jazz\n" +
+		"P4, Pop, play_audio|" + homedir + "/Pop|mode=sequential\n" +
+		"P5, Album, play_audio|" + homedir + "/Jazz/Album\n" +
+		"P6, Gone, play_audio|" + homedir + "/Rock\n" +
+		"P11, Stats, play_audio|Stats\n" +
+		"P22, Check, play_audio|Check\n"
+	if err := ioutil.WriteFile(homedir+"/mapping.txt", []byte(mapping), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return homedir
+}
+
+func waitCheck(t *testing.T) {
+	waitFor(t, "check", func() bool { return checker.progress() == "" })
+}
+
+func TestLibraryCheck(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	homedir := checkLibrary(t)
+	defer os.RemoveAll(homedir)
+	checker.init(homedir)
+
+	host := newFakeHost()
+	cmdCheck(nil, host.ph)
+	waitCheck(t)
+	cmdCheck([]string{"stop"}, host.ph)
+	status := host.args("PrintStatus")
+	want := []string{"checking 4 flac files", "check complete: 4 files, 3 problems", "check: not running"}
+	if strings.Join(status, "|") != strings.Join(want, "|") {
+		t.Errorf("PrintStatus %q, want %q", status, want)
+	}
+	if _, err := os.Stat(homedir + "/" + pluginname + ".checked"); !os.IsNotExist(err) {
+		t.Errorf("progress file left after a complete check")
+	}
+	data, err := ioutil.ReadFile(homedir + "/" + pluginname + ".check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := string(data)
+	for _, line := range []string{
+		", complete: 4 files, 1 ok\n",
+		"\ncorrupt:\n" + homedir + "/Jazz/Album/02.flac: 1 damaged frames\n",
+		"\ntruncated:\n" + homedir + "/Pop/03.flac: 3072 of 4410 samples\n",
+		"\nunverifiable:\n" + homedir + "/Pop/04.flac: no MD5 in STREAMINFO\n",
+	} {
+		if !strings.Contains(report, line) {
+			t.Errorf("report without %q:\n%s", line, report)
+		}
+	}
+}
+
+// TestLibraryCheckResume stops a check at the end of its window and runs it
+// again.
+func TestLibraryCheckResume(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	homedir := checkLibrary(t)
+	defer os.RemoveAll(homedir)
+	checker.init(homedir)
+
+	// the window has closed before the first file
+	host := newFakeHost()
+	checker.start(time.Now().Add(-time.Second), &host.ph)
+	waitCheck(t)
+	progressfile := homedir + "/" + pluginname + ".checked"
+	entries, started := readCheckProgress(progressfile)
+	if len(entries) != 0 || started == "" {
+		t.Fatalf("progress %v, started %q", entries, started)
+	}
+
+	// a run before was stopped after the damaged file, which it took for ok
+	progress, err := os.OpenFile(progressfile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress.WriteString("ok\t\t" + homedir + "/Jazz/01.flac\n")
+	progress.WriteString("ok\t\t" + homedir + "/Jazz/Album/02.flac\n")
+	progress.WriteString("ok\t\t" + homedir + "/Gone/06.flac\n")
+	progress.Close()
+	cmdCheck(nil, host.ph)
+	waitCheck(t)
+	status := host.args("PrintStatus")
+	want := []string{"checking 4 flac files", "check stopped: 0 of 4 files, 0 problems",
+		"check: resuming at 3 of 4 files", "check complete: 4 files, 2 problems"}
+	if strings.Join(status, "|") != strings.Join(want, "|") {
+		t.Errorf("PrintStatus %q, want %q", status, want)
+	}
+	data, err := ioutil.ReadFile(homedir + "/" + pluginname + ".check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := string(data)
+	if !strings.HasPrefix(report, "check started "+started+", complete: 4 files, 2 ok\n") ||
+		strings.Contains(report, "02.flac") || strings.Contains(report, "06.flac") {
+		t.Errorf("report:\n%s", report)
+	}
+}
+
+func TestCheckThrottle(t *testing.T) {
+	var slept time.Duration
+	checkSleep = func(d time.Duration) { slept += d }
+	defer func() { checkSleep = time.Sleep }()
+
+	throttle := newCheckThrottle(25)
+	throttle.pause()
+	if slept != 0 {
+		t.Errorf("slept %v after a short block", slept)
+	}
+	throttle.start = time.Now().Add(-40 * time.Millisecond)
+	throttle.pause()
+	if slept < 120*time.Millisecond || slept > time.Second {
+		t.Errorf("slept %v after 40ms of decoding at 25%%, want 120ms", slept)
+	}
+
+	slept = 0
+	throttle = newCheckThrottle(100)
+	throttle.start = time.Now().Add(-40 * time.Millisecond)
+	throttle.pause()
+	if slept != 0 {
+		t.Errorf("slept %v at 100%%", slept)
+	}
+}
+
+func TestCheckWindow(t *testing.T) {
+	for _, value := range []string{"1:00-6:00", "01:00", "01:00-25:00", "03:00-03:00", "night"} {
+		if from, to, err := parseCheckWindow(value); (err == nil) != (value == "1:00-6:00") {
+			t.Errorf("parseCheckWindow(%q) = %d, %d, %v", value, from, to, err)
+		}
+	}
+	at := func(day int, hour int) time.Time {
+		return time.Date(2026, 10, day, hour, 30, 0, 0, time.Local)
+	}
+	tests := []struct {
+		window string
+		now    time.Time
+		within bool
+		end    time.Time
+		night  string
+	}{
+		{"01:00-06:00", at(19, 3), true, at(19, 6).Add(-30 * time.Minute), "2026-10-19"},
+		{"01:00-06:00", at(19, 7), false, at(19, 6).Add(-30 * time.Minute), "2026-10-19"},
+		{"01:00-06:00", at(19, 0), false, at(18, 6).Add(-30 * time.Minute), "2026-10-18"},
+		{"22:00-05:00", at(19, 2), true, at(19, 5).Add(-30 * time.Minute), "2026-10-18"},
+		{"22:00-05:00", at(19, 23), true, at(20, 5).Add(-30 * time.Minute), "2026-10-19"},
+		{"22:00-05:00", at(19, 12), false, at(19, 5).Add(-30 * time.Minute), "2026-10-18"},
+	}
+	for _, test := range tests {
+		from, to, err := parseCheckWindow(test.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		within, end, night := checkWindowAt(test.now, from, to)
+		if within != test.within || !end.Equal(test.end) || night != test.night {
+			t.Errorf("%s at %s: %v, %s, %s; want %v, %s, %s", test.window, test.now.Format("02 15:04"),
+				within, end.Format("02 15:04"), night, test.within, test.end.Format("02 15:04"), test.night)
+		}
+	}
+}
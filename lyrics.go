@@ -0,0 +1,270 @@
+/*
+Lyrics. With "lyrics=info" (or "lyrics=hostcmd") on a mapping line, the lyric
+line belonging to the current playback position is sent with ph.PrintInfo (or
+ph.HostCmd("Lyrics", line)) while a song plays. Lyrics are taken from, in this
+order: a .lrc file next to the song ("song.lrc" or "song.mp3.lrc"), an embedded
+SYLT frame (mp3), or LYRICS (flac) / USLT (mp3) text. LRC-formatted text in
+LYRICS or USLT is synchronized; plain text is spread evenly over the song.
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/dhowden/tag"
+	"github.com/mehrvarz/tremote_plugin"
+)
+
+const (
+	lyricsOff     = ""
+	lyricsInfo    = "info"
+	lyricsHostCmd = "hostcmd"
+)
+
+type lyricLine struct {
+	at   float64 // seconds from the start of the file
+	text string
+}
+
+// lyrics is sorted by time
+type lyrics []lyricLine
+
+var (
+	lrcTimeTag   = regexp.MustCompile(`^\[(\d+):(\d+)(?:[.:](\d+))?\]`)
+	lrcOffsetTag = regexp.MustCompile(`^\[offset:\s*([+-]?\d+)\s*\]`)
+	lrcWordTag   = regexp.MustCompile(`<\d+:\d+(?:[.:]\d+)?>`)
+)
+
+// lyricsMode returns the lyrics setting of the active mapping line.
+func lyricsMode() string {
+	playModeLock.Lock()
+	defer playModeLock.Unlock()
+	switch mode := activeOptions["lyrics"]; mode {
+	case lyricsInfo, lyricsHostCmd:
+		return mode
+	case lyricsOff, "off":
+	default:
+		logm.Warningf("%s unknown lyrics=%s", pluginname, mode)
+	}
+	return lyricsOff
+}
+
+/*
+loadLyrics returns the lyrics of pathfile; nil if there are none. m are the
+tags of the file (may be nil) and duration the length of the song in seconds,
+used to spread unsynchronized lyrics.
+*/
+func loadLyrics(pathfile string, m tag.Metadata, duration float64) lyrics {
+	base := strings.TrimSuffix(pathfile, pathExt(pathfile))
+	for _, lrcfile := range []string{base + ".lrc", pathfile + ".lrc"} {
+		if file, err := os.Open(lrcfile); err == nil {
+			var lines []string
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				lines = append(lines, scanner.Text())
+			}
+			file.Close()
+			if lyr := parseLRC(lines); len(lyr) > 0 {
+				logm.Debugf("%s lyrics from %s", pluginname, lrcfile)
+				return lyr
+			}
+		}
+	}
+	if m == nil {
+		return nil
+	}
+	for _, name := range []string{"SYLT", "SLT"} {
+		if sylt, ok := m.Raw()[name].([]byte); ok {
+			if lyr := parseSYLT(sylt); len(lyr) > 0 {
+				logm.Debugf("%s lyrics from %s", pluginname, name)
+				return lyr
+			}
+		}
+	}
+	text := m.Lyrics()
+	if text == "" {
+		if unsynced, ok := m.Raw()["unsyncedlyrics"].(string); ok {
+			text = unsynced
+		}
+	}
+	if text == "" {
+		return nil
+	}
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	if lyr := parseLRC(lines); len(lyr) > 0 {
+		return lyr
+	}
+	return spreadLyrics(lines, duration)
+}
+
+func pathExt(pathfile string) string {
+	if dot := strings.LastIndex(pathfile, "."); dot > strings.LastIndex(pathfile, "/") {
+		return pathfile[dot:]
+	}
+	return ""
+}
+
+// parseLRC parses "[mm:ss.xx]text" lines; a line may carry several time tags.
+func parseLRC(lines []string) lyrics {
+	var lyr lyrics
+	offset := 0.0
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if match := lrcOffsetTag.FindStringSubmatch(line); match != nil {
+			ms, _ := strconv.Atoi(match[1])
+			// a positive offset shows the lyrics earlier
+			offset = -float64(ms) / 1000
+			continue
+		}
+		var times []float64
+		for {
+			match := lrcTimeTag.FindStringSubmatch(line)
+			if match == nil {
+				break
+			}
+			min, _ := strconv.Atoi(match[1])
+			sec, _ := strconv.Atoi(match[2])
+			at := float64(min*60 + sec)
+			if match[3] != "" {
+				frac, _ := strconv.Atoi(match[3])
+				at += float64(frac) / pow10(len(match[3]))
+			}
+			times = append(times, at)
+			line = line[len(match[0]):]
+		}
+		text := cleanTagText(lrcWordTag.ReplaceAllString(line, ""))
+		for _, at := range times {
+			lyr = append(lyr, lyricLine{at, text})
+		}
+	}
+	for i := range lyr {
+		lyr[i].at += offset
+	}
+	sort.SliceStable(lyr, func(i, j int) bool { return lyr[i].at < lyr[j].at })
+	return lyr
+}
+
+func pow10(n int) float64 {
+	f := 1.0
+	for ; n > 0; n-- {
+		f *= 10
+	}
+	return f
+}
+
+/*
+parseSYLT decodes an ID3v2 SYLT frame: encoding, language, time stamp format,
+content type, descriptor, then text and 32 bit time stamp pairs. Only time
+stamps in milliseconds are supported.
+*/
+func parseSYLT(b []byte) lyrics {
+	if len(b) < 6 || b[4] != 2 {
+		return nil
+	}
+	enc := b[0]
+	b = b[6:]
+	_, b = splitSYLTText(b, enc) // content descriptor
+	var lyr lyrics
+	for len(b) > 0 {
+		var text string
+		text, b = splitSYLTText(b, enc)
+		if len(b) < 4 {
+			break
+		}
+		ms := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		// lines often start with "\n", words without; we show lines
+		text = cleanTagText(text)
+		lyr = append(lyr, lyricLine{float64(ms) / 1000, text})
+	}
+	sort.SliceStable(lyr, func(i, j int) bool { return lyr[i].at < lyr[j].at })
+	return lyr
+}
+
+// splitSYLTText returns the terminated text at the start of b and the rest.
+func splitSYLTText(b []byte, enc byte) (string, []byte) {
+	if enc == 1 || enc == 2 {
+		// UTF-16, terminated by two zero bytes on an even position
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return decodeUTF16(b[:i], enc == 2), b[i+2:]
+			}
+		}
+		return decodeUTF16(b, enc == 2), nil
+	}
+	for i := range b {
+		if b[i] == 0 {
+			if enc == 0 {
+				return decodeLatin1(string(b[:i])), b[i+1:]
+			}
+			return string(b[:i]), b[i+1:]
+		}
+	}
+	return string(b), nil
+}
+
+// decodeUTF16 decodes UTF-16 with BOM, or big endian without BOM if bigEndian.
+func decodeUTF16(b []byte, bigEndian bool) string {
+	if len(b) >= 2 && b[0] == 0xff && b[1] == 0xfe {
+		bigEndian = false
+		b = b[2:]
+	} else if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+		bigEndian = true
+		b = b[2:]
+	}
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		if bigEndian {
+			u[i] = binary.BigEndian.Uint16(b[2*i:])
+		} else {
+			u[i] = binary.LittleEndian.Uint16(b[2*i:])
+		}
+	}
+	return string(utf16.Decode(u))
+}
+
+// spreadLyrics times unsynchronized lines evenly over the song.
+func spreadLyrics(lines []string, duration float64) lyrics {
+	var texts []string
+	for _, line := range lines {
+		if text := cleanTagText(line); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	if len(texts) == 0 || duration <= 0 {
+		return nil
+	}
+	lyr := make(lyrics, len(texts))
+	for i, text := range texts {
+		lyr[i] = lyricLine{duration * float64(i) / float64(len(texts)), text}
+	}
+	return lyr
+}
+
+// lineAt returns the index of the line to show at position (seconds); -1
+// before the first line.
+func (lyr lyrics) lineAt(position float64) int {
+	return sort.Search(len(lyr), func(i int) bool { return lyr[i].at > position }) - 1
+}
+
+// sendLyric shows a lyric line; an empty line (instrumental part) brings back
+// the now-playing string in info mode.
+func sendLyric(ph tremote_plugin.PluginHelper, mode string, text string, nowPlaying string) {
+	switch mode {
+	case lyricsInfo:
+		if text == "" {
+			ph.PrintInfo(nowPlaying)
+		} else {
+			ph.PrintInfo(displayText(text))
+		}
+	case lyricsHostCmd:
+		ph.HostCmd("Lyrics", text)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dhowden/tag"
+	"github.com/mehrvarz/log"
+)
+
+// lyricsString formats lyr as "at:text|..." for comparisons.
+func lyricsString(lyr lyrics) string {
+	var lines []string
+	for _, line := range lyr {
+		lines = append(lines, fmt.Sprintf("%g:%s", math.Round(line.at*1000)/1000, line.text))
+	}
+	return strings.Join(lines, "|")
+}
+
+func TestParseLRC(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{"simple", []string{"[00:01.50]One", "[00:03.25]Two"}, "1.5:One|3.25:Two"},
+		{"metadata and junk", []string{"[ar:Band]", "[ti:Song]", "no time", "", "[01:02]Three"}, "62:Three"},
+		{"fractions", []string{"[00:01.5]a", "[00:02.05]b", "[00:03:123]c"}, "1.5:a|2.05:b|3.123:c"},
+		{"several tags", []string{"[00:10.00][00:30.00]Chorus", "[00:20.00]Verse"}, "10:Chorus|20:Verse|30:Chorus"},
+		{"empty line", []string{"[00:01.00]One", "[00:02.00]", "[00:03.00]Two"}, "1:One|2:|3:Two"},
+		{"word tags", []string{"[00:01.00]<00:01.00>One <00:01.50>word"}, "1:One word"},
+		{"offset", []string{"[offset:+500]", "[00:01.00]One", "[00:02.00]Two"}, "0.5:One|1.5:Two"},
+		{"negative offset", []string{"[offset: -250 ]", "[00:01.00]One"}, "1.25:One"},
+		{"spaces", []string{"  [00:01.00]  One  "}, "1:One"},
+		{"unsorted", []string{"[00:05.00]Late", "[00:01.00]Early"}, "1:Early|5:Late"},
+		{"plain text", []string{"no", "time tags"}, ""},
+	}
+	for _, test := range tests {
+		if got := lyricsString(parseLRC(test.lines)); got != test.want {
+			t.Errorf("%s: %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// syltFrame builds a SYLT frame body with millisecond time stamps.
+func syltFrame(enc byte, format byte, descriptor []byte, entries ...interface{}) []byte {
+	b := append([]byte{enc, 'e', 'n', 'g', format, 1}, descriptor...)
+	for i := 0; i+1 < len(entries); i += 2 {
+		b = append(b, entries[i].([]byte)...)
+		ms := entries[i+1].(int)
+		b = append(b, byte(ms>>24), byte(ms>>16), byte(ms>>8), byte(ms))
+	}
+	return b
+}
+
+func TestParseSYLT(t *testing.T) {
+	latin1 := func(s string) []byte { return append([]byte(s), 0) }
+	utf16le := func(s string) []byte {
+		b := []byte{0xff, 0xfe}
+		for _, r := range s {
+			b = append(b, byte(r), byte(r>>8))
+		}
+		return append(b, 0, 0)
+	}
+	utf16be := func(s string) []byte {
+		var b []byte
+		for _, r := range s {
+			b = append(b, byte(r>>8), byte(r))
+		}
+		return append(b, 0, 0)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"Latin-1", syltFrame(0, 2, latin1("desc"), latin1("\nOne"), 1000, latin1("Caf\xe9"), 2500), "1:One|2.5:Café"},
+		{"UTF-8", syltFrame(3, 2, latin1(""), latin1("Björk"), 100), "0.1:Björk"},
+		{"UTF-16 with BOM", syltFrame(1, 2, utf16le("d"), utf16le("Für"), 2000, utf16le("Sie"), 1000), "1:Sie|2:Für"},
+		{"UTF-16BE", syltFrame(2, 2, utf16be(""), utf16be("Кино"), 300), "0.3:Кино"},
+		{"missing time stamp", append(syltFrame(0, 2, latin1(""), latin1("One"), 1000), latin1("Two")...), "1:One"},
+		{"MPEG frames", syltFrame(0, 1, latin1(""), latin1("One"), 1000), ""},
+		{"short", []byte{0, 'e', 'n', 'g', 2}, ""},
+	}
+	for _, test := range tests {
+		if got := lyricsString(parseSYLT(test.data)); got != test.want {
+			t.Errorf("%s: %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSpreadLyrics(t *testing.T) {
+	tests := []struct {
+		lines    []string
+		duration float64
+		want     string
+	}{
+		{[]string{"One", "", "Two", "Three", "Four"}, 200, "0:One|50:Two|100:Three|150:Four"},
+		{[]string{"One"}, 0, ""},
+		{[]string{"", " "}, 100, ""},
+	}
+	for _, test := range tests {
+		if got := lyricsString(spreadLyrics(test.lines, test.duration)); got != test.want {
+			t.Errorf("%q over %gs: %q, want %q", test.lines, test.duration, got, test.want)
+		}
+	}
+}
+
+func TestLineAt(t *testing.T) {
+	lyr := lyrics{{1, "a"}, {2, "b"}, {2, "c"}, {5, "d"}}
+	tests := []struct {
+		position float64
+		want     int
+	}{
+		{0, -1},
+		{0.99, -1},
+		{1, 0},
+		{1.5, 0},
+		{2, 2}, // the last of two lines at the same time
+		{4.9, 2},
+		{100, 3},
+	}
+	for _, test := range tests {
+		if got := lyr.lineAt(test.position); got != test.want {
+			t.Errorf("lineAt(%g) = %d, want %d", test.position, got, test.want)
+		}
+	}
+	if got := lyrics(nil).lineAt(1); got != -1 {
+		t.Errorf("no lyrics: lineAt = %d", got)
+	}
+}
+
+func TestLoadLyrics(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	dir, err := ioutil.TempDir("", "tremote_lyrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name     string
+		lrcfile  string // written next to the song, if set
+		comments []string
+		want     string
+	}{
+		{"no lyrics", "", nil, ""},
+		{"song.lrc", "%s.lrc", []string{"LYRICS=[00:01.00]Tag"}, "2:File"},
+		{"song.flac.lrc", "%s.flac.lrc", nil, "2:File"},
+		{"LRC in LYRICS", "", []string{"LYRICS=[00:01.00]One\r\n[00:03.00]Two"}, "1:One|3:Two"},
+		{"plain LYRICS", "", []string{"LYRICS=One\nTwo"}, "0:One|5:Two"},
+	}
+	for i, test := range tests {
+		fx := newFlacFixture(i+1, 44100, 16, 0.05)
+		fx.write(t, dir)
+		if test.comments != nil {
+			fx.tag(t, dir, test.comments...)
+		}
+		pathfile := dir + "/" + fx.name
+		if test.lrcfile != "" {
+			lrcfile := dir + "/" + fmt.Sprintf(test.lrcfile, strings.TrimSuffix(fx.name, ".flac"))
+			if err := ioutil.WriteFile(lrcfile, []byte("[ti:x]\n[00:02.00]File\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		file, err := os.Open(pathfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := tag.ReadFrom(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := lyricsString(loadLyrics(pathfile, m, 10)); got != test.want {
+			t.Errorf("%s: %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSendLyric(t *testing.T) {
+	tests := []struct {
+		mode, text string
+		fkt, arg   string
+	}{
+		{lyricsInfo, "Björk", "PrintInfo", "Björk"},
+		{lyricsInfo, "", "PrintInfo", "Now playing"}, // instrumental part
+		{lyricsHostCmd, "Line", "HostCmd", "Lyrics"},
+		{lyricsOff, "Line", "", ""},
+	}
+	for _, test := range tests {
+		host := newFakeHost()
+		sendLyric(host.ph, test.mode, test.text, "Now playing")
+		host.mu.Lock()
+		calls := host.calls
+		host.mu.Unlock()
+		if test.fkt == "" {
+			if len(calls) != 0 {
+				t.Errorf("%q: %+v, want no calls", test.mode, calls)
+			}
+		} else if len(calls) != 1 || calls[0].fkt != test.fkt || calls[0].arg != test.arg {
+			t.Errorf("%q %q: %+v, want %s(%q)", test.mode, test.text, calls, test.fkt, test.arg)
+		}
+	}
+}
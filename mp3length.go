@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+var (
+	errNoMp3Frame  = errors.New("no mp3 frame found")
+	errScanStopped = errors.New("mp3 scan stopped")
+)
+
+// bitrates in kbit/s by [mpeg1][layer-1][index]; mpeg1 = 1 for MPEG-1, 0 for MPEG-2/2.5
+var mp3Bitrates = [2][3][16]int{
+	{ // MPEG-2, 2.5
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	},
+	{ // MPEG-1
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	},
+}
+
+var mp3SampleRates = [4][3]int{
+	{11025, 12000, 8000},  // MPEG-2.5
+	{0, 0, 0},             // reserved
+	{22050, 24000, 16000}, // MPEG-2
+	{44100, 48000, 32000}, // MPEG-1
+}
+
+// mp3Frame is the information in an mp3 frame header we need
+type mp3Frame struct {
+	mpeg1           bool
+	layer           int
+	mono            bool
+	sampleRate      int
+	bitrate         int // bit/s
+	samplesPerFrame int
+	size            int // bytes, including the header
+}
+
+// parseMp3Frame decodes the 4 byte frame header at b.
+func parseMp3Frame(b []byte) (mp3Frame, bool) {
+	var fr mp3Frame
+	if len(b) < 4 || b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return fr, false
+	}
+	version := (b[1] >> 3) & 3 // 0=2.5 1=reserved 2=2 3=1
+	layer := 4 - int((b[1]>>1)&3)
+	bitrateIdx := b[2] >> 4
+	rateIdx := (b[2] >> 2) & 3
+	if version == 1 || layer == 4 || bitrateIdx == 0 || bitrateIdx == 15 || rateIdx == 3 {
+		return fr, false
+	}
+	fr.mpeg1 = version == 3
+	fr.layer = layer
+	fr.mono = b[3]>>6 == 3
+	m := 0
+	if fr.mpeg1 {
+		m = 1
+	}
+	fr.bitrate = mp3Bitrates[m][layer-1][bitrateIdx] * 1000
+	fr.sampleRate = mp3SampleRates[version][rateIdx]
+	padding := int(b[2]>>1) & 1
+	switch {
+	case layer == 1:
+		fr.samplesPerFrame = 384
+		fr.size = (12*fr.bitrate/fr.sampleRate + padding) * 4
+	case layer == 3 && !fr.mpeg1:
+		fr.samplesPerFrame = 576
+		fr.size = 72*fr.bitrate/fr.sampleRate + padding
+	default:
+		fr.samplesPerFrame = 1152
+		fr.size = 144*fr.bitrate/fr.sampleRate + padding
+	}
+	return fr, fr.size > 4
+}
+
+/*
+mp3Length returns the number of inter-channel samples of an mp3 file and its
+sample rate. mpg123 (as wrapped by go-mpg123) does not tell us, so we look at
+the first frame: a Xing/Info or VBRI header gives the exact frame count
+(exact=true). Without one, the length is estimated from the file size and the
+bitrate of the first frame, which is exact for CBR files only; see
+mp3ScanLength for the slow but exact way.
+*/
+func mp3Length(pathfile string) (uint64, int, bool, error) {
+	f, err := os.Open(pathfile)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer f.Close()
+	offset, fr, buf, err := firstMp3Frame(f)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	// Xing/Info header after the side information (layer 3)
+	side := 32
+	if fr.mpeg1 && fr.mono || !fr.mpeg1 && !fr.mono {
+		side = 17
+	}
+	if !fr.mpeg1 && fr.mono {
+		side = 9
+	}
+	if x := 4 + side; x+12 <= len(buf) {
+		tag := string(buf[x : x+4])
+		if (tag == "Xing" || tag == "Info") && buf[x+7]&1 != 0 {
+			frames := binary.BigEndian.Uint32(buf[x+8:])
+			return uint64(frames) * uint64(fr.samplesPerFrame), fr.sampleRate, true, nil
+		}
+	}
+	// VBRI header (Fraunhofer) 32 bytes after the frame header
+	if v := 4 + 32; v+18 <= len(buf) && string(buf[v:v+4]) == "VBRI" {
+		frames := binary.BigEndian.Uint32(buf[v+14:])
+		return uint64(frames) * uint64(fr.samplesPerFrame), fr.sampleRate, true, nil
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	size := fi.Size() - offset
+	tag := make([]byte, 3)
+	if _, err := f.ReadAt(tag, fi.Size()-128); err == nil && string(tag) == "TAG" {
+		size -= 128 // ID3v1
+	}
+	if size <= 0 {
+		return 0, 0, false, errNoMp3Frame
+	}
+	samples := uint64(size) * 8 * uint64(fr.sampleRate) / uint64(fr.bitrate)
+	return samples, fr.sampleRate, false, nil
+}
+
+/*
+mp3ScanLength returns the exact number of inter-channel samples of an mp3
+file by reading all frame headers (no decoding). This reads the whole file,
+so playSong runs it in the background, and only if progress is shown. It
+returns early with errScanStopped when stop is closed.
+*/
+func mp3ScanLength(pathfile string, stop chan struct{}) (uint64, error) {
+	f, err := os.Open(pathfile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	offset, _, _, err := firstMp3Frame(f)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return scanMp3Frames(f, stop)
+}
+
+// firstMp3Frame finds the first frame after an ID3v2 tag. It returns its file
+// offset and header, and the bytes from there on (up to 16 KB).
+func firstMp3Frame(f *os.File) (int64, mp3Frame, []byte, error) {
+	// skip an ID3v2 tag
+	var start int64
+	head := make([]byte, 10)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return 0, mp3Frame{}, nil, err
+	}
+	if bytes.HasPrefix(head, []byte("ID3")) {
+		start = 10 + int64(syncsafe(head[6:10]))
+		if head[5]&0x10 != 0 {
+			start += 10 // footer
+		}
+	}
+
+	buf := make([]byte, 16*1024)
+	n, err := f.ReadAt(buf, start)
+	if n == 0 {
+		if err == nil || err == io.EOF {
+			err = errNoMp3Frame
+		}
+		return 0, mp3Frame{}, nil, err
+	}
+	buf = buf[:n]
+
+	for i := 0; i+4 <= len(buf); i++ {
+		fr, ok := parseMp3Frame(buf[i:])
+		if !ok {
+			continue
+		}
+		// the next frame must follow, otherwise this was a false sync
+		if next := i + fr.size; next+4 <= len(buf) {
+			if _, ok := parseMp3Frame(buf[next:]); !ok {
+				continue
+			}
+		}
+		return start + int64(i), fr, buf[i:], nil
+	}
+	return 0, mp3Frame{}, nil, errNoMp3Frame
+}
+
+/*
+scanMp3Frames counts the samples of all complete frames in r. Junk between
+frames (a broken frame, an ID3v1 tag) is skipped: a header only counts if the
+next frame or an ID3v1 tag follows it, or the file ends there, so that audio
+data that happens to look like a header is not taken for one.
+*/
+func scanMp3Frames(r io.Reader, stop chan struct{}) (uint64, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	var samples uint64
+	synced := true
+	for n := 0; ; n++ {
+		if n%1024 == 0 {
+			select {
+			case <-stop:
+				return 0, errScanStopped
+			default:
+			}
+		}
+		header, err := br.Peek(4)
+		if err != nil {
+			break
+		}
+		fr, ok := parseMp3Frame(header)
+		if ok {
+			if next, err := br.Peek(fr.size + 4); err == nil {
+				_, ok = parseMp3Frame(next[fr.size:])
+				ok = ok || string(next[fr.size:fr.size+3]) == "TAG"
+			} else {
+				ok = synced // last frame
+			}
+		}
+		if !ok {
+			synced = false
+			br.Discard(1)
+			continue
+		}
+		synced = true
+		if _, err := br.Discard(fr.size); err != nil {
+			break // truncated last frame
+		}
+		samples += uint64(fr.samplesPerFrame)
+	}
+	if samples == 0 {
+		return 0, errNoMp3Frame
+	}
+	return samples, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParseMp3Frame(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		ok     bool
+		want   mp3Frame
+	}{
+		{"MPEG-1 layer III", []byte{0xff, 0xfb, 0x90, 0x64}, true,
+			mp3Frame{mpeg1: true, layer: 3, sampleRate: 44100, bitrate: 128000, samplesPerFrame: 1152, size: 417}},
+		{"padding", []byte{0xff, 0xfb, 0x92, 0x64}, true,
+			mp3Frame{mpeg1: true, layer: 3, sampleRate: 44100, bitrate: 128000, samplesPerFrame: 1152, size: 418}},
+		{"48 kHz mono", []byte{0xff, 0xfb, 0x94, 0xc0}, true,
+			mp3Frame{mpeg1: true, layer: 3, mono: true, sampleRate: 48000, bitrate: 128000, samplesPerFrame: 1152, size: 384}},
+		{"MPEG-2 layer III", []byte{0xff, 0xf3, 0x80, 0xc0}, true,
+			mp3Frame{layer: 3, mono: true, sampleRate: 22050, bitrate: 64000, samplesPerFrame: 576, size: 208}},
+		{"MPEG-2.5", []byte{0xff, 0xe3, 0x88, 0x00}, true,
+			mp3Frame{layer: 3, sampleRate: 8000, bitrate: 64000, samplesPerFrame: 576, size: 576}},
+		{"layer I", []byte{0xff, 0xff, 0x90, 0x00}, true,
+			mp3Frame{mpeg1: true, layer: 1, sampleRate: 44100, bitrate: 288000, samplesPerFrame: 384, size: 312}},
+		{"layer II", []byte{0xff, 0xfd, 0x90, 0x00}, true,
+			mp3Frame{mpeg1: true, layer: 2, sampleRate: 44100, bitrate: 160000, samplesPerFrame: 1152, size: 522}},
+		{"no sync", []byte{0xff, 0x7b, 0x90, 0x64}, false, mp3Frame{}},
+		{"reserved version", []byte{0xff, 0xeb, 0x90, 0x64}, false, mp3Frame{}},
+		{"reserved layer", []byte{0xff, 0xf9, 0x90, 0x64}, false, mp3Frame{}},
+		{"free bitrate", []byte{0xff, 0xfb, 0x00, 0x64}, false, mp3Frame{}},
+		{"bad bitrate", []byte{0xff, 0xfb, 0xf0, 0x64}, false, mp3Frame{}},
+		{"reserved sample rate", []byte{0xff, 0xfb, 0x9c, 0x64}, false, mp3Frame{}},
+		{"short", []byte{0xff, 0xfb, 0x90}, false, mp3Frame{}},
+	}
+	for _, test := range tests {
+		fr, ok := parseMp3Frame(test.header)
+		if ok != test.ok || ok && fr != test.want {
+			t.Errorf("%s: %+v %v, want %+v %v", test.name, fr, ok, test.want, test.ok)
+		}
+	}
+}
+
+// testMp3Frames returns n frames of 128 kbit/s, 44.1 kHz.
+func testMp3Frames(n int) []byte {
+	var data []byte
+	for i := 0; i < n; i++ {
+		frame := make([]byte, testMp3FrameSize)
+		copy(frame, []byte{0xff, 0xfb, 0x90, 0x64})
+		data = append(data, frame...)
+	}
+	return data
+}
+
+// testMp3InfoFrame returns a frame with a Xing (or VBRI) header saying frames.
+func testMp3InfoFrame(tag string, frames uint32) []byte {
+	frame := testMp3Frames(1)
+	if tag == "VBRI" {
+		copy(frame[4+32:], tag)
+		binary.BigEndian.PutUint32(frame[4+32+14:], frames)
+	} else {
+		copy(frame[4+32:], tag)
+		frame[4+32+7] = 1 // frame count present
+		binary.BigEndian.PutUint32(frame[4+32+8:], frames)
+	}
+	return frame
+}
+
+func TestMp3Length(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tremote_mp3length")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id3v2 := []byte{'I', 'D', '3', 3, 0, 0, 0, 0, 0, 20}
+	id3v2 = append(id3v2, make([]byte, 20)...)
+	id3v1 := append([]byte("TAG"), make([]byte, 125)...)
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	// 100 frames of 417 bytes at 128 kbit/s: 100*417*8/128000 s
+	const estimate = 100 * 417 * 8 * 44100 / 128000
+
+	tests := []struct {
+		name    string
+		data    []byte
+		samples uint64
+		exact   bool
+		err     bool
+	}{
+		{"CBR", testMp3Frames(100), estimate, false, false},
+		{"ID3v2 and ID3v1", join(id3v2, testMp3Frames(100), id3v1), estimate, false, false},
+		{"junk before the first frame", join(id3v2, []byte{0xff, 0xfb, 0x90, 1, 2, 3}, testMp3Frames(100)),
+			estimate, false, false},
+		{"Xing", join(id3v2, testMp3InfoFrame("Xing", 5000), testMp3Frames(10)), 5000 * 1152, true, false},
+		{"Info", join(testMp3InfoFrame("Info", 7), testMp3Frames(7)), 7 * 1152, true, false},
+		{"VBRI", join(testMp3InfoFrame("VBRI", 300), testMp3Frames(10)), 300 * 1152, true, false},
+		{"no frames", join(id3v2, make([]byte, 1000)), 0, false, true},
+		{"only a tag", id3v2, 0, false, true},
+		{"empty", nil, 0, false, true},
+	}
+	for _, test := range tests {
+		pathfile := dir + "/test.mp3"
+		if err := ioutil.WriteFile(pathfile, test.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		samples, rate, exact, err := mp3Length(pathfile)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: %d samples, want an error", test.name, samples)
+			}
+			continue
+		}
+		if err != nil || samples != test.samples || rate != 44100 || exact != test.exact {
+			t.Errorf("%s: %d samples, %d Hz, exact %v, err=%v; want %d samples, exact %v",
+				test.name, samples, rate, exact, err, test.samples, test.exact)
+		}
+	}
+}
+
+func TestScanMp3Frames(t *testing.T) {
+	junk := []byte{0xff, 0xfb, 0x90, 0x64, 1, 2, 3} // a header, but no frame follows
+	tests := []struct {
+		name    string
+		data    []byte
+		samples uint64
+	}{
+		{"frames", testMp3Frames(20), 20 * 1152},
+		{"junk between frames", bytes.Join([][]byte{testMp3Frames(5), junk, testMp3Frames(5)}, nil), 10 * 1152},
+		{"junk at the start", append(junk, testMp3Frames(3)...), 3 * 1152},
+		{"ID3v1 at the end", append(testMp3Frames(5), append([]byte("TAG"), make([]byte, 125)...)...), 5 * 1152},
+		{"truncated last frame", testMp3Frames(6)[:6*417-100], 5 * 1152},
+		{"no frames", make([]byte, 5000), 0},
+	}
+	for _, test := range tests {
+		samples, err := scanMp3Frames(bytes.NewReader(test.data), make(chan struct{}))
+		if samples != test.samples || (err != nil) != (test.samples == 0) {
+			t.Errorf("%s: %d samples, err=%v; want %d", test.name, samples, err, test.samples)
+		}
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if _, err := scanMp3Frames(bytes.NewReader(testMp3Frames(20)), stop); err != errScanStopped {
+		t.Errorf("stopped scan: err=%v", err)
+	}
+}
+
+func TestTrackSamples(t *testing.T) {
+	tests := []struct {
+		track *cueTrack
+		total uint64
+		want  uint64
+	}{
+		{nil, 1000, 1000},
+		{&cueTrack{start: 100, end: 400}, 1000, 300},
+		{&cueTrack{start: 400}, 1000, 600},            // last track
+		{&cueTrack{start: 400, end: 2000}, 1000, 600}, // sheet longer than the file
+		{&cueTrack{start: 1200}, 1000, 0},
+		{&cueTrack{start: 100, end: 400}, 0, 0}, // unknown length
+	}
+	for _, test := range tests {
+		if got := trackSamples(test.track, test.total); got != test.want {
+			t.Errorf("trackSamples(%+v, %d) = %d, want %d", test.track, test.total, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxOutputRate is the highest rate a song is upsampled to.
+const maxOutputRate = 384000
+
+// resampleRates are tried after the default rate of the device, when a song
+// has to be resampled.
+var resampleRates = []int{48000, 44100, 96000, 88200, 192000, 176400}
+
+var errNoOutputFormat = errors.New("no supported output format")
+
+/*
+outputFormat is how a song is played on the output device. Devices do not
+take every format ("Invalid sample rate"), so before a song plays the device
+is asked for these, in this order, at each rate with the sample formats for
+the bit depth of the song (sampleFormatsFor):
+
+	exact     the rate of the song
+	upsample  an integer multiple of it, e.g. 88200 for 44100
+	resample  the default rate of the device, then resampleRates
+
+Only the first one is tried with resample=off.
+*/
+type outputFormat struct {
+	device int
+	name   string // of the device
+	rate   int
+	sample sampleFormat
+	stage  string // exact, upsample or resample
+	reason string // why, for the log
+}
+
+// outputDeviceSetting returns device= of the active mapping line, or else
+// device in config.txt; "" for the default device.
+func outputDeviceSetting() string {
+	playModeLock.Lock()
+	device, ok := activeOptions["device"]
+	playModeLock.Unlock()
+	if !ok {
+		return configDevice
+	}
+	return device
+}
+
+// findDevice returns the index of the output device named by selector: its
+// index in devices, its name or a part of it (not case-sensitive); -1 if
+// there is none.
+func findDevice(devices []audioDevice, selector string) int {
+	if i, err := strconv.Atoi(selector); err == nil {
+		if i >= 0 && i < len(devices) && devices[i].channels > 0 {
+			return i
+		}
+		return -1
+	}
+	selector = strings.ToLower(selector)
+	for i, dev := range devices {
+		if dev.channels > 0 && strings.ToLower(dev.name) == selector {
+			return i
+		}
+	}
+	for i, dev := range devices {
+		if dev.channels > 0 && strings.Contains(strings.ToLower(dev.name), selector) {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+chooseOutput picks the output device and the format to play a song with
+channels, rate and bits on. Only with convert may that format need the song
+to be resampled. It returns errNoOutputFormat, with device and name set, if
+the device takes none of the formats; any other error means there is no
+device to use.
+*/
+func chooseOutput(channels int, rate int, bits int, convert bool) (outputFormat, error) {
+	devices, device, err := output.Devices()
+	if err != nil {
+		return outputFormat{}, err
+	}
+	for i, dev := range devices {
+		if dev.channels > 0 {
+			logm.Debugf("%s audio device %d [%s] channels=%d rate=%.0f",
+				pluginname, i, dev.name, dev.channels, dev.rate)
+		}
+	}
+	if selector := outputDeviceSetting(); selector != "" {
+		if i := findDevice(devices, selector); i >= 0 {
+			device = i
+		} else {
+			logm.Warningf("%s no audio device [%s]; using the default device", pluginname, selector)
+		}
+	}
+	if device < 0 || device >= len(devices) {
+		return outputFormat{}, errors.New("no audio output device")
+	}
+	return negotiateFormat(device, devices[device], channels, rate, bits, convert)
+}
+
+// negotiateFormat returns the first format in the declared order (see
+// outputFormat) that dev takes; only the exact one if not convert.
+func negotiateFormat(device int, dev audioDevice, channels int, rate int, bits int, convert bool) (outputFormat, error) {
+	format := outputFormat{device: device, name: dev.name}
+	formats := sampleFormatsFor(bits)
+	// supports returns the first format dev takes at r, and why it rejects
+	// the first one, if it does
+	supports := func(r int) (sampleFormat, error) {
+		var rejected error
+		for _, f := range formats {
+			err := output.IsFormatSupported(device, channels, float64(r), f)
+			if err == nil {
+				return f, rejected
+			}
+			if rejected == nil {
+				rejected = err
+			}
+		}
+		return sampleFormat{}, rejected
+	}
+	found := func(r int, f sampleFormat, stage string, reason string, formatRejected error) (outputFormat, error) {
+		format.rate, format.sample, format.stage, format.reason = r, f, stage, reason
+		if f != formats[0] {
+			format.reason += fmt.Sprintf("; %s rejected (%v)", formats[0].name, formatRejected)
+		}
+		return format, nil
+	}
+
+	f, rateRejected := supports(rate)
+	if f.bits > 0 {
+		return found(rate, f, "exact", fmt.Sprintf("device takes %d Hz", rate), rateRejected)
+	}
+	if !convert {
+		format.reason = fmt.Sprintf("device rejects %d Hz (%v); resample=off", rate, rateRejected)
+		return format, errNoOutputFormat
+	}
+	for factor := 2; rate*factor <= maxOutputRate; factor++ {
+		if f, err := supports(rate * factor); f.bits > 0 {
+			return found(rate*factor, f, "upsample",
+				fmt.Sprintf("device rejects %d Hz (%v); x%d", rate, rateRejected, factor), err)
+		}
+	}
+	for _, r := range append([]int{int(dev.rate)}, resampleRates...) {
+		if r <= 0 || r == rate || r%rate == 0 {
+			// tried already
+			continue
+		}
+		if f, err := supports(r); f.bits > 0 {
+			return found(r, f, "resample",
+				fmt.Sprintf("device rejects %d Hz (%v) and its multiples", rate, rateRejected), err)
+		}
+	}
+	format.reason = fmt.Sprintf("device rejects %d Hz (%v), its multiples and all rates to resample to",
+		rate, rateRejected)
+	return format, errNoOutputFormat
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+var errInvalidRate = errors.New("Invalid sample rate")
+
+// takes returns a captureOutput.rejects for devices taking rates in formats
+// of bits only.
+func takes(bits []int, rates ...float64) func(int, int, float64, sampleFormat) error {
+	return takesFormats(func(f sampleFormat) bool {
+		for _, b := range bits {
+			if f.bits == b {
+				return true
+			}
+		}
+		return false
+	}, rates...)
+}
+
+// takesFormats returns a captureOutput.rejects for devices taking rates in
+// the formats accepted only.
+func takesFormats(accepted func(sampleFormat) bool, rates ...float64) func(int, int, float64, sampleFormat) error {
+	return func(device int, channels int, sampleRate float64, f sampleFormat) error {
+		for _, r := range rates {
+			if r == sampleRate {
+				if accepted(f) {
+					return nil
+				}
+				return errors.New("Sample format not supported")
+			}
+		}
+		return errInvalidRate
+	}
+}
+
+// only accepts format f.
+func only(f sampleFormat) func(sampleFormat) bool {
+	return func(g sampleFormat) bool { return g == f }
+}
+
+var anyBits = []int{16, 24}
+
+// shifted returns samples shifted up by shift bits, or down if it is negative.
+func shifted(samples []int32, shift int) []int32 {
+	out := make([]int32, len(samples))
+	for i, sample := range samples {
+		if shift < 0 {
+			out[i] = sample >> uint(-shift)
+		} else {
+			out[i] = sample << uint(shift)
+		}
+	}
+	return out
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		rejects func(int, int, float64, sampleFormat) error
+		rate    int
+		bits    int
+		convert bool
+		want    outputFormat // rate, sample format and stage
+		wantErr error
+	}{
+		{"exact", nil, 44100, 16, true, outputFormat{rate: 44100, sample: formatS16, stage: "exact"}, nil},
+		{"exact 24 bit", takes(anyBits, 96000), 96000, 24, true, outputFormat{rate: 96000, sample: formatS24_3, stage: "exact"}, nil},
+		{"24 bit in 32", takesFormats(only(formatS24_32), 96000), 96000, 24, true, outputFormat{rate: 96000, sample: formatS24_32, stage: "exact"}, nil},
+		{"24 bit on a 32 bit device", takes([]int{32}, 96000), 96000, 24, true, outputFormat{rate: 96000, sample: formatS32, stage: "exact"}, nil},
+		{"24 bit on a 16 bit device", takes([]int{16}, 96000), 96000, 24, true, outputFormat{rate: 96000, sample: formatS16, stage: "exact"}, nil},
+		{"16 bit on a 24 bit device", takes([]int{24}, 44100), 44100, 16, true, outputFormat{rate: 44100, sample: formatS24_3, stage: "exact"}, nil},
+		{"16 bit on a 32 bit device", takes([]int{32}, 44100), 44100, 16, true, outputFormat{rate: 44100, sample: formatS32, stage: "exact"}, nil},
+		{"upsample x2", takes(anyBits, 48000, 88200), 44100, 16, true, outputFormat{rate: 88200, sample: formatS16, stage: "upsample"}, nil},
+		{"upsample x4", takes(anyBits, 176400), 44100, 24, true, outputFormat{rate: 176400, sample: formatS24_3, stage: "upsample"}, nil},
+		{"resample to the default rate", takes(anyBits, 48000, 96000), 44100, 16, true, outputFormat{rate: 48000, sample: formatS16, stage: "resample"}, nil},
+		{"resample to another rate", takes([]int{24}, 96000), 44100, 16, true, outputFormat{rate: 96000, sample: formatS24_3, stage: "resample"}, nil},
+		{"no format", takes(anyBits), 44100, 16, true, outputFormat{}, errNoOutputFormat},
+		{"resample=off: exact", takes(anyBits, 44100), 44100, 16, false, outputFormat{rate: 44100, sample: formatS16, stage: "exact"}, nil},
+		{"resample=off: no format", takes(anyBits, 48000, 88200), 44100, 16, false, outputFormat{}, errNoOutputFormat},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := newCaptureOutput(false)
+			out.rejects = test.rejects
+			output = out
+			defer func() { output = portaudioOutput{} }()
+
+			dev := audioDevice{name: "capture", channels: 2, rate: 48000}
+			got, err := negotiateFormat(0, dev, 2, test.rate, test.bits, test.convert)
+			if err != test.wantErr {
+				t.Fatalf("err %v, want %v", err, test.wantErr)
+			}
+			if err == nil && (got.rate != test.want.rate || got.sample != test.want.sample || got.stage != test.want.stage) {
+				t.Errorf("%d Hz %s %s, want %d Hz %s %s",
+					got.rate, got.sample.name, got.stage, test.want.rate, test.want.sample.name, test.want.stage)
+			}
+			if got.reason == "" {
+				t.Errorf("no reason given")
+			}
+		})
+	}
+}
+
+func TestFindDevice(t *testing.T) {
+	devices := []audioDevice{
+		{name: "USB Microphone", channels: 0, rate: 48000},
+		{name: "bcm2835 HDMI 1", channels: 8, rate: 44100},
+		{name: "USB Audio DAC", channels: 2, rate: 96000},
+	}
+	tests := []struct {
+		selector string
+		want     int
+	}{
+		{"1", 1},
+		{"2", 2},
+		{"0", -1}, // input only
+		{"3", -1},
+		{"USB Audio DAC", 2},
+		{"usb audio dac", 2},
+		{"hdmi", 1},
+		{"usb", 2},
+		{"spdif", -1},
+	}
+	for _, test := range tests {
+		if got := findDevice(devices, test.selector); got != test.want {
+			t.Errorf("findDevice(%q) = %d, want %d", test.selector, got, test.want)
+		}
+	}
+}
+
+// TestOutputDevice plays songs on devices that do not take every format.
+func TestOutputDevice(t *testing.T) {
+	devices := []audioDevice{
+		{name: "bcm2835 HDMI 1", channels: 2, rate: 48000},
+		{name: "USB Audio DAC", channels: 2, rate: 96000},
+	}
+	monoRejected := func(device int, channels int, sampleRate float64, format sampleFormat) error {
+		if channels != 2 {
+			return errors.New("Invalid number of channels")
+		}
+		return nil
+	}
+	tests := []struct {
+		name    string
+		options []string
+		config  string // device in config.txt
+		rejects func(int, int, float64, sampleFormat) error
+		song    *fixture
+		rate    float64 // of the stream
+		device  int     // of the stream
+		// the samples played; nil: resampled, or not played if rate is 0
+		want func(fx *fixture) []int32
+	}{
+		{
+			name: "exact", song: newFlacFixture(1, 44100, 16, 0.1), rate: 44100,
+			want: func(fx *fixture) []int32 { return fx.sinkSamples() },
+		},
+		{
+			name: "rates match: resampler bypassed", options: []string{"resample=best"}, song: newFlacFixture(1, 96000, 24, 0.1), rate: 96000,
+			want: func(fx *fixture) []int32 { return fx.sinkSamples() },
+		},
+		{
+			name: "upsample", rejects: takes(anyBits, 48000, 88200), song: newFlacFixture(1, 44100, 16, 0.1), rate: 88200,
+		},
+		{
+			name: "resample", options: []string{"resample=fast"}, rejects: takes(anyBits, 48000), song: newFlacFixture(1, 44100, 24, 0.1), rate: 48000,
+		},
+		{
+			name: "resample=off", options: []string{"resample=off"}, rejects: takes(anyBits, 48000), song: newFlacFixture(1, 44100, 16, 0.1),
+		},
+		{
+			name: "24 bit on a 16 bit device", rejects: takes([]int{16}, 48000, 96000), song: newFlacFixture(1, 96000, 24, 0.1), rate: 96000,
+			want: func(fx *fixture) []int32 { return shifted(fx.samples, -8) },
+		},
+		{
+			name: "24 bit in 32", rejects: takesFormats(only(formatS24_32), 48000, 96000), song: newFlacFixture(1, 96000, 24, 0.1), rate: 96000,
+			want: func(fx *fixture) []int32 { return fx.samples },
+		},
+		{
+			name: "16 bit on a 32 bit device", rejects: takes([]int{32}, 48000, 44100), song: newFlacFixture(1, 44100, 16, 0.1), rate: 44100,
+			want: func(fx *fixture) []int32 { return shifted(fx.samples, 16) },
+		},
+		{
+			name: "device by name", options: []string{"device=usb"}, song: newFlacFixture(1, 44100, 16, 0.1), rate: 44100, device: 1,
+			want: func(fx *fixture) []int32 { return fx.sinkSamples() },
+		},
+		{
+			name: "device by index in config.txt", config: "1", song: newFlacFixture(1, 44100, 16, 0.1), rate: 44100, device: 1,
+			want: func(fx *fixture) []int32 { return fx.sinkSamples() },
+		},
+		{
+			name: "mapping line before config.txt", options: []string{"device=HDMI"}, config: "1", song: newFlacFixture(1, 44100, 16, 0.1), rate: 44100,
+			want: func(fx *fixture) []int32 { return fx.sinkSamples() },
+		},
+		{
+			name: "unknown device", options: []string{"device=spdif"}, song: newFlacFixture(1, 44100, 16, 0.1), rate: 44100,
+			want: func(fx *fixture) []int32 { return fx.sinkSamples() },
+		},
+		{
+			name: "no format: next song", rejects: monoRejected, song: monoFixture(newFlacFixture(1, 44100, 16, 0.1)),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configDevice = test.config
+			defer func() { configDevice = "" }()
+			next := newFlacFixture(2, 48000, 16, 0.1)
+			h := newHarness(t, false, append([]string{"mode=sequential", "repeat=once"}, test.options...), test.song, next)
+			defer h.remove()
+			h.out.devices = devices
+			h.out.rejects = test.rejects
+			h.shortPress(1)
+			h.waitState(stateIdle)
+			h.finish()
+
+			streams := h.out.streams
+			if test.rate == 0 {
+				if got := h.outcomes(test.song.name); len(got) != 1 || got[0] != playError {
+					t.Errorf("outcome %v, want %s", got, playError)
+				}
+				if !h.host.called("PrintStatus", "no output format for 44100 Hz on bcm2835 HDMI 1") {
+					t.Errorf("no output format not shown: %q", h.host.args("PrintStatus"))
+				}
+			} else {
+				if len(streams) == 0 {
+					t.Fatalf("song not played")
+				}
+				stream := streams[0]
+				if stream.device != test.device || stream.sampleRate != test.rate {
+					t.Errorf("played on device %d at %.0f Hz, want device %d at %.0f Hz",
+						stream.device, stream.sampleRate, test.device, test.rate)
+				}
+				if test.want != nil && !equalSamples(stream.samples, test.want(test.song)) {
+					t.Errorf("wrong samples")
+				}
+				if stream.oversized > 0 {
+					t.Errorf("%d writes larger than %d frames", stream.oversized, stream.framesPerBuffer)
+				}
+				if test.want == nil {
+					// all but the last half filter length of the song
+					frames := float64(len(stream.samples) / test.song.channels)
+					want := float64(test.song.frames) * test.rate / float64(test.song.rate)
+					if frames > want || frames < want-200 {
+						t.Errorf("%.0f frames resampled, want %.0f", frames, want)
+					}
+				}
+				streams = streams[1:]
+			}
+			if len(streams) != 1 || !equalSamples(streams[0].samples, shifted(next.samples, streams[0].format.bits-next.bits)) {
+				t.Errorf("next song not played")
+			}
+		})
+	}
+}
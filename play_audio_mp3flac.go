@@ -16,17 +16,15 @@ to implement a pause function.
 package main
 
 import (
-	"fmt"
 	"time"
 	"strings"
-	"math/rand"
+	"strconv"
 	"os"
-	"io"
 	"io/ioutil"
+	"bufio"
 	"sync"
-	"runtime"
+	"sync/atomic"
 
-	"github.com/gordonklaus/portaudio"
 	"github.com/dhowden/tag"
 	"github.com/bobertlo/go-mpg123/mpg123"
 	"github.com/mewkiz/flac"
@@ -38,15 +36,29 @@ import (
 
 const (
 	queueSize           = 50
+	maxExcludedInRow    = 5000	// excluded songs in a row before the folder loop gives up
 )
 
 var (
 	pluginname          = "play_audio_mp3flac"
 	logm                log.Logger
-	songsPlayedQueueMap map[string]*go_queue.Queue
-	instanceNumber      = 0
-	abortFolderShuffle  = false
-	waitingForOlderInstanceToStop = false
+	songsPlayedQueueMap map[string]*go_queue.Queue	// only touched by the one running session
+	startOnce           sync.Once
+
+	// config.txt settings
+	configShuffleSeed   int64 = 0	// fixed shuffle seed to reproduce a session; 0 = random
+	configSaveSeed      = false		// write the shuffle seed to homedir
+	configWriteRatings  = writeRatingsOff	// write ratings into the files: off, on or dryrun
+	configAsciiDisplay  = asciiDisplayOff	// transliterate the display string to ASCII: false, true or strict
+	configProgress      = progressOff		// where progress updates go: status, hostcmd, display or off
+	configProgressInterval = 10		// seconds between progress updates; 0 = none
+	configArtworkSize   = 480		// max. artwork width and height in pixels; 0 = no scaling
+	configArtworkQuality = 85		// JPEG quality of scaled artwork
+	configDevice        = ""		// audio output device: index or (part of the) name; "" = default device
+	configResample      = defaultResample	// resampler quality: fast, good, best or off
+	configVerify        = false		// compare what reaches the sink with the MD5 of each flac file
+	configCheckLoad     = defaultCheckLoad	// percent of the time a library check may decode
+	configCheckWindow   = ""		// nightly library check, e.g. "01:00-06:00"; "" = none
 )
 
 func init() {
@@ -56,20 +68,17 @@ func init() {
 /*
 Action() is the entry point for any TRemote plugin. We need to make sure 
 Action() will always return quickly. This is why we start new goroutines for 
-opertations that take more time. The first thing we want to do is to figure 
-out if we are coping with a short or a long press event.
+opertations that take more time. Button events are handed over to the player 
+goroutine (player.go), which figures out if we are coping with a short or a 
+long press event and owns all playback state.
 */
 func Action(log log.Logger, pid int, longpress bool, pressedDuration int64, homedir string, rcs *tremote_plugin.RemoteControlSpec, ph tremote_plugin.PluginHelper, wg *sync.WaitGroup) error {
-	logm = log
-	//logm.Debugf("%s Action() pid=%d",pluginname,pid)
-
-	var lock_Mutex	sync.Mutex
-	lock_Mutex.Lock()
-
-	if instanceNumber==0 {
+	startOnce.Do(func() {
+		logm = log
 		firstinstance(homedir)
-	}
-	instanceNumber++
+		player = newPlayer(playFolder, realClock{})
+	})
+	//logm.Debugf("%s Action() pid=%d",pluginname,pid)
 
 	ph.HostCmd("ScreenPower","on")
 
@@ -78,135 +87,52 @@ func Action(log log.Logger, pid int, longpress bool, pressedDuration int64, home
 		strArray = rcs.StrArraylong
 	}
 
-	// here we try to find out if this is a shortpress or longpress button event
-	if !longpress && pressedDuration==0 {
-		// button has just been pressed; is still pressed
-		go func() {
-			// let's see if this becomes a longpress if pressed for tremote_plugin.LongPressDelay ms
-			var msWaited time.Duration = 0
-			for msWaited < tremote_plugin.LongPressDelay {
-				time.Sleep(50 * time.Millisecond)
-				msWaited += 50
-				if (*ph.PLastPressActionDone)[pid] {
-					// button has been taken care of
-					break
-				}
-				if (*ph.PLastPressedMS)[pid] == 0 {
-					// button is no longer pressed
-					break
-				}
-				// button is still pressed
-			}
-			// time is up or button released or button taken care of
-
-			if (*ph.PLastPressedMS)[pid]>0 && !(*ph.PLastPressActionDone)[pid] {
-				// button is still pressed; job not yet taken care of; this is a longpress; let's take care of it
-				(*ph.PLastPressActionDone)[pid] = true
-				actioncall(true, pid, strArray, ph, wg)
-			} else {
-				//logm.Debugf("%s Action() job outdated",pluginname)
-			}
-		}()
-
-	} else {
-		// button has been released
-		if (*ph.PLastPressActionDone)[pid] {
-			// button event has already been taken care of
-			logm.Debugf("%s Action() button event has already been taken care of",pluginname)
-		} else {
-			// we need to take care of it here
-			(*ph.PLastPressActionDone)[pid] = true
-			//logm.Debugf("%s short press pid=%d %d",pluginname,pid,(*ph.PLastPressActionDone)[pid])
-			go func() {
-				actioncall(false, pid, strArray, ph, wg)
-			}()
-		}
-	}
-
-	lock_Mutex.Unlock()
+	// the player goroutine finds out if this is a shortpress or longpress button event
+	player.button(buttonEvent{pid: pid, longpress: longpress, pressedDuration: pressedDuration,
+		strArray: strArray, ph: ph, wg: wg})
 	return nil
 }
 
 func firstinstance(homedir string) {
 	// do things here that are supposed to execute on first call only
-	//readConfig(homedir)
+	readConfig(homedir)
+	songdb.load(homedir)
+	initScrobbleLog(homedir)
+	favoriteList.init(homedir)
+	banList.init(homedir)
+	checker.init(homedir)
+	if configCheckWindow!="" {
+		go scheduleChecks(configCheckWindow)
+	}
+
+	seedHomedir := ""
+	if configSaveSeed {
+		seedHomedir = homedir
+	}
+	initShuffle(configShuffleSeed, seedHomedir)
 }
 
 /*
-actioncall() is always called with a new goroutine, separate from the framework.
-Some of the libraries we use may panic; we catch this here in order to not bring 
-the framework down.
-Our next task is to stop any other music player that might be currently active.
+playFolder() is the body of a session, started by the player in a new goroutine 
+once any other music player has been stopped (see player.go).
 If longpress is set true, we skip back one song using songsPlayedQueue.Pop().
 If longpress is set to false, we start our main jukebox funktion and enter a 
-random song playback loop.
+random song playback loop. We return when the player closes s.quit, at the end 
+of the playlist or on a fatal error.
 */
-func actioncall(longpress bool, pid int, strArray []string, ph tremote_plugin.PluginHelper, wg *sync.WaitGroup) {
-	// why
-	var lock_Mutex	sync.Mutex
-	lock_Mutex.Lock()
-
-	// why
-	wg.Add(1)
-
-	// why
-	defer func() {
-		if err := recover(); err != nil {
-			wg.Done()
- 			logm.Errorf("%s panic=%s", pluginname, err)
-			buf := make([]byte, 1<<16)
-			runtime.Stack(buf, true)
- 			logm.Errorf("%s stack=\n%s", pluginname, buf)
-		}
-	}()
-
-	instance := instanceNumber
-
-	// set PIdLastPressed (only music playing plugins need to do this)
-	*ph.PIdLastPressed = pid
-	logm.Infof("%s (%d) actioncall longpress=%v arg=%s", pluginname, instance, longpress, strArray[0])
-
-	if waitingForOlderInstanceToStop {
-		// an older instance of this plugin is already waiting for an even older instance to stop (!)
-		// we likely have too many overlapping actioncall() instances: giving up on this new instance
-		logm.Warningf("%s (%d) exit on waitingForOlderInstanceToStop",pluginname,instance)
-		lock_Mutex.Unlock()
-		return
-	}
-
-	if *ph.StopAudioPlayerChan!=nil {
-		waitingForOlderInstanceToStop = true
-		logm.Debugf("%s (%d) stopping other instance...",pluginname,instance)
-		*ph.StopAudioPlayerChan <- true
-		time.Sleep(200 * time.Millisecond)
-	} else {
-		// No instance of our player is currently active. There may be some other audio playing instance.
-		// Stop whatever audio player may currently be active.
-		waitingForOlderInstanceToStop = true
-		logm.Debugf("%s (%d) on start no audio Plugin active -> StopCurrentAudioPlayback()",pluginname,instance)
-		ph.StopCurrentAudioPlayback()
-		time.Sleep(200 * time.Millisecond)
-	}
-
-	var ourStopAudioPlayerChan chan bool = nil
-	if *ph.StopAudioPlayerChan==nil {
-		// this allows parent to stop us
-		ourStopAudioPlayerChan = make(chan bool)
-		*ph.StopAudioPlayerChan = ourStopAudioPlayerChan
-	} else {
-		// should never happen
-		logm.Warningf("%s (%d) StopAudioPlayerChan!=nil",pluginname,instance)
-	}
-	if *ph.PauseAudioPlayerChan==nil {
-		// this allows parent to pause us
-		*ph.PauseAudioPlayerChan = make(chan bool)
-	} else {
-		// should never happen
-		logm.Warningf("%s (%d) PauseAudioPlayerChan!=nil",pluginname,instance)
-	}
-	waitingForOlderInstanceToStop = false
-	lock_Mutex.Unlock()
+func playFolder(s *session) {
+	ph := s.ph
+	instance := s.instance
+	longpress := s.longpress
+	strArray := s.strArray
 	folder := strArray[0]
+	options := parseMappingOptions(strArray[1:])
+	setActiveFolder(folder, options)
+	firstSong := !longpress		// a new short press skips ahead, even in repeat=one mode
+	excludedInRow := 0			// banned or non-favorite songs skipped by the folder loop
+	if mode, repeat := playModeFor(folder, options); mode!=modeShuffle || repeat!=repeatAll {
+		announcePlayMode(ph, mode, repeat)
+	}
 
 	songsPlayedQueue := songsPlayedQueueMap[folder]
 	if songsPlayedQueue==nil {
@@ -231,14 +157,14 @@ func actioncall(longpress bool, pid int, strArray []string, ph tremote_plugin.Pl
 			goto end
 		}
 
-		pathfile := folder + "/" + previousFile.Value
-		if playSong(previousFile.Value,pathfile,ph,instance,songsPlayedQueue) {
+		pathfile, track := resolveTrackRef(folder, previousFile.Value)
+		if playSong(previousFile.Value,pathfile,track,ph,s,songsPlayedQueue) {
 			logm.Debugf("%s (%d) done playSong step back - manually aborted",pluginname, instance)
 			goto end
 		}
-		if abortFolderShuffle {
+		if s.abort {
 			// possibly unexpected portaudioStream.Write() issue
-			logm.Debugf("%s (%d) done playSong step back - abortFolderShuffle",pluginname, instance)
+			logm.Debugf("%s (%d) done playSong step back - abort",pluginname, instance)
 			goto end
 		}
 		logm.Debugf("%s (%d) done playSong step back",pluginname, instance)
@@ -254,6 +180,7 @@ func actioncall(longpress bool, pid int, strArray []string, ph tremote_plugin.Pl
 	for {
 		fileName := ""
 		pathfile := ""
+		var track *cueTrack
 		fileArray, err := ioutil.ReadDir(folder) // []os.FileInfo
 		if err == nil {
 			logm.Debugf("%s (%d) start folder %s loop...",pluginname, instance, folder)
@@ -264,12 +191,62 @@ func actioncall(longpress bool, pid int, strArray []string, ph tremote_plugin.Pl
 				break
 			}
 
+			// mode and repeat may be changed at runtime; apply them to each new song
+			mode, repeat := playModeFor(folder, options)
+			if repeat==repeatOne && !firstSong {
+				fileName = lastPlayed(folder)
+			}
+			if fileName=="" {
+				switch mode {
+				case modeAlbum:
+					// next track of the current album, or first track of a random album
+					fileName = nextAlbumTrack(folder, fileArray, songsPlayedQueue)
+					takeCueContinue(folder)
+				case modeSequential, modeTracks:
+					fileName = nextSequentialTrack(folder, fileArray, mode, repeat, firstSong)
+					takeCueContinue(folder)
+					if fileName=="" {
+						logm.Infof("%s reached end of playlist",pluginname)
+						ph.PrintStatus("end of playlist")
+					}
+				default:
+					// continue with the next track of a single-file album (cue sheet)
+					fileName = takeCueContinue(folder)
+					if fileName!="" {
+						logm.Debugf("%s '%s' next cue track", pluginname, fileName)
+					}
+				}
+			}
+			if fileName!="" && excludedSong(folder, fileName, options) {
+				// banned, or not a favorite on a favorites=only line
+				logm.Debugf("%s '%s' excluded - skip", pluginname, fileName)
+				setLastPlayed(folder, fileName)
+				firstSong = true	// do not repeat it in repeat=one mode
+				excludedInRow++
+				if excludedInRow > maxExcludedInRow {
+					logm.Infof("%s found no song that is not excluded; giving up",pluginname)
+					ph.PrintStatus("no playable songs")
+					break
+				}
+				continue
+			}
+			excludedInRow = 0
+			if fileName=="" && (mode==modeSequential || mode==modeTracks) {
+				break
+			}
+
+			// banned songs and non-favorites are treated like songs played recently
+			playable := songFilter{queue: songsPlayedQueue, folder: folder, options: options}
+
 			// randomize order of files in fileArray / shuffle play
-			randomizeFileInfoArray(fileArray)
+			// (only if shuffle picks the song: spread and weighted read the tags of the whole folder)
+			if fileName=="" && mode==modeShuffle {
+				strategyFor(options).order(folder, fileArray, playable)
+			}
 
 			// find next mp3 or flac file that has not yet been played
 			i := 0
-			for {
+			for fileName=="" && mode==modeShuffle {
 				if i>=len(fileArray) {
 					logm.Infof("%s reached end of folder list",pluginname)
 					break
@@ -281,19 +258,24 @@ func actioncall(longpress bool, pid int, strArray []string, ph tremote_plugin.Pl
 					//logm.Debugf("%s '%s' is a directory - skip",pluginname, nextFile.Name())
 				} else if songsPlayedQueue != nil && songsPlayedQueue.InQueue(nextFile.Name()) {
 					logm.Debugf("%s '%s' found inQueue - skip", pluginname, nextFile.Name())
-				} else if strings.HasSuffix(nextFile.Name(),".flac") {
-					fileName = nextFile.Name()
-					logm.Debugf("%s '%s' flac", pluginname, fileName)
-					break
-				} else if strings.HasSuffix(nextFile.Name(),".mp3") {
-					fileName = nextFile.Name()
-					logm.Debugf("%s '%s' mp3", pluginname, fileName)
-					break
+				} else if isAudioFile(nextFile.Name()) {
+					// a file split by a cue sheet returns its first unplayed track
+					fileName = unplayedTrackRef(folder, nextFile.Name(), playable)
+					if fileName!="" {
+						logm.Debugf("%s '%s' selected", pluginname, fileName)
+						break
+					}
+					logm.Debugf("%s '%s' excluded or all cue tracks found inQueue - skip", pluginname, nextFile.Name())
 				}
 				i++
 			}
 
 			if fileName=="" {
+				if repeat==repeatOnce {
+					logm.Infof("%s found no unplayed song; repeat=once: stop",pluginname)
+					ph.PrintStatus("all songs played")
+					break
+				}
 				// if PopOldest() fails, do not continue
 				if songsPlayedQueue.PopOldest(false)!=nil {
 					logm.Infof("%s found no song; try again after removing oldes song from queue",pluginname)
@@ -305,23 +287,24 @@ func actioncall(longpress bool, pid int, strArray []string, ph tremote_plugin.Pl
 				break
 			}
 
-			pathfile = folder+"/"+fileName
+			pathfile, track = resolveTrackRef(folder, fileName)
 			logm.Debugf("%s pathfile=%s", pluginname, pathfile)
 
 		} else {
 			// arg is not a folder but a single file; play file; do not loop
 			fileName = folder
 			pathfile = fileName
-			abortFolderShuffle = true
+			s.abort = true
 		}
 		
-		if playSong(fileName,pathfile,ph,instance,songsPlayedQueue) {
+		firstSong = false
+		if playSong(fileName,pathfile,track,ph,s,songsPlayedQueue) {
 			logm.Debugf("%s (%d) done playSong - manually aborted",pluginname, instance)
 			break
 		}
-		if abortFolderShuffle {
+		if s.abort {
 			// single file playback -or- unexpected/fatal portaudioStream related issue
-			logm.Debugf("%s (%d) exit loop on abortFolderShuffle",pluginname, instance)
+			logm.Debugf("%s (%d) exit loop on abort",pluginname, instance)
 			break
 		}
 		
@@ -329,35 +312,16 @@ func actioncall(longpress bool, pid int, strArray []string, ph tremote_plugin.Pl
 	}
 
 end:
-	var lock_Mutex2	sync.Mutex
-	lock_Mutex2.Lock()
+	// the player takes back StopAudioPlayerChan and PauseAudioPlayerChan
+	songdb.save(true)	// plays and ratings of the last songSaveDelay
 	logm.Debugf("%s (%d) exit",pluginname, instance)
-	abortFolderShuffle = false
-	if *ph.StopAudioPlayerChan!=nil && *ph.StopAudioPlayerChan==ourStopAudioPlayerChan {
-		*ph.StopAudioPlayerChan = nil
-	} else {
-		// should never happen
-		if *ph.StopAudioPlayerChan==nil {
-			logm.Warningf("%s (%d) StopAudioPlayerChan was nil",pluginname, instance)
-		} else if *ph.StopAudioPlayerChan!=ourStopAudioPlayerChan {
-			logm.Warningf("%s (%d) StopAudioPlayerChan!=ourStopAudioPlayerChan",pluginname, instance)
-		} else {
-			logm.Warningf("%s (%d) what?",pluginname, instance)
-		}
-	}
-	if *ph.PauseAudioPlayerChan!=nil {
-		*ph.PauseAudioPlayerChan = nil
-	} else {
-		// should never happen
-		logm.Warningf("%s (%d) ph.PauseAudioPlayerChan was nil",pluginname, instance)
-	}
-	wg.Done()
-	lock_Mutex2.Unlock()
 }
 
-func playSong(fileName string, pathfile string, ph tremote_plugin.PluginHelper,
-		instance int, songsPlayedQueue *go_queue.Queue) bool {
+func playSong(fileName string, pathfile string, track *cueTrack, ph tremote_plugin.PluginHelper,
+		s *session, songsPlayedQueue *go_queue.Queue) bool {
 	// returns true if manually aborted or on fatal error
+	// if track is set, only the samples of this cue track are played
+	instance := s.instance
 	isMp3 := false
 	isFlac := false
 	if strings.HasSuffix(pathfile,".flac") {
@@ -381,36 +345,18 @@ func playSong(fileName string, pathfile string, ph tremote_plugin.PluginHelper,
 	}
 	defer r.Close()
 
-	m, err := tag.ReadFrom(r)
+	info := songInfo{file: fileName}	// display template fields
+	m, err := readTags(r)
 	if err != nil {
 		logm.Warningf("%s read tags err=%s", pluginname, err.Error())
 	} else {
-		// remove control and extended characters from title, artist, album
-		title  := stripCtlAndExtFromUTF8(m.Title())
-		artist := stripCtlAndExtFromUTF8(m.Artist())
-		album  := stripCtlAndExtFromUTF8(m.Album())
-		logm.Debugf("%s (%d) tags: [%s, %s, %s]", pluginname, instance, title, artist, album)
-
-		id3tags = title
-		if artist!="" {
-			if id3tags=="" {
-				id3tags = artist
-			} else {
-				id3tags = id3tags + " - " + artist
-			}
-		}
-		if album!="" {
-			if id3tags=="" {
-				id3tags = album
-			} else {
-				id3tags = id3tags + " - " + album
-			}
-		}
-		if id3tags == "" {
-			id3tags = fileName
-		}
-		logm.Infof("%s tag string: [%s]", pluginname, id3tags)
-		
+		info.title  = cleanTagText(m.Title())
+		info.artist = cleanTagText(m.Artist())
+		info.album  = cleanTagText(m.Album())
+		info.year   = m.Year()
+		info.track, info.tracks = m.Track()
+		logm.Debugf("%s (%d) tags: [%s, %s, %s]", pluginname, instance, info.title, info.artist, info.album)
+
 		id3_artwork = m.Picture()
 		if id3_artwork==nil {
 			logm.Infof("%s tag artwork: none", pluginname)
@@ -420,17 +366,71 @@ func playSong(fileName string, pathfile string, ph tremote_plugin.PluginHelper,
 		}
 	}
 
-	songsPlayedQueue.Push(&go_queue.Node{fileName})
+	if track!=nil {
+		// the cue sheet knows better than the tags of the whole album file
+		info.title = cleanTagText(track.title)
+		info.track = track.number
+		info.tracks = len(loadCueTracks(pathfile))
+		if track.performer!="" {
+			info.artist = cleanTagText(track.performer)
+		}
+		if track.album!="" {
+			info.album = cleanTagText(track.album)
+		}
+		logm.Debugf("%s (%d) cue track %d: [%s, %s, %s] samples %d-%d", pluginname, instance,
+			track.number, info.title, info.artist, info.album, track.start, track.end)
+	}
+
+	// the final display string is rendered once the audio format is known
+	id3tags = info.display(defaultDisplayTemplate)
+	logm.Infof("%s tag string: [%s]", pluginname, id3tags)
+
+	songsPlayedQueue.Push(&go_queue.Node{Value: fileName})
 	logm.Debugf("%s (%d) start player thread...", pluginname,instance)
 
+	// statistics: record this play with its outcome on return
+	startTime := time.Now()
+	var samplesPlayed uint64	// inter-channel samples written to portaudio
+	var totalSamples uint64		// length of the song (track) in inter-channel samples; 0 = unknown
+	var scannedSamples uint64	// exact length of an mp3 file, set by a background scan
 	var sampleRate int64
+	var reachedEnd = false
+	var quitPlayback = false
+	var banned = false
+	outcome := playStopped
+	songKeyPlaying := songKey(pathfile, track)
+	setCurrentSong(songKeyPlaying, id3tags)
+	defer func() {
+		clearCurrentSong(songKeyPlaying)
+		if !quitPlayback {
+			if banned {
+				outcome = playBanned
+			} else if reachedEnd {
+				outcome = playFinished
+			} else {
+				outcome = playError
+			}
+		}
+		seconds := 0.0
+		if sampleRate>0 {
+			seconds = float64(samplesPlayed)/float64(sampleRate)
+		}
+		duration := 0.0
+		if sampleRate>0 {
+			duration = float64(totalSamples)/float64(sampleRate)
+		}
+		songdb.recordPlay(songKeyPlaying, startTime, seconds, duration, outcome)
+		scrobble(scrobbleEntry{artist: info.artist, album: info.album, title: info.title, track: info.track,
+			duration: duration, heard: seconds, start: startTime})
+	}()
+
 	var channels int
 	var bitsPerSample int
 	var bytesPerSample int
 	var mp3decoder *mpg123.Decoder
 	var flacstream *flac.Stream
-	var framesPerBuffer int		// determines the size of the decode buffer (mp3-only; flac sets this itself)
-	var outbufElements int		// number of outbuf elements, based on size of decoded block
+	var flacframes *flacFrames
+	var samplePos uint64		// inter-channel sample position in the file of the next decoded sample
 
 	if isMp3 {
 		// create mpg123 mp3decoder instance
@@ -456,10 +456,29 @@ func playSong(fileName string, pathfile string, ph tremote_plugin.PluginHelper,
 		bitsPerSample  = 16
 		bytesPerSample = bitsPerSample/8
 		logm.Infof("%s mpg123 sampleRate=%d channels=%d", pluginname, sampleRate, channels)
+		if sampleRate<=0 || channels<1 || channels>2 {
+			// no mpeg frame found, or nothing we can play
+			logm.Warningf("%s unsupported mp3 format sampleRate=%d channels=%d",pluginname, sampleRate, channels)
+			ph.PrintStatus("unsupported mp3 format")
+			ph.PrintInfo("")
+			return false
+		}
 
-		if sampleRate>44100 || bitsPerSample>16 {
-			info := fmt.Sprintf("%d %d",bitsPerSample,sampleRate)
-			ph.PrintStatus(info)
+
+		if samples, rate, exact, err := mp3Length(pathfile); err != nil {
+			logm.Debugf("%s mp3 length unknown err=%s", pluginname, err.Error())
+		} else if int64(rate)==sampleRate {
+			totalSamples = samples
+			if !exact && configProgress!=progressOff && configProgressInterval>0 {
+				// estimated from the bitrate: count the frames while the song plays
+				scanStop := make(chan struct{})
+				defer close(scanStop)
+				go func() {
+					if samples, err := mp3ScanLength(pathfile, scanStop); err==nil {
+						atomic.StoreUint64(&scannedSamples, samples)
+					}
+				}()
+			}
 		}
 
 		// make sure output format does not change
@@ -468,228 +487,288 @@ func playSong(fileName string, pathfile string, ph tremote_plugin.PluginHelper,
 
 	} else if isFlac {
 		// create flac decoder instance
-		flacstream, err = flac.Open(pathfile)
+		flacfile, err := os.Open(pathfile)
+		if err != nil {
+			logm.Warningf("%s error open flac file err=%s",pluginname, err.Error())
+			ph.PrintStatus("error open flac file %s"+err.Error())
+			ph.PrintInfo("")
+			return false
+		}
+		defer flacfile.Close()
+		flacstream, err = openFlacStream(flacfile)
 		if err != nil {
 			logm.Warningf("%s error open flac file err=%s",pluginname, err.Error())
 			ph.PrintStatus("error open flac file %s"+err.Error())
 			ph.PrintInfo("")
 			return false
 		}
-		defer flacstream.Close()
 
 		channels       = int(flacstream.Info.NChannels)
 		sampleRate     = int64(flacstream.Info.SampleRate)
 		bitsPerSample  = int(flacstream.Info.BitsPerSample)
 		bytesPerSample = bitsPerSample/8
+		totalSamples   = flacstream.Info.NSamples
 		logm.Infof("%s flac sampleRate=%d channels=%d bps=%d Bps=%d", 
 			pluginname, sampleRate, channels, bitsPerSample, bytesPerSample)
+		if sampleRate<=0 || channels<1 || channels>2 || (bitsPerSample!=16 && bitsPerSample!=24) {
+			logm.Warningf("%s unsupported flac format",pluginname)
+			ph.PrintStatus("unsupported flac format")
+			ph.PrintInfo("")
+			return false
+		}
 
-		if sampleRate>44100 || bitsPerSample>16 {
-			info := fmt.Sprintf("%d %d",bitsPerSample,sampleRate)
-			ph.PrintStatus(info)
+		// frames are read by flacFrames, which skips damaged ones
+		frameOffset, err := flacAudioOffset(flacfile)
+		if err != nil {
+			logm.Warningf("%s error open flac file err=%s",pluginname, err.Error())
+			ph.PrintStatus("error open flac file %s"+err.Error())
+			ph.PrintInfo("")
+			return false
+		}
+		if track!=nil && track.start>0 {
+			// jump close to the start of the cue track; the rest is decoded and skipped
+			offset, frameSample, err := flacSeek(flacfile, flacstream.Info, track.start)
+			if err != nil {
+				logm.Warningf("%s flac seek to %d err=%s; decoding from start",pluginname, track.start, err.Error())
+			} else {
+				logm.Debugf("%s flac seek to %d found frame at %d",pluginname, track.start, frameSample)
+				frameOffset = offset
+				samplePos = frameSample
+			}
+		}
+		flacframes, err = newFlacFrames(flacfile, flacstream.Info, frameOffset)
+		if err != nil {
+			logm.Warningf("%s error open flac file err=%s",pluginname, err.Error())
+			ph.PrintStatus("error open flac file %s"+err.Error())
+			ph.PrintInfo("")
+			return false
 		}
 	}
 
+	totalSamples = trackSamples(track, totalSamples)
+
+	// the output device may not take the format of the song: ask it and fall back
+	logm.Debugf("%s (%d) portaudio.Initialize()", pluginname,instance)
+	output.Initialize()
+	defer output.Terminate()
+	resampleSetting := resampleMode()
+	format, err := chooseOutput(channels, int(sampleRate), bitsPerSample, resampleSetting!=resampleOff)
+	if err==errNoOutputFormat {
+		// skip to next song
+		logm.Warningf("%s device %d [%s]: %s", pluginname, format.device, format.name, format.reason)
+		ph.PrintStatus("no output format for "+strconv.FormatInt(sampleRate,10)+" Hz on "+format.name)
+		ph.PrintInfo("")
+		return false
+	}
+	if err != nil {
+		logm.Warningf("%s error choosing audio output err=%s",pluginname, err.Error())
+		ph.PrintStatus("error choosing audio output: "+err.Error())
+		s.abort = true
+		return false
+	}
+	logm.Infof("%s (%d) output device %d [%s] %d Hz %s: %s, %s", pluginname, instance,
+		format.device, format.name, format.rate, format.sample.name, format.stage, format.reason)
+
+	info.bits = bitsPerSample
+	info.rate = sampleRate
+	if isFlac {
+		info.format = "FLAC"
+	} else {
+		info.format = "MP3"
+	}
+	if sampleRate>0 {
+		info.duration = float64(totalSamples)/float64(sampleRate)
+	}
+	displayTemplate, statusTemplate := displayTemplates()
+	id3tags = info.display(displayTemplate)
+	if status := info.render(statusTemplate); status!="" {
+		// e.g. "24 96000" for hi-res files
+		ph.PrintStatus(status)
+	}
+
 	// send id3 tags
 	ph.PrintInfo(id3tags)
+	progressInterval := time.Duration(configProgressInterval) * time.Second
+	lastProgress := time.Now()
+
+	// lyrics are timed against samplesPlayed (not for cue tracks: they belong to the whole file)
+	lyricsSetting := lyricsMode()
+	var songLyrics lyrics
+	lyricIdx := -1
+	if lyricsSetting!=lyricsOff && track==nil {
+		songLyrics = loadLyrics(pathfile, m, info.duration)
+		logm.Debugf("%s (%d) %d lyric lines", pluginname, instance, len(songLyrics))
+	}
 
 	// send artwork
-	if id3_artwork!=nil && len(id3_artwork.Data)>0 {
-		ph.ImageInfo(id3_artwork.Data,id3_artwork.MIMEType)
-	} else {
-		ph.ImageInfo(nil,"")
+	// embedded picture or cover file, scaled down; may take a moment for a large scan
+	var picData []byte
+	var picMime string
+	if id3_artwork!=nil {
+		picData, picMime = id3_artwork.Data, id3_artwork.MIMEType
 	}
+	go func() {
+		stillPlaying := func() bool {
+			key, _ := currentSong()
+			return key==songKeyPlaying
+		}
+		data, mimeType := songArtwork(pathfile, picData, picMime, stillPlaying)
+		if stillPlaying() {
+			ph.ImageInfo(data, mimeType)
+		}
+	}()
 
-	logm.Debugf("%s (%d) portaudio.Initialize()", pluginname,instance)
-	portaudio.Initialize()
-	defer portaudio.Terminate()
+	// decode ahead: a decoder goroutine fills the ring, the loop below drains it into the audio sink
+	// chunk: samples per write; a flac block or 4096 mp3 frames
+	chunk := 4096 * channels
+	if isFlac && flacstream.Info.BlockSizeMax>0 {
+		chunk = int(flacstream.Info.BlockSizeMax) * channels
+	}
+	ring := newSampleRing(ringSeconds, int(sampleRate)*channels, 2*chunk)
+	decoder := newSongDecoder(ring, channels, track, samplePos)
+	if isMp3 {
+		decoder.mp3decoder = newMp3Source(mp3decoder)
+	}
+	decoder.flacframes = flacframes
+	go decoder.run()
+	// runs before the decoders and files are closed
+	defer decoder.close()
+	setPlayingRing(ring)
+	defer setPlayingRing(nil)
 
 	// pump audio out
 	logm.Debugf("%s (%d) pump audio out...", pluginname,instance)
-	var playbackPaused = false
 	var framecount     = 0
-	var portaudioStream *portaudio.Stream
-	var outbuf16 []int16 = nil
-	var outbuf32 []int32 = nil
-	var quitPlayback = false
+	var portaudioStream audioStream
+	quality, _ := findResampleQuality(resampleSetting)
+	var chain = newSinkChain(format, channels, int(sampleRate), bitsPerSample, chunk, quality)
+	if resampled := chain.resampled; resampled!=nil {
+		logm.Infof("%s (%d) resample %d to %d Hz, quality %s (%d taps, %d phases)", pluginname, instance,
+			sampleRate, format.rate, quality.name, resampled.taps, resampled.phases)
+	}
+	if configVerify && isFlac && track==nil {
+		// whole flac files are compared with their MD5 once played to the end
+		chain.verify = newSinkVerifier(bitsPerSample)
+	}
+	var samples = make([]int32, chunk)
+	var starving = false		// the ring ran empty; counted once until it has a chunk again
+	var underruns = 0
+	var minFill = 100
 	for {
-		if playbackPaused {
+		if s.paused {
 			//logm.Debugf("%s playbackPaused", pluginname)
 			time.Sleep(500 * time.Millisecond)
 
+		} else if ring.buffered()<chunk && !decoder.finished() {
+			// decoder behind: wait for it (pause requests are taken below)
+			if portaudioStream!=nil && !starving {
+				starving = true
+				underruns++
+				atomic.AddUint64(&bufferStats.underruns, 1)
+				logm.Warningf("%s (%d) buffer underrun at sample %d",pluginname, instance, samplesPlayed)
+			}
+			select {
+			case <-ring.data:
+			case <-decoder.done:
+			case <-s.quit:
+			case <-time.After(100 * time.Millisecond):
+			}
+
 		} else {
-			var j = 0
-			if isMp3 {
-				// copy mp3 data -> audio -> portaudio out in chunks of 16KB
-				framesPerBuffer = 4096 * channels	// samples per buffer for two channels
-				audioBuf := make([]byte, framesPerBuffer * bytesPerSample)
-				var count int
-				count, err = mp3decoder.Read(audioBuf)
-				if err == mpg123.EOF {
-					err = nil
-					break
+			starving = false
+			if portaudioStream!=nil {
+				if fill := ring.fill(); fill<minFill {
+					minFill = fill
 				}
-				if err != nil {
-					logm.Warningf("%s error reading audio source err=%s",pluginname, err.Error())
+			}
+			j := ring.get(samples)
+			if j==0 {
+				// all decoded samples played
+				if decoder.err != nil {
+					// damaged flac frames and failed mp3 reads have been skipped already; this is fatal
+					// (truncated file, error budget used up): skip to next song
+					logm.Warningf("%s error reading audio source err=%s",pluginname, decoder.err.Error())
 					ph.PrintStatus("error reading audio source")
-					// skip to next song
-					break
-				}
-
-				if outbuf16 == nil {
-					outbufElements = count //* channels
-					logm.Debugf("%s audioBuf len=%dbytes read count=%dbytes", pluginname, len(audioBuf), count)
-
-					outbuf16 = make([]int16, framesPerBuffer)				// always assuming 16 bit from mp3
-					logm.Debugf("%s framesPerBuffer=%d len(outbuf16)=%delements", 
-						pluginname, framesPerBuffer, len(outbuf16))
-					portaudioStream, err = 
-						portaudio.OpenDefaultStream(0, channels, float64(sampleRate), framesPerBuffer, &outbuf16)
-					if err != nil {
-						// "Invalid sample rate"
-						logm.Warningf("%s error open audio sink for playback err=%s",pluginname, err.Error())
-						ph.PrintStatus("error open audio sink for playback: "+err.Error())
-						abortFolderShuffle = true
-						break
-					}
-					defer portaudioStream.Close()
-
-					err = portaudioStream.Start()
-					if err != nil {
-						logm.Warningf("%s error starting audio playback err=%s",pluginname, err.Error())
-						ph.PrintStatus("error starting audio playback: "+err.Error())
-						abortFolderShuffle = true
-						break
-					}
-					defer portaudioStream.Stop()
-
-					ph.HostCmd("AudioMute","off")
+				} else {
+					logm.Debugf("%s EOF",pluginname)
+					reachedEnd = decoder.reachedEnd
 				}
+				break
+			}
 
-				j = 0
-				for i := 0; i < count; i+=2 {
-					if j<framesPerBuffer {
-						outbuf16[j] = int16(audioBuf[i+1])<<8 | int16(audioBuf[i])
-						j++
-					}
+			if portaudioStream==nil {
+				logm.Debugf("%s chunk=%d bits=%d channels=%d",pluginname, chunk, bitsPerSample, channels)
+				portaudioStream, err = chain.sink.open(format.device, channels, float64(format.rate))
+				if err != nil {
+					// the format was accepted by the device: it is gone, or busy
+					logm.Warningf("%s error open audio sink for playback err=%s",pluginname, err.Error())
+					ph.PrintStatus("error open audio sink for playback: "+err.Error())
+					s.abort = true
+					break
 				}
+				defer portaudioStream.Close()
 
-			} else {
-				// flac
-				frame, err := flacstream.ParseNext()
+				err = portaudioStream.Start()
 				if err != nil {
-					// "invalid sync-code"
-					if err == io.EOF {
-						logm.Debugf("%s EOF",pluginname)
-						break
-					}
-
-					logm.Warningf("%s error flacstream.ParseNext() err=%s",pluginname, err.Error())
-					if strings.Index(err.Error(),"invalid sync-code")>=0 {
-						//logm.Debug("%s continue on 'invalid sync-code'",pluginname)
-					} else {
-						break
-					}
+					logm.Warningf("%s error starting audio playback err=%s",pluginname, err.Error())
+					ph.PrintStatus("error starting audio playback: "+err.Error())
+					s.abort = true
+					break
 				}
+				defer portaudioStream.Stop()
 
-				if (bytesPerSample==2 && outbuf16==nil) || (bytesPerSample==3 && outbuf32==nil) {
-					outbufElements = int(frame.BlockSize) * channels
-					if bytesPerSample==2 {
-						outbuf16 = make([]int16, outbufElements)
-						logm.Debugf("%s frame.BlockSize=%d outbufElements=%d len(outbuf16)=%d channels=%d",
-							pluginname, frame.BlockSize, outbufElements, len(outbuf16), channels)
-						portaudioStream, err = 
-							portaudio.OpenDefaultStream(0, channels, float64(sampleRate), outbufElements, &outbuf16)
-					} else if bytesPerSample==3 {
-						outbuf32 = make([]int32, outbufElements)
-						logm.Debugf("%s frame.BlockSize=%d outbufElements=%d len(outbuf32)=%d channels=%d",
-							pluginname, frame.BlockSize, outbufElements, len(outbuf32), channels)
-						// NOTE: for some reason I need outbufElements+100 on AMD64
-						portaudioStream, err = 
-							portaudio.OpenDefaultStream(0, channels, float64(sampleRate), outbufElements+100, &outbuf32)
-					}
-
-					if err != nil {
-						logm.Warningf("%s error open audio sink for playback err=%s",pluginname, err.Error())
-						ph.PrintStatus("error open audio sink for playback: "+err.Error())
-						abortFolderShuffle = true
-						break
-					}
-					defer portaudioStream.Close()
+				ph.HostCmd("AudioMute","off")
+			}
 
-					err = portaudioStream.Start()
-					if err != nil {
-						logm.Warningf("%s error starting audio playback err=%s",pluginname, err.Error())
-						ph.PrintStatus("error starting audio playback: "+err.Error())
-						portaudioStream.Close()
-						abortFolderShuffle = true
-						break
-					}
-					defer portaudioStream.Stop()
+			chain.set(samples[:j])
 
-					ph.HostCmd("AudioMute","off")
+			framecount++
+			//logm.Debugf("%s j=%d framecount=%d",pluginname, j,framecount)
+			samplesPlayed += uint64(j/channels)
+			if songLyrics!=nil {
+				if idx := songLyrics.lineAt(float64(samplesPlayed)/float64(sampleRate)); idx!=lyricIdx && idx>=0 {
+					lyricIdx = idx
+					sendLyric(ph, lyricsSetting, songLyrics[idx].text, id3tags)
 				}
-
-				//logm.Debugf("%s frame.BlockSize=%d %d",pluginname, frame.BlockSize,len(frame.Subframes))
-				if len(frame.Subframes) < channels {
-					logm.Warningf("%s len(frame.Subframes)=%d",pluginname, len(frame.Subframes))
-				} else {
-					if len(frame.Subframes[0].Samples) < int(frame.BlockSize) {
-						logm.Warningf("%s incomplete frame.Subframes[0].Samples < frame.BlockSize",pluginname)
-					} else if len(frame.Subframes[1].Samples) < int(frame.BlockSize) {
-						logm.Warningf("%s incomplete frame.Subframes[1].Samples < frame.BlockSize",pluginname)
-					} else {
-						j = 0
-						if bytesPerSample==2 {
-							for i:=0; i < int(frame.BlockSize); i++ {
-								if j<outbufElements {
-									outbuf16[j] = int16(frame.Subframes[0].Samples[i]); j++
-									if j<outbufElements {
-										outbuf16[j] = int16(frame.Subframes[1].Samples[i]); j++
-									}
-								}
-							}
-						} else {
-							for i:=0; i < int(frame.BlockSize); i++ {
-								if j<outbufElements {
-									outbuf32[j]=frame.Subframes[0].Samples[i]<<8; j++
-									if j<outbufElements {
-										outbuf32[j]=frame.Subframes[1].Samples[i]<<8; j++
-									}
-								}
-							}
-						}
-
-						//logm.Debugf("forward outbufElements=%d/%d frame.BlockSize=%d",outbufElements,j,frame.BlockSize)
-					}
+			}
+			if progressInterval>0 && configProgress!=progressOff && time.Since(lastProgress)>=progressInterval {
+				lastProgress = time.Now()
+				if samples := atomic.SwapUint64(&scannedSamples, 0); samples>0 {
+					totalSamples = trackSamples(track, samples)
+					info.duration = float64(totalSamples)/float64(sampleRate)
 				}
+				info.elapsed = float64(samplesPlayed)/float64(sampleRate)
+				info.sendProgress(ph, displayTemplate)
 			}
-
-			framecount++
-			//logm.Debugf("%s j=%d framecount=%d",pluginname, j,framecount)
 			err = portaudioStream.Write()
 			if err != nil {
 				logm.Warningf("%s error writing audio data err=%s",pluginname, err.Error())
 				// do not abort playback on "Output underflowed"
 				if err.Error()!="Output underflowed" {
-					abortFolderShuffle = true
+					s.abort = true
 					ph.PrintStatus("error writing audio data: "+err.Error())
 					break
 				}
+				atomic.AddUint64(&bufferStats.underflows, 1)
 			}
 		}
 
 		select {
-		case <-*ph.StopAudioPlayerChan:
-			// we are being aborted by Stop_current_stream()
-			logm.Debugf("%s (%d) stopped by StopAudioPlayerChan",pluginname, instance)
+		case <-s.quit:
+			// we are being aborted by the player: skip, step back or Stop_current_stream()
+			logm.Debugf("%s (%d) stopped by player (%s)",pluginname, instance, s.stopReason)
+			outcome = s.stopReason
 			//ph.HostCmd("AudioMute","on")
-			abortFolderShuffle = true
+			s.abort = true
 			quitPlayback = true
-		case <-*ph.PauseAudioPlayerChan:
-			playbackPaused = !playbackPaused
-			logm.Debugf("%s (%d) pausemode set to %v",pluginname, instance, playbackPaused)
-			if playbackPaused {
+		case s.paused = <-s.pause:
+			// the pause state stays with the session; a song skipped while paused starts paused
+			logm.Debugf("%s (%d) pausemode set to %v",pluginname, instance, s.paused)
+			if sampleRate>0 {
+				info.elapsed = float64(samplesPlayed)/float64(sampleRate)
+			}
+			id3tags = info.display(displayTemplate)
+			if s.paused {
 				ph.PrintInfo(id3tags+" - paused")
 			} else {
 				ph.PrintInfo(id3tags)
@@ -702,46 +781,60 @@ func playSong(fileName string, pathfile string, ph tremote_plugin.PluginHelper,
 			logm.Debugf("%s (%d) quitPlayback",pluginname, instance)
 			break
 		}
+		if takeSkipRequest() {
+			// current song was banned
+			logm.Debugf("%s (%d) skip requested",pluginname, instance)
+			banned = true
+			break
+		}
 	}
 
 	logm.Debugf("%s (%d) singleSongPlayback finished (framecount=%d)",pluginname, instance,framecount)
+	logm.Infof("%s (%d) buffer %.1fs, lowest fill %d%%, underruns %d",
+		pluginname, instance, ring.seconds(), minFill, underruns)
+	if chain.verify!=nil && reachedEnd {
+		report := chain.report(fileName, flacstream.Info, flacframes.errors)
+		if report.bitPerfect {
+			logm.Infof("%s (%d) verify %s", pluginname, instance, report)
+		} else {
+			logm.Warningf("%s (%d) verify %s", pluginname, instance, report)
+			ph.PrintStatus(report.String())
+		}
+	}
 	//ph.PrintInfo("")	// note: in case of inloop error, this may clear out the error-msg
 	return quitPlayback
 }
 
-// for removing control and extended characters from id3tags (see: The Wanton Song - Led Zep)
-// https://rosettacode.org/wiki/Strip_control_codes_and_extended_characters_from_a_string#Go
-func stripCtlAndExtFromUTF8(str string) string {
-	return strings.Map(func(r rune) rune {
-		if r >= 32 && r < 127 {
-			return r
-		}
-		return -1
-	}, str)
+// isAudioFile returns true for the file types we can play
+func isAudioFile(name string) bool {
+	return strings.HasSuffix(name,".flac") || strings.HasSuffix(name,".mp3")
 }
 
-func randomizeFileInfoArray(fileArray []os.FileInfo) {
-	entries := len(fileArray)
-	//logm.Infof("mapping randomizeListStrings: entries %d",entries)
-	for i := 0; i < len(fileArray); i++ {
-		swp1 := i //rand.Intn(entries)
-
-		// swp2 may not be == swp1
-		var swp2 int
-		for {
-			swp2 = rand.Intn(entries)
-			if swp2 != swp1 {
-				break
-			}
+/*
+parseMappingOptions parses the key=value tokens following the folder on a
+mapping line, e.g. "play_audio|/media/sda1/Music/Jazz|shuffle=album".
+*/
+func parseMappingOptions(tokens []string) map[string]string {
+	options := make(map[string]string)
+	for _, token := range tokens {
+		linetokens := strings.SplitN(token, "=", 2)
+		key := strings.ToLower(strings.TrimSpace(linetokens[0]))
+		if key == "" {
+			continue
 		}
-
-		swpEntry := fileArray[swp1]
-		fileArray[swp1] = fileArray[swp2]
-		fileArray[swp2] = swpEntry
+		value := ""
+		if len(linetokens) >= 2 {
+			value = strings.TrimSpace(linetokens[1])
+		}
+		options[key] = value
 	}
+	return options
 }
 
 /*
+readConfig reads our settings from config.txt in homedir. Lines look like
+"key = value"; everything after # is a comment. Unknown keys are ignored.
+*/
 func readConfig(path string) int {
 	pathfile := "config.txt"
 	if len(path)>0 { pathfile = path + "/config.txt" }
@@ -777,14 +870,91 @@ func readConfig(path string) int {
 				linecount++
 
 				switch key {
-				case "audiocontrol":
+				case "shuffleseed":
+					logm.Debugf("readConfig key=[%s] val=[%s]", key, value)
+					seed, err := strconv.ParseInt(value, 10, 64)
+					if err != nil {
+						logm.Warningf("readConfig key=[%s] val=[%s] err=%s", key, value, err.Error())
+					} else {
+						configShuffleSeed = seed
+					}
+				case "saveseed":
+					logm.Debugf("readConfig key=[%s] val=[%s]", key, value)
+					configSaveSeed = value=="true"
+				case "asciidisplay":
+					logm.Debugf("readConfig key=[%s] val=[%s]", key, value)
+					switch value {
+					case asciiDisplayOff, asciiDisplayOn, asciiDisplayStrict:
+						configAsciiDisplay = value
+					default:
+						logm.Warningf("readConfig key=[%s] val=[%s] must be false, true or strict", key, value)
+					}
+				case "progress":
 					logm.Debugf("readConfig key=[%s] val=[%s]", key, value)
-					AudioControl = value
+					switch value {
+					case progressOff, progressStatus, progressHostCmd, progressDisplay:
+						configProgress = value
+					default:
+						logm.Warningf("readConfig key=[%s] val=[%s] must be status, hostcmd, display or off", key, value)
+					}
+				case "progressinterval":
+					logm.Debugf("readConfig key=[%s] val=[%s]", key, value)
+					interval, err := strconv.Atoi(value)
+					if err != nil || interval < 0 {
+						logm.Warningf("readConfig key=[%s] val=[%s] must be seconds >= 0", key, value)
+					} else {
+						configProgressInterval = interval
+					}
+				case "artworksize", "artworkquality":
+					logm.Debugf("readConfig key=[%s] val=[%s]", key, value)
+					i, err := strconv.Atoi(value)
+					if err != nil || i < 0 || key=="artworkquality" && (i < 1 || i > 100) {
+						logm.Warningf("readConfig key=[%s] val=[%s] invalid", key, value)
+					} else if key=="artworksize" {
+						configArtworkSize = i
+					} else {
+						configArtworkQuality = i
+					}
+				case "device":
+					logm.Debugf("readConfig key=[%s] val=[%s]", key, value)
+					configDevice = value
+				case "resample":
+					logm.Debugf("readConfig key=[%s] val=[%s]", key, value)
+					if _, ok := findResampleQuality(value); ok || value==resampleOff {
+						configResample = value
+					} else {
+						logm.Warningf("readConfig key=[%s] val=[%s] must be fast, good, best or off", key, value)
+					}
+				case "verify":
+					logm.Debugf("readConfig key=[%s] val=[%s]", key, value)
+					configVerify = value=="true"
+				case "checkload":
+					logm.Debugf("readConfig key=[%s] val=[%s]", key, value)
+					load, err := strconv.Atoi(value)
+					if err != nil || load < 1 || load > 100 {
+						logm.Warningf("readConfig key=[%s] val=[%s] must be percent 1..100", key, value)
+					} else {
+						configCheckLoad = load
+					}
+				case "checkwindow":
+					logm.Debugf("readConfig key=[%s] val=[%s]", key, value)
+					if _, _, err := parseCheckWindow(value); err != nil {
+						logm.Warningf("readConfig key=[%s] val=[%s] %s", key, value, err.Error())
+					} else {
+						configCheckWindow = value
+					}
+				case "writeratings":
+					logm.Debugf("readConfig key=[%s] val=[%s]", key, value)
+					switch value {
+					case writeRatingsOff, writeRatingsOn, writeRatingsDryRun:
+						configWriteRatings = value
+					default:
+						logm.Warningf("readConfig key=[%s] val=[%s] must be off, on or dryrun", key, value)
+					}
 				}
 			}
 		}
 	}
 	return linecount
 }
-*/
 
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mehrvarz/tremote_plugin"
+)
+
+// step is one thing a playback test does: press a button, let the audio
+// output take samples, wait for something.
+type step func(h *harness)
+
+func shortPress(pid int) step { return func(h *harness) { h.shortPress(pid) } }
+func longPress(pid int) step  { return func(h *harness) { h.longPress(pid) } }
+func hostPause() step         { return func(h *harness) { h.hostPause() } }
+func hostStop() step          { return func(h *harness) { h.hostStop() } }
+func allow(n int) step        { return func(h *harness) { h.out.allow(n) } }
+func unlimited() step         { return func(h *harness) { h.out.unlimited() } }
+func waitWrites(n int) step   { return func(h *harness) { h.waitWrites(n) } }
+
+// command runs a plugin command, e.g. cmdBan, as the host would.
+func command(cmd func([]string, tremote_plugin.PluginHelper)) step {
+	return func(h *harness) { cmd(nil, h.host.ph) }
+}
+
+func waitState(state playerState) step {
+	return func(h *harness) { h.waitState(state) }
+}
+
+// allowSong lets a whole song through.
+func allowSong(name string) step {
+	return func(h *harness) { h.out.allow(h.writesFor(h.fixture(name))) }
+}
+
+// stillWrites checks that there are n writes, and no more arrive within d.
+func stillWrites(n int, d time.Duration) step {
+	return func(h *harness) {
+		time.Sleep(d)
+		if writes := h.out.writeCount(); writes != n {
+			h.t.Errorf("%d writes, want %d", writes, n)
+		}
+	}
+}
+
+// rapidPresses presses button pid n times, short and long presses mixed,
+// without waiting for anything in between.
+func rapidPresses(pid int, n int) step {
+	return func(h *harness) {
+		for i := 0; i < n; i++ {
+			h.press(pid)
+			if i%3 == 2 {
+				h.clock.fire(h.t, tremote_plugin.LongPressDelay*time.Millisecond)
+			}
+			h.release(pid)
+			if h.status().state == stateStarting {
+				h.clock.Advance(stopOthersDelay)
+			}
+		}
+	}
+}
+
+func TestPlayback(t *testing.T) {
+	tests := []struct {
+		name  string
+		gated bool // writes are held back until allowed
+		steps []step
+		// played: fixtures played, in order; played songs are complete,
+		// unless listed in partial
+		played   []string
+		partial  []string
+		outcomes map[string][]string
+		status   []string // PrintStatus calls expected
+		info     []string // PrintInfo calls expected
+		check    func(t *testing.T, h *harness)
+	}{
+		{
+			name:     "plays the folder once",
+			steps:    []step{shortPress(1), waitState(stateIdle)},
+			played:   []string{"01.flac", "02.flac", "03.mp3"},
+			outcomes: map[string][]string{"01.flac": {playFinished}, "02.flac": {playFinished}, "03.mp3": {playFinished}},
+			status:   []string{"24 96000", "end of playlist"},
+			info:     []string{"Song 1", "Song 2", "Song 3"},
+		},
+		{
+			name:  "short press skips",
+			gated: true,
+			steps: []step{shortPress(1), allow(2), waitWrites(2), shortPress(1), allow(1),
+				unlimited(), waitState(stateIdle)},
+			played:   []string{"01.flac", "02.flac", "03.mp3"},
+			partial:  []string{"01.flac"},
+			outcomes: map[string][]string{"01.flac": {playSkipped}, "02.flac": {playFinished}},
+			check: func(t *testing.T, h *harness) {
+				if writes := h.out.streams[0].writes; writes != 3 {
+					t.Errorf("skipped song got %d writes, want 3", writes)
+				}
+			},
+		},
+		{
+			name:  "ban skips without counting a skip",
+			gated: true,
+			steps: []step{shortPress(1), allow(2), waitWrites(2), command(cmdBan), allow(1),
+				unlimited(), waitState(stateIdle)},
+			played:   []string{"01.flac", "02.flac", "03.mp3"},
+			partial:  []string{"01.flac"},
+			outcomes: map[string][]string{"01.flac": {playBanned}, "02.flac": {playFinished}},
+			status:   []string{"banned: Song 1"},
+			check: func(t *testing.T, h *harness) {
+				key := h.folder + "/01.flac"
+				if rec := songdb.get(key); rec.plays != 0 || rec.skips != 0 {
+					t.Errorf("banned song: %d plays, %d skips; want 0, 0", rec.plays, rec.skips)
+				}
+				if data, err := ioutil.ReadFile(h.home + "/" + pluginname + ".banned"); err != nil ||
+					!strings.Contains(string(data), "\n"+key+"\n") {
+					t.Errorf("ban list %q err=%v", data, err)
+				}
+			},
+		},
+		{
+			name:  "long press steps back",
+			gated: true,
+			steps: []step{shortPress(1), allowSong("01.flac"), allow(1),
+				waitWrites(h01writes() + 1), longPress(1), allow(1),
+				unlimited(), waitState(stateIdle)},
+			played:   []string{"01.flac", "02.flac", "01.flac", "02.flac", "03.mp3"},
+			partial:  []string{"02.flac"},
+			outcomes: map[string][]string{"01.flac": {playFinished, playFinished}, "02.flac": {playBack, playFinished}},
+		},
+		{
+			name:  "pause and resume",
+			gated: true,
+			steps: []step{shortPress(1), allow(2), waitWrites(2), hostPause(),
+				unlimited(), waitWrites(3), stillWrites(3, 700*time.Millisecond), hostPause(),
+				waitState(stateIdle)},
+			played: []string{"01.flac", "02.flac", "03.mp3"},
+			info:   []string{"Song 1 - paused"},
+		},
+		{
+			name:     "host stops playback",
+			gated:    true,
+			steps:    []step{shortPress(1), allow(2), waitWrites(2), hostStop(), allow(1), waitState(stateIdle)},
+			played:   []string{"01.flac"},
+			partial:  []string{"01.flac"},
+			outcomes: map[string][]string{"01.flac": {playStopped}},
+		},
+		{
+			name:  "rapid presses",
+			gated: true,
+			steps: []step{rapidPresses(1, 12), allow(3), rapidPresses(1, 9), unlimited()},
+			check: func(t *testing.T, h *harness) {
+				if h.host.lastPressed != 1 {
+					t.Errorf("PIdLastPressed=%d, want 1", h.host.lastPressed)
+				}
+			},
+		},
+		{
+			name:   "long press without history",
+			steps:  []step{longPress(1), waitState(stateIdle)},
+			status: []string{"end of queue"},
+			check: func(t *testing.T, h *harness) {
+				if len(h.out.streams) != 0 {
+					t.Errorf("%d songs played, want none", len(h.out.streams))
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newHarness(t, test.gated, []string{"mode=sequential", "repeat=once"},
+				newFlacFixture(1, 44100, 16, 0.25),
+				newFlacFixture(2, 96000, 24, 0.1),
+				newMp3Fixture(3, 10))
+			defer h.remove()
+			for _, step := range test.steps {
+				step(h)
+			}
+			h.finish()
+
+			if test.played != nil {
+				names, complete := h.played()
+				if strings.Join(names, " ") != strings.Join(test.played, " ") {
+					t.Errorf("played %v, want %v", names, test.played)
+				}
+				for i, name := range names {
+					if i < len(complete) && !complete[i] && !contains(test.partial, name) {
+						t.Errorf("%s (#%d) not played completely", name, i+1)
+					}
+				}
+			}
+			for name, want := range test.outcomes {
+				if got := h.outcomes(name); strings.Join(got, " ") != strings.Join(want, " ") {
+					t.Errorf("%s outcomes %v, want %v", name, got, want)
+				}
+			}
+			for _, str := range test.status {
+				if !h.host.called("PrintStatus", str) {
+					t.Errorf("no PrintStatus(%q) in %q", str, h.host.args("PrintStatus"))
+				}
+			}
+			for _, str := range test.info {
+				if !h.host.called("PrintInfo", str) {
+					t.Errorf("no PrintInfo(%q) in %q", str, h.host.args("PrintInfo"))
+				}
+			}
+			if test.check != nil {
+				test.check(t, h)
+			}
+		})
+	}
+}
+
+// h01writes is the number of writes of 01.flac in TestPlayback.
+func h01writes() int {
+	return (int(0.25*44100) + testFlacBlockSize - 1) / testFlacBlockSize
+}
+
+func contains(list []string, str string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
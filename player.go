@@ -0,0 +1,442 @@
+/*
+Player owns all playback state. Action() and the playback goroutines never
+touch it directly: they send events to the one goroutine running Player.loop(),
+which makes every state transition.
+
+	idle -----> starting -----> playing <----> paused
+	  ^        (stop other         |             |
+	  |         audio players)     v             v
+	  +-------------------------- stopping <-----+
+	                                |
+	                                +--> starting the next session
+
+A session is one run of the folder loop (playFolder), started by a short or
+long press. Only one session runs at a time. A press while a session plays
+stops it (skip, or step back on long press); the next session starts once the
+old one is done. Presses while starting or stopping are dropped, as there
+would be too many overlapping sessions otherwise.
+*/
+package main
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/mehrvarz/tremote_plugin"
+)
+
+type playerState int
+
+const (
+	stateIdle     playerState = iota
+	stateStarting             // other audio players are being stopped
+	statePlaying
+	statePaused
+	stateStopping // the session has been told to quit
+)
+
+func (state playerState) String() string {
+	switch state {
+	case stateIdle:
+		return "idle"
+	case stateStarting:
+		return "starting"
+	case statePlaying:
+		return "playing"
+	case statePaused:
+		return "paused"
+	case stateStopping:
+		return "stopping"
+	}
+	return "unknown"
+}
+
+var (
+	// time other audio players get to release the audio device
+	stopOthersDelay = 200 * time.Millisecond
+	// time we wait for another audio player to take our stop request
+	stopOthersTimeout = 5 * time.Second
+)
+
+// clock is time as seen by the player; tests use a fake one
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func())
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) {
+	time.AfterFunc(d, f)
+}
+
+// session is one run of the folder loop
+type session struct {
+	instance   int
+	longpress  bool
+	pid        int
+	strArray   []string
+	ph         tremote_plugin.PluginHelper
+	wg         *sync.WaitGroup
+	quit       chan struct{} // closed by the player to stop playback
+	pause      chan bool     // pause state requested by the player
+	stopReason string        // why quit was closed: playSkipped, playBack or playStopped
+
+	// owned by the session goroutine
+	abort  bool // end the folder loop after the current song
+	paused bool
+}
+
+// button events as received by Action()
+type buttonEvent struct {
+	pid             int
+	longpress       bool
+	pressedDuration int64
+	strArray        []string
+	ph              tremote_plugin.PluginHelper
+	wg              *sync.WaitGroup
+}
+
+// events sent to the player goroutine
+type (
+	longPressTimeout struct {
+		pid   int
+		press int
+	}
+	othersStopped struct{}
+	sessionDone   struct{ s *session }
+	statusRequest struct{ reply chan playerStatus }
+)
+
+// playerStatus is a snapshot of the player, for tests and logging
+type playerStatus struct {
+	state    playerState
+	instance int       // number of the current (or last) session
+	stop     chan bool // what *ph.StopAudioPlayerChan is set to by us
+	pause    chan bool // what *ph.PauseAudioPlayerChan is set to by us
+}
+
+// buttonState is what the player knows about a button
+type buttonState struct {
+	pressed bool
+	done    bool        // the press has been acted upon
+	press   int         // counts presses; identifies the press a long press timer belongs to
+	event   buttonEvent // the press event
+}
+
+type Player struct {
+	events chan interface{}
+	play   func(s *session) // the session body; playFolder
+	clock  clock
+
+	// owned by the loop goroutine
+	state     playerState
+	buttons   map[int]*buttonState
+	instances int
+	session   *session     // the running session; nil if idle or starting
+	next      *buttonEvent // press to start a session for, once starting/stopping is done
+	stop      chan bool    // ours, while a session runs: the host stops us here
+	pause     chan bool    // ours, while a session runs: the host pauses us here
+}
+
+var player *Player
+
+// newPlayer returns a player in state idle, running sessions with play.
+func newPlayer(play func(s *session), clock clock) *Player {
+	p := &Player{
+		events:  make(chan interface{}),
+		play:    play,
+		clock:   clock,
+		buttons: make(map[int]*buttonState),
+	}
+	go p.loop()
+	return p
+}
+
+// button hands a button event over to the player goroutine.
+func (p *Player) button(ev buttonEvent) {
+	p.events <- ev
+}
+
+// status returns a snapshot of the player state.
+func (p *Player) status() playerStatus {
+	reply := make(chan playerStatus)
+	p.events <- statusRequest{reply}
+	return <-reply
+}
+
+// loop is the only goroutine to change the player state. It must never block
+// on anything but its select.
+func (p *Player) loop() {
+	for {
+		select {
+		case event := <-p.events:
+			switch ev := event.(type) {
+			case buttonEvent:
+				p.handleButton(ev)
+			case longPressTimeout:
+				p.handleLongPressTimeout(ev)
+			case othersStopped:
+				p.handleOthersStopped()
+			case sessionDone:
+				p.handleSessionDone(ev.s)
+			case statusRequest:
+				ev.reply <- playerStatus{state: p.state, instance: p.instances, stop: p.stop, pause: p.pause}
+			}
+		case <-p.stop:
+			// another audio player (or the host) stops us
+			logm.Debugf("%s stopped by StopAudioPlayerChan in state %s", pluginname, p.state)
+			p.next = nil
+			p.stopSession(playStopped)
+		case <-p.pause:
+			p.togglePause()
+		}
+	}
+}
+
+func (p *Player) setState(state playerState) {
+	if state != p.state {
+		logm.Debugf("%s player %s -> %s", pluginname, p.state, state)
+		p.state = state
+	}
+}
+
+/*
+handleButton sorts out short and long presses. A press starts a timer; if the
+button is still pressed when it fires, this is a long press. Otherwise the
+release is a short press. Commands are executed once, on release or long press.
+*/
+func (p *Player) handleButton(ev buttonEvent) {
+	b := p.buttons[ev.pid]
+	if b == nil {
+		b = &buttonState{}
+		p.buttons[ev.pid] = b
+	}
+	if !ev.longpress && ev.pressedDuration == 0 {
+		// button has just been pressed; is still pressed
+		b.press++
+		b.pressed, b.done, b.event = true, false, ev
+		if pluginCommand(ev.strArray) == nil {
+			pid, press := ev.pid, b.press
+			p.clock.AfterFunc(tremote_plugin.LongPressDelay*time.Millisecond, func() {
+				p.events <- longPressTimeout{pid, press}
+			})
+		}
+		return
+	}
+
+	// button has been released (or the host tells us about a long press)
+	wasPressed := b.pressed
+	b.pressed = false
+	if wasPressed && b.done {
+		logm.Debugf("%s Action() button event has already been taken care of", pluginname)
+		return
+	}
+	b.done = true
+	p.actOn(ev, false)
+}
+
+func (p *Player) handleLongPressTimeout(ev longPressTimeout) {
+	b := p.buttons[ev.pid]
+	if b == nil || b.press != ev.press || !b.pressed || b.done {
+		// released, or a newer press
+		return
+	}
+	b.done = true
+	p.actOn(b.event, true)
+}
+
+// actOn executes a command, or asks for a session to be started.
+func (p *Player) actOn(ev buttonEvent, longpress bool) {
+	ph := ev.ph
+	(*ph.PLastPressActionDone)[ev.pid] = true
+	if command := pluginCommand(ev.strArray); command != nil {
+		// commands do not start or stop playback
+		logm.Infof("%s command %v", pluginname, ev.strArray)
+		go command(ev.strArray[1:], ph)
+		return
+	}
+	if len(ev.strArray) < 1 {
+		logm.Warningf("%s no folder given", pluginname)
+		return
+	}
+
+	if mode, _ := playModeFor(ev.strArray[0], parseMappingOptions(ev.strArray[1:])); !longpress && isDoublePress(ev.pid, p.clock.Now()) && mode == modeAlbum {
+		// double press in album shuffle mode: skip the rest of the album
+		// (even if this press gets dropped below)
+		logm.Infof("%s double press: skip album", pluginname)
+		requestAlbumSkip(ev.strArray[0])
+	}
+
+	// set PIdLastPressed (only music playing plugins need to do this)
+	*ph.PIdLastPressed = ev.pid
+	logm.Infof("%s actioncall longpress=%v arg=%s state=%s", pluginname, longpress, ev.strArray[0], p.state)
+
+	ev.longpress = longpress
+	switch p.state {
+	case stateIdle:
+		p.next = &ev
+		p.stopOthers(ph)
+	case statePlaying, statePaused:
+		p.next = &ev
+		if longpress {
+			p.stopSession(playBack)
+		} else {
+			p.stopSession(playSkipped)
+		}
+	default:
+		// we likely have too many overlapping presses: giving up on this one
+		logm.Warningf("%s press dropped in state %s", pluginname, p.state)
+	}
+}
+
+/*
+stopOthers stops whatever other audio player may be active, then gives it
+stopOthersDelay to release the audio device. This takes time, so it is done
+in a separate goroutine, which sends othersStopped when done.
+*/
+func (p *Player) stopOthers(ph tremote_plugin.PluginHelper) {
+	p.setState(stateStarting)
+	other := *ph.StopAudioPlayerChan
+	go func() {
+		if other != nil {
+			logm.Debugf("%s stopping other audio player...", pluginname)
+			select {
+			case other <- true:
+			case <-time.After(stopOthersTimeout):
+				logm.Warningf("%s other audio player did not take the stop request", pluginname)
+			}
+		} else {
+			// no audio plugin registered; there may be some other audio playing instance
+			logm.Debugf("%s on start no audio Plugin active -> StopCurrentAudioPlayback()", pluginname)
+			ph.StopCurrentAudioPlayback()
+		}
+		p.clock.AfterFunc(stopOthersDelay, func() {
+			p.events <- othersStopped{}
+		})
+	}()
+}
+
+func (p *Player) handleOthersStopped() {
+	if p.state != stateStarting {
+		logm.Warningf("%s othersStopped in state %s", pluginname, p.state)
+		return
+	}
+	p.startSession()
+}
+
+// startSession starts a session for p.next.
+func (p *Player) startSession() {
+	ev := p.next
+	p.next = nil
+	if ev == nil {
+		p.setState(stateIdle)
+		return
+	}
+	ph := ev.ph
+	p.instances++
+	s := &session{
+		instance:  p.instances,
+		longpress: ev.longpress,
+		pid:       ev.pid,
+		strArray:  ev.strArray,
+		ph:        ph,
+		wg:        ev.wg,
+		quit:      make(chan struct{}),
+		pause:     make(chan bool, 1),
+	}
+
+	// this allows parent to stop and pause us
+	if *ph.StopAudioPlayerChan != nil {
+		// should never happen
+		logm.Warningf("%s (%d) StopAudioPlayerChan!=nil", pluginname, s.instance)
+	}
+	if *ph.PauseAudioPlayerChan != nil {
+		// should never happen
+		logm.Warningf("%s (%d) PauseAudioPlayerChan!=nil", pluginname, s.instance)
+	}
+	p.stop = make(chan bool)
+	p.pause = make(chan bool)
+	*ph.StopAudioPlayerChan = p.stop
+	*ph.PauseAudioPlayerChan = p.pause
+	p.session = s
+	p.setState(statePlaying)
+
+	s.wg.Add(1)
+	go func() {
+		// some of the libraries we use may panic; we catch this here in
+		// order to not bring the framework down
+		defer func() {
+			if err := recover(); err != nil {
+				logm.Errorf("%s panic=%s", pluginname, err)
+				buf := make([]byte, 1<<16)
+				runtime.Stack(buf, true)
+				logm.Errorf("%s stack=\n%s", pluginname, buf)
+			}
+			p.events <- sessionDone{s}
+			s.wg.Done()
+		}()
+		p.play(s)
+	}()
+}
+
+// stopSession tells the running session to quit.
+func (p *Player) stopSession(reason string) {
+	if p.session == nil || p.state == stateStopping {
+		return
+	}
+	p.session.stopReason = reason
+	close(p.session.quit)
+	p.setState(stateStopping)
+}
+
+func (p *Player) togglePause() {
+	var paused bool
+	switch p.state {
+	case statePlaying:
+		paused = true
+		p.setState(statePaused)
+	case statePaused:
+		paused = false
+		p.setState(statePlaying)
+	default:
+		logm.Debugf("%s pause ignored in state %s", pluginname, p.state)
+		return
+	}
+	// only the latest request counts
+	select {
+	case <-p.session.pause:
+	default:
+	}
+	p.session.pause <- paused
+}
+
+func (p *Player) handleSessionDone(s *session) {
+	if s != p.session {
+		logm.Warningf("%s (%d) unknown session done", pluginname, s.instance)
+		return
+	}
+	logm.Debugf("%s (%d) session done in state %s", pluginname, s.instance, p.state)
+	ph := s.ph
+	if *ph.StopAudioPlayerChan == p.stop {
+		*ph.StopAudioPlayerChan = nil
+	} else {
+		// another audio player has taken over
+		logm.Warningf("%s (%d) StopAudioPlayerChan!=ours", pluginname, s.instance)
+	}
+	if *ph.PauseAudioPlayerChan == p.pause {
+		*ph.PauseAudioPlayerChan = nil
+	} else {
+		logm.Warningf("%s (%d) PauseAudioPlayerChan!=ours", pluginname, s.instance)
+	}
+	p.stop, p.pause = nil, nil
+	p.session = nil
+
+	// the old session has released the audio device: start the next one right away
+	p.startSession()
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mehrvarz/log"
+	"github.com/mehrvarz/tremote_plugin"
+)
+
+// startTestPlayer makes Action() use a new player running play instead of
+// playFolder.
+func startTestPlayer(play func(s *session)) {
+	stopOthersDelay = 5 * time.Millisecond
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	player = newPlayer(play, realClock{})
+}
+
+// press presses button pid for held, the way the host reports it.
+func press(pid int, held time.Duration, rcs *tremote_plugin.RemoteControlSpec, ph tremote_plugin.PluginHelper, wg *sync.WaitGroup) {
+	Action(log.NullLogger, pid, false, 0, "", rcs, ph, wg)
+	time.Sleep(held)
+	Action(log.NullLogger, pid, false, int64(held/time.Millisecond)+1, "", rcs, ph, wg)
+}
+
+func waitPlayer(t *testing.T, want playerState) playerStatus {
+	for i := 0; i < 500; i++ {
+		if st := player.status(); st.state == want {
+			return st
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("player state %s, want %s", player.status().state, want)
+	return playerStatus{}
+}
+
+func TestPlayerTransitions(t *testing.T) {
+	started := make(chan *session, 10)
+	ended := make(chan *session, 10)
+	startTestPlayer(func(s *session) {
+		started <- s
+		for {
+			select {
+			case <-s.quit:
+				ended <- s
+				return
+			case s.paused = <-s.pause:
+			}
+		}
+	})
+	ph := newFakeHost().ph
+	rcs := &tremote_plugin.RemoteControlSpec{StrArray: []string{"/music"}}
+	var wg sync.WaitGroup
+
+	// short press: start
+	press(3, 0, rcs, ph, &wg)
+	s1 := <-started
+	if s1.longpress {
+		t.Errorf("short press started a long press session")
+	}
+	st := waitPlayer(t, statePlaying)
+	if *ph.StopAudioPlayerChan != st.stop || *ph.PauseAudioPlayerChan != st.pause || st.stop == nil {
+		t.Errorf("StopAudioPlayerChan/PauseAudioPlayerChan not set while playing")
+	}
+	if *ph.PIdLastPressed != 3 {
+		t.Errorf("PIdLastPressed=%d, want 3", *ph.PIdLastPressed)
+	}
+
+	// host pauses and resumes
+	st.pause <- true
+	waitPlayer(t, statePaused)
+	st.pause <- true
+	waitPlayer(t, statePlaying)
+
+	// short press again: skip
+	press(3, 0, rcs, ph, &wg)
+	if s := <-ended; s != s1 || s.stopReason != playSkipped {
+		t.Errorf("session %d ended with %q, want session %d %q", s.instance, s.stopReason, s1.instance, playSkipped)
+	}
+	s2 := <-started
+
+	// long press: step back
+	press(3, 700*time.Millisecond, rcs, ph, &wg)
+	if s := <-ended; s != s2 || s.stopReason != playBack {
+		t.Errorf("session %d ended with %q, want session %d %q", s.instance, s.stopReason, s2.instance, playBack)
+	}
+	if s3 := <-started; !s3.longpress {
+		t.Errorf("long press started a short press session")
+	}
+
+	// another audio player stops us
+	st = waitPlayer(t, statePlaying)
+	st.stop <- true
+	if s := <-ended; s.stopReason != playStopped {
+		t.Errorf("session ended with %q, want %q", s.stopReason, playStopped)
+	}
+	waitPlayer(t, stateIdle)
+	if *ph.StopAudioPlayerChan != nil || *ph.PauseAudioPlayerChan != nil {
+		t.Errorf("StopAudioPlayerChan/PauseAudioPlayerChan not cleared when idle")
+	}
+	wg.Wait()
+}
+
+// TestPlayerButtonMashing presses buttons as fast as possible while the host
+// pauses and stops us. Run with -race.
+func TestPlayerButtonMashing(t *testing.T) {
+	// button 4 switches the play mode of whatever folder is active
+	defer savePlayModeOverrides()()
+	var running, sessions int32
+	startTestPlayer(func(s *session) {
+		if n := atomic.AddInt32(&running, 1); n > 1 {
+			t.Errorf("%d sessions running at the same time", n)
+		}
+		defer atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&sessions, 1)
+		// a session may also end by itself (end of playlist)
+		end := time.After(time.Duration(rand.Intn(200)) * time.Millisecond)
+		for {
+			select {
+			case <-s.quit:
+				if s.stopReason == "" {
+					t.Errorf("session %d stopped without a reason", s.instance)
+				}
+				return
+			case s.paused = <-s.pause:
+			case <-end:
+				return
+			}
+		}
+	})
+	ph := newFakeHost().ph
+	var wg sync.WaitGroup
+	var mashers sync.WaitGroup
+
+	for pid := 1; pid <= 4; pid++ {
+		rcs := &tremote_plugin.RemoteControlSpec{StrArray: []string{"/music"}}
+		if pid == 4 {
+			rcs.StrArray = []string{"PlayMode"}
+		}
+		mashers.Add(1)
+		go func(pid int) {
+			defer mashers.Done()
+			for i := 0; i < 40; i++ {
+				held := time.Duration(rand.Intn(20)) * time.Millisecond
+				if rand.Intn(10) == 0 {
+					held = 550 * time.Millisecond
+				}
+				press(pid, held, rcs, ph, &wg)
+				time.Sleep(time.Duration(rand.Intn(10)) * time.Millisecond)
+			}
+		}(pid)
+	}
+
+	// the host pauses us, or another audio player stops us
+	mashers.Add(1)
+	go func() {
+		defer mashers.Done()
+		for i := 0; i < 200; i++ {
+			st := player.status()
+			ch := st.pause
+			if rand.Intn(5) == 0 {
+				ch = st.stop
+			}
+			if ch != nil {
+				select {
+				case ch <- true:
+				case <-time.After(20 * time.Millisecond):
+					// session ended in the meantime
+				}
+			}
+			time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+		}
+	}()
+	mashers.Wait()
+
+	// stop whatever plays now
+	for i := 0; i < 500; i++ {
+		st := player.status()
+		if st.state == stateIdle {
+			break
+		}
+		if st.stop != nil {
+			select {
+			case st.stop <- true:
+			case <-time.After(10 * time.Millisecond):
+			}
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitPlayer(t, stateIdle)
+	wg.Wait()
+	if n := atomic.LoadInt32(&running); n != 0 {
+		t.Errorf("%d sessions still running", n)
+	}
+	if atomic.LoadInt32(&sessions) == 0 {
+		t.Errorf("no session started")
+	}
+	if *ph.StopAudioPlayerChan != nil || *ph.PauseAudioPlayerChan != nil {
+		t.Errorf("StopAudioPlayerChan/PauseAudioPlayerChan not cleared when idle")
+	}
+	t.Logf("%d sessions", atomic.LoadInt32(&sessions))
+}
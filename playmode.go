@@ -0,0 +1,249 @@
+/*
+Play modes. The order in which songs are picked (mode) and what happens at the
+end of a song or playlist (repeat) can be set per mapping line, for instance
+"play_audio|/media/sda1/Audiobooks|mode=sequential|repeat=once", and switched
+at runtime with the PlayMode and Repeat commands.
+*/
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mehrvarz/tremote_plugin"
+)
+
+const (
+	modeShuffle    = "shuffle"    // random songs (default)
+	modeAlbum      = "album"      // random albums, tracks in order
+	modeSequential = "sequential" // natural sort order of the file names
+	modeTracks     = "tracks"     // track number order
+
+	repeatAll  = "all"  // continue forever (default)
+	repeatOne  = "one"  // repeat the current song
+	repeatOnce = "once" // play everything once, then stop
+)
+
+var (
+	playModes   = []string{modeShuffle, modeAlbum, modeSequential, modeTracks}
+	repeatModes = []string{repeatAll, repeatOne, repeatOnce}
+)
+
+var (
+	playModeLock      sync.Mutex
+	activeFolder      string                    // folder of the running folder loop
+	activeOptions     map[string]string         // mapping options of activeFolder
+	modeOverrideMap   = make(map[string]string) // folder -> mode set at runtime
+	repeatOverrideMap = make(map[string]string) // folder -> repeat set at runtime
+	lastPlayedMap     = make(map[string]string) // folder -> ref of the song started last
+)
+
+// playModeFor returns the mode and repeat setting of a folder. A setting made
+// at runtime takes precedence over the mapping options.
+func playModeFor(folder string, options map[string]string) (string, string) {
+	mode := options["mode"]
+	if mode == "" && options["shuffle"] == "album" {
+		mode = modeAlbum
+	}
+	if !validSetting(mode, playModes) {
+		if mode != "" {
+			logm.Warningf("%s unknown mode=%s", pluginname, mode)
+		}
+		mode = modeShuffle
+	}
+	repeat := options["repeat"]
+	if !validSetting(repeat, repeatModes) {
+		if repeat != "" {
+			logm.Warningf("%s unknown repeat=%s", pluginname, repeat)
+		}
+		repeat = repeatAll
+	}
+
+	playModeLock.Lock()
+	defer playModeLock.Unlock()
+	if override := modeOverrideMap[folder]; override != "" {
+		mode = override
+	}
+	if override := repeatOverrideMap[folder]; override != "" {
+		repeat = override
+	}
+	return mode, repeat
+}
+
+func validSetting(value string, values []string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// nextSetting returns the value following current in values (cycling).
+func nextSetting(current string, values []string) string {
+	for i, v := range values {
+		if v == current {
+			return values[(i+1)%len(values)]
+		}
+	}
+	return values[0]
+}
+
+// setActiveFolder registers the folder (and its mapping options) that the
+// PlayMode and Repeat commands will apply to.
+func setActiveFolder(folder string, options map[string]string) {
+	playModeLock.Lock()
+	activeFolder = folder
+	activeOptions = options
+	playModeLock.Unlock()
+}
+
+func setLastPlayed(folder string, ref string) {
+	playModeLock.Lock()
+	lastPlayedMap[folder] = ref
+	playModeLock.Unlock()
+}
+
+func lastPlayed(folder string) string {
+	playModeLock.Lock()
+	defer playModeLock.Unlock()
+	return lastPlayedMap[folder]
+}
+
+func announcePlayMode(ph tremote_plugin.PluginHelper, mode string, repeat string) {
+	ph.PrintStatus("play mode " + mode + ", repeat " + repeat)
+}
+
+/*
+cmdPlayMode implements "play_audio|PlayMode|<mode>". Without an argument it
+cycles through shuffle, album, sequential and tracks. The new mode applies to
+the currently active folder, starting with the next song.
+*/
+func cmdPlayMode(args []string, ph tremote_plugin.PluginHelper) {
+	playModeLock.Lock()
+	folder, options := activeFolder, activeOptions
+	playModeLock.Unlock()
+	if folder == "" {
+		ph.PrintStatus("play mode: no active folder")
+		return
+	}
+	mode, repeat := playModeFor(folder, options)
+	if len(args) > 0 && args[0] != "" {
+		if !validSetting(args[0], playModes) {
+			ph.PrintStatus("unknown play mode " + args[0])
+			return
+		}
+		mode = args[0]
+	} else {
+		mode = nextSetting(mode, playModes)
+	}
+	playModeLock.Lock()
+	modeOverrideMap[folder] = mode
+	playModeLock.Unlock()
+	logm.Infof("%s %s: play mode %s", pluginname, folder, mode)
+	announcePlayMode(ph, mode, repeat)
+}
+
+// cmdRepeat implements "play_audio|Repeat|<all|one|once>"; without an
+// argument it cycles through the repeat settings.
+func cmdRepeat(args []string, ph tremote_plugin.PluginHelper) {
+	playModeLock.Lock()
+	folder, options := activeFolder, activeOptions
+	playModeLock.Unlock()
+	if folder == "" {
+		ph.PrintStatus("repeat: no active folder")
+		return
+	}
+	mode, repeat := playModeFor(folder, options)
+	if len(args) > 0 && args[0] != "" {
+		if !validSetting(args[0], repeatModes) {
+			ph.PrintStatus("unknown repeat mode " + args[0])
+			return
+		}
+		repeat = args[0]
+	} else {
+		repeat = nextSetting(repeat, repeatModes)
+	}
+	playModeLock.Lock()
+	repeatOverrideMap[folder] = repeat
+	playModeLock.Unlock()
+	logm.Infof("%s %s: repeat %s", pluginname, folder, repeat)
+	announcePlayMode(ph, mode, repeat)
+}
+
+/*
+nextSequentialTrack returns the ref following the song played last in
+sequential or tracks mode. At the end of the list it starts over, unless
+repeat is set to once. restart is set for the first song of a new button
+press, which also starts over after the list has been played once.
+*/
+func nextSequentialTrack(folder string, fileArray []os.FileInfo, mode string, repeat string, restart bool) string {
+	refs := sequentialRefs(folder, fileArray, mode)
+	if len(refs) == 0 {
+		return ""
+	}
+	last := lastPlayed(folder)
+	idx := 0
+	for i, ref := range refs {
+		if ref == last {
+			idx = i + 1
+			break
+		}
+	}
+	if idx >= len(refs) {
+		if repeat == repeatOnce && !restart {
+			return ""
+		}
+		idx = 0
+	}
+	return refs[idx]
+}
+
+// sequentialRefs lists the songs of a folder and its sub directories (one
+// level deep) in play order. Directories are played in natural name order;
+// inside a directory files are sorted by name or by track number.
+func sequentialRefs(folder string, fileArray []os.FileInfo, mode string) []string {
+	var dirs []string
+	var names []string
+	for _, fi := range fileArray {
+		if fi == nil {
+			continue
+		}
+		if fi.IsDir() {
+			dirs = append(dirs, fi.Name())
+		} else if isAudioFile(fi.Name()) {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool { return naturalLess(dirs[i], dirs[j]) })
+
+	refs := orderedRefs(folder, names, mode)
+	for _, dir := range dirs {
+		subArray, err := ioutil.ReadDir(folder + "/" + dir)
+		if err != nil {
+			continue
+		}
+		var subNames []string
+		for _, sub := range subArray {
+			if !sub.IsDir() && isAudioFile(sub.Name()) {
+				subNames = append(subNames, dir+"/"+sub.Name())
+			}
+		}
+		refs = append(refs, orderedRefs(folder, subNames, mode)...)
+	}
+	return refs
+}
+
+func orderedRefs(folder string, names []string, mode string) []string {
+	if mode == modeTracks {
+		sortByTrackNumber(folder, names)
+	} else {
+		sort.Slice(names, func(i, j int) bool {
+			return naturalLess(strings.ToLower(names[i]), strings.ToLower(names[j]))
+		})
+	}
+	return expandCueRefs(folder, names)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mehrvarz/log"
+)
+
+// savePlayModeOverrides saves the mode and repeat set at runtime; the
+// function it returns puts them back.
+func savePlayModeOverrides() func() {
+	copyMap := func(m map[string]string) map[string]string {
+		c := make(map[string]string, len(m))
+		for k, v := range m {
+			c[k] = v
+		}
+		return c
+	}
+	playModeLock.Lock()
+	modes, repeats := copyMap(modeOverrideMap), copyMap(repeatOverrideMap)
+	playModeLock.Unlock()
+	return func() {
+		playModeLock.Lock()
+		modeOverrideMap, repeatOverrideMap = modes, repeats
+		playModeLock.Unlock()
+	}
+}
+
+func TestPlayModeFor(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	defer savePlayModeOverrides()()
+	tests := []struct {
+		options      string
+		override     string // mode and repeat set at runtime
+		mode, repeat string
+	}{
+		{"", "", modeShuffle, repeatAll},
+		{"mode=sequential", "", modeSequential, repeatAll},
+		{"mode=tracks|repeat=once", "", modeTracks, repeatOnce},
+		{"shuffle=album", "", modeAlbum, repeatAll},
+		{"mode=sequential|shuffle=album", "", modeSequential, repeatAll},
+		{"mode=random|repeat=twice", "", modeShuffle, repeatAll},
+		{"mode=sequential|repeat=once", "album one", modeAlbum, repeatOne},
+		{"mode=sequential", " once", modeSequential, repeatOnce},
+	}
+	for i, test := range tests {
+		folder := "/music/" + strings.Repeat("x", i)
+		if test.override != "" {
+			overrides := strings.Split(test.override, " ")
+			playModeLock.Lock()
+			modeOverrideMap[folder], repeatOverrideMap[folder] = overrides[0], overrides[1]
+			playModeLock.Unlock()
+		}
+		options := parseMappingOptions(strings.Split(test.options, "|"))
+		if mode, repeat := playModeFor(folder, options); mode != test.mode || repeat != test.repeat {
+			t.Errorf("%q, set %q: %s, %s; want %s, %s", test.options, test.override, mode, repeat, test.mode, test.repeat)
+		}
+	}
+}
+
+func TestNextSetting(t *testing.T) {
+	want := []string{modeAlbum, modeSequential, modeTracks, modeShuffle}
+	for i, mode := range playModes {
+		if next := nextSetting(mode, playModes); next != want[i] {
+			t.Errorf("after %s: %s, want %s", mode, next, want[i])
+		}
+	}
+	if next := nextSetting("unknown", repeatModes); next != repeatAll {
+		t.Errorf("after unknown: %s", next)
+	}
+}
+
+// TestPlayModeCommands switches mode and repeat of the active folder.
+func TestPlayModeCommands(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	defer savePlayModeOverrides()()
+	host := newFakeHost()
+	setActiveFolder("", nil)
+	cmdPlayMode(nil, host.ph)
+	folder := "/music/commands"
+	setActiveFolder(folder, map[string]string{"mode": modeSequential})
+	cmdPlayMode(nil, host.ph)
+	cmdPlayMode([]string{"shuffle"}, host.ph)
+	cmdPlayMode([]string{"loud"}, host.ph)
+	cmdRepeat(nil, host.ph)
+	cmdRepeat([]string{"all"}, host.ph)
+	cmdRepeat([]string{"twice"}, host.ph)
+	want := []string{
+		"play mode: no active folder",
+		"play mode tracks, repeat all",
+		"play mode shuffle, repeat all",
+		"unknown play mode loud",
+		"play mode shuffle, repeat one",
+		"play mode shuffle, repeat all",
+		"unknown repeat mode twice",
+	}
+	if got := host.args("PrintStatus"); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("PrintStatus\n%q\nwant\n%q", got, want)
+	}
+	setActiveFolder("", nil)
+}
+
+// sequentialFolder writes files whose names and track numbers are in
+// different orders, in the folder and in two sub directories.
+func sequentialFolder(t *testing.T) (string, []os.FileInfo) {
+	dir, err := ioutil.TempDir("", "tremote_sequential")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"/CD 10", "/CD 2"} {
+		if err := os.Mkdir(dir+sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []struct {
+		name  string
+		track string
+	}{
+		{"Track 10.flac", "1"},
+		{"track 9.flac", "2"},
+		{"Track 1.flac", "3"},
+		{"cover.jpg", ""},
+		{"CD 2/b.flac", "1"},
+		{"CD 2/a.flac", "2"},
+		{"CD 10/x.flac", "1"},
+	}
+	for i, f := range files {
+		if f.track == "" {
+			ioutil.WriteFile(dir+"/"+f.name, []byte("jpeg"), 0644)
+			continue
+		}
+		fx := newFlacFixture(i+1, 44100, 16, 0.05)
+		fx.name = f.name
+		fx.write(t, dir)
+		fx.tag(t, dir, "TRACKNUMBER="+f.track)
+	}
+	fileArray, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, fileArray
+}
+
+func TestSequentialRefs(t *testing.T) {
+	dir, fileArray := sequentialFolder(t)
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{modeSequential, "Track 1.flac|track 9.flac|Track 10.flac|CD 2/a.flac|CD 2/b.flac|CD 10/x.flac"},
+		{modeTracks, "Track 10.flac|track 9.flac|Track 1.flac|CD 2/b.flac|CD 2/a.flac|CD 10/x.flac"},
+	}
+	for _, test := range tests {
+		if got := strings.Join(sequentialRefs(dir, fileArray, test.mode), "|"); got != test.want {
+			t.Errorf("%s:\n got %s\nwant %s", test.mode, got, test.want)
+		}
+	}
+}
+
+func TestNextSequentialTrack(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	dir, fileArray := sequentialFolder(t)
+	defer os.RemoveAll(dir)
+	refs := sequentialRefs(dir, fileArray, modeSequential)
+	tests := []struct {
+		last    string
+		repeat  string
+		restart bool
+		want    string
+	}{
+		{"", repeatAll, true, refs[0]},
+		{refs[0], repeatAll, false, refs[1]},
+		{refs[2], repeatOnce, false, refs[3]},
+		{refs[5], repeatAll, false, refs[0]}, // starts over
+		{refs[5], repeatOnce, false, ""},     // end of the playlist
+		{refs[5], repeatOnce, true, refs[0]}, // a new press starts over
+		{"gone.flac", repeatOnce, false, refs[0]},
+	}
+	for _, test := range tests {
+		setLastPlayed(dir, test.last)
+		if got := nextSequentialTrack(dir, fileArray, modeSequential, test.repeat, test.restart); got != test.want {
+			t.Errorf("after %q, repeat %s, restart %v: %q, want %q", test.last, test.repeat, test.restart, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+/*
+Rating write-back. Ratings set with the Rate command are kept in songdb. With
+"writeratings = on" in config.txt they are also written into the file: an
+ID3v2 POPM frame for mp3, RATING and FMPS_RATING Vorbis comments for flac.
+The file is rewritten to a temporary file next to it, which then replaces the
+original by rename, so an interrupted write never leaves a damaged file.
+With "writeratings = dryrun" the planned changes are only logged and listed
+in play_audio_mp3flac.tagchanges in homedir. Cue sheet tracks share one file
+and are only rated in songdb.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mehrvarz/tremote_plugin"
+)
+
+const (
+	writeRatingsOff    = "off"
+	writeRatingsOn     = "on"
+	writeRatingsDryRun = "dryrun"
+)
+
+// popmEmail identifies our POPM frame
+var popmEmail = pluginname
+
+var errUnsupportedTag = errors.New("unsupported tag layout")
+
+// popmByte maps 1-5 stars to a POPM rating byte the way Windows Media Player does.
+var popmByte = [6]byte{0, 1, 64, 128, 196, 255}
+
+/*
+cmdRate implements "play_audio|Rate|<0-5>": it sets the rating of the song
+currently playing (0 removes it). The rating is used by strategy=weighted.
+*/
+func cmdRate(args []string, ph tremote_plugin.PluginHelper) {
+	key, info := currentSong()
+	if key == "" {
+		ph.PrintStatus("rate: no song playing")
+		return
+	}
+	stars := -1
+	if len(args) > 0 {
+		stars, _ = strconv.Atoi(args[0])
+	}
+	if stars < 0 || stars > 5 {
+		ph.PrintStatus("rate: rating must be 0-5")
+		return
+	}
+	songdb.update(key, func(rec *songRecord) {
+		rec.rating = stars
+	})
+	logm.Infof("%s rating %d %s", pluginname, stars, key)
+	ph.PrintStatus(fmt.Sprintf("%d stars: %s", stars, info))
+
+	if _, number := splitTrackRef(key); number > 0 || configWriteRatings == writeRatingsOff {
+		return
+	}
+	if err := writeRating(key, stars, configWriteRatings == writeRatingsDryRun); err != nil {
+		logm.Warningf("%s write rating to %s err=%s", pluginname, key, err.Error())
+		ph.PrintStatus("rating not written to file: " + err.Error())
+	}
+}
+
+// writeRating writes stars into the tags of pathfile, or only lists the
+// change if dryrun is set.
+func writeRating(pathfile string, stars int, dryrun bool) error {
+	var change string
+	var rewrite func(src *os.File, dst io.Writer) error
+	if strings.HasSuffix(pathfile, ".flac") {
+		comments := []string{}
+		if stars > 0 {
+			comments = []string{
+				"RATING=" + strconv.Itoa(stars*20),
+				"FMPS_RATING=" + strconv.FormatFloat(float64(stars)/5, 'f', 1, 64),
+			}
+		}
+		change = "vorbis comments " + strings.Join(comments, " ")
+		rewrite = func(src *os.File, dst io.Writer) error {
+			return rewriteFlacComments(src, dst, []string{"RATING", "FMPS_RATING"}, comments)
+		}
+	} else {
+		change = fmt.Sprintf("id3v2 POPM %s rating=%d", popmEmail, popmByte[stars])
+		rewrite = func(src *os.File, dst io.Writer) error {
+			return rewriteID3Popm(src, dst, popmByte[stars])
+		}
+	}
+
+	if dryrun {
+		logm.Infof("%s dryrun %s: %s", pluginname, pathfile, change)
+		listTagChange(pathfile + "\t" + change)
+		return nil
+	}
+	logm.Infof("%s write %s: %s", pluginname, pathfile, change)
+	return rewriteFile(pathfile, rewrite)
+}
+
+func listTagChange(line string) {
+	songdb.lock.Lock()
+	dbfile := songdb.pathfile
+	songdb.lock.Unlock()
+	if dbfile == "" {
+		return
+	}
+	listfile := filepath.Dir(dbfile) + "/" + pluginname + ".tagchanges"
+	file, err := os.OpenFile(listfile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logm.Warningf("%s write %s err=%s", pluginname, listfile, err.Error())
+		return
+	}
+	fmt.Fprintf(file, "%s\t%s\n", time.Now().Format(time.RFC3339), line)
+	file.Close()
+}
+
+// rewriteFile replaces pathfile with the output of rewrite, atomically by
+// renaming a temporary file in the same directory. The new file keeps the
+// mode, owner and modification time of the old one, so a rated song does not
+// look new to strategy=weighted.
+func rewriteFile(pathfile string, rewrite func(src *os.File, dst io.Writer) error) error {
+	src, err := os.Open(pathfile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmpfile := filepath.Dir(pathfile) + "/." + filepath.Base(pathfile) + ".tmp"
+	dst, err := os.OpenFile(tmpfile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = rewrite(src, dst)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = keepAttributes(tmpfile, fi)
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, pathfile)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+	}
+	return err
+}
+
+// chownFile is os.Chown; tests replace it.
+var chownFile = os.Chown
+
+// keepAttributes gives pathfile the owner, mode and modification time in fi.
+// The owner goes first, as chown clears setuid and setgid bits. Only root may
+// give a file away, so a failing chown (a song owned by another user, as is
+// usual on a NAS) is logged and the file ends up owned by us.
+func keepAttributes(pathfile string, fi os.FileInfo) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if cur, err := os.Stat(pathfile); err != nil {
+			return err
+		} else if cst, ok := cur.Sys().(*syscall.Stat_t); !ok || cst.Uid != st.Uid || cst.Gid != st.Gid {
+			if err := chownFile(pathfile, int(st.Uid), int(st.Gid)); err != nil {
+				logm.Warningf("%s keep owner %d:%d err=%s", pluginname, st.Uid, st.Gid, err.Error())
+			}
+		}
+	}
+	if err := os.Chmod(pathfile, fi.Mode()); err != nil {
+		return err
+	}
+	return os.Chtimes(pathfile, time.Now(), fi.ModTime())
+}
+
+/*
+rewriteID3Popm copies an mp3 file, replacing the POPM frame with our email in
+its ID3v2.3 or v2.4 tag by one with the new rating (rating 0 removes it). All
+other frames, including the POPM frames of other players, are copied byte for
+byte. A file without ID3v2 tag gets a new v2.3 tag. Tags using
+unsynchronisation or an extended header, and v2.2 tags, are not touched.
+*/
+func rewriteID3Popm(src *os.File, dst io.Writer, rating byte) error {
+	header := make([]byte, 10)
+	n, err := io.ReadFull(src, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	version := byte(3)
+	var frames []byte
+	replaced := false
+	audioStart := int64(0)
+	if n == 10 && bytes.HasPrefix(header, []byte("ID3")) {
+		version = header[3]
+		if version != 3 && version != 4 || header[5]&0xc0 != 0 {
+			return errUnsupportedTag
+		}
+		size := syncsafe(header[6:10])
+		audioStart = 10 + int64(size)
+		if header[5]&0x10 != 0 {
+			audioStart += 10 // footer
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(src, body); err != nil {
+			return err
+		}
+		for pos := 0; pos+10 <= len(body) && body[pos] != 0; {
+			frameSize := int(binary.BigEndian.Uint32(body[pos+4:]))
+			if version == 4 {
+				frameSize = int(syncsafe(body[pos+4 : pos+8]))
+			}
+			end := pos + 10 + frameSize
+			if frameSize < 0 || end > len(body) {
+				return errUnsupportedTag
+			}
+			if isOurPopm(body[pos:end]) {
+				// the new frame takes the place of the old one
+				if !replaced {
+					frames = append(frames, popmFrame(version, rating)...)
+					replaced = true
+				}
+			} else {
+				frames = append(frames, body[pos:end]...)
+			}
+			pos = end
+		}
+	}
+	if !replaced {
+		frames = append(frames, popmFrame(version, rating)...)
+	}
+	frames = append(frames, make([]byte, 1024)...) // padding for later edits
+
+	newHeader := []byte{'I', 'D', '3', version, 0, 0, 0, 0, 0, 0}
+	putSyncsafe(newHeader[6:10], uint32(len(frames)))
+	if _, err := dst.Write(newHeader); err != nil {
+		return err
+	}
+	if _, err := dst.Write(frames); err != nil {
+		return err
+	}
+	if _, err := src.Seek(audioStart, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// isOurPopm reports whether frame is a POPM frame with our email. Frames
+// compressed or encrypted (format flags set) are never ours.
+func isOurPopm(frame []byte) bool {
+	return string(frame[:4]) == "POPM" && frame[9] == 0 &&
+		bytes.HasPrefix(frame[10:], append([]byte(popmEmail), 0))
+}
+
+// popmFrame returns a POPM frame with our email and rating, nil for rating 0.
+func popmFrame(version byte, rating byte) []byte {
+	if rating == 0 {
+		return nil
+	}
+	popm := append([]byte(popmEmail), 0, rating)
+	frame := make([]byte, 10, 10+len(popm))
+	copy(frame, "POPM")
+	if version == 4 {
+		putSyncsafe(frame[4:8], uint32(len(popm)))
+	} else {
+		binary.BigEndian.PutUint32(frame[4:], uint32(len(popm)))
+	}
+	return append(frame, popm...)
+}
+
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7f)<<21 | uint32(b[1]&0x7f)<<14 | uint32(b[2]&0x7f)<<7 | uint32(b[3]&0x7f)
+}
+
+func putSyncsafe(b []byte, v uint32) {
+	b[0] = byte(v>>21) & 0x7f
+	b[1] = byte(v>>14) & 0x7f
+	b[2] = byte(v>>7) & 0x7f
+	b[3] = byte(v) & 0x7f
+}
+
+/*
+rewriteFlacComments copies a flac file, removing the Vorbis comments named in
+remove (case insensitive) and adding the comments in add. A file without
+VORBIS_COMMENT block gets one after STREAMINFO.
+*/
+func rewriteFlacComments(src *os.File, dst io.Writer, remove []string, add []string) error {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(src, magic); err != nil {
+		return err
+	}
+	if string(magic) != "fLaC" {
+		return errUnsupportedTag
+	}
+
+	type block struct {
+		typ  byte
+		data []byte
+	}
+	var blocks []block
+	for last := false; !last; {
+		head := make([]byte, 4)
+		if _, err := io.ReadFull(src, head); err != nil {
+			return err
+		}
+		last = head[0]&0x80 != 0
+		data := make([]byte, int(head[1])<<16|int(head[2])<<8|int(head[3]))
+		if _, err := io.ReadFull(src, data); err != nil {
+			return err
+		}
+		blocks = append(blocks, block{head[0] & 0x7f, data})
+	}
+
+	found := false
+	for i := range blocks {
+		if blocks[i].typ == 4 {
+			data, err := editVorbisComments(blocks[i].data, remove, add)
+			if err != nil {
+				return err
+			}
+			blocks[i].data = data
+			found = true
+			break
+		}
+	}
+	if !found {
+		data, err := editVorbisComments(nil, remove, add)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks[:1], append([]block{{4, data}}, blocks[1:]...)...)
+	}
+
+	if _, err := dst.Write(magic); err != nil {
+		return err
+	}
+	for i, b := range blocks {
+		if len(b.data) >= 1<<24 {
+			return errUnsupportedTag
+		}
+		typ := b.typ
+		if i == len(blocks)-1 {
+			typ |= 0x80
+		}
+		head := []byte{typ, byte(len(b.data) >> 16), byte(len(b.data) >> 8), byte(len(b.data))}
+		if _, err := dst.Write(head); err != nil {
+			return err
+		}
+		if _, err := dst.Write(b.data); err != nil {
+			return err
+		}
+	}
+	// the reader is positioned at the first audio frame
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+// editVorbisComments returns a VORBIS_COMMENT block (data == nil: new block)
+// without the comments named in remove, plus the comments in add.
+func editVorbisComments(data []byte, remove []string, add []string) ([]byte, error) {
+	vendor := []byte(pluginname)
+	var comments [][]byte
+	if data != nil {
+		r := bytes.NewReader(data)
+		var n uint32
+		if err := binary.Read(r, binary.LittleEndian, &n); err != nil || int(n) > r.Len() {
+			return nil, errUnsupportedTag
+		}
+		vendor = make([]byte, n)
+		r.Read(vendor)
+		var count uint32
+		if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+			return nil, errUnsupportedTag
+		}
+		for i := uint32(0); i < count; i++ {
+			if err := binary.Read(r, binary.LittleEndian, &n); err != nil || int(n) > r.Len() {
+				return nil, errUnsupportedTag
+			}
+			comment := make([]byte, n)
+			r.Read(comment)
+			name := string(comment)
+			if eq := strings.IndexByte(name, '='); eq >= 0 {
+				name = name[:eq]
+			}
+			keep := true
+			for _, rm := range remove {
+				if strings.EqualFold(name, rm) {
+					keep = false
+				}
+			}
+			if keep {
+				comments = append(comments, comment)
+			}
+		}
+	}
+	for _, comment := range add {
+		comments = append(comments, []byte(comment))
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(len(vendor)))
+	buf.Write(vendor)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(comments)))
+	for _, comment := range comments {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(comment)))
+		buf.Write(comment)
+	}
+	return buf.Bytes(), nil
+}
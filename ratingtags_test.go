@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mehrvarz/log"
+)
+
+// id3Frame returns an ID3v2 frame; v2.4 sizes are syncsafe.
+func id3Frame(version byte, id string, data []byte) []byte {
+	frame := make([]byte, 10, 10+len(data))
+	copy(frame, id)
+	if version == 4 {
+		putSyncsafe(frame[4:8], uint32(len(data)))
+	} else {
+		binary.BigEndian.PutUint32(frame[4:], uint32(len(data)))
+	}
+	return append(frame, data...)
+}
+
+// id3File returns an mp3 file with an ID3v2 tag holding frames and padding,
+// followed by audio.
+func id3File(version byte, frames [][]byte, padding int, audio []byte) []byte {
+	body := bytes.Join(frames, nil)
+	body = append(body, make([]byte, padding)...)
+	data := []byte{'I', 'D', '3', version, 0, 0, 0, 0, 0, 0}
+	putSyncsafe(data[6:10], uint32(len(body)))
+	return append(append(data, body...), audio...)
+}
+
+// id3Frames splits an mp3 file into the frames of its ID3v2 tag and the audio.
+func id3Frames(t *testing.T, data []byte) ([][]byte, []byte) {
+	if !bytes.HasPrefix(data, []byte("ID3")) {
+		t.Fatalf("no ID3v2 tag")
+	}
+	version := data[3]
+	end := 10 + int(syncsafe(data[6:10]))
+	var frames [][]byte
+	for pos := 10; pos+10 <= end && data[pos] != 0; {
+		size := int(binary.BigEndian.Uint32(data[pos+4:]))
+		if version == 4 {
+			size = int(syncsafe(data[pos+4 : pos+8]))
+		}
+		frames = append(frames, data[pos:pos+10+size])
+		pos += 10 + size
+	}
+	return frames, data[end:]
+}
+
+// rewriteBytes runs rewrite on data through a temporary file.
+func rewriteBytes(t *testing.T, data []byte, rewrite func(src *os.File, dst io.Writer) error) []byte {
+	src, err := ioutil.TempFile("", "tremote_tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+	src.Write(data)
+	src.Seek(0, io.SeekStart)
+	var dst bytes.Buffer
+	if err := rewrite(src, &dst); err != nil {
+		t.Fatal(err)
+	}
+	return dst.Bytes()
+}
+
+func TestRewriteID3Popm(t *testing.T) {
+	audio := newMp3Fixture(1, 3).mp3Bytes()
+	audio = audio[10+int(syncsafe(audio[6:10])):]
+	for _, version := range []byte{3, 4} {
+		title := id3Frame(version, "TIT2", []byte("\x00Song 1"))
+		// a POPM frame of another player, with a play counter
+		wmp := id3Frame(version, "POPM", []byte("Windows Media Player 9 Series\x00\xc4\x00\x00\x00\x07"))
+		ours := func(rating byte) []byte {
+			return id3Frame(version, "POPM", append([]byte(popmEmail), 0, rating))
+		}
+		tests := []struct {
+			name   string
+			frames [][]byte
+			rating byte
+			want   [][]byte
+		}{
+			{"add", [][]byte{title, wmp}, 196, [][]byte{title, wmp, ours(196)}},
+			{"replace", [][]byte{title, ours(64), wmp}, 255, [][]byte{title, ours(255), wmp}},
+			{"remove", [][]byte{wmp, ours(64), title}, 0, [][]byte{wmp, title}},
+			{"nothing to remove", [][]byte{title, wmp}, 0, [][]byte{title, wmp}},
+		}
+		for _, test := range tests {
+			for _, padding := range []int{0, 2000} {
+				got := rewriteBytes(t, id3File(version, test.frames, padding, audio), func(src *os.File, dst io.Writer) error {
+					return rewriteID3Popm(src, dst, test.rating)
+				})
+				if got[3] != version {
+					t.Errorf("v2.%d %s: rewritten as v2.%d", version, test.name, got[3])
+				}
+				frames, gotAudio := id3Frames(t, got)
+				if !bytes.Equal(bytes.Join(frames, nil), bytes.Join(test.want, nil)) {
+					t.Errorf("v2.%d %s, %d padding: frames %q, want %q", version, test.name, padding, frames, test.want)
+				}
+				if !bytes.Equal(gotAudio, audio) {
+					t.Errorf("v2.%d %s, %d padding: audio changed", version, test.name, padding)
+				}
+			}
+		}
+	}
+
+	// a file without tag gets a v2.3 one
+	got := rewriteBytes(t, audio, func(src *os.File, dst io.Writer) error {
+		return rewriteID3Popm(src, dst, 128)
+	})
+	frames, gotAudio := id3Frames(t, got)
+	if got[3] != 3 || len(frames) != 1 || !bytes.Equal(frames[0], id3Frame(3, "POPM", append([]byte(popmEmail), 0, 128))) ||
+		!bytes.Equal(gotAudio, audio) {
+		t.Errorf("no tag: %q", got[:40])
+	}
+
+	for name, data := range map[string][]byte{
+		"v2.2":              append([]byte{'I', 'D', '3', 2, 0, 0, 0, 0, 0, 0}, audio...),
+		"unsynchronisation": append([]byte{'I', 'D', '3', 3, 0, 0x80, 0, 0, 0, 0}, audio...),
+		"frame too long":    id3File(3, [][]byte{id3Frame(3, "TIT2", []byte("\x00Song 1"))[:12]}, 0, audio),
+	} {
+		src, err := ioutil.TempFile("", "tremote_tags")
+		if err != nil {
+			t.Fatal(err)
+		}
+		src.Write(data)
+		src.Seek(0, io.SeekStart)
+		if err := rewriteID3Popm(src, ioutil.Discard, 128); err != errUnsupportedTag {
+			t.Errorf("%s: %v, want %v", name, err, errUnsupportedTag)
+		}
+		src.Close()
+		os.Remove(src.Name())
+	}
+}
+
+// flacBlock is a metadata block of a flac file.
+type flacBlock struct {
+	typ  byte
+	data []byte
+}
+
+// flacBlocks splits a flac file into its metadata blocks and the audio.
+func flacBlocks(t *testing.T, data []byte) ([]flacBlock, []byte) {
+	if !bytes.HasPrefix(data, []byte("fLaC")) {
+		t.Fatalf("no flac file")
+	}
+	var blocks []flacBlock
+	pos := 4
+	for last := false; !last; {
+		last = data[pos]&0x80 != 0
+		size := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		blocks = append(blocks, flacBlock{data[pos] & 0x7f, data[pos+4 : pos+4+size]})
+		pos += 4 + size
+	}
+	return blocks, data[pos:]
+}
+
+// vorbisComments returns the vendor and the comments of a VORBIS_COMMENT block.
+func vorbisComments(data []byte) (string, []string) {
+	n := int(binary.LittleEndian.Uint32(data))
+	vendor := string(data[4 : 4+n])
+	pos := 4 + n
+	count := int(binary.LittleEndian.Uint32(data[pos:]))
+	pos += 4
+	var comments []string
+	for i := 0; i < count; i++ {
+		n := int(binary.LittleEndian.Uint32(data[pos:]))
+		comments = append(comments, string(data[pos+4:pos+4+n]))
+		pos += 4 + n
+	}
+	return vendor, comments
+}
+
+func TestRewriteFlacComments(t *testing.T) {
+	fx := newFlacFixture(1, 44100, 16, 0.1)
+	data := fx.flacBytes()
+	blocks, audio := flacBlocks(t, data)
+	vendor, _ := vorbisComments(blocks[1].data)
+	// a PADDING block after the comments, and a file without comments
+	padded := append([]byte("fLaC"), 0, 0, 0, 34)
+	padded = append(padded, blocks[0].data...)
+	n := len(blocks[1].data)
+	padded = append(padded, 4, byte(n>>16), byte(n>>8), byte(n))
+	padded = append(padded, blocks[1].data...)
+	padded = append(padded, 0x81, 0, 0, 16)
+	padded = append(padded, make([]byte, 16)...)
+	padded = append(padded, audio...)
+	noComments := append([]byte("fLaC"), 0x80, 0, 0, 34)
+	noComments = append(noComments, blocks[0].data...)
+	noComments = append(noComments, audio...)
+
+	rate := []string{"RATING", "FMPS_RATING"}
+	tests := []struct {
+		name   string
+		data   []byte
+		remove []string
+		add    []string
+		want   []string
+		types  []byte
+	}{
+		{"add", data, rate, []string{"RATING=80", "FMPS_RATING=0.8"},
+			[]string{"TITLE=Song 1", "RATING=80", "FMPS_RATING=0.8"}, []byte{0, 4}},
+		{"padding", padded, rate, []string{"RATING=100", "FMPS_RATING=1.0"},
+			[]string{"TITLE=Song 1", "RATING=100", "FMPS_RATING=1.0"}, []byte{0, 4, 1}},
+		{"no comments", noComments, rate, []string{"RATING=20"}, []string{"RATING=20"}, []byte{0, 4}},
+	}
+	for _, test := range tests {
+		got := rewriteBytes(t, test.data, func(src *os.File, dst io.Writer) error {
+			return rewriteFlacComments(src, dst, test.remove, test.add)
+		})
+		gotBlocks, gotAudio := flacBlocks(t, got)
+		var types []byte
+		for _, b := range gotBlocks {
+			types = append(types, b.typ)
+		}
+		if !bytes.Equal(types, test.types) || !bytes.Equal(gotBlocks[0].data, blocks[0].data) {
+			t.Fatalf("%s: blocks %v, want %v", test.name, types, test.types)
+		}
+		gotVendor, comments := vorbisComments(gotBlocks[1].data)
+		if test.name != "no comments" && gotVendor != vendor || !equalStrings(comments, test.want) {
+			t.Errorf("%s: vendor %q, comments %q; want %q", test.name, gotVendor, comments, test.want)
+		}
+		if len(gotBlocks) > 2 && !bytes.Equal(gotBlocks[2].data, make([]byte, 16)) {
+			t.Errorf("%s: padding changed", test.name)
+		}
+		if !bytes.Equal(gotAudio, audio) {
+			t.Errorf("%s: audio changed", test.name)
+		}
+
+		// a second rating replaces the first, case insensitive; the block shrinks
+		again := rewriteBytes(t, got, func(src *os.File, dst io.Writer) error {
+			return rewriteFlacComments(src, dst, []string{"rating", "fmps_rating"}, nil)
+		})
+		againBlocks, againAudio := flacBlocks(t, again)
+		if _, comments := vorbisComments(againBlocks[1].data); len(comments) != len(test.want)-len(test.add) ||
+			!bytes.Equal(againAudio, audio) {
+			t.Errorf("%s: rating not removed: %q", test.name, comments)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestWriteRating rates files on disk: the result must still play bit-perfect
+// and keep its mode and modification time.
+func TestWriteRating(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	dir, err := ioutil.TempDir("", "tremote_tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	flac := newFlacFixture(1, 44100, 16, 0.3)
+	mp3 := newMp3Fixture(2, 10)
+	mtime := time.Now().Add(-400 * 24 * time.Hour).Truncate(time.Second)
+	for _, fx := range []*fixture{flac, mp3} {
+		fx.write(t, dir)
+		pathfile := dir + "/" + fx.name
+		os.Chmod(pathfile, 0640)
+		os.Chtimes(pathfile, mtime, mtime)
+		for _, stars := range []int{4, 5, 0} {
+			if err := writeRating(pathfile, stars, false); err != nil {
+				t.Fatalf("%s, %d stars: %v", fx.name, stars, err)
+			}
+			fi, err := os.Stat(pathfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode() != 0640 || !fi.ModTime().Equal(mtime) {
+				t.Errorf("%s, %d stars: mode %v, mtime %v; want %v, %v", fx.name, stars, fi.Mode(), fi.ModTime(), os.FileMode(0640), mtime)
+			}
+		}
+	}
+	if entry, err := checkFlac(dir+"/"+flac.name, newCheckThrottle(100), func() bool { return false }); err != nil || entry.result != checkOK {
+		t.Errorf("rated flac: %s (%s) %v", entry.result, entry.detail, err)
+	}
+	data, err := ioutil.ReadFile(dir + "/" + mp3.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := mp3.mp3Bytes()
+	if _, audio := id3Frames(t, data); !bytes.Equal(audio, orig[10+int(syncsafe(orig[6:10])):]) {
+		t.Errorf("rated mp3: audio changed")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("%d files left in the directory, want 2", len(files))
+	}
+}
+
+// foreignOwner makes a file look owned by the next user and group.
+type foreignOwner struct {
+	os.FileInfo
+}
+
+func (fi foreignOwner) Sys() interface{} {
+	st := *fi.FileInfo.Sys().(*syscall.Stat_t)
+	st.Uid++
+	st.Gid++
+	return &st
+}
+
+// TestRateForeignFile rates a song owned by another user: the owner cannot be
+// restored (only root may chown), but the rating is still written and the
+// mode and modification time are kept.
+func TestRateForeignFile(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	defer func(orig func(string, int, int) error) { chownFile = orig }(chownFile)
+	var chowns int
+	chownFile = func(name string, uid, gid int) error {
+		chowns++
+		return &os.PathError{Op: "chown", Path: name, Err: syscall.EPERM}
+	}
+	dir, err := ioutil.TempDir("", "tremote_tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fx := newMp3Fixture(1, 10)
+	fx.write(t, dir)
+	pathfile := dir + "/" + fx.name
+	mtime := time.Now().Add(-400 * 24 * time.Hour).Truncate(time.Second)
+	checkAttributes := func(name string) {
+		fi, err := os.Stat(pathfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != 0640 || !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: mode %v, mtime %v; want %v, %v", name, fi.Mode(), fi.ModTime(), os.FileMode(0640), mtime)
+		}
+	}
+	os.Chmod(pathfile, 0640)
+	os.Chtimes(pathfile, mtime, mtime)
+
+	// our own file: no chown needed
+	if err := writeRating(pathfile, 3, false); err != nil || chowns != 0 {
+		t.Errorf("own file: err=%v, %d chowns", err, chowns)
+	}
+	checkAttributes("own file")
+
+	fi, err := os.Stat(pathfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keepAttributes(pathfile, foreignOwner{fi}); err != nil || chowns != 1 {
+		t.Errorf("keepAttributes: err=%v, %d chowns", err, chowns)
+	}
+	checkAttributes("keepAttributes")
+
+	// only root can give the song to another user
+	if os.Getuid() == 0 {
+		if err := os.Chown(pathfile, 12345, 12345); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeRating(pathfile, 5, false); err != nil || chowns != 2 {
+			t.Fatalf("foreign file: err=%v, %d chowns", err, chowns)
+		}
+		checkAttributes("foreign file")
+		data, err := ioutil.ReadFile(pathfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames, _ := id3Frames(t, data)
+		rated := false
+		for _, frame := range frames {
+			rated = rated || isOurPopm(frame) && frame[len(frame)-1] == popmByte[5]
+		}
+		if !rated {
+			t.Errorf("foreign file: not rated, frames %q", frames)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"math"
+)
+
+// resampleQuality is a preset of the resampler filter.
+type resampleQuality struct {
+	name          string
+	zeroCrossings int     // of the sinc on each side: the filter length
+	rolloff       float64 // cutoff, as a fraction of the lower Nyquist frequency
+	beta          float64 // Kaiser window; higher: more stopband attenuation, wider transition
+}
+
+const (
+	resampleOff     = "off"
+	defaultResample = "good"
+)
+
+// resampleQualities are the presets of resample= (mapping line or config.txt).
+var resampleQualities = []resampleQuality{
+	{name: "fast", zeroCrossings: 8, rolloff: 0.85, beta: 8},
+	{name: "good", zeroCrossings: 16, rolloff: 0.91, beta: 10},
+	{name: "best", zeroCrossings: 32, rolloff: 0.95, beta: 12},
+}
+
+// maxResamplePhases is the number of filter phases kept, at most. Rates with
+// a larger ratio (after reduction) use the nearest phase.
+const maxResamplePhases = 1024
+
+// resampleMode returns resample= of the active mapping line, or else
+// resample in config.txt.
+func resampleMode() string {
+	playModeLock.Lock()
+	mode, ok := activeOptions["resample"]
+	playModeLock.Unlock()
+	if !ok {
+		mode = configResample
+	}
+	if mode == resampleOff {
+		return mode
+	}
+	if _, ok := findResampleQuality(mode); !ok {
+		logm.Warningf("%s unknown resample=%s", pluginname, mode)
+		return defaultResample
+	}
+	return mode
+}
+
+func findResampleQuality(name string) (resampleQuality, bool) {
+	for _, q := range resampleQualities {
+		if q.name == name {
+			return q, true
+		}
+	}
+	return resampleQualities[1], false
+}
+
+/*
+resampler converts interleaved samples to another rate, for a device that
+does not take the rate of a song. It is a polyphase windowed-sinc filter: for
+a ratio of out/in = l/m (reduced), output frame j lies at input frame j*m/l,
+and is the sum of the input frames around it, weighted by the phase of the
+filter for the fraction j*m%l/l. Each phase is a Kaiser windowed sinc with
+its cutoff below the lower of both Nyquist frequencies, scaled to unity gain.
+Output frame 0 lies on input frame 0: there is no delay to make up for, but
+the last half filter length of a song is not played. Buffers are allocated up
+front: process does not allocate.
+*/
+type resampler struct {
+	quality  resampleQuality
+	channels int
+	l, m     int       // out/in rate ratio, reduced
+	phases   int       // filter phases: l, or maxResamplePhases if l is larger
+	half     int       // taps on each side of the output position
+	taps     int       // 2*half
+	coeffs   []float32 // phases*taps
+	min, max float64   // sample range of the song's bit depth
+
+	in     []int32 // input frames, interleaved: history, then the last process call
+	frames int     // frames in in
+	pos    int     // input frame at or before the next output frame
+	phase  int     // position of the next output frame after pos, in 1/l frames
+	buf    []int32 // output
+}
+
+// newResampler returns a resampler from inRate to outRate of samples of bits,
+// for writes of up to maxSamples samples.
+func newResampler(channels int, inRate int, outRate int, bits int, maxSamples int, quality resampleQuality) *resampler {
+	g := gcd(inRate, outRate)
+	r := &resampler{quality: quality, channels: channels, l: outRate / g, m: inRate / g}
+	r.phases = r.l
+	if r.phases > maxResamplePhases {
+		r.phases = maxResamplePhases
+	}
+	// downsampling: the cutoff moves down, the filter gets longer
+	scale := 1.0
+	if r.l < r.m {
+		scale = float64(r.l) / float64(r.m)
+	}
+	r.half = int(math.Ceil(float64(quality.zeroCrossings) / scale))
+	r.taps = 2 * r.half
+	r.coeffs = make([]float32, r.phases*r.taps)
+	cutoff := quality.rolloff * scale
+	norm := besselI0(quality.beta)
+	for p := 0; p < r.phases; p++ {
+		coeffs := r.coeffs[p*r.taps : (p+1)*r.taps]
+		frac := float64(p) / float64(r.phases)
+		sum := 0.0
+		h := make([]float64, r.taps)
+		for k := range h {
+			// distance of tap k from the output position, in input frames
+			d := float64(k-r.half+1) - frac
+			x := d / float64(r.half)
+			if x <= -1 || x >= 1 {
+				continue
+			}
+			h[k] = cutoff * sinc(cutoff*d) * besselI0(quality.beta*math.Sqrt(1-x*x)) / norm
+			sum += h[k]
+		}
+		for k := range h {
+			coeffs[k] = float32(h[k] / sum)
+		}
+	}
+	r.max = float64(int32(1)<<uint(bits-1) - 1)
+	r.min = -r.max - 1
+
+	// start with half-1 frames of silence before the first frame
+	r.frames = r.half - 1
+	r.pos = r.half - 1
+	r.in = make([]int32, (r.taps+maxSamples/channels+1)*channels)
+	r.buf = make([]int32, r.outputSize(maxSamples))
+	return r
+}
+
+// outputSize returns the number of samples process returns for n samples, at most.
+func (r *resampler) outputSize(n int) int {
+	frames := int64(n / r.channels)
+	return int((frames*int64(r.l)/int64(r.m) + 2) * int64(r.channels))
+}
+
+// process resamples samples; the result is valid until the next call.
+func (r *resampler) process(samples []int32) []int32 {
+	ch := r.channels
+	r.frames += copy(r.in[r.frames*ch:], samples) / ch
+	out := r.buf[:0]
+	for r.pos+r.half < r.frames {
+		p := r.phase
+		if r.phases != r.l {
+			p = int(int64(r.phase) * int64(r.phases) / int64(r.l))
+		}
+		coeffs := r.coeffs[p*r.taps : (p+1)*r.taps]
+		x := r.in[(r.pos-r.half+1)*ch : (r.pos+r.half+1)*ch]
+		if ch == 2 {
+			var left, right float64
+			for k, h := range coeffs {
+				left += float64(x[2*k]) * float64(h)
+				right += float64(x[2*k+1]) * float64(h)
+			}
+			out = append(out, r.clip(left), r.clip(right))
+		} else {
+			for c := 0; c < ch; c++ {
+				var acc float64
+				for k, h := range coeffs {
+					acc += float64(x[k*ch+c]) * float64(h)
+				}
+				out = append(out, r.clip(acc))
+			}
+		}
+		r.phase += r.m
+		r.pos += r.phase / r.l
+		r.phase %= r.l
+	}
+	// keep the frames the next output frames need
+	if drop := r.pos - r.half + 1; drop > 0 {
+		copy(r.in, r.in[drop*ch:r.frames*ch])
+		r.frames -= drop
+		r.pos -= drop
+	}
+	return out
+}
+
+// clip rounds v to a sample of the song's bit depth.
+func (r *resampler) clip(v float64) int32 {
+	v = math.Floor(v + 0.5)
+	if v > r.max {
+		return int32(r.max)
+	}
+	if v < r.min {
+		return int32(r.min)
+	}
+	return int32(v)
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// besselI0 is the modified Bessel function of the first kind, order 0.
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; term > 1e-12*sum; k++ {
+		term *= (x / (2 * float64(k))) * (x / (2 * float64(k)))
+		sum += term
+	}
+	return sum
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// sine returns seconds of a sine of freq Hz at rate, amplitude in full scale
+// of bits, in all channels.
+func sine(channels int, rate int, bits int, freq float64, amplitude float64, seconds float64) []int32 {
+	frames := int(seconds * float64(rate))
+	samples := make([]int32, frames*channels)
+	scale := amplitude * float64(int32(1)<<uint(bits-1)-1)
+	for i := 0; i < frames; i++ {
+		v := int32(math.Floor(scale*math.Sin(2*math.Pi*freq*float64(i)/float64(rate)) + 0.5))
+		for c := 0; c < channels; c++ {
+			samples[i*channels+c] = v
+		}
+	}
+	return samples
+}
+
+// resampleAll resamples samples in chunks of chunk samples.
+func resampleAll(r *resampler, samples []int32, chunk int) []int32 {
+	var out []int32
+	for len(samples) > 0 {
+		n := chunk
+		if n > len(samples) {
+			n = len(samples)
+		}
+		out = append(out, r.process(samples[:n])...)
+		samples = samples[n:]
+	}
+	return out
+}
+
+// snr returns the signal to noise ratio in dB of got, a sine of freq Hz at
+// rate, compared to the exact sine. The ends are left out: the filter only
+// sees half of its input there.
+func snr(got []int32, channels int, rate int, bits int, freq float64, amplitude float64) float64 {
+	scale := amplitude * float64(int32(1)<<uint(bits-1)-1)
+	var signal, noise float64
+	frames := len(got) / channels
+	for i := rate / 100; i < frames-rate/100; i++ {
+		want := scale * math.Sin(2*math.Pi*freq*float64(i)/float64(rate))
+		for c := 0; c < channels; c++ {
+			d := float64(got[i*channels+c]) - want
+			signal += want * want
+			noise += d * d
+		}
+	}
+	return 10 * math.Log10(signal/noise)
+}
+
+func TestResamplerQuality(t *testing.T) {
+	tests := []struct {
+		in, out int
+		bits    int
+		minSNR  []float64 // dB, of fast, good and best
+	}{
+		{44100, 48000, 24, []float64{85, 98, 115}},
+		{88200, 48000, 24, []float64{85, 98, 115}},
+		{44100, 96000, 16, []float64{84, 86, 86}}, // 16 bit: rounding noise
+		{48000, 44100, 24, []float64{85, 98, 115}},
+		{96000, 192000, 24, []float64{85, 98, 115}},
+	}
+	for _, test := range tests {
+		samples := sine(2, test.in, test.bits, 997, 0.5, 0.5)
+		for i, quality := range resampleQualities {
+			r := newResampler(2, test.in, test.out, test.bits, 4096, quality)
+			got := resampleAll(r, samples, 4096)
+			frames := len(got) / 2
+			want := len(samples) / 2 * test.out / test.in
+			if frames > want || frames < want-r.half*test.out/test.in-2 {
+				t.Errorf("%d to %d %s: %d frames, want %d", test.in, test.out, quality.name, frames, want)
+			}
+			if db := snr(got, 2, test.out, test.bits, 997, 0.5); db < test.minSNR[i] {
+				t.Errorf("%d to %d %s: SNR %.1f dB, want %.0f dB", test.in, test.out, quality.name, db, test.minSNR[i])
+			}
+		}
+	}
+}
+
+// TestResamplerStopband checks that a tone above the Nyquist frequency of the
+// output rate does not fold back into the audio band.
+func TestResamplerStopband(t *testing.T) {
+	minAttenuation := []float64{85, 100, 110} // dB, of fast, good and best
+	samples := sine(1, 96000, 24, 30000, 0.5, 0.5)
+	for i, quality := range resampleQualities {
+		r := newResampler(1, 96000, 48000, 24, 4096, quality)
+		got := resampleAll(r, samples, 4096)
+		// the 30 kHz tone would alias to 18 kHz: compare the power left with the
+		// input's, leaving out the ends, where the tone starts and stops
+		var in, out float64
+		for _, v := range samples[960 : len(samples)-960] {
+			in += float64(v) * float64(v)
+		}
+		for _, v := range got[480 : len(got)-480] {
+			out += float64(v) * float64(v)
+		}
+		in /= float64(len(samples) - 2*960)
+		out /= float64(len(got) - 2*480)
+		if db := 10 * math.Log10(in/out); db < minAttenuation[i] {
+			t.Errorf("%s: 30 kHz attenuated by %.1f dB, want %.0f dB", quality.name, db, minAttenuation[i])
+		}
+	}
+}
+
+func TestResamplerChunks(t *testing.T) {
+	// DC stays DC
+	dc := make([]int32, 2000)
+	for i := range dc {
+		dc[i] = 1000
+	}
+	r := newResampler(1, 44100, 48000, 24, len(dc), resampleQualities[1])
+	for i, v := range r.process(dc)[r.half:] {
+		if v != 1000 {
+			t.Fatalf("DC: sample %d is %d, want 1000", i, v)
+		}
+	}
+
+	// stereo 44100 to 48000, in one go and in odd chunks
+	rnd := rand.New(rand.NewSource(1))
+	samples := make([]int32, 2*44100)
+	for i := range samples {
+		samples[i] = rnd.Int31n(1<<23) - 1<<22
+	}
+	quality := resampleQualities[0]
+	whole := resampleAll(newResampler(2, 44100, 48000, 24, len(samples), quality), samples, len(samples))
+	r = newResampler(2, 44100, 48000, 24, 2*333, quality)
+	chunked := resampleAll(r, samples, 2*333)
+	if !equalSamples(chunked, whole) {
+		t.Errorf("chunked output differs")
+	}
+	for _, n := range []int{2, 2 * 333} {
+		if out := len(r.process(samples[:n])); out > r.outputSize(n) {
+			t.Errorf("%d samples out of %d, outputSize %d", out, n, r.outputSize(n))
+		}
+	}
+	if allocs := testing.AllocsPerRun(100, func() { r.process(samples[:2*333]) }); allocs != 0 {
+		t.Errorf("%.1f allocations per process, want 0", allocs)
+	}
+}
+
+func BenchmarkResample44to48(b *testing.B) {
+	samples := sine(2, 44100, 24, 997, 0.5, 0.1)[:2*4096]
+	r := newResampler(2, 44100, 48000, 24, len(samples), resampleQualities[1])
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.process(samples)
+	}
+}
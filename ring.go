@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/mehrvarz/tremote_plugin"
+)
+
+// ringSeconds is how much decoded audio playSong keeps ahead of the output.
+// Enough to ride out a Pi Zero busy with scanning a folder or scaling artwork.
+const ringSeconds = 4
+
+/*
+sampleRing is a single producer, single consumer ring buffer of interleaved
+samples: the decoder goroutine puts, the output loop gets. Neither takes a
+lock; each side only stores its own counter. The channels merely wake up a
+side waiting for the other one.
+*/
+type sampleRing struct {
+	// 64-bit words first: atomic access needs them aligned on ARM
+	written uint64 // samples put so far; stored by the producer only
+	taken   uint64 // samples got so far; stored by the consumer only
+
+	buf   []int32
+	mask  uint64
+	rate  int           // samples per second, all channels
+	data  chan struct{} // signalled after a put
+	space chan struct{} // signalled after a get
+}
+
+// newSampleRing returns a ring for seconds of audio at rate samples per second
+// (all channels), and at least minSize samples.
+func newSampleRing(seconds int, rate int, minSize int) *sampleRing {
+	size := seconds * rate
+	if size < minSize {
+		size = minSize
+	}
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+	return &sampleRing{buf: make([]int32, n), mask: uint64(n - 1), rate: rate,
+		data: make(chan struct{}, 1), space: make(chan struct{}, 1)}
+}
+
+// put appends samples, waiting for space as needed. It returns false if stop
+// was closed before all of them fit.
+func (ring *sampleRing) put(samples []int32, stop <-chan struct{}) bool {
+	for len(samples) > 0 {
+		written := atomic.LoadUint64(&ring.written)
+		free := uint64(len(ring.buf)) - (written - atomic.LoadUint64(&ring.taken))
+		if free == 0 {
+			select {
+			case <-ring.space:
+			case <-stop:
+				return false
+			}
+			continue
+		}
+		if free > uint64(len(samples)) {
+			free = uint64(len(samples))
+		}
+		pos := written & ring.mask
+		n := copy(ring.buf[pos:], samples[:free])
+		copy(ring.buf, samples[n:free])
+		atomic.StoreUint64(&ring.written, written+free)
+		signal(ring.data)
+		samples = samples[free:]
+	}
+	return true
+}
+
+// get moves up to len(dst) samples into dst and returns their number. It does
+// not wait; 0 means the ring is empty.
+func (ring *sampleRing) get(dst []int32) int {
+	taken := atomic.LoadUint64(&ring.taken)
+	avail := atomic.LoadUint64(&ring.written) - taken
+	if avail > uint64(len(dst)) {
+		avail = uint64(len(dst))
+	}
+	if avail == 0 {
+		return 0
+	}
+	pos := taken & ring.mask
+	n := copy(dst[:avail], ring.buf[pos:])
+	copy(dst[n:avail], ring.buf)
+	atomic.StoreUint64(&ring.taken, taken+avail)
+	signal(ring.space)
+	return int(avail)
+}
+
+// buffered returns the number of samples waiting to be got.
+func (ring *sampleRing) buffered() int {
+	taken := atomic.LoadUint64(&ring.taken)
+	return int(atomic.LoadUint64(&ring.written) - taken)
+}
+
+// fill returns the fill level in percent.
+func (ring *sampleRing) fill() int {
+	return ring.buffered() * 100 / len(ring.buf)
+}
+
+// seconds returns the capacity in seconds of audio.
+func (ring *sampleRing) seconds() float64 {
+	return float64(len(ring.buf)) / float64(ring.rate)
+}
+
+// signal wakes up whoever waits on c, if anyone; it never blocks.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+/*
+bufferStats is reported by the Buffer command and logged at the end of each
+song. The counters cover all songs since the plugin was loaded.
+*/
+var bufferStats struct {
+	underruns  uint64       // the output found the ring empty while the decoder was still busy
+	underflows uint64       // the sink ran dry ("Output underflowed")
+	ring       atomic.Value // *sampleRing of the song playing; nil if none
+}
+
+func setPlayingRing(ring *sampleRing) {
+	bufferStats.ring.Store(ring)
+}
+
+// bufferReport returns e.g. "buffer 97% of 4.0s, underruns 0, sink underflows 0".
+func bufferReport() string {
+	state := "buffer idle"
+	if ring, _ := bufferStats.ring.Load().(*sampleRing); ring != nil {
+		state = fmt.Sprintf("buffer %d%% of %.1fs", ring.fill(), ring.seconds())
+	}
+	return fmt.Sprintf("%s, underruns %d, sink underflows %d", state,
+		atomic.LoadUint64(&bufferStats.underruns), atomic.LoadUint64(&bufferStats.underflows))
+}
+
+// cmdBuffer shows the fill level of the decode-ahead buffer and the underrun
+// counters, e.g. to see whether a Pi Zero keeps up.
+func cmdBuffer(args []string, ph tremote_plugin.PluginHelper) {
+	report := bufferReport()
+	logm.Infof("%s %s", pluginname, report)
+	ph.PrintStatus(report)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSampleRing(t *testing.T) {
+	// odd chunk sizes, so that puts and gets wrap around the end at different places
+	ring := newSampleRing(1, 1000, 0)
+	if len(ring.buf) != 1024 {
+		t.Fatalf("ring of %d samples, want 1024", len(ring.buf))
+	}
+	const total = 100000
+	stop := make(chan struct{})
+	defer close(stop)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		block := make([]int32, 333)
+		for n := 0; n < total; {
+			if total-n < len(block) {
+				block = block[:total-n]
+			}
+			for i := range block {
+				block[i] = int32(n + i)
+			}
+			if !ring.put(block, stop) {
+				return
+			}
+			n += len(block)
+		}
+	}()
+
+	dst := make([]int32, 457)
+	next := 0
+	deadline := time.Now().Add(waitTimeout)
+	for next < total && time.Now().Before(deadline) {
+		n := ring.get(dst)
+		if n == 0 {
+			select {
+			case <-ring.data:
+			case <-time.After(10 * time.Millisecond):
+			}
+			continue
+		}
+		for _, sample := range dst[:n] {
+			if int(sample) != next {
+				t.Fatalf("got sample %d, want %d", sample, next)
+			}
+			next++
+		}
+	}
+	<-done
+	if next != total || ring.buffered() != 0 {
+		t.Errorf("got %d samples, %d left; want %d, 0 left", next, ring.buffered(), total)
+	}
+}
+
+func TestSampleRingStop(t *testing.T) {
+	ring := newSampleRing(1, 16, 0)
+	stop := make(chan struct{})
+	result := make(chan bool)
+	go func() { result <- ring.put(make([]int32, 40), stop) }()
+	waitFor(t, "full ring", func() bool { return ring.buffered() == 16 })
+	if ring.fill() != 100 {
+		t.Errorf("fill %d%%, want 100%%", ring.fill())
+	}
+	close(stop)
+	if <-result {
+		t.Errorf("put returned true after stop")
+	}
+}
+
+func TestBufferCommand(t *testing.T) {
+	host := newFakeHost()
+	ring := newSampleRing(2, 1000, 0)
+	ring.put(make([]int32, 512), nil)
+	setPlayingRing(ring)
+	defer setPlayingRing(nil)
+	cmdBuffer(nil, host.ph)
+	status := host.args("PrintStatus")
+	if len(status) != 1 || !strings.HasPrefix(status[0], "buffer 25% of 2.0s, underruns ") {
+		t.Errorf("PrintStatus %q", status)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Offline scrobbling. Completed plays are appended to .scrobbler.log in homedir,
+in the Audioscrobbler portable player format (as written by Rockbox), so that
+existing tools can submit them to Last.fm or ListenBrainz later. A play counts
+as completed once half of the song or 4 minutes have been heard. Songs shorter
+than 30 seconds and songs without artist or title are not scrobbled.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	scrobbleMinDuration = 30.0  // seconds
+	scrobbleMaxRequired = 240.0 // seconds heard that always count as completed
+)
+
+type scrobbleEntry struct {
+	artist   string
+	album    string
+	title    string
+	track    int       // 0 = unknown
+	duration float64   // seconds; 0 = unknown
+	heard    float64   // seconds
+	start    time.Time // start of playback
+}
+
+var (
+	scrobbleLock    sync.Mutex
+	scrobbleLogfile string // "" = no scrobbling
+)
+
+func initScrobbleLog(homedir string) {
+	scrobbleLock.Lock()
+	scrobbleLogfile = homedir + "/.scrobbler.log"
+	scrobbleLock.Unlock()
+}
+
+// completed reports whether enough of the song was heard to scrobble it.
+func (e scrobbleEntry) completed() bool {
+	if e.artist == "" || e.title == "" {
+		return false
+	}
+	if e.duration > 0 && e.duration < scrobbleMinDuration {
+		return false
+	}
+	return mostlyHeard(e.heard, e.duration)
+}
+
+// scrobble appends e to the scrobble log if it is a completed play.
+func scrobble(e scrobbleEntry) {
+	if !e.completed() {
+		return
+	}
+	scrobbleLock.Lock()
+	defer scrobbleLock.Unlock()
+	if scrobbleLogfile == "" {
+		return
+	}
+	file, err := os.OpenFile(scrobbleLogfile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logm.Warningf("%s scrobble log err=%s", pluginname, err.Error())
+		return
+	}
+	defer file.Close()
+	if fi, err := file.Stat(); err == nil && fi.Size() == 0 {
+		fmt.Fprintf(file, "#AUDIOSCROBBLER/1.1\n#TZ/UTC\n#CLIENT/%s\n", pluginname)
+	}
+
+	track := ""
+	if e.track > 0 {
+		track = fmt.Sprintf("%d", e.track)
+	}
+	// artist album title tracknum duration rating(L=listened) timestamp musicbrainz-id
+	_, err = fmt.Fprintf(file, "%s\t%s\t%s\t%s\t%d\tL\t%d\t\n",
+		scrobbleField(e.artist), scrobbleField(e.album), scrobbleField(e.title), track,
+		int(e.duration+0.5), e.start.Unix())
+	if err != nil {
+		logm.Warningf("%s scrobble log err=%s", pluginname, err.Error())
+	}
+}
+
+// scrobbleField removes the tabs and line breaks that would break the format.
+func scrobbleField(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return ' '
+		}
+		return r
+	}, strings.TrimSpace(s))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestScrobbleCompleted(t *testing.T) {
+	tests := []struct {
+		name            string
+		artist, title   string
+		duration, heard float64
+		want            bool
+	}{
+		{"half heard", "Band", "Song", 300, 150, true},
+		{"less than half", "Band", "Song", 300, 149, false},
+		{"4 minutes of a long song", "Band", "Song", 1200, 240, true},
+		{"short song", "Band", "Song", 29, 29, false},
+		{"30 seconds", "Band", "Song", 30, 15, true},
+		{"unknown duration", "Band", "Song", 0, 239, false},
+		{"unknown duration, 4 minutes", "Band", "Song", 0, 240, true},
+		{"no artist", "", "Song", 300, 300, false},
+		{"no title", "Band", "", 300, 300, false},
+	}
+	for _, test := range tests {
+		e := scrobbleEntry{artist: test.artist, title: test.title, duration: test.duration, heard: test.heard}
+		if got := e.completed(); got != test.want {
+			t.Errorf("%s: completed %v", test.name, got)
+		}
+	}
+}
+
+func TestScrobbleLog(t *testing.T) {
+	home, err := ioutil.TempDir("", "tremote_home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	scrobbleLock.Lock()
+	logfile := scrobbleLogfile
+	scrobbleLock.Unlock()
+	defer func() {
+		scrobbleLock.Lock()
+		scrobbleLogfile = logfile
+		scrobbleLock.Unlock()
+	}()
+	initScrobbleLog(home)
+
+	start := time.Unix(1760000000, 0)
+	scrobble(scrobbleEntry{artist: "The Band", album: "Live\tat Home", title: " Intro\r\n", track: 1,
+		duration: 61.6, heard: 61.6, start: start})
+	scrobble(scrobbleEntry{artist: "The Band", title: "Skipped", duration: 200, heard: 20, start: start})
+	scrobble(scrobbleEntry{artist: "Solo", title: "Stream", heard: 300, start: start.Add(time.Hour)})
+	data, err := ioutil.ReadFile(home + "/.scrobbler.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "#AUDIOSCROBBLER/1.1\n#TZ/UTC\n#CLIENT/" + pluginname + "\n" +
+		"The Band\tLive at Home\tIntro\t1\t62\tL\t1760000000\t\n" +
+		"Solo\t\tStream\t\t0\tL\t1760003600\t\n"
+	if string(data) != want {
+		t.Errorf("scrobble log\n%q\nwant\n%q", data, want)
+	}
+}
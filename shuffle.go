@@ -0,0 +1,145 @@
+/*
+Shuffle randomness. All random decisions of the jukebox are taken from one
+seeded source, so that a reported session can be reproduced: the seed is
+logged on start, can be fixed with "shuffleseed=<n>" in config.txt and can be
+written to homedir with "saveseed=true".
+*/
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	shuffleLock sync.Mutex
+	shuffleRand *rand.Rand
+	shuffleSeed int64
+)
+
+// initShuffle seeds the shuffle source. seed==0 picks a seed from the clock.
+// If homedir is set, the seed is stored in homedir for later reproduction.
+func initShuffle(seed int64, homedir string) {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	shuffleLock.Lock()
+	shuffleSeed = seed
+	shuffleRand = rand.New(rand.NewSource(seed))
+	shuffleLock.Unlock()
+	logm.Infof("%s shuffle seed=%d", pluginname, seed)
+
+	if homedir != "" {
+		seedfile := homedir + "/" + pluginname + ".seed"
+		err := ioutil.WriteFile(seedfile, []byte(strconv.FormatInt(seed, 10)+"\n"), 0644)
+		if err != nil {
+			logm.Warningf("%s write %s err=%s", pluginname, seedfile, err.Error())
+		}
+	}
+}
+
+// shuffleIntn returns a random number in [0,n) from the seeded source.
+func shuffleIntn(n int) int {
+	shuffleLock.Lock()
+	defer shuffleLock.Unlock()
+	if shuffleRand == nil {
+		// Action() not called yet (tests); seed from the clock
+		shuffleSeed = time.Now().UnixNano()
+		shuffleRand = rand.New(rand.NewSource(shuffleSeed))
+	}
+	return shuffleRand.Intn(n)
+}
+
+// shuffleFloat64 returns a random number in [0,1) from the seeded source.
+func shuffleFloat64() float64 {
+	shuffleLock.Lock()
+	defer shuffleLock.Unlock()
+	if shuffleRand == nil {
+		shuffleSeed = time.Now().UnixNano()
+		shuffleRand = rand.New(rand.NewSource(shuffleSeed))
+	}
+	return shuffleRand.Float64()
+}
+
+// shuffleFileInfoArray shuffles fileArray in place (Fisher-Yates). Unlike
+// swapping every element with any other element, this makes every
+// permutation equally likely.
+func shuffleFileInfoArray(fileArray []os.FileInfo) {
+	for i := len(fileArray) - 1; i > 0; i-- {
+		j := shuffleIntn(i + 1)
+		fileArray[i], fileArray[j] = fileArray[j], fileArray[i]
+	}
+}
+
+// shufflePerm returns a random permutation of [0,n).
+func shufflePerm(n int) []int {
+	perm := make([]int, n)
+	for i := range perm {
+		perm[i] = i
+	}
+	for i := n - 1; i > 0; i-- {
+		j := shuffleIntn(i + 1)
+		perm[i], perm[j] = perm[j], perm[i]
+	}
+	return perm
+}
+
+// shuffleStrategy orders the files of a folder for the shuffle loop, which
+// plays the first file not found in songsPlayedQueue.
+type shuffleStrategy interface {
+	order(folder string, fileArray []os.FileInfo, songsPlayedQueue queueChecker)
+}
+
+// randomStrategy is plain random order
+type randomStrategy struct{}
+
+func (randomStrategy) order(folder string, fileArray []os.FileInfo, songsPlayedQueue queueChecker) {
+	shuffleFileInfoArray(fileArray)
+}
+
+// strategyFor returns the shuffle strategy selected by the mapping options,
+// e.g. "play_audio|/media/sda1/Music/Pop|strategy=spread".
+func strategyFor(options map[string]string) shuffleStrategy {
+	switch options["strategy"] {
+	case "", "random":
+		return randomStrategy{}
+	case "spread":
+		return newSpreadStrategy(options)
+	case "weighted":
+		return newWeightedStrategy(options)
+	}
+	logm.Warningf("%s unknown strategy=%s", pluginname, options["strategy"])
+	return randomStrategy{}
+}
+
+// optionInt returns an integer mapping option, or def if not set or invalid.
+func optionInt(options map[string]string, key string, def int) int {
+	value, ok := options[key]
+	if !ok {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		logm.Warningf("%s option %s=%s err=%s", pluginname, key, value, err.Error())
+		return def
+	}
+	return i
+}
+
+// optionFloat returns a float mapping option, or def if not set or invalid.
+func optionFloat(options map[string]string, key string, def float64) float64 {
+	value, ok := options[key]
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		logm.Warningf("%s option %s=%s err=%s", pluginname, key, value, err.Error())
+		return def
+	}
+	return f
+}
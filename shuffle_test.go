@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mehrvarz/log"
+)
+
+// testFile is an os.FileInfo for a file that need not exist.
+type testFile struct {
+	name  string
+	mtime time.Time
+}
+
+func (f testFile) Name() string       { return f.name }
+func (f testFile) Size() int64        { return 0 }
+func (f testFile) Mode() os.FileMode  { return 0644 }
+func (f testFile) ModTime() time.Time { return f.mtime }
+func (f testFile) IsDir() bool        { return false }
+func (f testFile) Sys() interface{}   { return nil }
+
+// testFiles returns os.FileInfos for names.
+func testFiles(names ...string) []os.FileInfo {
+	files := make([]os.FileInfo, len(names))
+	for i, name := range names {
+		files[i] = testFile{name: name}
+	}
+	return files
+}
+
+func fileNames(files []os.FileInfo) []string {
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = f.Name()
+	}
+	return names
+}
+
+func TestShuffleSeed(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	names := []string{"a.mp3", "b.mp3", "c.flac", "d.flac", "e.mp3", "f.mp3", "g.flac", "h.mp3"}
+	run := func(seed int64) (string, []int) {
+		initShuffle(seed, "")
+		files := testFiles(names...)
+		shuffleFileInfoArray(files)
+		return strings.Join(fileNames(files), " "), shufflePerm(20)
+	}
+	order1, perm1 := run(42)
+	order2, perm2 := run(42)
+	if order1 != order2 || !equalInts(perm1, perm2) {
+		t.Errorf("seed 42 twice: %s %v, then %s %v", order1, perm1, order2, perm2)
+	}
+	if order3, perm3 := run(43); order3 == order1 && equalInts(perm3, perm1) {
+		t.Errorf("seeds 42 and 43: same order %s %v", order1, perm1)
+	}
+
+	home, err := ioutil.TempDir("", "tremote_home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	initShuffle(42, home)
+	if data, err := ioutil.ReadFile(home + "/" + pluginname + ".seed"); err != nil || string(data) != "42\n" {
+		t.Errorf("seed file %q, %v", data, err)
+	}
+}
+
+// TestShufflePermutation checks that every element is kept, and that every
+// position gets every element about equally often.
+func TestShufflePermutation(t *testing.T) {
+	initShuffle(1, "")
+	const n, runs = 5, 20000
+	names := []string{"0", "1", "2", "3", "4"}
+	var files, perms [n][n]int
+	for r := 0; r < runs; r++ {
+		shuffled := testFiles(names...)
+		shuffleFileInfoArray(shuffled)
+		order := fileNames(shuffled)
+		perm := shufflePerm(n)
+		for i := 0; i < n; i++ {
+			files[i][order[i][0]-'0']++
+			perms[i][perm[i]]++
+		}
+		sort.Strings(order)
+		sorted := append([]int{}, perm...)
+		sort.Ints(sorted)
+		if strings.Join(order, "") != "01234" || !equalInts(sorted, []int{0, 1, 2, 3, 4}) {
+			t.Fatalf("not a permutation: %v %v", order, perm)
+		}
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			// expected runs/n = 4000, standard deviation ~57
+			if files[i][j] < 3700 || files[i][j] > 4300 || perms[i][j] < 3700 || perms[i][j] > 4300 {
+				t.Errorf("position %d, element %d: %d and %d times, want about %d", i, j, files[i][j], perms[i][j], runs/n)
+			}
+		}
+	}
+	if got := shufflePerm(0); len(got) != 0 {
+		t.Errorf("shufflePerm(0) = %v", got)
+	}
+}
+
+// TestShuffleSession plays a folder twice with the same seed: the sessions
+// play the songs in the same order.
+func TestShuffleSession(t *testing.T) {
+	var orders []string
+	for i := 0; i < 2; i++ {
+		var fixtures []*fixture
+		for n := 1; n <= 6; n++ {
+			fixtures = append(fixtures, newFlacFixture(n, 44100, 16, 0.05))
+		}
+		h := newHarness(t, false, []string{"repeat=once"}, fixtures...)
+		initShuffle(7, "")
+		h.shortPress(1)
+		h.waitState(stateIdle)
+		h.finish()
+		h.remove()
+		names, _ := h.played()
+		if len(names) != len(fixtures) {
+			t.Fatalf("played %v", names)
+		}
+		orders = append(orders, strings.Join(names, " "))
+	}
+	if orders[0] != orders[1] {
+		t.Errorf("seed 7 played %s, then %s", orders[0], orders[1])
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
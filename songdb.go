@@ -0,0 +1,203 @@
+/*
+songdb is a small per-song database stored as a tab separated text file in
+homedir (play_audio_mp3flac.songs). It keeps our own rating, the play and skip
+counts and the time a song was played last. Songs are identified by pathfile,
+or by "pathfile#n" for a cue sheet track. Every single play is also appended
+to play_audio_mp3flac.plays with the time, the seconds heard and the outcome.
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// songSaveDelay limits how often the database file gets rewritten; changes
+// made in between are saved when it is over.
+var songSaveDelay = 30 * time.Second
+
+type songRecord struct {
+	rating     int   // our own rating 1-5; 0 = not rated
+	plays      int   // number of times played to the end (or mostly heard)
+	lastPlayed int64 // unix time; 0 = never
+	skips      int   // number of times skipped by short press
+}
+
+// play outcomes, as written to the play log
+const (
+	playFinished = "finished" // played to the end
+	playSkipped  = "skipped"  // short press: next song
+	playBack     = "back"     // long press: previous song
+	playStopped  = "stopped"  // stopped via StopAudioPlayerChan (other player, host)
+	playError    = "error"    // decoding or audio output failed
+	playBanned   = "banned"   // skipped by the Ban command
+)
+
+type songDatabase struct {
+	lock     sync.Mutex
+	pathfile string // "" = memory only
+	logfile  string // play log; "" = none
+	records  map[string]*songRecord
+	dirty    bool
+	lastSave time.Time
+	flush    *time.Timer // saves the changes made within songSaveDelay
+}
+
+var songdb = &songDatabase{records: make(map[string]*songRecord)}
+
+// songKey returns the database key of a file or of a cue track of it.
+func songKey(pathfile string, track *cueTrack) string {
+	if track != nil {
+		return trackRef(pathfile, track.number)
+	}
+	return pathfile
+}
+
+// load reads the database from homedir; a missing file is not an error.
+func (db *songDatabase) load(homedir string) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.pathfile = homedir + "/" + pluginname + ".songs"
+	db.logfile = homedir + "/" + pluginname + ".plays"
+	file, err := os.Open(db.pathfile)
+	if err != nil {
+		logm.Debugf("%s songdb %s not loaded: %s", pluginname, db.pathfile, err.Error())
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		rec := &songRecord{}
+		if len(fields) > 1 {
+			rec.rating, _ = strconv.Atoi(fields[1])
+		}
+		if len(fields) > 2 {
+			rec.plays, _ = strconv.Atoi(fields[2])
+		}
+		if len(fields) > 3 {
+			rec.lastPlayed, _ = strconv.ParseInt(fields[3], 10, 64)
+		}
+		if len(fields) > 4 {
+			rec.skips, _ = strconv.Atoi(fields[4])
+		}
+		db.records[fields[0]] = rec
+	}
+	logm.Infof("%s songdb %s: %d songs", pluginname, db.pathfile, len(db.records))
+}
+
+// save writes the database, at most once per songSaveDelay unless forced. A
+// save that has to wait is done by a timer.
+func (db *songDatabase) save(force bool) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.pathfile == "" || !db.dirty {
+		return
+	}
+	if wait := songSaveDelay - time.Since(db.lastSave); !force && wait > 0 {
+		if db.flush == nil {
+			db.flush = time.AfterFunc(wait, func() { db.save(true) })
+		}
+		return
+	}
+	if db.flush != nil {
+		db.flush.Stop()
+		db.flush = nil
+	}
+
+	tmpfile := db.pathfile + ".tmp"
+	file, err := os.Create(tmpfile)
+	if err != nil {
+		logm.Warningf("%s songdb save err=%s", pluginname, err.Error())
+		return
+	}
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "# pathfile\trating\tplays\tlastplayed\tskips\n")
+	for key, rec := range db.records {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", key, rec.rating, rec.plays, rec.lastPlayed, rec.skips)
+	}
+	err = w.Flush()
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmpfile, db.pathfile)
+	}
+	if err != nil {
+		logm.Warningf("%s songdb save err=%s", pluginname, err.Error())
+		return
+	}
+	db.dirty = false
+	db.lastSave = time.Now()
+}
+
+// get returns a copy of the record of key (zero values if unknown).
+func (db *songDatabase) get(key string) songRecord {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if rec := db.records[key]; rec != nil {
+		return *rec
+	}
+	return songRecord{}
+}
+
+// update calls fn with the record of key, creating it if needed.
+func (db *songDatabase) update(key string, fn func(rec *songRecord)) {
+	db.lock.Lock()
+	rec := db.records[key]
+	if rec == nil {
+		rec = &songRecord{}
+		db.records[key] = rec
+	}
+	fn(rec)
+	db.dirty = true
+	db.lock.Unlock()
+	db.save(false)
+}
+
+/*
+recordPlay records a play of key that started at start and lasted seconds (of
+duration; 0 = unknown), and appends it to the play log:
+"2026-10-19T20:15:04+02:00<tab>seconds<tab>outcome<tab>key".
+The play only counts if the song finished or was mostly heard (see
+mostlyHeard); a short press counts as a skip.
+*/
+func (db *songDatabase) recordPlay(key string, start time.Time, seconds, duration float64, outcome string) {
+	db.update(key, func(rec *songRecord) {
+		if outcome == playFinished || mostlyHeard(seconds, duration) {
+			rec.plays++
+		}
+		rec.lastPlayed = start.Unix()
+		if outcome == playSkipped {
+			rec.skips++
+		}
+	})
+
+	db.lock.Lock()
+	logfile := db.logfile
+	db.lock.Unlock()
+	if logfile == "" {
+		return
+	}
+	file, err := os.OpenFile(logfile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logm.Warningf("%s play log err=%s", pluginname, err.Error())
+		return
+	}
+	fmt.Fprintf(file, "%s\t%.1f\t%s\t%s\n", start.Format(time.RFC3339), seconds, outcome, key)
+	file.Close()
+}
+
+// mostlyHeard reports whether seconds of a song of duration count as a play:
+// half of the song or scrobbleMaxRequired seconds, as for scrobbling.
+func mostlyHeard(seconds, duration float64) bool {
+	return duration > 0 && seconds >= duration/2 || seconds >= scrobbleMaxRequired
+}
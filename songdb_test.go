@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mehrvarz/log"
+)
+
+// savedRecord returns the line of key in the database file of db, "" if none.
+func savedRecord(db *songDatabase, key string) string {
+	data, _ := ioutil.ReadFile(db.pathfile)
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, key+"\t") {
+			return line
+		}
+	}
+	return ""
+}
+
+// TestSongdbFlush checks that changes within songSaveDelay of a save are
+// saved when it is over.
+func TestSongdbFlush(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	defer func(delay time.Duration) { songSaveDelay = delay }(songSaveDelay)
+	songSaveDelay = 100 * time.Millisecond
+	home, err := ioutil.TempDir("", "tremote_home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	db := &songDatabase{records: make(map[string]*songRecord)}
+	db.load(home)
+	db.update("/music/01.flac", func(rec *songRecord) { rec.rating = 4 })
+	if got := savedRecord(db, "/music/01.flac"); got != "/music/01.flac\t4\t0\t0\t0" {
+		t.Fatalf("first change not saved at once: %q", got)
+	}
+	db.recordPlay("/music/01.flac", time.Unix(1000, 0), 10, 200, playSkipped)
+	db.recordPlay("/music/02.mp3", time.Unix(2000, 0), 10, 200, playFinished)
+	if got := savedRecord(db, "/music/02.mp3"); got != "" {
+		t.Errorf("saved within songSaveDelay: %q", got)
+	}
+	waitFor(t, "flush", func() bool { return savedRecord(db, "/music/02.mp3") != "" })
+	if got := savedRecord(db, "/music/01.flac"); got != "/music/01.flac\t4\t0\t1000\t1" {
+		t.Errorf("flushed %q", got)
+	}
+
+	// a forced save stops the timer
+	db.update("/music/02.mp3", func(rec *songRecord) { rec.rating = 2 })
+	db.save(true)
+	db.lock.Lock()
+	flush := db.flush
+	db.lock.Unlock()
+	if flush != nil || savedRecord(db, "/music/02.mp3") != "/music/02.mp3\t2\t1\t2000\t0" {
+		t.Errorf("forced save: timer %v, %q", flush, savedRecord(db, "/music/02.mp3"))
+	}
+}
+
+func TestRecordPlay(t *testing.T) {
+	tests := []struct {
+		name         string
+		seconds      float64
+		duration     float64
+		outcome      string
+		plays, skips int
+	}{
+		{"finished", 200, 200, playFinished, 1, 0},
+		{"skipped", 10, 200, playSkipped, 0, 1},
+		{"skipped late", 150, 200, playSkipped, 1, 1},
+		{"stopped early", 30, 200, playStopped, 0, 0},
+		{"stopped after 4 minutes", 240, 600, playStopped, 1, 0},
+		{"unknown duration", 100, 0, playBack, 0, 0},
+		{"error", 5, 200, playError, 0, 0},
+	}
+	for _, test := range tests {
+		db := &songDatabase{records: make(map[string]*songRecord)}
+		db.recordPlay("/music/01.flac", time.Unix(1000, 0), test.seconds, test.duration, test.outcome)
+		if rec := db.get("/music/01.flac"); rec.plays != test.plays || rec.skips != test.skips || rec.lastPlayed != 1000 {
+			t.Errorf("%s: %d plays, %d skips, last played %d; want %d, %d, 1000",
+				test.name, rec.plays, rec.skips, rec.lastPlayed, test.plays, test.skips)
+		}
+	}
+}
+
+// TestSongdbSessionEnd checks that the plays of a session are saved when it ends.
+func TestSongdbSessionEnd(t *testing.T) {
+	first, second := newFlacFixture(1, 44100, 16, 0.1), newFlacFixture(2, 44100, 16, 0.1)
+	h := newHarness(t, false, []string{"mode=sequential", "repeat=once"}, first, second)
+	defer h.remove()
+	h.shortPress(1)
+	h.waitState(stateIdle)
+	h.finish()
+	for _, fx := range []*fixture{first, second} {
+		if rec := songdb.get(h.folder + "/" + fx.name); rec.plays != 1 ||
+			!strings.HasPrefix(savedRecord(songdb, h.folder+"/"+fx.name), h.folder+"/"+fx.name+"\t0\t1\t") {
+			t.Errorf("%s: %d plays, saved %q", fx.name, rec.plays, savedRecord(songdb, h.folder+"/"+fx.name))
+		}
+	}
+}
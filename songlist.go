@@ -0,0 +1,248 @@
+/*
+Favorite and ban lists. Both are plain text files in homedir with one song
+per line (pathfile, or "pathfile#n" for a cue sheet track; a pathfile covers
+all of its tracks). Lines starting with # are comments. The files may be
+edited while the plugin is running; they are reloaded when they change.
+
+	P12, Fav, play_audio|Favorite
+	P13, Ban, play_audio|Ban
+	P14, Fav, play_audio|/media/sda1/Music|favorites=only
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mehrvarz/tremote_plugin"
+)
+
+// songListCheckDelay limits how often a list file is checked for changes
+const songListCheckDelay = 2 * time.Second
+
+type songList struct {
+	lock      sync.Mutex
+	name      string // file name in homedir
+	pathfile  string // "" = memory only
+	modTime   time.Time
+	lastCheck time.Time
+	keys      map[string]bool
+}
+
+var (
+	favoriteList = &songList{name: pluginname + ".favorites", keys: make(map[string]bool)}
+	banList      = &songList{name: pluginname + ".banned", keys: make(map[string]bool)}
+
+	currentSongLock sync.Mutex
+	currentSongKey  string // songdb key of the song playing now; "" = none
+	currentSongInfo string // its display string
+	skipRequested   bool   // playSong is to skip to the next song
+)
+
+func (l *songList) init(homedir string) {
+	l.lock.Lock()
+	l.pathfile = homedir + "/" + l.name
+	l.lock.Unlock()
+	l.contains("")
+}
+
+// reload reads the file again if it has changed. Call with l.lock held.
+func (l *songList) reload() {
+	if l.pathfile == "" || time.Since(l.lastCheck) < songListCheckDelay {
+		return
+	}
+	l.lastCheck = time.Now()
+	fi, err := os.Stat(l.pathfile)
+	if err != nil || fi.ModTime().Equal(l.modTime) {
+		return
+	}
+	file, err := os.Open(l.pathfile)
+	if err != nil {
+		logm.Warningf("%s read %s err=%s", pluginname, l.pathfile, err.Error())
+		return
+	}
+	defer file.Close()
+	keys := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			keys[line] = true
+		}
+	}
+	l.keys = keys
+	l.modTime = fi.ModTime()
+	logm.Infof("%s %s: %d songs", pluginname, l.pathfile, len(keys))
+}
+
+// contains reports whether key, or the whole file of a cue track key, is listed.
+func (l *songList) contains(key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.reload()
+	if l.keys[key] {
+		return true
+	}
+	if fileName, number := splitTrackRef(key); number > 0 {
+		return l.keys[fileName]
+	}
+	return false
+}
+
+// set adds (on=true) or removes key and writes the file. Removing a cue track
+// whose whole file is listed replaces the file by its other tracks.
+func (l *songList) set(key string, on bool) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.reload()
+	if on {
+		l.keys[key] = true
+	} else {
+		delete(l.keys, key)
+		if fileName, number := splitTrackRef(key); number > 0 && l.keys[fileName] {
+			delete(l.keys, fileName)
+			for _, track := range loadCueTracks(fileName) {
+				if track.number != number {
+					l.keys[trackRef(fileName, track.number)] = true
+				}
+			}
+		}
+	}
+	if l.pathfile == "" {
+		return nil
+	}
+
+	keys := make([]string, 0, len(l.keys))
+	for k := range l.keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tmpfile := l.pathfile + ".tmp"
+	file, err := os.Create(tmpfile)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "# %s: one file (or file#track) per line\n", l.name)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s\n", k)
+	}
+	err = w.Flush()
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmpfile, l.pathfile)
+	}
+	if err == nil {
+		if fi, serr := os.Stat(l.pathfile); serr == nil {
+			l.modTime = fi.ModTime()
+		}
+	}
+	return err
+}
+
+// excludedSong reports whether the folder loop must not pick ref: it is
+// banned, or the mapping line asks for favorites only and it is none.
+func excludedSong(folder string, ref string, options map[string]string) bool {
+	key := folder + "/" + ref
+	if banList.contains(key) {
+		return true
+	}
+	return options["favorites"] == "only" && !favoriteList.contains(key)
+}
+
+// songFilter adds excludedSong to the songsPlayedQueue check, so that
+// excluded songs look as if they had been played recently.
+type songFilter struct {
+	queue   queueChecker
+	folder  string
+	options map[string]string
+}
+
+func (f songFilter) InQueue(ref string) bool {
+	return (f.queue != nil && f.queue.InQueue(ref)) || excludedSong(f.folder, ref, f.options)
+}
+
+func setCurrentSong(key string, info string) {
+	currentSongLock.Lock()
+	currentSongKey = key
+	currentSongInfo = info
+	skipRequested = false
+	currentSongLock.Unlock()
+}
+
+// clearCurrentSong is called when key has stopped playing.
+func clearCurrentSong(key string) {
+	currentSongLock.Lock()
+	if currentSongKey == key {
+		currentSongKey = ""
+		currentSongInfo = ""
+		skipRequested = false
+	}
+	currentSongLock.Unlock()
+}
+
+func currentSong() (string, string) {
+	currentSongLock.Lock()
+	defer currentSongLock.Unlock()
+	return currentSongKey, currentSongInfo
+}
+
+// requestSkip makes playSong stop the current song and continue with the next.
+func requestSkip() {
+	currentSongLock.Lock()
+	skipRequested = currentSongKey != ""
+	currentSongLock.Unlock()
+}
+
+func takeSkipRequest() bool {
+	currentSongLock.Lock()
+	defer currentSongLock.Unlock()
+	skip := skipRequested
+	skipRequested = false
+	return skip
+}
+
+// cmdFavorite implements "play_audio|Favorite": it adds the current song to
+// the favorites, or removes it if it is a favorite already.
+func cmdFavorite(args []string, ph tremote_plugin.PluginHelper) {
+	key, info := currentSong()
+	if key == "" {
+		ph.PrintStatus("favorite: no song playing")
+		return
+	}
+	on := !favoriteList.contains(key)
+	if err := favoriteList.set(key, on); err != nil {
+		logm.Warningf("%s favorite %s err=%s", pluginname, key, err.Error())
+		ph.PrintStatus("favorite: " + err.Error())
+		return
+	}
+	logm.Infof("%s favorite=%v %s", pluginname, on, key)
+	if on {
+		ph.PrintStatus("favorite: " + info)
+	} else {
+		ph.PrintStatus("no longer favorite: " + info)
+	}
+}
+
+// cmdBan implements "play_audio|Ban": the current song is skipped and never
+// picked again. Remove it from play_audio_mp3flac.banned to undo.
+func cmdBan(args []string, ph tremote_plugin.PluginHelper) {
+	key, info := currentSong()
+	if key == "" {
+		ph.PrintStatus("ban: no song playing")
+		return
+	}
+	if err := banList.set(key, true); err != nil {
+		logm.Warningf("%s ban %s err=%s", pluginname, key, err.Error())
+		ph.PrintStatus("ban: " + err.Error())
+		return
+	}
+	logm.Infof("%s banned %s", pluginname, key)
+	ph.PrintStatus("banned: " + info)
+	requestSkip()
+}
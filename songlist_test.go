@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mehrvarz/log"
+)
+
+func TestSongListContains(t *testing.T) {
+	l := &songList{name: "test", keys: map[string]bool{"/m/a.flac": true, "/m/live.flac#2": true}}
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"/m/a.flac", true},
+		{"/m/a.flac#3", true}, // a track of a listed file
+		{"/m/live.flac#2", true},
+		{"/m/live.flac#1", false},
+		{"/m/live.flac", false}, // one track does not list the file
+		{"/m/b.flac", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := l.contains(test.key); got != test.want {
+			t.Errorf("contains(%q) = %v", test.key, got)
+		}
+	}
+}
+
+// TestSongListSet toggles songs and cue tracks and reads the file back.
+func TestSongListSet(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	dir, err := ioutil.TempDir("", "tremote_songlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fx := newFlacFixture(1, 44100, 16, 0.1)
+	fx.name = "album.flac"
+	fx.write(t, dir)
+	if err := ioutil.WriteFile(dir+"/album.cue", []byte(testCueSheet), 0644); err != nil {
+		t.Fatal(err)
+	}
+	album := dir + "/album.flac"
+
+	tests := []struct {
+		name string
+		key  string
+		on   bool
+		want string // keys in the file afterwards
+	}{
+		{"add a file", dir + "/a.flac", true, "a.flac"},
+		{"add a whole cue file", album, true, "a.flac album.flac"},
+		{"remove a track of it", album + "#2", false, "a.flac album.flac#1 album.flac#3"},
+		{"remove another track", album + "#1", false, "a.flac album.flac#3"},
+		{"add the track again", album + "#1", true, "a.flac album.flac#1 album.flac#3"},
+		{"remove a file", dir + "/a.flac", false, "album.flac#1 album.flac#3"},
+		{"remove a missing file", dir + "/b.flac", false, "album.flac#1 album.flac#3"},
+	}
+	l := &songList{name: "test.list", keys: make(map[string]bool)}
+	l.init(dir)
+	for _, test := range tests {
+		if err := l.set(test.key, test.on); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		data, err := ioutil.ReadFile(dir + "/test.list")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if !strings.HasPrefix(line, "#") {
+				keys = append(keys, strings.TrimPrefix(line, dir+"/"))
+			}
+		}
+		if got := strings.Join(keys, " "); got != test.want {
+			t.Errorf("%s: %q, want %q", test.name, got, test.want)
+		}
+		if l.contains(test.key) != test.on {
+			t.Errorf("%s: contains(%q) = %v", test.name, test.key, !test.on)
+		}
+	}
+
+	// an edit of the file is picked up
+	ioutil.WriteFile(dir+"/test.list", []byte("# edited\n"+album+"\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(dir+"/test.list", later, later)
+	l.lock.Lock()
+	l.lastCheck = time.Time{}
+	l.lock.Unlock()
+	if !l.contains(album+"#2") || len(l.keys) != 1 {
+		t.Errorf("after the edit: keys %v", l.keys)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Artist-spread shuffle. Random order, but a song is only picked if its artist
+has not been played within the last artistspacing songs, and its album not
+within the last albumspacing songs. If no such song exists (small folder), the
+spacing is relaxed step by step, down to plain random order.
+*/
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultArtistSpacing = 3
+	defaultAlbumSpacing  = 10
+	maxRecentSongs       = 200
+)
+
+type spreadStrategy struct {
+	artistSpacing int
+	albumSpacing  int
+}
+
+// recentSong is the artist and album of a song played recently
+type recentSong struct {
+	artist string
+	album  string
+}
+
+var (
+	recentLock sync.Mutex
+	recentMap  = make(map[string][]recentSong) // folder -> songs started, most recent last
+)
+
+func newSpreadStrategy(options map[string]string) spreadStrategy {
+	return spreadStrategy{
+		artistSpacing: optionInt(options, "artistspacing", defaultArtistSpacing),
+		albumSpacing:  optionInt(options, "albumspacing", defaultAlbumSpacing),
+	}
+}
+
+// recordRecentSong remembers artist and album of a song started in folder.
+func recordRecentSong(folder string, artist string, album string) {
+	recentLock.Lock()
+	defer recentLock.Unlock()
+	recent := append(recentMap[folder], recentSong{strings.ToLower(artist), strings.ToLower(album)})
+	if len(recent) > maxRecentSongs {
+		recent = recent[len(recent)-maxRecentSongs:]
+	}
+	recentMap[folder] = recent
+}
+
+func recentSongs(folder string) []recentSong {
+	recentLock.Lock()
+	defer recentLock.Unlock()
+	return append([]recentSong(nil), recentMap[folder]...)
+}
+
+/*
+order shuffles fileArray and moves the first song that keeps the spacing to
+the front. Tags are only read for the songs being looked at, so a large
+folder does not have to be scanned completely.
+*/
+func (s spreadStrategy) order(folder string, fileArray []os.FileInfo, songsPlayedQueue queueChecker) {
+	shuffleFileInfoArray(fileArray)
+	recent := recentSongs(folder)
+
+	artistSpacing, albumSpacing := s.artistSpacing, s.albumSpacing
+	for {
+		for i, fi := range fileArray {
+			if fi == nil || fi.IsDir() || !isAudioFile(fi.Name()) {
+				continue
+			}
+			if songsPlayedQueue != nil && songsPlayedQueue.InQueue(fi.Name()) {
+				continue
+			}
+			st := readSongTags(folder + "/" + fi.Name())
+			if spacingConflict(recent, strings.ToLower(st.artist), artistSpacing, false) ||
+				spacingConflict(recent, strings.ToLower(st.album), albumSpacing, true) {
+				continue
+			}
+			if artistSpacing < s.artistSpacing || albumSpacing < s.albumSpacing {
+				logm.Infof("%s spread relaxed to artistspacing=%d albumspacing=%d",
+					pluginname, artistSpacing, albumSpacing)
+			}
+			fileArray[0], fileArray[i] = fileArray[i], fileArray[0]
+			return
+		}
+		if artistSpacing <= 0 && albumSpacing <= 0 {
+			// nothing to pick; the folder loop deals with this
+			return
+		}
+		// relax gradually
+		if artistSpacing > 0 {
+			artistSpacing--
+		}
+		if albumSpacing > 0 {
+			albumSpacing--
+		}
+	}
+}
+
+// spacingConflict reports whether artist (or album, if byAlbum is set) is
+// found among the last spacing recent songs. Empty values never conflict.
+func spacingConflict(recent []recentSong, value string, spacing int, byAlbum bool) bool {
+	if value == "" {
+		return false
+	}
+	for i := len(recent) - 1; i >= 0 && i >= len(recent)-spacing; i-- {
+		if (!byAlbum && recent[i].artist == value) || (byAlbum && recent[i].album == value) {
+			return true
+		}
+	}
+	return false
+}
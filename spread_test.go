@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mehrvarz/log"
+)
+
+func TestSpacingConflict(t *testing.T) {
+	recent := []recentSong{{"a", "x"}, {"b", "y"}, {"c", "z"}, {"", ""}}
+	tests := []struct {
+		value   string
+		spacing int
+		byAlbum bool
+		want    bool
+	}{
+		{"c", 2, false, true},
+		{"b", 2, false, false},
+		{"b", 3, false, true},
+		{"a", 4, false, true},
+		{"a", 100, false, true},
+		{"d", 100, false, false},
+		{"a", 0, false, false},
+		{"", 100, false, false}, // no tag: never a conflict
+		{"x", 4, true, true},
+		{"x", 3, true, false},
+		{"a", 4, true, false}, // an artist is not an album
+	}
+	for _, test := range tests {
+		if got := spacingConflict(recent, test.value, test.spacing, test.byAlbum); got != test.want {
+			t.Errorf("spacingConflict(%q, %d, album %v) = %v", test.value, test.spacing, test.byAlbum, got)
+		}
+	}
+}
+
+func TestRecordRecentSong(t *testing.T) {
+	folder := "/music/recent"
+	for i := 0; i < maxRecentSongs+5; i++ {
+		recordRecentSong(folder, "Artist", "Album")
+	}
+	recordRecentSong(folder, "The BAND", "Live")
+	recent := recentSongs(folder)
+	if len(recent) != maxRecentSongs || recent[len(recent)-1] != (recentSong{"the band", "live"}) {
+		t.Errorf("%d recent songs, last %v", len(recent), recent[len(recent)-1])
+	}
+}
+
+func TestSpreadOrder(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	dir, err := ioutil.TempDir("", "tremote_spread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := []struct {
+		name, artist, album string
+	}{
+		{"a1.flac", "A", "A1"},
+		{"a2.flac", "A", "A2"},
+		{"b1.flac", "B", "B1"},
+		{"b2.flac", "b", "B2"},
+		{"c1.flac", "C", "A1"},
+	}
+	for i, f := range files {
+		fx := newFlacFixture(i+1, 44100, 16, 0.05)
+		fx.name = f.name
+		fx.write(t, dir)
+		fx.tag(t, dir, "ARTIST="+f.artist, "ALBUM="+f.album)
+	}
+	fileArray, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		recent  []recentSong // played before, oldest first
+		played  playedRefs
+		options map[string]string
+		want    map[string]bool // songs that may come first
+	}{
+		{
+			name:   "artist spacing",
+			recent: []recentSong{{"b", "b1"}, {"a", "a2"}},
+			want:   map[string]bool{"c1.flac": true},
+		},
+		{
+			// C is not recent, but album A1 is: relaxed until b2 fits
+			name:   "album spacing",
+			recent: []recentSong{{"x", "a1"}, {"b", "b1"}, {"a", "a2"}},
+			want:   map[string]bool{"b2.flac": true},
+		},
+		{
+			name:    "spacing from the options",
+			recent:  []recentSong{{"x", "a1"}, {"b", "b1"}, {"a", "a2"}},
+			options: map[string]string{"artistspacing": "1", "albumspacing": "2"},
+			want:    map[string]bool{"b2.flac": true, "c1.flac": true},
+		},
+		{
+			name:   "played recently",
+			recent: []recentSong{{"b", "b1"}},
+			played: playedRefs{"a1.flac": true, "c1.flac": true},
+			want:   map[string]bool{"a2.flac": true},
+		},
+		{
+			// every artist played last: the spacing is relaxed
+			name:   "relaxed",
+			recent: []recentSong{{"c", "x"}, {"b", "y"}, {"a", "z"}},
+			played: playedRefs{"c1.flac": true},
+			want:   map[string]bool{"b1.flac": true, "b2.flac": true},
+		},
+	}
+	for _, test := range tests {
+		recentLock.Lock()
+		delete(recentMap, dir)
+		recentLock.Unlock()
+		for _, r := range test.recent {
+			recordRecentSong(dir, r.artist, r.album)
+		}
+		for run := 0; run < 20; run++ {
+			order := append([]os.FileInfo(nil), fileArray...)
+			newSpreadStrategy(test.options).order(dir, order, test.played)
+			if !test.want[order[0].Name()] {
+				t.Errorf("%s: %s first, want one of %v", test.name, order[0].Name(), test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Play statistics reports, built from songdb. "play_audio|Stats" writes the
+most skipped and the never played songs of the active folder to
+play_audio_mp3flac.report in homedir and shows a short summary.
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mehrvarz/tremote_plugin"
+)
+
+// maxReportSongs limits the length of the most skipped list
+const maxReportSongs = 50
+
+type songStat struct {
+	key string
+	songRecord
+}
+
+// mostSkipped returns the songs below folder that were skipped at least once,
+// most skipped first (ties: highest skip ratio first, then by key).
+func mostSkipped(folder string) []songStat {
+	prefix := folder + "/"
+	var stats []songStat
+	songdb.lock.Lock()
+	for key, rec := range songdb.records {
+		if rec.skips > 0 && strings.HasPrefix(key, prefix) {
+			stats = append(stats, songStat{key, *rec})
+		}
+	}
+	songdb.lock.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].skips != stats[j].skips {
+			return stats[i].skips > stats[j].skips
+		}
+		if ri, rj := stats[i].skips*stats[j].plays, stats[j].skips*stats[i].plays; ri != rj {
+			return ri > rj
+		}
+		return stats[i].key < stats[j].key
+	})
+	return stats
+}
+
+// neverPlayed returns the songs of folder (one sub directory level deep, cue
+// tracks expanded) that have no play recorded.
+func neverPlayed(folder string) []string {
+	fileArray, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil
+	}
+	var refs []string
+	for _, ref := range sequentialRefs(folder, fileArray, modeSequential) {
+		if songdb.get(folder+"/"+ref).plays == 0 {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+func cmdStats(args []string, ph tremote_plugin.PluginHelper) {
+	playModeLock.Lock()
+	folder := activeFolder
+	playModeLock.Unlock()
+	if folder == "" {
+		ph.PrintStatus("stats: no active folder")
+		return
+	}
+	skipped := mostSkipped(folder)
+	never := neverPlayed(folder)
+	summary := fmt.Sprintf("%d songs skipped, %d never played", len(skipped), len(never))
+	logm.Infof("%s %s: %s", pluginname, folder, summary)
+
+	songdb.lock.Lock()
+	pathfile := songdb.pathfile
+	songdb.lock.Unlock()
+	if pathfile != "" {
+		reportfile := filepath.Dir(pathfile) + "/" + pluginname + ".report"
+		if err := writeStatsReport(reportfile, folder, skipped, never); err != nil {
+			logm.Warningf("%s write %s err=%s", pluginname, reportfile, err.Error())
+		}
+	}
+	ph.PrintStatus(summary)
+}
+
+func writeStatsReport(reportfile string, folder string, skipped []songStat, never []string) error {
+	file, err := os.Create(reportfile)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "%s\n\nmost skipped (skips/plays):\n", folder)
+	for i, stat := range skipped {
+		if i >= maxReportSongs {
+			break
+		}
+		fmt.Fprintf(w, "%4d/%-4d %s\n", stat.skips, stat.plays, strings.TrimPrefix(stat.key, folder+"/"))
+	}
+	fmt.Fprintf(w, "\nnever played:\n")
+	for _, ref := range never {
+		fmt.Fprintf(w, "%s\n", ref)
+	}
+	err = w.Flush()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
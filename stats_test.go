@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mehrvarz/log"
+)
+
+func TestMostSkipped(t *testing.T) {
+	folder := "/stats/skipped"
+	records := map[string]songRecord{
+		"a.flac":        {plays: 10, skips: 2},
+		"b.flac":        {plays: 4, skips: 2}, // same skips, higher ratio
+		"c.flac":        {plays: 5, skips: 5},
+		"d.flac":        {plays: 4, skips: 2}, // same as b
+		"e.flac":        {plays: 3},
+		"sub/f.flac#2":  {plays: 1, skips: 1},
+		"album.flac#3":  {plays: 2, skips: 2},
+		"album.flac#10": {plays: 2, skips: 2},
+	}
+	for key, rec := range records {
+		setRecord(folder+"/"+key, rec)
+	}
+	setRecord(folder+"x/g.flac", songRecord{plays: 1, skips: 9})
+	var got []string
+	for _, stat := range mostSkipped(folder) {
+		got = append(got, strings.TrimPrefix(stat.key, folder+"/"))
+	}
+	want := "c.flac album.flac#10 album.flac#3 b.flac d.flac a.flac sub/f.flac#2"
+	if strings.Join(got, " ") != want {
+		t.Errorf("most skipped\n%s\nwant\n%s", strings.Join(got, " "), want)
+	}
+}
+
+// TestStatsCommand writes the report for the active folder.
+func TestStatsCommand(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	home, err := ioutil.TempDir("", "tremote_home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	folder := home + "/music"
+	os.Mkdir(folder, 0755)
+	for i, name := range []string{"01.flac", "02.flac", "03.flac"} {
+		fx := newFlacFixture(i+1, 44100, 16, 0.05)
+		fx.name = name
+		fx.write(t, folder)
+	}
+
+	songdb.lock.Lock()
+	pathfile, logfile := songdb.pathfile, songdb.logfile
+	songdb.pathfile, songdb.logfile = home+"/"+pluginname+".songs", home+"/"+pluginname+".plays"
+	songdb.lock.Unlock()
+	defer func() {
+		songdb.lock.Lock()
+		songdb.pathfile, songdb.logfile = pathfile, logfile
+		songdb.lock.Unlock()
+	}()
+	start := time.Date(2026, 10, 19, 20, 15, 4, 0, time.UTC)
+	songdb.recordPlay(folder+"/01.flac", start, 12.34, 200, playSkipped)
+	songdb.recordPlay(folder+"/01.flac", start, 200, 200, playFinished)
+	songdb.recordPlay(folder+"/03.flac", start, 3, 200, playSkipped)
+
+	host := newFakeHost()
+	setActiveFolder(folder, nil)
+	defer setActiveFolder("", nil)
+	cmdStats(nil, host.ph)
+	if !host.called("PrintStatus", "2 songs skipped, 2 never played") {
+		t.Errorf("PrintStatus %q", host.args("PrintStatus"))
+	}
+	report, err := ioutil.ReadFile(home + "/" + pluginname + ".report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := folder + "\n\nmost skipped (skips/plays):\n" +
+		"   1/0    03.flac\n   1/1    01.flac\n\nnever played:\n02.flac\n03.flac\n"
+	if string(report) != want {
+		t.Errorf("report\n%s\nwant\n%s", report, want)
+	}
+	plays, err := ioutil.ReadFile(home + "/" + pluginname + ".plays")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := strings.Split(string(plays), "\n")[0]; line != "2026-10-19T20:15:04Z\t12.3\tskipped\t"+folder+"/01.flac" {
+		t.Errorf("play log %q", line)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dhowden/tag"
+)
+
+// songTags holds the tag fields needed to group, order and pick songs
+// without opening the file every time.
+type songTags struct {
+	title   string
+	artist  string
+	album   string
+	track   int
+	disc    int
+	rating  int // 1-5 stars from POPM, FMPS_RATING or RATING; 0 = not rated
+	modTime time.Time
+}
+
+var (
+	tagCacheLock sync.Mutex
+	tagCache     = make(map[string]*songTags) // pathfile -> tags
+)
+
+// readSongTags returns the (cached) tags of pathfile. A file that cannot be
+// read or has no tags results in empty fields, never in nil.
+func readSongTags(pathfile string) *songTags {
+	fi, err := os.Stat(pathfile)
+	if err != nil {
+		return &songTags{}
+	}
+
+	tagCacheLock.Lock()
+	cached := tagCache[pathfile]
+	tagCacheLock.Unlock()
+	if cached != nil && cached.modTime.Equal(fi.ModTime()) {
+		return cached
+	}
+
+	st := &songTags{modTime: fi.ModTime()}
+	f, err := os.Open(pathfile)
+	if err == nil {
+		m, err := readTags(f)
+		if err == nil {
+			st.title = cleanTagText(m.Title())
+			st.artist = cleanTagText(m.Artist())
+			st.album = cleanTagText(m.Album())
+			st.track, _ = m.Track()
+			st.disc, _ = m.Disc()
+			st.rating = tagRating(m.Raw())
+		}
+		f.Close()
+	}
+
+	tagCacheLock.Lock()
+	tagCache[pathfile] = st
+	tagCacheLock.Unlock()
+	return st
+}
+
+// readTags is tag.ReadFrom, with malformed tags rejected (checkTags) and
+// panics turned into errors.
+func readTags(r io.ReadSeeker) (m tag.Metadata, err error) {
+	if err = checkTags(r); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			m, err = nil, fmt.Errorf("tag parser panic: %v", r)
+		}
+	}()
+	return tag.ReadFrom(r)
+}
+
+// tagRating converts the rating tags used by common players to 1-5 stars.
+func tagRating(raw map[string]interface{}) int {
+	// ID3v2 POPM: email, 0, rating byte (1-255), play counter
+	if popm, ok := raw["POPM"].([]byte); ok {
+		if i := strings.IndexByte(string(popm), 0); i >= 0 && i+1 < len(popm) {
+			return popmStars(popm[i+1])
+		}
+	}
+	// Vorbis comments: FMPS_RATING is 0.0-1.0, RATING is 1-5 or 0-100
+	if value, ok := raw["fmps_rating"].(string); ok {
+		if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && f > 0 {
+			return clampStars(int(f*5 + 0.5))
+		}
+	}
+	if value, ok := raw["rating"].(string); ok {
+		if i, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && i > 0 {
+			if i > 5 {
+				i = (i + 10) / 20
+			}
+			return clampStars(i)
+		}
+	}
+	return 0
+}
+
+// popmStars maps a POPM rating byte the way Windows Media Player does.
+func popmStars(b byte) int {
+	switch {
+	case b == 0:
+		return 0
+	case b < 32:
+		return 1
+	case b < 96:
+		return 2
+	case b < 160:
+		return 3
+	case b < 224:
+		return 4
+	}
+	return 5
+}
+
+func clampStars(i int) int {
+	if i < 1 {
+		return 1
+	}
+	if i > 5 {
+		return 5
+	}
+	return i
+}
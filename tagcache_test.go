@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTagRating(t *testing.T) {
+	tests := []struct {
+		name  string
+		raw   map[string]interface{}
+		stars int
+	}{
+		{"none", map[string]interface{}{}, 0},
+		{"POPM 1", map[string]interface{}{"POPM": []byte("a@b\x00\x01\x00\x00\x00\x03")}, 1},
+		{"POPM 64", map[string]interface{}{"POPM": []byte("a@b\x00\x40")}, 2},
+		{"POPM 128", map[string]interface{}{"POPM": []byte("\x00\x80")}, 3},
+		{"POPM 196", map[string]interface{}{"POPM": []byte("a@b\x00\xc4")}, 4},
+		{"POPM 255", map[string]interface{}{"POPM": []byte("a@b\x00\xff")}, 5},
+		{"POPM unrated", map[string]interface{}{"POPM": []byte("a@b\x00\x00")}, 0},
+		{"POPM without rating", map[string]interface{}{"POPM": []byte("a@b\x00")}, 0},
+		{"FMPS_RATING", map[string]interface{}{"fmps_rating": "0.6"}, 3},
+		{"FMPS_RATING 1.0", map[string]interface{}{"fmps_rating": " 1.0 "}, 5},
+		{"FMPS_RATING first", map[string]interface{}{"fmps_rating": "0.2", "rating": "100"}, 1},
+		{"RATING stars", map[string]interface{}{"rating": "4"}, 4},
+		{"RATING percent", map[string]interface{}{"rating": "80"}, 4},
+		{"RATING 10", map[string]interface{}{"rating": "10"}, 1},
+		{"RATING 100", map[string]interface{}{"rating": "100"}, 5},
+		{"RATING 0", map[string]interface{}{"rating": "0"}, 0},
+		{"RATING text", map[string]interface{}{"rating": "good"}, 0},
+	}
+	for _, test := range tests {
+		if stars := tagRating(test.raw); stars != test.stars {
+			t.Errorf("%s: %d stars, want %d", test.name, stars, test.stars)
+		}
+	}
+}
+
+// TestReadSongTags reads the tags of a flac file, again after it changed.
+func TestReadSongTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tremote_tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fx := newFlacFixture(1, 44100, 16, 0.05)
+	fx.write(t, dir)
+	fx.tag(t, dir, "ARTIST=Band", "ALBUM=Blue", "TRACKNUMBER=3", "TRACKTOTAL=12", "DISCNUMBER=2", "RATING=60")
+	pathfile := dir + "/" + fx.name
+	st := readSongTags(pathfile)
+	if st.title != "Song 1" || st.artist != "Band" || st.album != "Blue" || st.track != 3 || st.disc != 2 || st.rating != 3 {
+		t.Errorf("tags %+v", *st)
+	}
+
+	// a rewrite with a new modification time is read again
+	err = rewriteFile(pathfile, func(src *os.File, dst io.Writer) error {
+		return rewriteFlacComments(src, dst, []string{"album"}, []string{"ALBUM=Red"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := readSongTags(pathfile); st.album != "Blue" {
+		t.Errorf("same modification time: album %q, want the cached Blue", st.album)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(pathfile, later, later)
+	if st := readSongTags(pathfile); st.album != "Red" || st.artist != "Band" {
+		t.Errorf("after the rewrite: album %q, artist %q", st.album, st.artist)
+	}
+	if st := readSongTags(dir + "/missing.flac"); st == nil || st.title != "" {
+		t.Errorf("missing file: %+v", st)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+/*
+dhowden/tag and mewkiz/flac trust the length fields of tags and metadata
+blocks: a damaged file claiming a 4 GB comment makes them allocate 4 GB, and
+running out of memory cannot be recovered from. The checks below walk the
+same structures first and reject lengths reaching beyond what is there.
+*/
+
+var errTagLength = errors.New("tag length beyond end of tag")
+
+// checkTags rejects a file whose tags dhowden/tag cannot be trusted with. r is
+// at its start again afterwards.
+func checkTags(r io.ReadSeeker) error {
+	defer r.Seek(0, io.SeekStart)
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	head := make([]byte, 11)
+	if _, err := io.ReadFull(r, head); err != nil {
+		// too short for any tag; tag.ReadFrom says so itself
+		return nil
+	}
+	switch {
+	case string(head[0:4]) == "fLaC":
+		return checkFlacMetadata(r, size)
+	case string(head[0:4]) == "OggS", string(head[4:8]) == "ftyp":
+		// not a file we play
+		return errors.New("ogg or mp4 container")
+	case string(head[0:3]) == "ID3":
+		return checkID3v2(r, size)
+	}
+	return nil
+}
+
+// checkID3v2 checks the frame sizes of the ID3v2 tag at the start of r.
+func checkID3v2(r io.ReadSeeker, size int64) error {
+	header := make([]byte, 10)
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	version := header[3]
+	tagSize := int64(syncsafe(header[6:10]))
+	if 10+tagSize > size {
+		return errTagLength
+	}
+	if version != 3 && version != 4 {
+		// v2.2 frame sizes have 24 bits: nothing to worry about
+		return nil
+	}
+	body := make([]byte, tagSize)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	pos := 0
+	if header[5]&0x40 != 0 {
+		// extended header; dhowden/tag reads it before undoing unsynchronisation
+		if len(body) < 4 {
+			return errTagLength
+		}
+		if version == 3 {
+			pos = 4 + int(binary.BigEndian.Uint32(body))
+		} else {
+			pos = int(syncsafe(body[0:4]))
+		}
+		if pos < 4 || pos > len(body) {
+			return errTagLength
+		}
+	}
+	if header[5]&0x80 != 0 {
+		// unsynchronisation: dhowden/tag reads frames with 0xff 0x00 turned into 0xff
+		body = append(body[:pos:pos], bytes.Replace(body[pos:], []byte{0xff, 0}, []byte{0xff}, -1)...)
+	}
+	for pos+10 <= len(body) {
+		frameSize := int(binary.BigEndian.Uint32(body[pos+4:]))
+		if version == 4 {
+			frameSize = int(syncsafe(body[pos+4 : pos+8]))
+		}
+		if frameSize == 0 {
+			// padding
+			break
+		}
+		end := pos + 10 + frameSize
+		if frameSize < 0 || end > len(body) {
+			if validFrameID(body[pos : pos+4]) {
+				return errTagLength
+			}
+			// dhowden/tag stops at garbage beyond the end of the tag
+			break
+		}
+		pos = end
+	}
+	return nil
+}
+
+func validFrameID(id []byte) bool {
+	for _, c := range id {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// checkFlacMetadata checks the metadata blocks of the flac file r, in
+// particular the lengths inside VORBIS_COMMENT and PICTURE blocks. r is at
+// its start again afterwards.
+func checkFlacMetadata(r io.ReadSeeker, size int64) error {
+	defer r.Seek(0, io.SeekStart)
+	offset, err := r.Seek(4, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	var hdr [4]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return err
+		}
+		isLast := hdr[0]&0x80 != 0
+		blockType := hdr[0] & 0x7f
+		length := int64(hdr[1])<<16 | int64(hdr[2])<<8 | int64(hdr[3])
+		offset += 4
+		if offset+length > size {
+			return errors.New("flac metadata block beyond end of file")
+		}
+		switch blockType {
+		case 4, 6: // VORBIS_COMMENT, PICTURE
+			body := make([]byte, length)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return err
+			}
+			if blockType == 4 {
+				err = checkVorbisComment(body)
+			} else {
+				err = checkFlacPicture(body)
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			if _, err := r.Seek(offset+length, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		offset += length
+		if isLast {
+			return nil
+		}
+	}
+}
+
+// checkVorbisComment checks a VORBIS_COMMENT block: vendor string, count and
+// comments, all lengths little endian.
+func checkVorbisComment(body []byte) error {
+	pos := 0
+	field := func() (int, error) {
+		if pos+4 > len(body) {
+			return 0, errTagLength
+		}
+		n := int(binary.LittleEndian.Uint32(body[pos:]))
+		pos += 4
+		return n, nil
+	}
+	n, err := field()
+	if err != nil || n < 0 || n > len(body)-pos {
+		return errTagLength
+	}
+	pos += n
+	count, err := field()
+	if err != nil || count < 0 || count > (len(body)-pos)/4 {
+		// every comment takes at least 4 bytes
+		return errTagLength
+	}
+	for i := 0; i < count; i++ {
+		n, err := field()
+		if err != nil || n < 0 || n > len(body)-pos {
+			return errTagLength
+		}
+		pos += n
+	}
+	return nil
+}
+
+// checkFlacPicture checks a PICTURE block: type, MIME type, description,
+// four numbers and the picture data, all lengths big endian.
+func checkFlacPicture(body []byte) error {
+	pos := 4
+	for _, skip := range []int{0, 16} {
+		// MIME type; description, followed by width, height, depth and colors
+		if pos+4 > len(body) {
+			return errTagLength
+		}
+		n := int(binary.BigEndian.Uint32(body[pos:]))
+		pos += 4
+		if n < 0 || n > len(body)-pos {
+			return errTagLength
+		}
+		pos += n + skip
+	}
+	if pos+4 > len(body) {
+		return errTagLength
+	}
+	if n := int(binary.BigEndian.Uint32(body[pos:])); n < 0 || n > len(body)-pos-4 {
+		return errTagLength
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+cleanTagText turns a tag value into proper UTF-8 without control characters.
+dhowden/tag decodes the ID3v2 text encodings (Latin-1, UTF-16 with BOM,
+UTF-16BE, UTF-8), but returns ID3v1 fields as raw bytes, which are Latin-1.
+Many taggers also write UTF-8 into frames declared as Latin-1, which comes back
+as "BjÃ¶rk"; such strings are decoded again as UTF-8.
+*/
+func cleanTagText(str string) string {
+	if !utf8.ValidString(str) {
+		str = decodeLatin1(str)
+	} else if fixed, ok := undoLatin1Mojibake(str); ok {
+		str = fixed
+	}
+	str = strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return ' '
+		}
+		if unicode.IsControl(r) || r == '\ufeff' || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, str)
+	return strings.TrimSpace(str)
+}
+
+func decodeLatin1(str string) string {
+	runes := make([]rune, len(str))
+	for i := 0; i < len(str); i++ {
+		runes[i] = rune(str[i])
+	}
+	return string(runes)
+}
+
+// undoLatin1Mojibake returns the UTF-8 string hidden in str if str consists of
+// Latin-1 runes only and their bytes form valid multi-byte UTF-8.
+func undoLatin1Mojibake(str string) (string, bool) {
+	buf := make([]byte, 0, len(str))
+	multibyte := false
+	for _, r := range str {
+		if r > 0xff {
+			return "", false
+		}
+		if r >= 0x80 {
+			multibyte = true
+		}
+		buf = append(buf, byte(r))
+	}
+	if !multibyte || !utf8.Valid(buf) {
+		return "", false
+	}
+	return string(buf), true
+}
+
+// Values of "asciidisplay" in config.txt.
+const (
+	asciiDisplayOff    = "false"
+	asciiDisplayOn     = "true"
+	asciiDisplayStrict = "strict"
+)
+
+// displayText prepares a tag value for ph.PrintInfo. With "asciidisplay" in
+// config.txt it is transliterated for display clients that cannot show
+// anything but ASCII.
+func displayText(str string) string {
+	str = cleanTagText(str)
+	if configAsciiDisplay != asciiDisplayOff {
+		str = transliterate(str, configAsciiDisplay == asciiDisplayStrict)
+	}
+	return str
+}
+
+/*
+transliterate replaces non-ASCII letters by their closest ASCII spelling:
+accents are dropped ("Sigur Rós" -> "Sigur Ros"), Cyrillic and Greek are
+romanized. A text with runes that have no known spelling (e.g. Japanese) is
+returned unchanged, so that a display able to show UTF-8 shows it instead of
+"????". With strict set, such runes become '?' and the result is pure ASCII.
+*/
+func transliterate(str string, strict bool) string {
+	var b strings.Builder
+	for _, r := range str {
+		if r < 0x80 {
+			b.WriteRune(r)
+			continue
+		}
+		if ascii, ok := translitMap[r]; ok {
+			b.WriteString(ascii)
+			continue
+		}
+		if ascii, ok := translitMap[unicode.ToLower(r)]; ok && unicode.IsUpper(r) {
+			if ascii != "" {
+				b.WriteString(strings.ToUpper(ascii[:1]) + ascii[1:])
+			}
+			continue
+		}
+		if unicode.IsSpace(r) {
+			b.WriteByte(' ')
+		} else if strict {
+			b.WriteByte('?')
+		} else {
+			return str
+		}
+	}
+	return b.String()
+}
+
+var translitMap = map[rune]string{}
+
+func init() {
+	add := func(to string, from string) {
+		for _, r := range from {
+			translitMap[r] = to
+		}
+	}
+	// Latin
+	add("a", "àáâãäåāăą")
+	add("A", "ÀÁÂÃÄÅĀĂĄ")
+	add("ae", "æ")
+	add("AE", "Æ")
+	add("c", "çćĉċč")
+	add("C", "ÇĆĈĊČ")
+	add("d", "ďđð")
+	add("D", "ĎĐÐ")
+	add("e", "èéêëēĕėęě")
+	add("E", "ÈÉÊËĒĔĖĘĚ")
+	add("g", "ĝğġģ")
+	add("G", "ĜĞĠĢ")
+	add("h", "ĥħ")
+	add("H", "ĤĦ")
+	add("i", "ìíîïĩīĭįı")
+	add("I", "ÌÍÎÏĨĪĬĮİ")
+	add("j", "ĵ")
+	add("J", "Ĵ")
+	add("k", "ķ")
+	add("K", "Ķ")
+	add("l", "ĺļľŀł")
+	add("L", "ĹĻĽĿŁ")
+	add("n", "ñńņňŉ")
+	add("N", "ÑŃŅŇ")
+	add("o", "òóôõöøōŏő")
+	add("O", "ÒÓÔÕÖØŌŎŐ")
+	add("oe", "œ")
+	add("OE", "Œ")
+	add("r", "ŕŗř")
+	add("R", "ŔŖŘ")
+	add("s", "śŝşšș")
+	add("S", "ŚŜŞŠȘ")
+	add("ss", "ß")
+	add("t", "ţťŧț")
+	add("T", "ŢŤŦȚ")
+	add("th", "þ")
+	add("Th", "Þ")
+	add("u", "ùúûüũūŭůűų")
+	add("U", "ÙÚÛÜŨŪŬŮŰŲ")
+	add("w", "ŵ")
+	add("W", "Ŵ")
+	add("y", "ýÿŷ")
+	add("Y", "ÝŸŶ")
+	add("z", "źżž")
+	add("Z", "ŹŻŽ")
+	// punctuation
+	add("'", "‘’‚′")
+	add("\"", "“”„″«»")
+	add("-", "‐‑‒–—―")
+	add("...", "…")
+	add(" ", "\u00a0\u2007\u202f")
+	// Cyrillic (lower case; upper case is derived)
+	cyrillic := []string{
+		"а", "a", "б", "b", "в", "v", "г", "g", "д", "d", "е", "e", "ё", "yo", "ж", "zh",
+		"з", "z", "и", "i", "й", "y", "к", "k", "л", "l", "м", "m", "н", "n", "о", "o",
+		"п", "p", "р", "r", "с", "s", "т", "t", "у", "u", "ф", "f", "х", "kh", "ц", "ts",
+		"ч", "ch", "ш", "sh", "щ", "shch", "ъ", "", "ы", "y", "ь", "", "э", "e", "ю", "yu",
+		"я", "ya", "і", "i", "ї", "yi", "є", "ye", "ґ", "g", "ў", "u", "ђ", "dj", "ј", "j",
+		"љ", "lj", "њ", "nj", "ћ", "c", "џ", "dz",
+	}
+	// Greek
+	greek := []string{
+		"α", "a", "β", "v", "γ", "g", "δ", "d", "ε", "e", "ζ", "z", "η", "i", "θ", "th",
+		"ι", "i", "κ", "k", "λ", "l", "μ", "m", "ν", "n", "ξ", "x", "ο", "o", "π", "p",
+		"ρ", "r", "σ", "s", "ς", "s", "τ", "t", "υ", "y", "φ", "f", "χ", "ch", "ψ", "ps",
+		"ω", "o", "ά", "a", "έ", "e", "ή", "i", "ί", "i", "ό", "o", "ύ", "y", "ώ", "o",
+	}
+	for _, table := range [][]string{cyrillic, greek} {
+		for i := 0; i+1 < len(table); i += 2 {
+			r, _ := utf8.DecodeRuneInString(table[i])
+			translitMap[r] = table[i+1] // "" (hard and soft sign): dropped
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestCleanTagText(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Björk", "Björk"},
+		{"Bj\xf6rk", "Björk"}, // ID3v1 Latin-1
+		{"BjÃ¶rk", "Björk"},   // UTF-8 declared as Latin-1
+		{"Ã", "Ã"},            // Latin-1, not UTF-8
+		{"\ufeffTitle\x00", "Title"},
+		{" Line\tone\r\ntwo ", "Line one  two"},
+		{"日本語", "日本語"},
+	}
+	for _, test := range tests {
+		if got := cleanTagText(test.in); got != test.want {
+			t.Errorf("cleanTagText(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestTransliterate(t *testing.T) {
+	tests := []struct {
+		in     string
+		strict bool
+		want   string
+	}{
+		{"Sigur Rós", false, "Sigur Ros"},
+		{"Björk Guðmundsdóttir", false, "Bjork Gudmundsdottir"},
+		{"Straße", false, "Strasse"},
+		{"ÆON Œuvre", false, "AEON OEuvre"},
+		{"Кино", false, "Kino"},
+		{"Щедрик", false, "Shchedrik"},
+		{"объект", false, "obekt"}, // hard sign dropped
+		{"Ελλάδα", false, "Ellada"},
+		{"“Quote” – …", false, "\"Quote\" - ..."},
+		{"a b", false, "a b"},
+		{"坂本 龍一", false, "坂本 龍一"}, // no spelling: kept
+		{"Café 坂本", false, "Café 坂本"},
+		{"坂本 龍一", true, "?? ??"},
+		{"Café 坂本", true, "Cafe ??"},
+		{"plain", true, "plain"},
+	}
+	for _, test := range tests {
+		if got := transliterate(test.in, test.strict); got != test.want {
+			t.Errorf("transliterate(%q, %v) = %q, want %q", test.in, test.strict, got, test.want)
+		}
+	}
+}
+
+func TestDisplayText(t *testing.T) {
+	defer func(orig string) { configAsciiDisplay = orig }(configAsciiDisplay)
+	tests := []struct {
+		ascii string
+		in    string
+		want  string
+	}{
+		{asciiDisplayOff, "Bj\xf6rk", "Björk"},
+		{asciiDisplayOn, "Bj\xf6rk", "Bjork"},
+		{asciiDisplayOn, "東京", "東京"},
+		{asciiDisplayStrict, "東京", "??"},
+	}
+	for _, test := range tests {
+		configAsciiDisplay = test.ascii
+		if got := displayText(test.in); got != test.want {
+			t.Errorf("asciidisplay=%s: displayText(%q) = %q, want %q", test.ascii, test.in, got, test.want)
+		}
+	}
+}
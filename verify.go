@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mehrvarz/tremote_plugin"
+	"github.com/mewkiz/flac/meta"
+)
+
+/*
+sinkVerifier hashes what reaches the sink the way the MD5 in STREAMINFO is
+computed: the samples at the bit depth of the song, interleaved, little
+endian, 2 or 3 bytes each. Sink samples are shifted back to the bit depth of
+the song; whatever a stage changed on the way shows as an MD5 mismatch.
+*/
+type sinkVerifier struct {
+	md5       hash.Hash
+	bits      int // of the song
+	buf       []byte
+	samples   uint64 // hashed so far
+	extraBits bool   // sink samples with bits below the depth of the song (dither)
+}
+
+func newSinkVerifier(bits int) *sinkVerifier {
+	return &sinkVerifier{md5: md5.New(), bits: bits}
+}
+
+// add hashes the samples in sb.
+func (v *sinkVerifier) add(sb *sinkBuffer) {
+	bytesPerSample := v.bits / 8
+	n := sb.samples()
+	if cap(v.buf) < n*bytesPerSample {
+		v.buf = make([]byte, n*bytesPerSample)
+	}
+	buf := v.buf[:n*bytesPerSample]
+	// back to the depth of the song
+	var down, up uint
+	if sb.format.bits > v.bits {
+		down = uint(sb.format.bits - v.bits)
+	} else {
+		up = uint(v.bits - sb.format.bits)
+	}
+	var below int32
+	for i := 0; i < n; i++ {
+		x := sb.sample(i)
+		below |= x
+		sample := x >> down << up
+		buf[i*bytesPerSample] = byte(sample)
+		buf[i*bytesPerSample+1] = byte(sample >> 8)
+		if bytesPerSample == 3 {
+			buf[i*3+2] = byte(sample >> 16)
+		}
+	}
+	if below&(1<<down-1) != 0 {
+		v.extraBits = true
+	}
+	v.md5.Write(buf)
+	v.samples += uint64(n)
+}
+
+// verifyReport is the result of comparing what reached the sink with the MD5
+// in STREAMINFO.
+type verifyReport struct {
+	name       string
+	verified   bool // there is an MD5 to compare with
+	bitPerfect bool
+	result     string // e.g. "MD5 ok"
+	stages     string // what touched the samples
+}
+
+// String returns e.g. "bit-perfect: song.flac, MD5 ok; gain none, resampling
+// none, dithering none, truncation none".
+func (r verifyReport) String() string {
+	verdict := "NOT bit-perfect"
+	if !r.verified {
+		verdict = "unverified"
+	} else if r.bitPerfect {
+		verdict = "bit-perfect"
+	}
+	return fmt.Sprintf("%s: %s, %s; %s", verdict, r.name, r.result, r.stages)
+}
+
+// stages tells which stages of the chain touch the samples of a song of rate
+// and bits. The plugin has no gain and no dither stage; a mixer of the host
+// audio system, if there is one, is out of its sight.
+func (chain *sinkChain) stages(rate int, bits int) string {
+	resampling := "none"
+	if r := chain.resampled; r != nil {
+		resampling = fmt.Sprintf("%d->%d Hz (%s)", rate, rate*r.l/r.m, r.quality.name)
+	}
+	truncation := "none"
+	if sink := chain.sink.format; sink.bits < bits {
+		truncation = fmt.Sprintf("%d->%d bit", bits, sink.bits)
+		if !chain.sink.truncated {
+			truncation += ", no bits lost"
+		}
+	}
+	return fmt.Sprintf("gain none, resampling %s, dithering none, truncation %s", resampling, truncation)
+}
+
+// report compares what chain.verify got with STREAMINFO of the song. skipped
+// is the number of damaged frames left out.
+func (chain *sinkChain) report(name string, info *meta.StreamInfo, skipped int) verifyReport {
+	v := chain.verify
+	r := verifyReport{name: name, stages: chain.stages(int(info.SampleRate), int(info.BitsPerSample))}
+	var sum [md5.Size]uint8
+	copy(sum[:], v.md5.Sum(nil))
+	switch {
+	case info.MD5sum == [md5.Size]uint8{}:
+		r.result = "no MD5 in STREAMINFO"
+	case sum == info.MD5sum && !v.extraBits:
+		r.verified, r.bitPerfect = true, true
+		r.result = "MD5 ok"
+	default:
+		r.verified = true
+		r.result = "MD5 mismatch"
+	}
+	if v.extraBits {
+		r.result += ", sink samples have bits below the depth of the song"
+	}
+	if skipped > 0 {
+		r.result += fmt.Sprintf(", %d damaged frames skipped", skipped)
+	}
+	if want := info.NSamples * uint64(info.NChannels); info.NSamples > 0 && v.samples != want && chain.resampled == nil {
+		r.result += fmt.Sprintf(", %d of %d samples", v.samples, want)
+	}
+	return r
+}
+
+/*
+verifyFlac decodes pathfile through the chain playSong would use for it on
+the output device, without playing it, and reports whether the samples reach
+the sink unchanged.
+*/
+func verifyFlac(pathfile string) (verifyReport, error) {
+	f, err := os.Open(pathfile)
+	if err != nil {
+		return verifyReport{}, err
+	}
+	defer f.Close()
+	stream, err := openFlacStream(f)
+	if err != nil {
+		return verifyReport{}, err
+	}
+	info := stream.Info
+	channels, rate, bits := int(info.NChannels), int(info.SampleRate), int(info.BitsPerSample)
+	if rate <= 0 || channels < 1 || channels > 2 || (bits != 16 && bits != 24) {
+		return verifyReport{}, errors.New("unsupported flac format")
+	}
+	offset, err := flacAudioOffset(f)
+	if err != nil {
+		return verifyReport{}, err
+	}
+	frames, err := newFlacFrames(f, info, offset)
+	if err != nil {
+		return verifyReport{}, err
+	}
+
+	output.Initialize()
+	defer output.Terminate()
+	mode := resampleMode()
+	format, err := chooseOutput(channels, rate, bits, mode != resampleOff)
+	if err != nil {
+		if err == errNoOutputFormat {
+			err = errors.New("no output format on " + format.name)
+		}
+		return verifyReport{}, err
+	}
+	chunk := 4096 * channels
+	if info.BlockSizeMax > 0 {
+		chunk = int(info.BlockSizeMax) * channels
+	}
+	quality, _ := findResampleQuality(mode)
+	chain := newSinkChain(format, channels, rate, bits, chunk, quality)
+	chain.verify = newSinkVerifier(bits)
+	decoder := newSongDecoder(nil, channels, nil, 0)
+	decoder.flacframes = frames
+	for {
+		_, err := decoder.decodeBlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return verifyReport{}, err
+		}
+		chain.set(decoder.block)
+	}
+	return chain.report(filepath.Base(pathfile), info, frames.errors), nil
+}
+
+var verifyBusy int32 // a verification is running
+
+// cmdVerify checks whether a flac file reaches the sink bit-perfect: the file
+// given as argument, or else the song playing.
+func cmdVerify(args []string, ph tremote_plugin.PluginHelper) {
+	pathfile := ""
+	if len(args) > 0 {
+		pathfile = args[0]
+	} else if key, _ := currentSong(); key != "" {
+		pathfile, _ = splitTrackRef(key)
+	}
+	if pathfile == "" {
+		ph.PrintStatus("verify: no song playing")
+		return
+	}
+	if !strings.HasSuffix(pathfile, ".flac") {
+		// only flac files carry an MD5 of their samples
+		ph.PrintStatus("verify: not a flac file")
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&verifyBusy, 0, 1) {
+		ph.PrintStatus("verify: busy")
+		return
+	}
+	defer atomic.StoreInt32(&verifyBusy, 0)
+
+	ph.PrintStatus("verifying " + filepath.Base(pathfile))
+	report, err := verifyFlac(pathfile)
+	if err != nil {
+		logm.Warningf("%s verify %s err=%s", pluginname, pathfile, err.Error())
+		ph.PrintStatus("verify: " + err.Error())
+		return
+	}
+	logm.Infof("%s verify %s", pluginname, report)
+	ph.PrintStatus(report.String())
+}
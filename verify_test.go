@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mehrvarz/log"
+)
+
+// withoutMD5 zeroes the MD5 in STREAMINFO, as encoders that do not compute it
+// leave it.
+func withoutMD5(fx *fixture, data []byte) []byte {
+	// "fLaC", block header, 18 bytes of STREAMINFO before the MD5
+	for i := 26; i < 42; i++ {
+		data[i] = 0
+	}
+	return data
+}
+
+// fine returns fx with sample values using all 24 bits.
+func fine(fx *fixture) *fixture {
+	for i := range fx.samples {
+		fx.samples[i] += int32(i % 200)
+	}
+	return fx
+}
+
+func TestVerify(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	const exact = "gain none, resampling none, dithering none, truncation none"
+	tests := []struct {
+		name    string
+		fx      *fixture
+		damage  func(fx *fixture, data []byte) []byte
+		rejects func(int, int, float64, sampleFormat) error
+		status  string // PrintStatus of the result
+	}{
+		{
+			name: "16/44.1", fx: newFlacFixture(1, 44100, 16, 0.3),
+			status: "bit-perfect: 01.flac, MD5 ok; " + exact,
+		},
+		{
+			name: "24/96", fx: predicted(newFlacFixture(1, 96000, 24, 0.3)),
+			status: "bit-perfect: 01.flac, MD5 ok; " + exact,
+		},
+		{
+			name: "16 bit on a 24 bit device", fx: newFlacFixture(1, 44100, 16, 0.3), rejects: takes([]int{24}, 44100),
+			status: "bit-perfect: 01.flac, MD5 ok; " + exact,
+		},
+		{
+			name: "24 bit in 32", fx: fine(newFlacFixture(1, 96000, 24, 0.3)), rejects: takesFormats(only(formatS24_32), 96000),
+			status: "bit-perfect: 01.flac, MD5 ok; " + exact,
+		},
+		{
+			name: "24 bit on a 32 bit device", fx: fine(newFlacFixture(1, 96000, 24, 0.3)), rejects: takes([]int{32}, 96000),
+			status: "bit-perfect: 01.flac, MD5 ok; " + exact,
+		},
+		{
+			name: "16 bit on a 32 bit device", fx: newFlacFixture(1, 44100, 16, 0.3), rejects: takes([]int{32}, 44100),
+			status: "bit-perfect: 01.flac, MD5 ok; " + exact,
+		},
+		{
+			name: "24 bit on a 16 bit device", fx: fine(newFlacFixture(1, 96000, 24, 0.3)), rejects: takes([]int{16}, 96000),
+			status: "NOT bit-perfect: 01.flac, MD5 mismatch; gain none, resampling none, dithering none, truncation 24->16 bit",
+		},
+		{
+			name: "24 bit song of 16 bit samples on a 16 bit device", fx: newFlacFixture(1, 96000, 24, 0.3), rejects: takes([]int{16}, 96000),
+			status: "bit-perfect: 01.flac, MD5 ok; gain none, resampling none, dithering none, truncation 24->16 bit, no bits lost",
+		},
+		{
+			name: "resampled", fx: newFlacFixture(1, 44100, 16, 0.3), rejects: takes(anyBits, 48000),
+			status: "NOT bit-perfect: 01.flac, MD5 mismatch; gain none, resampling 44100->48000 Hz (good), dithering none, truncation none",
+		},
+		{
+			name: "damaged frame", fx: newFlacFixture(1, 44100, 16, 0.3), damage: damageFrame(3),
+			status: "NOT bit-perfect: 01.flac, MD5 mismatch, 1 damaged frames skipped, 24412 of 26460 samples; " + exact,
+		},
+		{
+			name: "no MD5", fx: newFlacFixture(1, 44100, 16, 0.3), damage: withoutMD5,
+			status: "unverified: 01.flac, no MD5 in STREAMINFO; " + exact,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "tremote_verify")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			test.fx.damage = test.damage
+			test.fx.write(t, dir)
+			out := newCaptureOutput(false)
+			out.rejects = test.rejects
+			output = out
+			defer func() { output = portaudioOutput{} }()
+
+			host := newFakeHost()
+			cmdVerify([]string{dir + "/" + test.fx.name}, host.ph)
+			status := host.args("PrintStatus")
+			if len(status) != 2 || status[0] != "verifying 01.flac" || status[1] != test.status {
+				t.Errorf("PrintStatus %q,\nwant %q", status, test.status)
+			}
+			if len(out.streams) != 0 {
+				t.Errorf("verification played the song")
+			}
+		})
+	}
+}
+
+func TestVerifyCommand(t *testing.T) {
+	host := newFakeHost()
+	cmdVerify(nil, host.ph)
+	cmdVerify([]string{"/music/song.mp3"}, host.ph)
+	cmdVerify([]string{"/music/missing.flac"}, host.ph)
+	status := host.args("PrintStatus")
+	want := []string{"verify: no song playing", "verify: not a flac file", "verifying missing.flac",
+		"verify: open /music/missing.flac: no such file or directory"}
+	if strings.Join(status, "|") != strings.Join(want, "|") {
+		t.Errorf("PrintStatus %q, want %q", status, want)
+	}
+}
+
+// TestVerifyPlayback checks songs while they play, with verify = true.
+func TestVerifyPlayback(t *testing.T) {
+	configVerify = true
+	defer func() { configVerify = false }()
+	perfect := newFlacFixture(1, 44100, 16, 0.1)
+	truncated := fine(newFlacFixture(2, 96000, 24, 0.1))
+	h := newHarness(t, false, []string{"mode=sequential", "repeat=once"}, perfect, truncated)
+	defer h.remove()
+	h.out.rejects = takes([]int{16}, 44100, 96000)
+	h.shortPress(1)
+	h.waitState(stateIdle)
+	h.finish()
+
+	if h.host.called("PrintStatus", "bit-perfect: 01.flac") {
+		t.Errorf("bit-perfect song reported: %q", h.host.args("PrintStatus"))
+	}
+	if !h.host.called("PrintStatus", "NOT bit-perfect: 02.flac, MD5 mismatch; gain none, resampling none, dithering none, truncation 24->16 bit") {
+		t.Errorf("truncated song not reported: %q", h.host.args("PrintStatus"))
+	}
+}
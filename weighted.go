@@ -0,0 +1,116 @@
+/*
+Weighted shuffle. Random order, but songs with a higher weight tend to come
+first. The weight of a song is made of four terms:
+
+	rating   stars/3 (1-5 stars; not rated counts as 3 stars, giving 1.0)
+	plays    1/(1+ln(1+plays)), so heavily played songs come up less often
+	recency  1 + days since played last / recencydays (max 2, never played = 2)
+	new      2 if the file was modified within newdays, else 1
+
+The rating is taken from songdb if set, else from the POPM, FMPS_RATING or
+RATING tag. With combine=product (default) the weight is
+rating^wrating * plays^wplays * recency^wrecency * new^wnew; with combine=sum
+it is wrating*rating + wplays*plays + wrecency*recency + wnew*new. A factor
+of 0 disables a term. Sub directories have the neutral weight 1.
+*/
+package main
+
+import (
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+type weightedStrategy struct {
+	wRating     float64
+	wPlays      float64
+	wRecency    float64
+	wNew        float64
+	sum         bool
+	recencyDays float64
+	newDays     float64
+}
+
+func newWeightedStrategy(options map[string]string) weightedStrategy {
+	ws := weightedStrategy{
+		wRating:     optionFloat(options, "wrating", 2),
+		wPlays:      optionFloat(options, "wplays", 1),
+		wRecency:    optionFloat(options, "wrecency", 1),
+		wNew:        optionFloat(options, "wnew", 1),
+		recencyDays: optionFloat(options, "recencydays", 90),
+		newDays:     optionFloat(options, "newdays", 30),
+	}
+	switch options["combine"] {
+	case "", "product":
+	case "sum":
+		ws.sum = true
+	default:
+		logm.Warningf("%s unknown combine=%s", pluginname, options["combine"])
+	}
+	if ws.recencyDays <= 0 {
+		ws.recencyDays = 90
+	}
+	return ws
+}
+
+/*
+order sorts fileArray by weighted random keys u^(1/weight) (Efraimidis and
+Spirakis), which picks songs with a probability proportional to their weight
+while still producing a complete order for the folder loop.
+*/
+func (ws weightedStrategy) order(folder string, fileArray []os.FileInfo, songsPlayedQueue queueChecker) {
+	keys := make(map[os.FileInfo]float64, len(fileArray))
+	now := time.Now()
+	for _, fi := range fileArray {
+		if fi == nil {
+			continue
+		}
+		weight := 1.0
+		if !fi.IsDir() && isAudioFile(fi.Name()) {
+			weight = ws.weight(folder+"/"+fi.Name(), fi, now)
+		}
+		keys[fi] = math.Pow(shuffleFloat64(), 1/weight)
+	}
+	sort.SliceStable(fileArray, func(i, j int) bool {
+		return keys[fileArray[i]] > keys[fileArray[j]]
+	})
+}
+
+func (ws weightedStrategy) weight(pathfile string, fi os.FileInfo, now time.Time) float64 {
+	rec := songdb.get(pathfile)
+	stars := rec.rating
+	if stars == 0 {
+		stars = readSongTags(pathfile).rating
+	}
+	if stars == 0 {
+		stars = 3
+	}
+	rating := float64(stars) / 3
+
+	plays := 1 / (1 + math.Log(1+float64(rec.plays)))
+
+	recency := 2.0
+	if rec.lastPlayed > 0 {
+		days := now.Sub(time.Unix(rec.lastPlayed, 0)).Hours() / 24
+		recency = 1 + math.Min(math.Max(days, 0)/ws.recencyDays, 1)
+	}
+
+	isNew := 1.0
+	if now.Sub(fi.ModTime()).Hours()/24 < ws.newDays {
+		isNew = 2
+	}
+
+	var weight float64
+	if ws.sum {
+		weight = ws.wRating*rating + ws.wPlays*plays + ws.wRecency*recency + ws.wNew*isNew
+	} else {
+		weight = math.Pow(rating, ws.wRating) * math.Pow(plays, ws.wPlays) *
+			math.Pow(recency, ws.wRecency) * math.Pow(isNew, ws.wNew)
+	}
+	if weight <= 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+		// never exclude a song entirely
+		weight = 1e-6
+	}
+	return weight
+}
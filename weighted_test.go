@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mehrvarz/log"
+)
+
+// setRecord puts rec into songdb without saving it.
+func setRecord(key string, rec songRecord) {
+	songdb.lock.Lock()
+	songdb.records[key] = &rec
+	songdb.lock.Unlock()
+}
+
+func TestWeight(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	now := time.Now()
+	old := now.Add(-365 * 24 * time.Hour)
+	days := func(d float64) int64 { return now.Add(-time.Duration(d * 24 * float64(time.Hour))).Unix() }
+	tests := []struct {
+		name    string
+		options map[string]string
+		rec     songRecord
+		mtime   time.Time
+		want    float64
+	}{
+		{"neutral", nil, songRecord{}, old, 2}, // never played: recency 2
+		{"5 stars", nil, songRecord{rating: 5}, old, 5.0 / 3 * 5.0 / 3 * 2},
+		{"1 star", nil, songRecord{rating: 1}, old, 1.0 / 9 * 2},
+		{"played 10 times", nil, songRecord{plays: 10, lastPlayed: days(45)}, old, 1 / (1 + math.Log(11)) * 1.5},
+		{"played just now", nil, songRecord{plays: 1, lastPlayed: now.Unix()}, old, 1 / (1 + math.Log(2))},
+		{"played long ago", nil, songRecord{plays: 1, lastPlayed: days(400)}, old, 1 / (1 + math.Log(2)) * 2},
+		{"new", nil, songRecord{}, now.Add(-24 * time.Hour), 4},
+		{"new for 7 days", map[string]string{"newdays": "7"}, songRecord{}, now.Add(-8 * 24 * time.Hour), 2},
+		{"rating off", map[string]string{"wrating": "0"}, songRecord{rating: 5}, old, 2},
+		{"recencydays", map[string]string{"recencydays": "10"}, songRecord{plays: 1, lastPlayed: days(5)},
+			old, 1 / (1 + math.Log(2)) * 1.5},
+		{"sum", map[string]string{"combine": "sum"}, songRecord{rating: 3}, old, 2 + 1 + 2 + 1},
+		{"sum, weighted", map[string]string{"combine": "sum", "wrating": "3", "wplays": "0", "wrecency": "0.5", "wnew": "0"},
+			songRecord{rating: 4}, old, 3*4.0/3 + 0.5*2},
+		{"never zero", map[string]string{"combine": "sum", "wrating": "0", "wplays": "0", "wrecency": "0", "wnew": "0"},
+			songRecord{}, old, 1e-6},
+	}
+	for i, test := range tests {
+		pathfile := "/weighted/" + string(rune('a'+i)) + ".flac"
+		setRecord(pathfile, test.rec)
+		ws := newWeightedStrategy(test.options)
+		got := ws.weight(pathfile, testFile{name: pathfile, mtime: test.mtime}, now)
+		// lastPlayed is in whole seconds
+		if math.Abs(got-test.want) > 1e-6*test.want {
+			t.Errorf("%s: weight %g, want %g", test.name, got, test.want)
+		}
+	}
+}
+
+// TestWeightedOrder checks that songs come first in proportion to their weight.
+func TestWeightedOrder(t *testing.T) {
+	startOnce.Do(func() {
+		logm = log.NullLogger
+	})
+	initShuffle(5, "")
+	old := time.Now().Add(-365 * 24 * time.Hour)
+	folder := "/weighted/order"
+	setRecord(folder+"/good.flac", songRecord{rating: 5})
+	setRecord(folder+"/bad.flac", songRecord{rating: 1})
+	ws := newWeightedStrategy(map[string]string{"wrating": "1"})
+	// weights 5/3*2 and 1/3*2: good first 5 of 6 times
+	const runs = 6000
+	first := 0
+	for r := 0; r < runs; r++ {
+		fileArray := []os.FileInfo{testFile{"bad.flac", old}, testFile{"good.flac", old}}
+		ws.order(folder, fileArray, nil)
+		if fileArray[0].Name() == "good.flac" {
+			first++
+		}
+	}
+	if first < 4850 || first > 5150 {
+		t.Errorf("good.flac first %d of %d times, want about %d", first, runs, runs*5/6)
+	}
+}